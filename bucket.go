@@ -19,7 +19,7 @@ const (
 	BUCKET_DIR_SUFFIX   = "-bucket" // Suffix allows non-buckets to be ignored.
 	DEFAULT_BUCKET_NAME = "default"
 	STORE_FILE_SUFFIX   = "store"
-	STORES_PER_BUCKET   = 1 // The # of *.store files per bucket (ignoring compaction).
+	STORES_PER_BUCKET   = 1 // The default # of *.store files per bucket (ignoring compaction).
 	VBID_DDOC           = uint16(0xffff)
 )
 
@@ -29,6 +29,7 @@ var statAggPeriodic *periodically
 var statAggPassPeriodic *periodically
 
 var bucketUnavailable = errors.New("Bucket unavailable")
+var bucketFlushDisabled = errors.New("Flush is disabled for the bucket")
 
 type Bucket interface {
 	Name() string
@@ -36,6 +37,7 @@ type Bucket interface {
 	Compact() error
 	Close() error
 	Flush() error
+	FlushAll() error
 	Load() error
 
 	Subscribe(ch chan<- interface{})
@@ -64,6 +66,8 @@ type Bucket interface {
 	SetDDocs(old, val *DDocs) bool
 
 	GetItemBytes() int64
+	GetResidentBytes() int64
+	EvictItems(targetBytes int64)
 
 	PushErr(err error)
 	Errs() []error
@@ -81,10 +85,13 @@ type livebucket struct {
 	vbucketDDoc  *VBucket
 	bucketstores map[int]*bucketstore
 	observer     broadcast.Broadcaster
+	journal      *journal // Nil unless the JournalEnabled setting is on.
 
 	bucketItemBytes int64
 	activity        int64 // To track quiescence opportunities.
 
+	evictLock sync.Mutex // Serializes EvictItems().
+
 	ddocs unsafe.Pointer // *DDocs, holding the json.Unmarshal'ed design docs.
 
 	lock  sync.Mutex // Lock covers the fields below.
@@ -159,14 +166,23 @@ func NewBucket(name, dirForBucket string, settings *BucketSettings) (
 func bucketFileNames(dirForBucket string, settings *BucketSettings) (
 	fileNames []string, err error) {
 	if settings.MemoryOnly < MemoryOnly_LEVEL_PERSIST_NOTHING {
+		// An existing bucket keeps the number of store files it has,
+		// as its vbuckets live in them.
+		n, err := numStoreFiles(dirForBucket, STORE_FILE_SUFFIX)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			settings.NumStores = n
+		}
 		fileNames, err = latestStoreFileNames(dirForBucket,
-			STORES_PER_BUCKET, STORE_FILE_SUFFIX)
+			settings.numStores(), STORE_FILE_SUFFIX)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		fileNames = make([]string, STORES_PER_BUCKET)
-		for i := 0; i < STORES_PER_BUCKET; i++ {
+		fileNames = make([]string, settings.numStores())
+		for i := range fileNames {
 			fileNames[i] = makeStoreFileName(strconv.FormatInt(int64(i), 10),
 				0, STORE_FILE_SUFFIX)
 		}
@@ -236,6 +252,35 @@ func (b *livebucket) Close() error {
 		bs.Close()
 	}
 	b.observer.Close()
+	changesPubSub.Delete(sequenceId(b.name))
+	if b.journal != nil {
+		b.journal.Close()
+	}
+	return nil
+}
+
+// Starts journaling the bucket's mutations, when the bucket has files
+// and its settings ask for a journal.  As subscriptions are
+// retroactive, this should happen after the vbuckets are loaded.  The
+// journal follows the loaded vbuckets before we return, and the later
+// vbuckets as they're created, so that it sees all their mutations.
+func (b *livebucket) startJournal() error {
+	if !b.settings.JournalEnabled ||
+		b.settings.MemoryOnly >= MemoryOnly_LEVEL_PERSIST_NOTHING {
+		return nil
+	}
+	j, err := openJournal(b.dir, b.settings)
+	if err != nil {
+		return err
+	}
+	b.journal = j
+	b.Subscribe(j.ch)
+	for vbid := 0; vbid < b.settings.NumPartitions; vbid++ {
+		if vb, _ := b.GetVBucket(uint16(vbid)); vb != nil {
+			j.follow(vb)
+		}
+	}
+	go j.run(b)
 	return nil
 }
 
@@ -243,24 +288,56 @@ func (b *livebucket) GetBucketStore(idx int) *bucketstore {
 	return b.bucketstores[idx]
 }
 
-func (b *livebucket) Flush() error {
+// Runs a function on every bucketstore concurrently, as each
+// bucketstore has its own file and disk lock, returning the first error.
+func (b *livebucket) visitBucketStores(fun func(bs *bucketstore) error) error {
+	errs := make(chan error, len(b.bucketstores))
 	for _, bs := range b.bucketstores {
-		_, err := bs.Flush()
-		if err != nil {
-			return err
+		go func(bs *bucketstore) {
+			errs <- fun(bs)
+		}(bs)
+	}
+	var rv error
+	for range b.bucketstores {
+		if err := <-errs; err != nil && rv == nil {
+			rv = err
 		}
 	}
-	return nil
+	return rv
 }
 
-func (b *livebucket) Compact() error {
-	for _, bs := range b.bucketstores {
-		err := bs.Compact()
+func (b *livebucket) Flush() error {
+	return b.visitBucketStores(func(bs *bucketstore) error {
+		_, err := bs.Flush()
+		return err
+	})
+}
+
+// Removes all items from all partitions, keeping the partitions,
+// their states and the design docs.
+func (b *livebucket) FlushAll() error {
+	if !b.settings.FlushEnabled {
+		return bucketFlushDisabled
+	}
+	for vbid := 0; vbid < b.settings.NumPartitions; vbid++ {
+		vb, err := b.GetVBucket(uint16(vbid))
 		if err != nil {
 			return err
 		}
+		if vb == nil {
+			continue
+		}
+		if err = vb.flushItems(); err != nil {
+			return err
+		}
 	}
-	return nil
+	return b.Flush()
+}
+
+func (b *livebucket) Compact() error {
+	return b.visitBucketStores(func(bs *bucketstore) error {
+		return bs.Compact()
+	})
 }
 
 func (b *livebucket) Load() (err error) {
@@ -334,7 +411,7 @@ func (b *livebucket) CreateVBucket(vbid uint16) (*VBucket, error) {
 	if b == nil || !b.Available() {
 		return nil, errors.New("cannot create vbucket as bucket is unavailable")
 	}
-	bs := b.bucketstores[int(vbid)%STORES_PER_BUCKET]
+	bs := b.bucketstores[int(vbid)%len(b.bucketstores)]
 	if bs == nil {
 		return nil, errors.New("cannot create vbucket as bucketstore missing")
 	}
@@ -342,9 +419,15 @@ func (b *livebucket) CreateVBucket(vbid uint16) (*VBucket, error) {
 	if err != nil {
 		return nil, err
 	}
+	if b.journal != nil {
+		b.journal.follow(vb)
+	}
 	if b.casVBucket(vbid, vb, nil) {
 		return vb, nil
 	}
+	if b.journal != nil {
+		b.journal.unfollow(vb)
+	}
 	return nil, errors.New("vbucket already exists")
 }
 
@@ -357,6 +440,9 @@ func (b *livebucket) DestroyVBucket(vbid uint16) (destroyed bool) {
 				destroyed = true
 			}
 		})
+		if destroyed && b.journal != nil {
+			b.journal.unfollow(vb)
+		}
 	}
 	return
 }
@@ -467,6 +553,19 @@ func (b *livebucket) GetItemBytes() int64 {
 	return atomic.LoadInt64(&b.bucketItemBytes)
 }
 
+// Returns the item bytes that are in memory, which the quota charges,
+// leaving out the items that are only on disk.
+func (b *livebucket) GetResidentBytes() int64 {
+	rv := b.GetItemBytes()
+	for _, bs := range b.bucketstores {
+		rv -= atomic.LoadInt64(&bs.evictedBytes)
+	}
+	if rv < 0 {
+		return 0
+	}
+	return rv
+}
+
 func (b *livebucket) PushErr(err error) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
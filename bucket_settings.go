@@ -2,10 +2,18 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -19,25 +27,158 @@ const (
 	MemoryOnly_LEVEL_PERSIST_NOTHING = 2
 )
 
+// Durability levels, for when item changes reach the disk.
+const (
+	// Item changes are only flushed on request, such as by a REST
+	// flush or a durable mutation.
+	DURABILITY_NONE = "none"
+
+	// Item changes are flushed periodically.  The default.
+	DURABILITY_INTERVAL = "interval"
+
+	// Item changes are flushed periodically, and each flush is
+	// fsync'ed before it counts as persisted.
+	DURABILITY_FSYNC = "fsync"
+
+	// Every mutation waits for a flush and fsync that covers it, where
+	// concurrent mutations share the same flush.
+	DURABILITY_SYNC = "sync"
+)
+
+// Eviction policies, for how a bucket frees memory when its items
+// reach its quota, where persisted buckets drop the items that are
+// already on disk from memory and memory-only buckets delete items.
+const (
+	// Writes over the quota fail with E2BIG.  The default.
+	EVICTION_NONE = "none"
+
+	// Randomly chosen items are evicted.
+	EVICTION_RANDOM = "random"
+
+	// The items that were written longest ago are evicted, going by
+	// the treap priorities of their key-index entries.
+	EVICTION_LRU = "lru"
+
+	// Only items on disk are dropped from memory, which needs a bucket
+	// that persists items.
+	EVICTION_VALUE = "value"
+)
+
+var evictionPolicies = map[string]bool{
+	"":              true,
+	EVICTION_NONE:   true,
+	EVICTION_RANDOM: true,
+	EVICTION_LRU:    true,
+	EVICTION_VALUE:  true,
+}
+
+var durabilities = map[string]bool{
+	"":                  true,
+	DURABILITY_NONE:     true,
+	DURABILITY_INTERVAL: true,
+	DURABILITY_FSYNC:    true,
+	DURABILITY_SYNC:     true,
+}
+
 type BucketSettings struct {
-	NumPartitions    int    `json:"numPartitions"`
-	PasswordHashFunc string `json:"passwordHashFunc"`
-	PasswordHash     string `json:"passwordHash"`
-	PasswordSalt     string `json:"passwordSalt"`
-	QuotaBytes       int64  `json:"quotaBytes"`
-	MemoryOnly       int    `json:"memoryOnly"`
-	UUID             string `json:"uuid"`
+	NumPartitions      int    `json:"numPartitions"`
+	NumStores          int    `json:"numStores"` // 0 for STORES_PER_BUCKET.
+	PasswordHashFunc   string `json:"passwordHashFunc"`
+	PasswordHash       string `json:"passwordHash"`
+	PasswordSalt       string `json:"passwordSalt"`
+	PasswordIterations int    `json:"passwordIterations"`
+	PasswordCramMD5    string `json:"passwordCramMD5"` // HMAC-MD5 key states.
+	QuotaBytes         int64  `json:"quotaBytes"`
+	MemoryOnly         int    `json:"memoryOnly"`
+	UUID               string `json:"uuid"`
+	FlushEnabled       bool   `json:"flushEnabled"`
+	Durability         string `json:"durability"`     // "" for DURABILITY_INTERVAL.
+	EvictionPolicy     string `json:"evictionPolicy"` // "" for EVICTION_NONE.
+
+	JournalEnabled   bool  `json:"journalEnabled"`
+	JournalValues    bool  `json:"journalValues"`    // Journal item values, too.
+	JournalFileBytes int64 `json:"journalFileBytes"` // Rotation size, 0 for default.
+	JournalMaxBytes  int64 `json:"journalMaxBytes"`  // Total size, 0 for no limit.
+	JournalRetention int64 `json:"journalRetention"` // In seconds, 0 for forever.
 }
 
-type pwverifier func(salt string, bpass, input []byte) bool
+const (
+	PBKDF2_SHA256 = "PBKDF2-SHA256"
+	BCRYPT        = "bcrypt"
+)
+
+type pwverifier func(salt string, iterations int, bpass, input []byte) bool
 
 var pwverifiers = map[string]pwverifier{
-	"": func(salt string, bpass, input []byte) bool {
+	"": func(salt string, iterations int, bpass, input []byte) bool {
 		if salt != "" {
 			return false
 		}
 		return bytes.Equal([]byte(bpass), input)
 	},
+	SCRAM_SHA256: func(salt string, iterations int, bpass, input []byte) bool {
+		saltBytes, err := base64.StdEncoding.DecodeString(salt)
+		if err != nil {
+			return false
+		}
+		storedKey, _, err := parseScramHash(string(bpass))
+		if err != nil {
+			return false
+		}
+		inputStoredKey, _ := scramKeys(input, saltBytes, iterations)
+		return hmac.Equal(storedKey, inputStoredKey)
+	},
+	PBKDF2_SHA256: func(salt string, iterations int, bpass, input []byte) bool {
+		saltBytes, err := base64.StdEncoding.DecodeString(salt)
+		if err != nil {
+			return false
+		}
+		hash, err := base64.StdEncoding.DecodeString(string(bpass))
+		if err != nil || len(hash) == 0 {
+			return false
+		}
+		return hmac.Equal(hash,
+			pbkdf2SHA256(input, saltBytes, iterations, len(hash)))
+	},
+	BCRYPT: func(salt string, iterations int, bpass, input []byte) bool {
+		if salt != "" { // The bcrypt hash includes its own salt.
+			return false
+		}
+		return bcrypt.CompareHashAndPassword(bpass, input) == nil
+	},
+}
+
+type pwhasher func(password []byte) (salt string, iterations int,
+	hash string, err error)
+
+var pwhashers = map[string]pwhasher{
+	SCRAM_SHA256: func(password []byte) (string, int, string, error) {
+		salt := make([]byte, SCRAM_SALT_LEN)
+		if _, err := rand.Read(salt); err != nil {
+			return "", 0, "", err
+		}
+		storedKey, serverKey := scramKeys(password, salt,
+			DEFAULT_PASSWORD_ITERATIONS)
+		return base64.StdEncoding.EncodeToString(salt),
+			DEFAULT_PASSWORD_ITERATIONS,
+			base64.StdEncoding.EncodeToString(storedKey) + ":" +
+				base64.StdEncoding.EncodeToString(serverKey), nil
+	},
+	PBKDF2_SHA256: func(password []byte) (string, int, string, error) {
+		salt := make([]byte, SCRAM_SALT_LEN)
+		if _, err := rand.Read(salt); err != nil {
+			return "", 0, "", err
+		}
+		hash := pbkdf2SHA256(password, salt, DEFAULT_PASSWORD_ITERATIONS,
+			sha256.Size)
+		return base64.StdEncoding.EncodeToString(salt),
+			DEFAULT_PASSWORD_ITERATIONS,
+			base64.StdEncoding.EncodeToString(hash), nil
+	},
+	BCRYPT: func(password []byte) (string, int, string, error) {
+		hash, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+		return "", 0, string(hash), err
+	},
 }
 
 func (bs *BucketSettings) Auth(input []byte) bool {
@@ -48,7 +189,104 @@ func (bs *BucketSettings) Auth(input []byte) bool {
 	if fun == nil {
 		return false
 	}
-	return fun(bs.PasswordSalt, []byte(bs.PasswordHash), input)
+	return fun(bs.PasswordSalt, bs.PasswordIterations,
+		[]byte(bs.PasswordHash), input)
+}
+
+// Stores the password as a salted hash, using one of the pwhashers,
+// instead of in the clear.  Only when asked, it also keeps the CRAM-MD5
+// key states, which are as good as the password for CRAM-MD5.
+func (bs *BucketSettings) SetPassword(hashFunc, password string,
+	cramMD5 bool) error {
+	fun := pwhashers[hashFunc]
+	if fun == nil {
+		return fmt.Errorf("unknown password hash func: %v", hashFunc)
+	}
+	salt, iterations, hash, err := fun([]byte(password))
+	if err != nil {
+		return err
+	}
+	bs.PasswordCramMD5 = ""
+	if cramMD5 {
+		if bs.PasswordCramMD5, err = cramMD5Keys([]byte(password)); err != nil {
+			return err
+		}
+	}
+	bs.PasswordHashFunc = hashFunc
+	bs.PasswordSalt = salt
+	bs.PasswordIterations = iterations
+	bs.PasswordHash = hash
+	return nil
+}
+
+// Returns the SCRAM-SHA-256 salt, iterations and keys for the
+// bucket's password.  A cleartext password gets freshly salted keys.
+func (bs *BucketSettings) scramCredentials() (salt []byte, iterations int,
+	storedKey, serverKey []byte, err error) {
+	switch bs.PasswordHashFunc {
+	case "":
+		if bs.PasswordSalt != "" {
+			return nil, 0, nil, nil, errors.New("unexpected password salt")
+		}
+		salt = make([]byte, SCRAM_SALT_LEN)
+		if _, err = rand.Read(salt); err != nil {
+			return nil, 0, nil, nil, err
+		}
+		iterations = DEFAULT_PASSWORD_ITERATIONS
+		storedKey, serverKey = scramKeys([]byte(bs.PasswordHash), salt, iterations)
+		return salt, iterations, storedKey, serverKey, nil
+	case SCRAM_SHA256:
+		salt, err = base64.StdEncoding.DecodeString(bs.PasswordSalt)
+		if err != nil {
+			return nil, 0, nil, nil, err
+		}
+		storedKey, serverKey, err = parseScramHash(bs.PasswordHash)
+		return salt, bs.PasswordIterations, storedKey, serverKey, err
+	}
+	return nil, 0, nil, nil,
+		fmt.Errorf("no scram credentials for password hash func: %v",
+			bs.PasswordHashFunc)
+}
+
+// CRAM-MD5 needs either the password itself or the HMAC-MD5 key
+// states that SetPassword() keeps next to a hashed password, when it's
+// asked to.
+func (bs *BucketSettings) AuthCramMD5(challenge, digest []byte) bool {
+	if bs == nil {
+		return false
+	}
+	if bs.PasswordHashFunc == "" && bs.PasswordSalt == "" {
+		return hmac.Equal(cramMD5Digest([]byte(bs.PasswordHash), challenge),
+			digest)
+	}
+	if bs.PasswordCramMD5 == "" {
+		return false
+	}
+	expected, err := cramMD5KeysDigest(bs.PasswordCramMD5, challenge)
+	return err == nil && hmac.Equal(expected, digest)
+}
+
+// Returns the number of store files, where each vbucket lives in the
+// store file of its vbid modulo this number.
+func (bs *BucketSettings) numStores() int {
+	if bs.NumStores <= 0 {
+		return STORES_PER_BUCKET
+	}
+	return bs.NumStores
+}
+
+func (bs *BucketSettings) durability() string {
+	if bs.Durability == "" {
+		return DURABILITY_INTERVAL
+	}
+	return bs.Durability
+}
+
+func (bs *BucketSettings) evictionPolicy() string {
+	if bs.EvictionPolicy == "" {
+		return EVICTION_NONE
+	}
+	return bs.EvictionPolicy
 }
 
 func (bs *BucketSettings) Copy() *BucketSettings {
@@ -60,9 +298,20 @@ func (bs *BucketSettings) Copy() *BucketSettings {
 func (bs *BucketSettings) SafeView() map[string]interface{} {
 	return map[string]interface{}{
 		"numPartitions": bs.NumPartitions,
+		"numStores":     bs.numStores(),
 		"quotaBytes":    bs.QuotaBytes,
 		"memoryOnly":    bs.MemoryOnly,
 		"uuid":          bs.UUID,
+		"flushEnabled":  bs.FlushEnabled,
+		"durability":    bs.durability(),
+
+		"evictionPolicy": bs.evictionPolicy(),
+
+		"journalEnabled":   bs.JournalEnabled,
+		"journalValues":    bs.JournalValues,
+		"journalFileBytes": bs.JournalFileBytes,
+		"journalMaxBytes":  bs.JournalMaxBytes,
+		"journalRetention": bs.JournalRetention,
 	}
 }
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -39,3 +40,42 @@ func TestBucketSettingsAuth(t *testing.T) {
 		}
 	}
 }
+
+func TestBucketSettingsSetPassword(t *testing.T) {
+	for _, hf := range []string{SCRAM_SHA256, PBKDF2_SHA256, BCRYPT} {
+		bs := &BucketSettings{}
+		if err := bs.SetPassword(hf, "pswd", false); err != nil {
+			t.Fatalf("Expected SetPassword(%v) to work, got %v", hf, err)
+		}
+		if bs.PasswordHashFunc != hf ||
+			strings.Contains(bs.PasswordHash, "pswd") {
+			t.Errorf("Expected a %v hashed password, got %#v", hf, bs)
+		}
+		if !bs.Auth([]byte("pswd")) {
+			t.Errorf("Expected %v auth to work", hf)
+		}
+		if bs.Auth([]byte("wrong")) || bs.Auth([]byte{}) {
+			t.Errorf("Expected %v auth with wrong password to fail", hf)
+		}
+		if bs.PasswordCramMD5 != "" || bs.AuthCramMD5([]byte("<challenge>"),
+			cramMD5Digest([]byte("pswd"), []byte("<challenge>"))) {
+			t.Errorf("Expected no CRAM-MD5 keys for a %v password", hf)
+		}
+
+		// The CRAM-MD5 key states are only kept when asked for.
+		if err := bs.SetPassword(hf, "pswd", true); err != nil {
+			t.Fatalf("Expected SetPassword(%v) to work, got %v", hf, err)
+		}
+		if !bs.AuthCramMD5([]byte("<challenge>"),
+			cramMD5Digest([]byte("pswd"), []byte("<challenge>"))) ||
+			bs.AuthCramMD5([]byte("<challenge>"),
+				cramMD5Digest([]byte("wrong"), []byte("<challenge>"))) {
+			t.Errorf("Expected CRAM-MD5 to work for a %v password", hf)
+		}
+	}
+
+	bs := &BucketSettings{}
+	if bs.SetPassword("notimplemented", "pswd", false) == nil {
+		t.Errorf("Expected SetPassword with unknown hash func to fail")
+	}
+}
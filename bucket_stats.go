@@ -66,18 +66,40 @@ type BucketStats struct {
 	Incrs       int64 `json:"incrs"`
 	Decrs       int64 `json:"decrs"`
 	Deletes     int64 `json:"deletes"`
+	Touches     int64 `json:"touches"`
 	Creates     int64 `json:"creates"`
 	Updates     int64 `json:"updates"`
 	Expirable   int64 `json:"expirable"`
 	RGets       int64 `json:"rGets"`
 	RGetResults int64 `json:"rGetResults"`
+	Observes    int64 `json:"observes"`
 	Unknowns    int64 `json:"unknowns"`
 
+	GetLocks        int64 `json:"getLocks"`
+	LockRejects     int64 `json:"lockRejects"`
+	LockExpirations int64 `json:"lockExpirations"`
+	LockedItems     int64 `json:"lockedItems"`
+
+	GetMetas      int64 `json:"getMetas"`
+	SetWithMetas  int64 `json:"setWithMetas"`
+	DelWithMetas  int64 `json:"delWithMetas"`
+	MetaConflicts int64 `json:"metaConflicts"`
+
+	TapReceives int64 `json:"tapReceives"`
+
 	IncomingValueBytes int64 `json:"incomingValueBytes"`
 	OutgoingValueBytes int64 `json:"outgoingValueBytes"`
 	ItemBytes          int64 `json:"itemBytes"`
 
 	StoreErrors int64 `json:"storeErrors"`
+	LoadRepairs int64 `json:"loadRepairs"` // Key-index repairs at load.
+
+	DurableWaits  int64 `json:"durableWaits"`
+	DurableErrors int64 `json:"durableErrors"`
+
+	Evictions       int64 `json:"evictions"`       // Items on disk dropped from memory.
+	EvictionDeletes int64 `json:"evictionDeletes"` // Items deleted to free memory.
+	DeletionPurges  int64 `json:"deletionPurges"`  // Deletions dropped from memory.
 }
 
 func (s *BucketStats) Add(in *BucketStats) {
@@ -102,15 +124,32 @@ func (s *BucketStats) Op(in *BucketStats, op func(int64, int64) int64) {
 	s.Incrs = op(s.Incrs, atomic.LoadInt64(&in.Incrs))
 	s.Decrs = op(s.Decrs, atomic.LoadInt64(&in.Decrs))
 	s.Deletes = op(s.Deletes, atomic.LoadInt64(&in.Deletes))
+	s.Touches = op(s.Touches, atomic.LoadInt64(&in.Touches))
 	s.Creates = op(s.Creates, atomic.LoadInt64(&in.Creates))
 	s.Updates = op(s.Updates, atomic.LoadInt64(&in.Updates))
 	s.RGets = op(s.RGets, atomic.LoadInt64(&in.RGets))
 	s.RGetResults = op(s.RGetResults, atomic.LoadInt64(&in.RGetResults))
+	s.Observes = op(s.Observes, atomic.LoadInt64(&in.Observes))
+	s.GetLocks = op(s.GetLocks, atomic.LoadInt64(&in.GetLocks))
+	s.LockRejects = op(s.LockRejects, atomic.LoadInt64(&in.LockRejects))
+	s.LockExpirations = op(s.LockExpirations, atomic.LoadInt64(&in.LockExpirations))
+	s.LockedItems = op(s.LockedItems, atomic.LoadInt64(&in.LockedItems))
+	s.GetMetas = op(s.GetMetas, atomic.LoadInt64(&in.GetMetas))
+	s.SetWithMetas = op(s.SetWithMetas, atomic.LoadInt64(&in.SetWithMetas))
+	s.DelWithMetas = op(s.DelWithMetas, atomic.LoadInt64(&in.DelWithMetas))
+	s.MetaConflicts = op(s.MetaConflicts, atomic.LoadInt64(&in.MetaConflicts))
+	s.TapReceives = op(s.TapReceives, atomic.LoadInt64(&in.TapReceives))
 	s.Unknowns = op(s.Unknowns, atomic.LoadInt64(&in.Unknowns))
 	s.IncomingValueBytes = op(s.IncomingValueBytes, atomic.LoadInt64(&in.IncomingValueBytes))
 	s.OutgoingValueBytes = op(s.OutgoingValueBytes, atomic.LoadInt64(&in.OutgoingValueBytes))
 	s.ItemBytes = int64(op(s.ItemBytes, atomic.LoadInt64(&in.ItemBytes)))
 	s.StoreErrors = op(s.StoreErrors, atomic.LoadInt64(&in.StoreErrors))
+	s.LoadRepairs = op(s.LoadRepairs, atomic.LoadInt64(&in.LoadRepairs))
+	s.DurableWaits = op(s.DurableWaits, atomic.LoadInt64(&in.DurableWaits))
+	s.DurableErrors = op(s.DurableErrors, atomic.LoadInt64(&in.DurableErrors))
+	s.Evictions = op(s.Evictions, atomic.LoadInt64(&in.Evictions))
+	s.EvictionDeletes = op(s.EvictionDeletes, atomic.LoadInt64(&in.EvictionDeletes))
+	s.DeletionPurges = op(s.DeletionPurges, atomic.LoadInt64(&in.DeletionPurges))
 }
 
 func (s *BucketStats) Aggregate(in Aggregatable) {
@@ -134,15 +173,32 @@ func (s *BucketStats) Equal(in *BucketStats) bool {
 		s.Incrs == atomic.LoadInt64(&in.Incrs) &&
 		s.Decrs == atomic.LoadInt64(&in.Decrs) &&
 		s.Deletes == atomic.LoadInt64(&in.Deletes) &&
+		s.Touches == atomic.LoadInt64(&in.Touches) &&
 		s.Creates == atomic.LoadInt64(&in.Creates) &&
 		s.Updates == atomic.LoadInt64(&in.Updates) &&
 		s.RGets == atomic.LoadInt64(&in.RGets) &&
 		s.RGetResults == atomic.LoadInt64(&in.RGetResults) &&
+		s.Observes == atomic.LoadInt64(&in.Observes) &&
+		s.GetLocks == atomic.LoadInt64(&in.GetLocks) &&
+		s.LockRejects == atomic.LoadInt64(&in.LockRejects) &&
+		s.LockExpirations == atomic.LoadInt64(&in.LockExpirations) &&
+		s.LockedItems == atomic.LoadInt64(&in.LockedItems) &&
+		s.GetMetas == atomic.LoadInt64(&in.GetMetas) &&
+		s.SetWithMetas == atomic.LoadInt64(&in.SetWithMetas) &&
+		s.DelWithMetas == atomic.LoadInt64(&in.DelWithMetas) &&
+		s.MetaConflicts == atomic.LoadInt64(&in.MetaConflicts) &&
+		s.TapReceives == atomic.LoadInt64(&in.TapReceives) &&
 		s.Unknowns == atomic.LoadInt64(&in.Unknowns) &&
 		s.IncomingValueBytes == atomic.LoadInt64(&in.IncomingValueBytes) &&
 		s.OutgoingValueBytes == atomic.LoadInt64(&in.OutgoingValueBytes) &&
 		s.ItemBytes == atomic.LoadInt64(&in.ItemBytes) &&
-		s.StoreErrors == atomic.LoadInt64(&in.StoreErrors)
+		s.StoreErrors == atomic.LoadInt64(&in.StoreErrors) &&
+		s.LoadRepairs == atomic.LoadInt64(&in.LoadRepairs) &&
+		s.DurableWaits == atomic.LoadInt64(&in.DurableWaits) &&
+		s.DurableErrors == atomic.LoadInt64(&in.DurableErrors) &&
+		s.Evictions == atomic.LoadInt64(&in.Evictions) &&
+		s.EvictionDeletes == atomic.LoadInt64(&in.EvictionDeletes) &&
+		s.DeletionPurges == atomic.LoadInt64(&in.DeletionPurges)
 }
 
 func (s *BucketStats) Send(ch chan<- statItem) {
@@ -159,15 +215,32 @@ func (s *BucketStats) Send(ch chan<- statItem) {
 	ch <- statItem{"incrs", strconv.FormatInt(s.Incrs, 10)}
 	ch <- statItem{"decrs", strconv.FormatInt(s.Decrs, 10)}
 	ch <- statItem{"deletes", strconv.FormatInt(s.Deletes, 10)}
+	ch <- statItem{"touches", strconv.FormatInt(s.Touches, 10)}
 	ch <- statItem{"creates", strconv.FormatInt(s.Creates, 10)}
 	ch <- statItem{"updates", strconv.FormatInt(s.Updates, 10)}
 	ch <- statItem{"rgets", strconv.FormatInt(s.RGets, 10)}
 	ch <- statItem{"rget_results", strconv.FormatInt(s.RGetResults, 10)}
+	ch <- statItem{"observes", strconv.FormatInt(s.Observes, 10)}
+	ch <- statItem{"get_locks", strconv.FormatInt(s.GetLocks, 10)}
+	ch <- statItem{"lock_rejects", strconv.FormatInt(s.LockRejects, 10)}
+	ch <- statItem{"lock_expirations", strconv.FormatInt(s.LockExpirations, 10)}
+	ch <- statItem{"locked_items", strconv.FormatInt(s.LockedItems, 10)}
+	ch <- statItem{"get_metas", strconv.FormatInt(s.GetMetas, 10)}
+	ch <- statItem{"set_with_metas", strconv.FormatInt(s.SetWithMetas, 10)}
+	ch <- statItem{"del_with_metas", strconv.FormatInt(s.DelWithMetas, 10)}
+	ch <- statItem{"meta_conflicts", strconv.FormatInt(s.MetaConflicts, 10)}
+	ch <- statItem{"tap_receives", strconv.FormatInt(s.TapReceives, 10)}
 	ch <- statItem{"unknowns", strconv.FormatInt(s.Unknowns, 10)}
 	ch <- statItem{"incoming_value_bytes", strconv.FormatInt(s.IncomingValueBytes, 10)}
 	ch <- statItem{"outgoing_value_bytes", strconv.FormatInt(s.OutgoingValueBytes, 10)}
 	ch <- statItem{"item_bytes", strconv.FormatInt(s.ItemBytes, 10)}
 	ch <- statItem{"store_errors", strconv.FormatInt(s.StoreErrors, 10)}
+	ch <- statItem{"load_repairs", strconv.FormatInt(s.LoadRepairs, 10)}
+	ch <- statItem{"durable_waits", strconv.FormatInt(s.DurableWaits, 10)}
+	ch <- statItem{"durable_errors", strconv.FormatInt(s.DurableErrors, 10)}
+	ch <- statItem{"evictions", strconv.FormatInt(s.Evictions, 10)}
+	ch <- statItem{"eviction_deletes", strconv.FormatInt(s.EvictionDeletes, 10)}
+	ch <- statItem{"deletion_purges", strconv.FormatInt(s.DeletionPurges, 10)}
 }
 
 // This is slightly more complicated than it would generally need to
@@ -193,6 +266,12 @@ func transmitStats(w io.Writer) (chan<- statItem, <-chan error) {
 
 func doStats(b Bucket, w io.Writer, key string) error {
 	ch, errs := transmitStats(w)
+	sendStats(b, ch, key)
+	close(ch)
+	return <-errs
+}
+
+func sendStats(b Bucket, ch chan<- statItem, key string) {
 	ch <- statItem{"uptime", time.Since(serverStart).String()}
 	ch <- statItem{"version", VERSION}
 
@@ -205,10 +284,10 @@ func doStats(b Bucket, w io.Writer, key string) error {
 	} else {
 		agg := AggregateBucketStats(b, key)
 		agg.Send(ch)
+		if replications != nil {
+			replications.sendStats(b, ch)
+		}
 	}
-
-	close(ch)
-	return <-errs
 }
 
 func updateMutationStats(cmdIn gomemcached.CommandCode, stats *BucketStats) (cmd gomemcached.CommandCode) {
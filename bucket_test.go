@@ -7,6 +7,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -434,7 +435,7 @@ func TestEmptyBucketSampleStats(t *testing.T) {
 	if s.CurBucket == nil {
 		t.Errorf("Expected current stats to be non-nil")
 	}
-	if !s.CurBucket.Equal(&BucketStats{ItemBytes: 240}) {
+	if !s.CurBucket.Equal(&BucketStats{ItemBytes: 405}) {
 		t.Errorf("Expected current stats to be zeroed, got: %#v", s.CurBucket)
 	}
 
@@ -545,6 +546,47 @@ func TestBucketsLoad(t *testing.T) {
 	}
 }
 
+func TestBucketsLoadHashesPassword(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	b, err := NewBuckets(d,
+		&BucketSettings{
+			NumPartitions: 1,
+		})
+	defer b.CloseAll()
+	if err != nil {
+		t.Fatalf("Expected NewBuckets() to work on temp dir")
+	}
+	_, err = b.New("b1", &BucketSettings{NumPartitions: 1, PasswordHash: "pswd"})
+	if err != nil {
+		t.Fatalf("Expected New() to work, got %v", err)
+	}
+	b.Close("b1", false)
+
+	b1, err := b.LoadBucket("b1")
+	if err != nil {
+		t.Fatalf("Expected LoadBucket() to work, got %v", err)
+	}
+	settings := b1.GetBucketSettings()
+	if settings.PasswordHashFunc != *passwordHashFunc ||
+		settings.PasswordHash == "pswd" {
+		t.Errorf("Expected the cleartext password to be hashed, got %#v", settings)
+	}
+	if !b1.Auth([]byte("pswd")) || b1.Auth([]byte("wrong")) {
+		t.Errorf("Expected auth to work with the hashed password")
+	}
+	bdir, _ := b.Path("b1")
+	files, _ := filepath.Glob(filepath.Join(bdir, "settings.json*"))
+	for _, f := range files {
+		if j, _ := ioutil.ReadFile(f); strings.Contains(string(j), "pswd") {
+			t.Errorf("Expected no cleartext password in %v", f)
+		}
+	}
+	if len(files) == 0 {
+		t.Errorf("Expected settings files")
+	}
+}
+
 func TestSetVBState(t *testing.T) {
 	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
 	defer os.RemoveAll(testBucketDir)
@@ -1078,3 +1120,83 @@ func TestMkVariousStats(t *testing.T) {
 		t.Errorf("expected stats sampler to be true")
 	}
 }
+
+func TestFlushAll(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+			FlushEnabled:  true,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+
+	r0 := &reqHandler{currentBucket: b0}
+	vb0, _ := b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+
+	testLoadInts(t, r0, 2, 5)
+	testExpectInts(t, r0, 2, []int{0, 1, 2, 3, 4}, "initial data load")
+
+	prevMeta := vb0.Meta()
+	prevItemBytes := b0.GetItemBytes()
+
+	res := r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.FLUSH,
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected FLUSH to work, got: %v", res)
+	}
+	testExpectInts(t, r0, 2, []int{}, "after flush")
+
+	if vb0.stats.Items != 0 {
+		t.Errorf("expected 0 items after flush, got: %v", vb0.stats.Items)
+	}
+	if b0.GetItemBytes() >= prevItemBytes {
+		t.Errorf("expected item bytes to drop after flush, got: %v, was: %v",
+			b0.GetItemBytes(), prevItemBytes)
+	}
+	meta := vb0.Meta()
+	if meta.MetaCas <= prevMeta.MetaCas {
+		t.Errorf("expected flush to bump meta cas, got: %v, was: %v",
+			meta.MetaCas, prevMeta.MetaCas)
+	}
+	if vb0.GetVBState() != VBActive {
+		t.Errorf("expected flush to keep vbucket active, got: %v",
+			vb0.GetVBState())
+	}
+
+	testLoadInts(t, r0, 2, 2)
+	testExpectInts(t, r0, 2, []int{0, 1}, "reload after flush")
+	if vb0.stats.Items != 2 {
+		t.Errorf("expected 2 items after reload, got: %v", vb0.stats.Items)
+	}
+
+	b0.Flush()
+	b0.Close()
+
+	b1, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b1.Close()
+	if err = b1.Load(); err != nil {
+		t.Fatalf("expected Load to work, got: %v", err)
+	}
+	r1 := &reqHandler{currentBucket: b1}
+	testExpectInts(t, r1, 2, []int{0, 1}, "data re-load after flush")
+
+	res = r1.HandleMessage(nil, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.FLUSH,
+	})
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("expected FLUSH to be disabled, got: %v", res)
+	}
+	testExpectInts(t, r1, 2, []int{0, 1}, "after disabled flush")
+}
@@ -77,17 +77,45 @@ func (b *Buckets) alloc_unlocked(name string,
 			return nil, fmt.Errorf("could not access bucket dir: %v", bdir)
 		}
 	}
-	_, err = settings.load(bdir)
+	exists, err := settings.load(bdir)
 	if err != nil {
 		return nil, err
 	}
-	return NewBucket(name, bdir, settings)
+	if !exists || settings.PasswordHashFunc != "" || settings.PasswordHash == "" {
+		return NewBucket(name, bdir, settings)
+	}
+
+	// Older settings have cleartext passwords, which are hashed
+	// here and then saved by NewBucket().
+	log.Printf("hashing cleartext password of bucket: %v", name)
+	err = settings.SetPassword(*passwordHashFunc, settings.PasswordHash,
+		*passwordCramMD5)
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := NewBucket(name, bdir, settings)
+	if err != nil {
+		return nil, err
+	}
+	// The save moved the cleartext settings to the old settings file.
+	err = os.Remove(filepath.Join(bdir, "settings.json.old"))
+	if err != nil && !os.IsNotExist(err) {
+		bucket.Close()
+		return nil, fmt.Errorf("could not remove old settings of bucket: %v,"+
+			" err: %v", name, err)
+	}
+	return bucket, nil
 }
 
 func (b *Buckets) register_unlocked(name string, bucket Bucket) {
 	var ch chan bool
 	if lb, ok := bucket.(*livebucket); ok {
 		ch = lb.availablech
+		if err := lb.startJournal(); err != nil {
+			log.Printf("could not start journal of bucket: %v, err: %v",
+				name, err)
+			lb.PushErr(err)
+		}
 	}
 	quiescePeriodic.Register(ch, b.makeQuiescer(name))
 	b.buckets[name] = bucket
@@ -100,6 +100,11 @@ func (s *bucketstore) compactGo(bsf *bucketstorefile, compactPath string) error
 			if err != nil {
 				return err
 			}
+			if s.fsyncs() {
+				if err = compactFile.Sync(); err != nil {
+					return err
+				}
+			}
 			compactStore.Close()
 			compactFile.Close()
 
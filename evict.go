@@ -0,0 +1,237 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"log"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/steveyen/gkvlite"
+)
+
+const (
+	// Eviction frees memory until the resident item bytes are down
+	// to this percent of the quota, so that evictions come in batches.
+	EVICTION_TARGET_PERCENT = 90
+
+	// The treap priority of a key-index entry in an lru bucket is the
+	// minute of its last write, wrapping about once a year, followed
+	// by random bits that keep the treap balanced within a minute.
+	LRU_TICK_BITS   = 19
+	LRU_RANDOM_BITS = 12
+)
+
+func lruPriority(now time.Time) int32 {
+	tick := (now.Unix() / 60) & (1<<LRU_TICK_BITS - 1)
+	return int32(tick<<LRU_RANDOM_BITS) | rand.Int31n(1<<LRU_RANDOM_BITS)
+}
+
+// Returns how many minutes ago an lruPriority was assigned.
+func lruAge(priority int32, now time.Time) int64 {
+	tick := int64(priority) >> LRU_RANDOM_BITS
+	return (now.Unix()/60 - tick) & (1<<LRU_TICK_BITS - 1)
+}
+
+// Returns the treap priority for a new key-index entry.
+func (s *bucketstore) keyPriority() int32 {
+	if s.eviction == EVICTION_LRU {
+		return lruPriority(time.Now())
+	}
+	return rand.Int31()
+}
+
+type evictCandidate struct {
+	vb       *VBucket
+	key      []byte
+	priority int32
+}
+
+type evictCandidates []evictCandidate
+
+func (a evictCandidates) Len() int      { return len(a) }
+func (a evictCandidates) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+
+// Orders the candidates oldest first.
+type evictCandidatesByAge struct {
+	evictCandidates
+	now time.Time
+}
+
+func (a evictCandidatesByAge) Less(i, j int) bool {
+	ai := lruAge(a.evictCandidates[i].priority, a.now)
+	aj := lruAge(a.evictCandidates[j].priority, a.now)
+	if ai != aj {
+		return ai > aj
+	}
+	return a.evictCandidates[i].priority < a.evictCandidates[j].priority
+}
+
+// Frees memory per the bucket's eviction policy, until the resident
+// item bytes are at or below the target bytes.
+func (b *livebucket) EvictItems(targetBytes int64) {
+	b.evictLock.Lock()
+	defer b.evictLock.Unlock()
+
+	policy := b.settings.evictionPolicy()
+	persists := b.settings.MemoryOnly == MemoryOnly_LEVEL_PERSIST_EVERYTHING
+	if policy == EVICTION_NONE || (policy == EVICTION_VALUE && !persists) ||
+		b.GetResidentBytes() <= targetBytes {
+		return
+	}
+
+	// A bucket that persists everything lets gkvlite drop the items
+	// that are already on disk from memory, until a pass drops nothing.
+	if persists {
+		for b.GetResidentBytes() > targetBytes {
+			var n uint64
+			for vbid := 0; vbid < b.settings.NumPartitions; vbid++ {
+				if vb, _ := b.GetVBucket(uint16(vbid)); vb != nil {
+					n += vb.evictSomeItems()
+				}
+			}
+			if n == 0 {
+				return
+			}
+		}
+		return
+	}
+
+	// Memory-only buckets first drop the deletions that they kept for
+	// tap and changes clients, and only delete the items of active
+	// vbuckets, as replicas follow their deletions.
+	var candidates evictCandidates
+	for vbid := 0; vbid < b.settings.NumPartitions; vbid++ {
+		vb, _ := b.GetVBucket(uint16(vbid))
+		if vb == nil {
+			continue
+		}
+		vb.purgeDeletions(b.GetResidentBytes() - targetBytes)
+		if b.GetResidentBytes() <= targetBytes {
+			return
+		}
+		if vb.GetVBState() != VBActive {
+			continue
+		}
+		keys, _ := vb.ps.colls()
+		err := vb.ps.visit(keys, nil, false, func(kItem *gkvlite.Item) bool {
+			candidates = append(candidates,
+				evictCandidate{vb, kItem.Key, kItem.Priority})
+			return true
+		})
+		if err != nil {
+			log.Printf("evict: could not visit keys of vbucket: %v, err: %v",
+				vbid, err)
+		}
+	}
+	switch policy {
+	case EVICTION_RANDOM:
+		for i := range candidates {
+			j := rand.Intn(i + 1)
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		}
+	case EVICTION_LRU:
+		sort.Sort(evictCandidatesByAge{candidates, time.Now()})
+	}
+
+	for _, c := range candidates {
+		if b.GetResidentBytes() <= targetBytes {
+			return
+		}
+		if err := c.vb.evictDelete(c.key); err != nil {
+			log.Printf("evict: could not evict key: %v, vbucket: %v, err: %v",
+				string(c.key), c.vb.vbid, err)
+		}
+	}
+}
+
+// Evicts items before a mutation that adds itemBytes would put the
+// bucket's resident bytes over its quota.
+func (v *VBucket) makeRoom(itemBytes int64) {
+	settings := v.parent.GetBucketSettings()
+	if settings.QuotaBytes <= 0 ||
+		settings.evictionPolicy() == EVICTION_NONE ||
+		v.parent.GetResidentBytes()+itemBytes < settings.QuotaBytes {
+		return
+	}
+	v.parent.EvictItems(
+		settings.QuotaBytes*EVICTION_TARGET_PERCENT/100 - itemBytes)
+}
+
+// Lets gkvlite drop some items that are on disk from memory, returning
+// how many it dropped.  As gkvlite doesn't tell what those took, each
+// dropped change counts as the average item bytes of the vbucket.
+func (v *VBucket) evictSomeItems() uint64 {
+	keysEvicted, changesEvicted := v.ps.evictSomeItems()
+	n := keysEvicted + changesEvicted
+	if n > 0 {
+		atomic.AddInt64(&v.stats.Evictions, int64(n))
+	}
+	items := atomic.LoadInt64(&v.stats.Items)
+	if changesEvicted > 0 && items > 0 {
+		itemBytes := atomic.LoadInt64(&v.stats.ItemBytes)
+		evicted := int64(changesEvicted) * itemBytes / items
+		if max := itemBytes - atomic.LoadInt64(&v.ps.evictedBytes); evicted > max {
+			evicted = max
+		}
+		v.ps.addEvictedBytes(evicted)
+	}
+	return n
+}
+
+// Drops the oldest deletions of a memory-only vbucket, as they
+// otherwise take memory until the bucket is flushed.
+func (v *VBucket) purgeDeletions(maxBytes int64) {
+	if maxBytes <= 0 {
+		return
+	}
+	purged, freed, err := v.ps.purgeDeletions(maxBytes)
+	if err != nil {
+		log.Printf("evict: could not purge deletions of vbucket: %v, err: %v",
+			v.vbid, err)
+	}
+	if purged > 0 {
+		atomic.AddInt64(&v.stats.DeletionPurges, int64(purged))
+		atomic.AddInt64(&v.stats.ItemBytes, -freed)
+		atomic.AddInt64(v.bucketItemBytes, -freed)
+	}
+}
+
+// Deletes an item to free its memory, unless it's locked.
+func (v *VBucket) evictDelete(key []byte) (err error) {
+	var deltaItemBytes int64
+	var cas uint64
+	now := time.Now()
+
+	v.Apply(func() {
+		var i *item
+		i, err = v.ps.get(key)
+		if err != nil || i == nil || v.getLock(key, i, now) != nil {
+			return
+		}
+		cas = atomic.AddUint64(&v.Meta().LastCas, 1)
+		deltaItemBytes, err = v.ps.del(key, cas, i)
+	})
+	if err != nil || cas == 0 {
+		return err
+	}
+
+	atomic.AddInt64(&v.stats.EvictionDeletes, 1)
+	atomic.AddInt64(&v.stats.Items, -1)
+	atomic.AddInt64(&v.stats.ItemBytes, deltaItemBytes)
+	atomic.AddInt64(v.bucketItemBytes, deltaItemBytes)
+	v.markStale()
+	v.submitMutation(mutation{v.vbid, key, cas, true, nil})
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+func testEvictBucket(t *testing.T, dir string, memoryOnly int,
+	policy string) (Bucket, *VBucket) {
+	b, err := NewBucket("test", dir,
+		&BucketSettings{
+			NumPartitions:  1,
+			QuotaBytes:     2000,
+			MemoryOnly:     memoryOnly,
+			EvictionPolicy: policy,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	vb, _ := b.CreateVBucket(0)
+	b.SetVBState(0, VBActive)
+	return b, vb
+}
+
+func testEvictSet(vb *VBucket, key string, size int) *gomemcached.MCResponse {
+	return vbMutate(vb, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SET,
+		Key:    []byte(key),
+		Body:   make([]byte, size),
+	})
+}
+
+func TestEvictNone(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	b, vb := testEvictBucket(t, d, MemoryOnly_LEVEL_PERSIST_NOTHING, "")
+	defer b.Close()
+
+	var res *gomemcached.MCResponse
+	for i := 0; i < 50; i++ {
+		res = testEvictSet(vb, fmt.Sprintf("k%v", i), 100)
+		if res.Status != gomemcached.SUCCESS {
+			break
+		}
+	}
+	if res.Status != gomemcached.E2BIG {
+		t.Errorf("expected to reach the quota, got: %v", res)
+	}
+	if vb.stats.Evictions != 0 || vb.stats.EvictionDeletes != 0 {
+		t.Errorf("expected no evictions, got: %#v", vb.stats)
+	}
+}
+
+func TestEvictDelete(t *testing.T) {
+	for _, policy := range []string{EVICTION_RANDOM, EVICTION_LRU} {
+		d, _ := ioutil.TempDir("./tmp", "test")
+		b, vb := testEvictBucket(t, d, MemoryOnly_LEVEL_PERSIST_NOTHING, policy)
+
+		for i := 0; i < 50; i++ {
+			res := testEvictSet(vb, fmt.Sprintf("k%v", i), 100)
+			if res.Status != gomemcached.SUCCESS {
+				t.Errorf("expected %v eviction to make room, got: %v",
+					policy, res)
+			}
+		}
+		if vb.stats.EvictionDeletes == 0 || vb.stats.DeletionPurges == 0 ||
+			vb.stats.Items >= 50 ||
+			b.GetItemBytes() > 2000 {
+			t.Errorf("expected %v eviction deletes, got: %#v, %v",
+				policy, vb.stats, b.GetItemBytes())
+		}
+		res := GetItem(b, []byte("k49"), VBActive)
+		if res.Status != gomemcached.SUCCESS {
+			t.Errorf("expected the latest item to stay, got: %v", res)
+		}
+		res = testEvictSet(vb, "toobig", 3000)
+		if res.Status != gomemcached.E2BIG {
+			t.Errorf("expected an item over the quota to fail, got: %v", res)
+		}
+		b.Close()
+		os.RemoveAll(d)
+	}
+}
+
+func TestEvictValue(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	b, vb := testEvictBucket(t, d, MemoryOnly_LEVEL_PERSIST_EVERYTHING,
+		EVICTION_VALUE)
+	defer b.Close()
+
+	n := 50
+	for i := 0; i < n; i++ {
+		res := testEvictSet(vb, fmt.Sprintf("k%v", i), 100)
+		if res.Status != gomemcached.SUCCESS {
+			t.Fatalf("expected value eviction to make room, got: %v, %v",
+				i, res)
+		}
+		if err := b.Flush(); err != nil {
+			t.Fatalf("expected Flush to work, got: %v", err)
+		}
+	}
+	// Dropping items on disk from memory frees the quota, which charges
+	// the resident bytes, without deleting anything.
+	if vb.stats.Evictions == 0 || vb.stats.EvictionDeletes != 0 ||
+		vb.stats.Items != int64(n) || b.GetItemBytes() <= 2000 ||
+		b.GetResidentBytes() >= 2000 {
+		t.Errorf("expected value eviction to free the quota, got: %#v, %v, %v",
+			vb.stats, b.GetItemBytes(), b.GetResidentBytes())
+	}
+	for i := 0; i < n; i++ {
+		res := GetItem(b, []byte(fmt.Sprintf("k%v", i)), VBActive)
+		if res.Status != gomemcached.SUCCESS || len(res.Body) != 100 {
+			t.Errorf("expected an item to stay readable, got: %v", res)
+		}
+	}
+}
+
+func TestEvictLRUReads(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	b, vb := testEvictBucket(t, d, MemoryOnly_LEVEL_PERSIST_NOTHING,
+		EVICTION_LRU)
+	defer b.Close()
+
+	testEvictSet(vb, "a", 10)
+	keys, _ := vb.ps.colls()
+	kItem, _ := keys.GetItem([]byte("a"), true)
+	kOld := kItem.Copy()
+	kOld.Priority = lruPriority(time.Now().Add(-time.Hour))
+	keys.SetItem(kOld)
+
+	// A read moves the key to the current minute.
+	if res := GetItem(b, []byte("a"), VBActive); res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected a get to work, got: %v", res)
+	}
+	kItem, _ = keys.GetItem([]byte("a"), true)
+	if kItem == nil || lruAge(kItem.Priority, time.Now()) != 0 ||
+		kItem.Transient == nil {
+		t.Errorf("expected a read to renew the lru priority, got: %#v", kItem)
+	}
+}
+
+func TestLRUPriority(t *testing.T) {
+	now := time.Now()
+	var candidates evictCandidates
+	for _, minutes := range []int{5, 0, 60, 1} {
+		p := lruPriority(now.Add(-time.Duration(minutes) * time.Minute))
+		if p < 0 || lruAge(p, now) != int64(minutes) {
+			t.Errorf("expected an age of %v minutes, got: %v, %v",
+				minutes, p, lruAge(p, now))
+		}
+		candidates = append(candidates, evictCandidate{priority: p})
+	}
+	sort.Sort(evictCandidatesByAge{candidates, now})
+	for i, minutes := range []int64{60, 5, 1, 0} {
+		if lruAge(candidates[i].priority, now) != minutes {
+			t.Errorf("expected the oldest candidates first, got: %v", candidates)
+		}
+	}
+
+	// The ticks wrap, without ages going negative.
+	later := now.Add(time.Duration(1<<LRU_TICK_BITS) * time.Minute)
+	if lruAge(lruPriority(now), later) != 0 ||
+		lruAge(lruPriority(later), now) != 0 {
+		t.Errorf("expected wrapped ticks to have ages of 0")
+	}
+}
@@ -16,6 +16,7 @@ type FileLike interface {
 	io.WriterAt
 	Stat() (os.FileInfo, error)
 	Truncate(size int64) error
+	Sync() error
 }
 
 type fileLike struct {
@@ -64,3 +65,14 @@ func (f *fileLike) Truncate(size int64) (err error) {
 	})
 	return
 }
+
+// Commits the underlying file's writes to stable storage.
+func (f *fileLike) Sync() (err error) {
+	if f.mode&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return unWritable
+	}
+	err = f.fs.Do(f.path, f.mode, func(file *os.File) error {
+		return file.Sync()
+	})
+	return
+}
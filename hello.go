@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/dustin/gomemcached"
+	"github.com/golang/snappy"
+)
+
+// HELLO features, as negotiated per connection.
+const (
+	FEATURE_DATATYPE       = uint16(0x01) // Implies JSON and snappy.
+	FEATURE_TCPNODELAY     = uint16(0x03)
+	FEATURE_MUTATION_SEQNO = uint16(0x04)
+	FEATURE_SNAPPY         = uint16(0x0a)
+	FEATURE_JSON           = uint16(0x0b)
+)
+
+// The datatype bits of the binary protocol header.
+const (
+	DATATYPE_JSON   = uint8(0x01)
+	DATATYPE_SNAPPY = uint8(0x02)
+)
+
+var helloFeatures = map[uint16]bool{
+	FEATURE_DATATYPE:       true,
+	FEATURE_TCPNODELAY:     true,
+	FEATURE_MUTATION_SEQNO: true,
+	FEATURE_SNAPPY:         true,
+	FEATURE_JSON:           true,
+}
+
+// Wraps a binary protocol connection so that vbucket ops can report
+// the datatype of the item values they return, as gomemcached's
+// MCResponse has no datatype field.
+type responseWriter struct {
+	io.Writer
+	value    bool // True when the response carries an item value.
+	datatype uint8
+	seqno    uint64 // The seqno of a mutation.
+}
+
+func setResponseDatatype(w io.Writer, i *item) {
+	if rw, ok := w.(*responseWriter); ok {
+		rw.value = true
+		rw.datatype = i.datatype
+	}
+}
+
+func setResponseSeqno(w io.Writer, seqno uint64) {
+	if rw, ok := w.(*responseWriter); ok {
+		rw.seqno = seqno
+	}
+}
+
+func detectDatatype(data []byte) uint8 {
+	if json.Valid(data) {
+		return DATATYPE_JSON
+	}
+	return 0
+}
+
+// The key of a HELLO request is the client's agent name, and the body
+// is the list of features that the client wants.  The response body
+// lists the subset of those features that are now enabled.
+func (rh *reqHandler) hello(w io.Writer,
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if len(req.Body)%2 != 0 || len(req.Extras) != 0 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("invalid HELLO body"),
+		}
+	}
+
+	rh.features = map[uint16]bool{}
+	res := &gomemcached.MCResponse{Body: []byte{}}
+	for j := 0; j < len(req.Body); j += 2 {
+		f := binary.BigEndian.Uint16(req.Body[j:])
+		if !helloFeatures[f] || rh.features[f] {
+			continue
+		}
+		rh.features[f] = true
+		res.Body = append(res.Body, req.Body[j:j+2]...)
+	}
+
+	if rh.features[FEATURE_TCPNODELAY] {
+		if rw, ok := w.(*responseWriter); ok {
+			if c, ok := rw.Writer.(*net.TCPConn); ok {
+				c.SetNoDelay(true)
+			}
+		}
+	}
+
+	return res
+}
+
+func (rh *reqHandler) datatypeEnabled(f uint16) bool {
+	return rh.features[f] || rh.features[FEATURE_DATATYPE]
+}
+
+// Uncompresses a snappy compressed request body, returning an error
+// response if the request's datatype wasn't negotiated or is invalid.
+func (rh *reqHandler) decodeRequest(req *gomemcached.MCRequest,
+	datatype uint8) *gomemcached.MCResponse {
+	if datatype&^(DATATYPE_JSON|DATATYPE_SNAPPY) != 0 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte(fmt.Sprintf("unknown datatype: %v", datatype)),
+		}
+	}
+	if datatype&DATATYPE_SNAPPY == 0 {
+		return nil
+	}
+	if !rh.datatypeEnabled(FEATURE_SNAPPY) {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("snappy datatype was not negotiated"),
+		}
+	}
+	body, err := snappy.Decode(nil, req.Body)
+	if err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte(fmt.Sprintf("snappy decode error: %v", err)),
+		}
+	}
+	req.Body = body
+	return nil
+}
+
+var seqnoOpcodes = map[gomemcached.CommandCode]bool{
+	gomemcached.SET:       true,
+	gomemcached.ADD:       true,
+	gomemcached.REPLACE:   true,
+	gomemcached.APPEND:    true,
+	gomemcached.PREPEND:   true,
+	gomemcached.DELETE:    true,
+	gomemcached.INCREMENT: true,
+	gomemcached.DECREMENT: true,
+}
+
+// Applies the negotiated features to a response, returning the
+// datatype for the response header.
+func (rh *reqHandler) encodeResponse(req *gomemcached.MCRequest,
+	res *gomemcached.MCResponse, rw *responseWriter) uint8 {
+	if res.Status != gomemcached.SUCCESS {
+		return 0
+	}
+
+	if rh.features[FEATURE_MUTATION_SEQNO] && seqnoOpcodes[req.Opcode] &&
+		len(res.Extras) == 0 {
+		// The extras are the vbucket uuid and the mutation's seqno.
+		res.Extras = make([]byte, 16)
+		if vb, _ := rh.currentBucket.GetVBucket(req.VBucket); vb != nil {
+			binary.BigEndian.PutUint64(res.Extras,
+				vb.Meta().failoverLog()[0].UUID)
+		}
+		binary.BigEndian.PutUint64(res.Extras[8:], rw.seqno)
+	}
+
+	if !rw.value {
+		return 0
+	}
+	var datatype uint8
+	if rh.datatypeEnabled(FEATURE_JSON) {
+		datatype = rw.datatype & DATATYPE_JSON
+	}
+	if rh.datatypeEnabled(FEATURE_SNAPPY) && len(res.Body) > 0 {
+		compressed := snappy.Encode(nil, res.Body)
+		if len(compressed) < len(res.Body) {
+			res.Body = compressed
+			datatype |= DATATYPE_SNAPPY
+		}
+	}
+	return datatype
+}
@@ -17,6 +17,9 @@ type item struct {
 	key       []byte
 	exp, flag uint32
 	cas       uint64
+	rev       uint64 // Revision #, incremented on every change to the key.
+	seqno     uint64 // The vbucket's sequence # for this change.
+	datatype  uint8  // DATATYPE_XXX bits describing the data.
 	data      []byte
 }
 
@@ -26,11 +29,14 @@ func (i item) String() string {
 
 func (i *item) clone() *item {
 	return &item{
-		key:  i.key,
-		exp:  i.exp,
-		flag: i.flag,
-		cas:  i.cas,
-		data: i.data,
+		key:      i.key,
+		exp:      i.exp,
+		flag:     i.flag,
+		cas:      i.cas,
+		rev:      i.rev,
+		seqno:    i.seqno,
+		data:     i.data,
+		datatype: i.datatype,
 	}
 }
 
@@ -51,6 +57,9 @@ func (i *item) Equal(j *item) bool {
 		i.exp == j.exp &&
 		i.flag == j.flag &&
 		i.cas == j.cas &&
+		i.rev == j.rev &&
+		i.seqno == j.seqno &&
+		i.datatype == j.datatype &&
 		bytes.Equal(i.data, j.data)
 }
 
@@ -63,6 +72,27 @@ func (i item) isExpired(t time.Time) bool {
 
 const itemHdrLen = 4 + 4 + 8 + 2 + 4
 
+// The optional rev, datatype and seqno trailer follows the key and
+// data, so that items persisted before those were tracked are still
+// readable.  Each field is only written when it or a later field is
+// non-zero.
+const itemRevLen = 8
+const itemDatatypeLen = 1
+const itemSeqnoLen = 8
+
+func (i *item) trailerLen() int {
+	if i.seqno != 0 {
+		return itemRevLen + itemDatatypeLen + itemSeqnoLen
+	}
+	if i.datatype != 0 {
+		return itemRevLen + itemDatatypeLen
+	}
+	if i.rev == 0 {
+		return 0
+	}
+	return itemRevLen
+}
+
 func (i *item) toValueBytes() []byte {
 	if len(i.key) > MAX_ITEM_KEY_LENGTH {
 		return nil
@@ -71,7 +101,7 @@ func (i *item) toValueBytes() []byte {
 		return nil
 	}
 
-	rv := make([]byte, itemHdrLen+len(i.key)+len(i.data))
+	rv := make([]byte, itemHdrLen+len(i.key)+len(i.data)+i.trailerLen())
 	off := 0
 	binary.BigEndian.PutUint32(rv[off:], i.exp)
 	off += 4
@@ -85,7 +115,19 @@ func (i *item) toValueBytes() []byte {
 	off += 4
 	n := copy(rv[off:], i.key)
 	off += n
-	copy(rv[off:], i.data)
+	n = copy(rv[off:], i.data)
+	off += n
+	if i.trailerLen() > 0 {
+		binary.BigEndian.PutUint64(rv[off:], i.rev)
+		off += itemRevLen
+	}
+	if i.trailerLen() > itemRevLen {
+		rv[off] = i.datatype
+		off += itemDatatypeLen
+	}
+	if i.seqno != 0 {
+		binary.BigEndian.PutUint64(rv[off:], i.seqno)
+	}
 	return rv
 }
 
@@ -116,6 +158,19 @@ func (i *item) fromValueBytes(b []byte) (err error) {
 	} else {
 		i.data = []byte{}
 	}
+	i.rev = 0
+	i.datatype = 0
+	i.seqno = 0
+	end := itemHdrLen + int(keylen) + int(datalen)
+	if len(b) >= end+itemRevLen {
+		i.rev = binary.BigEndian.Uint64(b[end:])
+	}
+	if len(b) >= end+itemRevLen+itemDatatypeLen {
+		i.datatype = b[end+itemRevLen]
+	}
+	if len(b) >= end+itemRevLen+itemDatatypeLen+itemSeqnoLen {
+		i.seqno = binary.BigEndian.Uint64(b[end+itemRevLen+itemDatatypeLen:])
+	}
 	return nil
 }
 
@@ -123,7 +178,7 @@ func (i *item) fromValueBytes(b []byte) (err error) {
 // the changes collection (not counting any gkvlite tree nodes).
 func (i *item) NumBytes() int64 {
 	// 8 == sizeof CAS, which is the key used in the changes collection.
-	return int64(len(i.key)+len(i.data)) + itemHdrLen + 8
+	return int64(len(i.key)+len(i.data)+i.trailerLen()) + itemHdrLen + 8
 }
 
 func itemValLength(coll *gkvlite.Collection, i *gkvlite.Item) int {
@@ -153,7 +208,7 @@ func itemValLength(coll *gkvlite.Collection, i *gkvlite.Item) int {
 	if item == nil {
 		panic(fmt.Sprintf("itemValLength invoked on nil item, i: %#v", i))
 	}
-	return itemHdrLen + len(item.key) + len(item.data)
+	return itemHdrLen + len(item.key) + len(item.data) + item.trailerLen()
 }
 
 func itemValWrite(coll *gkvlite.Collection, i *gkvlite.Item,
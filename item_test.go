@@ -151,6 +151,79 @@ func TestItemNilSerialization(t *testing.T) {
 	}
 }
 
+func TestItemRevSerialization(t *testing.T) {
+	i := &item{
+		key:  []byte("a"),
+		cas:  0xfedcba9876432100,
+		data: []byte("b"),
+	}
+	ib := i.toValueBytes()
+	i.rev = 0x1234
+	rb := i.toValueBytes()
+	if len(rb) != len(ib)+itemRevLen {
+		t.Errorf("expected rev trailer, got %v vs %v", len(rb), len(ib))
+	}
+	j := &item{}
+	if err := j.fromValueBytes(rb); err != nil {
+		t.Errorf("expected item.fromValueBytes() to work, got %v", err)
+	}
+	if !i.Equal(j) {
+		t.Errorf("expected serialize/deserialize to keep rev, got %v", j.rev)
+	}
+	if err := j.fromValueBytes(ib); err != nil {
+		t.Errorf("expected item.fromValueBytes() to work, got %v", err)
+	}
+	if j.rev != 0 {
+		t.Errorf("expected no rev without trailer, got %v", j.rev)
+	}
+}
+
+func TestItemDatatypeSerialization(t *testing.T) {
+	i := &item{
+		key:      []byte("a"),
+		cas:      0xfedcba9876432100,
+		data:     []byte(`{"b":1}`),
+		datatype: DATATYPE_JSON,
+	}
+	b := i.toValueBytes()
+	if len(b) != itemHdrLen+len(i.key)+len(i.data)+itemRevLen+itemDatatypeLen {
+		t.Errorf("expected rev and datatype trailer, got %v", len(b))
+	}
+	if int64(len(b))+8 != i.NumBytes() {
+		t.Errorf("expected NumBytes to count trailer, got %v", i.NumBytes())
+	}
+	j := &item{}
+	if err := j.fromValueBytes(b); err != nil {
+		t.Errorf("expected item.fromValueBytes() to work, got %v", err)
+	}
+	if !i.Equal(j) {
+		t.Errorf("expected serialize/deserialize to keep datatype, got %v",
+			j.datatype)
+	}
+}
+
+func TestItemSeqnoSerialization(t *testing.T) {
+	i := &item{
+		key:   []byte("a"),
+		cas:   0xfedcba9876432100,
+		data:  []byte("b"),
+		seqno: 0x0102030405060708,
+	}
+	b := i.toValueBytes()
+	if len(b) != itemHdrLen+len(i.key)+len(i.data)+
+		itemRevLen+itemDatatypeLen+itemSeqnoLen {
+		t.Errorf("expected rev, datatype and seqno trailer, got %v", len(b))
+	}
+	j := &item{}
+	if err := j.fromValueBytes(b); err != nil {
+		t.Errorf("expected item.fromValueBytes() to work, got %v", err)
+	}
+	if !i.Equal(j) {
+		t.Errorf("expected serialize/deserialize to keep seqno, got %v",
+			j.seqno)
+	}
+}
+
 func TestCASSerialization(t *testing.T) {
 	cas0 := uint64(0xfedcba9876432100)
 	b0 := casBytes(cas0)
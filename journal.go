@@ -0,0 +1,349 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	JOURNAL_FILE_PREFIX     = "journal"
+	JOURNAL_FILE_SUFFIX     = "jsonl"
+	JOURNAL_FILE_BYTES      = 16 * 1024 * 1024 // Default size before rotation.
+	JOURNAL_TAIL_LIMIT      = 100
+	JOURNAL_OP_SET          = "set"
+	JOURNAL_OP_DELETE       = "delete"
+	JOURNAL_OP_FLUSH        = "flush"
+	JOURNAL_OP_VBUCKETSTATE = "state"
+)
+
+// One line of a journal file.
+type journalRecord struct {
+	Time  time.Time `json:"time"`
+	VBId  uint16    `json:"vbid"`
+	Key   string    `json:"key,omitempty"`
+	Cas   uint64    `json:"cas,omitempty"`
+	Op    string    `json:"op"`
+	State string    `json:"state,omitempty"` // For vbucket state changes.
+	Value []byte    `json:"value,omitempty"`
+}
+
+// An append-only, per-bucket log of mutations and vbucket state
+// changes, as JSON lines in numbered files in the bucket dir.  The
+// current file is rotated when it grows past the JournalFileBytes
+// setting, and older files are removed past the JournalMaxBytes and
+// JournalRetention settings.
+type journal struct {
+	dir      string
+	settings *BucketSettings
+	done     chan bool
+	ch       chan interface{} // The events that we journal.
+
+	vbsLock sync.Mutex        // Covers vbs, separately from the lock below.
+	vbs     map[*VBucket]bool // The vbuckets that we follow, or nil once closed.
+
+	lock sync.Mutex // Lock covers the fields below.
+	f    *os.File
+	ver  int   // Version of the current file.
+	vers []int // Versions of all the files, ascending.
+	size int64 // Size of the current file.
+}
+
+func openJournal(dir string, settings *BucketSettings) (*journal, error) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	j := &journal{
+		dir:      dir,
+		settings: settings,
+		done:     make(chan bool),
+		ch:       make(chan interface{}, 1024),
+		vbs:      map[*VBucket]bool{},
+	}
+	for _, fileInfo := range fileInfos {
+		prefix, ver, err := parseStoreFileName(fileInfo.Name(),
+			JOURNAL_FILE_SUFFIX)
+		if err == nil && prefix == JOURNAL_FILE_PREFIX && !fileInfo.IsDir() {
+			j.vers = append(j.vers, ver)
+		}
+	}
+	sort.Ints(j.vers)
+	if len(j.vers) > 0 {
+		j.ver = j.vers[len(j.vers)-1]
+	} else {
+		j.vers = []int{j.ver}
+	}
+	if err = j.openFile(); err != nil {
+		return nil, err
+	}
+	j.prune(time.Now())
+	return j, nil
+}
+
+func (j *journal) fileName(ver int) string {
+	return filepath.Join(j.dir,
+		makeStoreFileName(JOURNAL_FILE_PREFIX, ver, JOURNAL_FILE_SUFFIX))
+}
+
+func (j *journal) openFile() error {
+	f, err := os.OpenFile(j.fileName(j.ver),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	j.f = f
+	j.size = fi.Size()
+	return nil
+}
+
+func (j *journal) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.f == nil {
+		return nil
+	}
+	close(j.done)
+	err := j.f.Close()
+	j.f = nil
+	return err
+}
+
+func (j *journal) append(r *journalRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.f == nil {
+		return fmt.Errorf("journal is closed, dir: %v", j.dir)
+	}
+	maxFileBytes := j.settings.JournalFileBytes
+	if maxFileBytes <= 0 {
+		maxFileBytes = JOURNAL_FILE_BYTES
+	}
+	if j.size > 0 && j.size+int64(len(line)) > maxFileBytes {
+		if err = j.rotate(r.Time); err != nil {
+			return err
+		}
+	}
+	n, err := j.f.Write(line)
+	j.size += int64(n)
+	return err
+}
+
+// Switches to the next file, with the lock held.
+func (j *journal) rotate(now time.Time) error {
+	if err := j.f.Close(); err != nil {
+		return err
+	}
+	j.ver++
+	j.vers = append(j.vers, j.ver)
+	if err := j.openFile(); err != nil {
+		j.f = nil
+		return err
+	}
+	j.prune(now)
+	return nil
+}
+
+// Removes the oldest files, but never the current one, while they're
+// older than the retention period or are over the size limit.
+func (j *journal) prune(now time.Time) {
+	fileInfos := make([]os.FileInfo, len(j.vers))
+	total := int64(0)
+	for i, ver := range j.vers {
+		if fi, err := os.Stat(j.fileName(ver)); err == nil {
+			fileInfos[i] = fi
+			total += fi.Size()
+		}
+	}
+	retention := time.Duration(j.settings.JournalRetention) * time.Second
+	for len(j.vers) > 1 {
+		if fi := fileInfos[0]; fi != nil {
+			expired := retention > 0 && now.Sub(fi.ModTime()) > retention
+			over := j.settings.JournalMaxBytes > 0 &&
+				total > j.settings.JournalMaxBytes
+			if !expired && !over {
+				break
+			}
+			if err := os.Remove(j.fileName(j.vers[0])); err != nil {
+				log.Printf("journal: could not remove: %v, err: %v",
+					j.fileName(j.vers[0]), err)
+				break
+			}
+			total -= fi.Size()
+		}
+		j.vers, fileInfos = j.vers[1:], fileInfos[1:]
+	}
+}
+
+// Returns the last limit records that happened after the since time,
+// optionally only the mutations with a cas greater than the given cas
+// (when cas is non-zero) or only one vbucket (when vbid is non-negative).
+func (j *journal) tail(vbid int, cas uint64, since time.Time, limit int) (
+	[]*journalRecord, error) {
+	j.lock.Lock()
+	vers := append([]int(nil), j.vers...)
+	ver, size := j.ver, j.size
+	j.lock.Unlock()
+
+	rv := []*journalRecord{}
+	for _, v := range vers {
+		f, err := os.Open(j.fileName(v))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // Pruned since we looked.
+			}
+			return nil, err
+		}
+		var r io.Reader = f
+		if v == ver {
+			// Only complete lines, as appends may be ongoing.
+			r = io.LimitReader(f, size)
+		}
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadBytes('\n')
+			if err != nil {
+				break
+			}
+			jr := &journalRecord{}
+			if err = json.Unmarshal(line, jr); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("journal: bad record in: %v, err: %v",
+					j.fileName(v), err)
+			}
+			if (vbid >= 0 && jr.VBId != uint16(vbid)) ||
+				(cas > 0 && jr.Cas <= cas) || !jr.Time.After(since) {
+				continue
+			}
+			rv = append(rv, jr)
+			if limit > 0 && len(rv) > limit {
+				rv = rv[1:]
+			}
+		}
+		f.Close()
+	}
+	return rv, nil
+}
+
+// Follows a vbucket's mutations.  This happens before the vbucket is
+// used, so that the journal has all of its mutations.
+func (j *journal) follow(vb *VBucket) {
+	j.vbsLock.Lock()
+	defer j.vbsLock.Unlock()
+	if j.vbs != nil && !j.vbs[vb] {
+		vb.observer.Register(j.ch)
+		j.vbs[vb] = true
+	}
+}
+
+func (j *journal) unfollow(vb *VBucket) {
+	j.vbsLock.Lock()
+	defer j.vbsLock.Unlock()
+	if j.vbs[vb] {
+		vb.observer.Unregister(j.ch)
+		delete(j.vbs, vb)
+	}
+}
+
+// Journals a bucket's events, until the journal is closed, where the
+// events come from the bucket and from the vbuckets that it follows.
+func (j *journal) run(b Bucket) {
+	for {
+		select {
+		case <-j.done:
+			j.unsubscribe(b)
+			return
+		case i := <-j.ch:
+			var r *journalRecord
+			switch o := i.(type) {
+			case mutation:
+				r = j.mutationRecord(o)
+			case vbucketChange:
+				r = &journalRecord{
+					Time:  time.Now(),
+					VBId:  o.vbid,
+					Op:    JOURNAL_OP_VBUCKETSTATE,
+					State: o.newState.String(),
+				}
+			default:
+				log.Printf("journal: unhandled event type %T: %v", i, i)
+				continue
+			}
+			if err := j.append(r); err != nil {
+				b.PushErr(fmt.Errorf("journal: %v", err))
+			}
+		}
+	}
+}
+
+// Stops the bucket and its vbuckets from sending us events, while
+// draining the events that are on their way, so that the senders
+// don't block on a channel that nobody reads anymore.
+func (j *journal) unsubscribe(b Bucket) {
+	stopch := make(chan bool)
+	defer close(stopch)
+	go func() {
+		for {
+			select {
+			case <-j.ch:
+			case <-stopch:
+				return
+			}
+		}
+	}()
+	b.Unsubscribe(j.ch)
+	j.vbsLock.Lock()
+	defer j.vbsLock.Unlock()
+	for vb := range j.vbs {
+		vb.observer.Unregister(j.ch)
+	}
+	j.vbs = nil
+}
+
+func (j *journal) mutationRecord(m mutation) *journalRecord {
+	r := &journalRecord{
+		Time: time.Now(),
+		VBId: m.vb,
+		Key:  string(m.key),
+		Cas:  m.cas,
+		Op:   JOURNAL_OP_SET,
+	}
+	if len(m.key) == 0 {
+		r.Op = JOURNAL_OP_FLUSH
+	} else if m.deleted {
+		r.Op = JOURNAL_OP_DELETE
+	} else if j.settings.JournalValues {
+		r.Value = m.data
+	}
+	return r
+}
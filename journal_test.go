@@ -0,0 +1,278 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-broadcast"
+	"github.com/dustin/gomemcached"
+)
+
+// Waits for the journal to have n records of an op (or of any op, for
+// an empty op) since a time.
+func waitForJournal(t *testing.T, j *journal, since time.Time, op string,
+	n int) []*journalRecord {
+	var records []*journalRecord
+	for i := 0; i < 500; i++ {
+		all, _ := j.tail(-1, 0, since, 0)
+		records = nil
+		for _, r := range all {
+			if op == "" || r.Op == op {
+				records = append(records, r)
+			}
+		}
+		if len(records) >= n {
+			return records
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %v journal records of op: %v, got %v",
+		n, op, len(records))
+	return nil
+}
+
+func TestJournalBucket(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	bs, _ := NewBuckets(d, &BucketSettings{
+		NumPartitions:  2,
+		JournalEnabled: true,
+		JournalValues:  true,
+	})
+	defer bs.CloseAll()
+	b, err := bs.New("b", bs.settings)
+	if err != nil {
+		t.Fatalf("Expected bucket, got %v", err)
+	}
+	j := b.(*livebucket).journal
+	if j == nil {
+		t.Fatalf("Expected a journal")
+	}
+	// The journal follows a new vbucket before its first mutation, and
+	// keeps the value of every set, even when a later set replaced it.
+	b.CreateVBucket(0)
+	b.SetVBState(0, VBActive)
+	SetItem(b, []byte("b"), []byte("b0"), VBActive)
+	SetItem(b, []byte("b"), []byte("bb"), VBActive)
+	records := waitForJournal(t, j, time.Time{}, JOURNAL_OP_VBUCKETSTATE, 1)
+	if records[0].VBId != 0 || records[0].State != "active" {
+		t.Errorf("Expected a vbucket state record, got %#v", records[0])
+	}
+	sets := waitForJournal(t, j, time.Time{}, JOURNAL_OP_SET, 2)
+	if sets[0].Key != "b" || string(sets[0].Value) != "b0" ||
+		string(sets[1].Value) != "bb" || sets[1].Cas <= sets[0].Cas {
+		t.Errorf("Expected set records, got %#v, %#v", sets[0], sets[1])
+	}
+	sets = sets[1:]
+	vb, _ := GetVBucketForKey(b, []byte("b"))
+	tapTestMutate(vb, gomemcached.DELETE, "b", "")
+	dels := waitForJournal(t, j, time.Time{}, JOURNAL_OP_DELETE, 1)
+	if dels[0].Key != "b" || dels[0].Value != nil || dels[0].Cas <= sets[0].Cas {
+		t.Errorf("Expected a delete record, got %#v", dels[0])
+	}
+
+	// Unknown events are skipped rather than crashing the journal.
+	j.ch <- 19
+	j.ch <- mutation{vb: 1, key: []byte("z"), cas: 1}
+	waitForJournal(t, j, time.Time{}, JOURNAL_OP_SET, 3)
+
+	// Journaling continues after a reload.
+	b.Flush()
+	bs.Close("b", false)
+	reloaded := time.Now()
+	b, err = bs.LoadBucket("b")
+	if err != nil {
+		t.Fatalf("Expected bucket to reload, got %v", err)
+	}
+	j = b.(*livebucket).journal
+	waitForJournal(t, j, reloaded, JOURNAL_OP_VBUCKETSTATE, 1)
+	SetItem(b, []byte("b"), []byte("bbb"), VBActive)
+	sets = waitForJournal(t, j, reloaded, JOURNAL_OP_SET, 1)
+	if sets[0].Key != "b" || string(sets[0].Value) != "bbb" {
+		t.Errorf("Expected journaling after reload, got %#v", sets[0])
+	}
+	if all, _ := j.tail(-1, 0, time.Time{}, 0); all[0].Time.After(reloaded) {
+		t.Errorf("Expected the records from before the reload")
+	}
+}
+
+// Tracks the channels that are registered with a broadcaster.
+type testRegistrations struct {
+	broadcast.Broadcaster
+	m      sync.Mutex
+	regs   map[chan<- interface{}]bool
+	unregs int
+}
+
+func (r *testRegistrations) Register(ch chan<- interface{}) {
+	r.m.Lock()
+	r.regs[ch] = true
+	r.m.Unlock()
+	r.Broadcaster.Register(ch)
+}
+
+func (r *testRegistrations) Unregister(ch chan<- interface{}) {
+	r.m.Lock()
+	delete(r.regs, ch)
+	r.unregs++
+	r.m.Unlock()
+	r.Broadcaster.Unregister(ch)
+}
+
+func (r *testRegistrations) count() int {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return len(r.regs)
+}
+
+func TestJournalCloseUnsubscribes(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	bs, _ := NewBuckets(d, &BucketSettings{
+		NumPartitions:  2,
+		JournalEnabled: true,
+	})
+	defer bs.CloseAll()
+	b, _ := bs.New("b", bs.settings)
+	lb := b.(*livebucket)
+	vb, _ := b.CreateVBucket(0)
+	if !lb.journal.vbs[vb] {
+		t.Fatalf("Expected the journal to follow the created vbucket")
+	}
+	vbRegs := &testRegistrations{Broadcaster: vb.observer,
+		regs: map[chan<- interface{}]bool{}}
+	vb.observer = vbRegs
+	bRegs := &testRegistrations{Broadcaster: lb.observer,
+		regs: map[chan<- interface{}]bool{}}
+	lb.observer = bRegs
+
+	// A destroyed vbucket isn't followed anymore.
+	vb1, _ := b.CreateVBucket(1)
+	vb1Regs := &testRegistrations{Broadcaster: vb1.observer,
+		regs: map[chan<- interface{}]bool{}}
+	vb1.observer = vb1Regs
+	b.DestroyVBucket(1)
+	if lb.journal.vbs[vb1] || vb1Regs.unregs != 1 {
+		t.Errorf("Expected the journal to stop following a destroyed vbucket")
+	}
+
+	lb.journal.Close()
+	for i := 0; i < 100; i++ {
+		vbRegs.m.Lock()
+		unregs := vbRegs.unregs
+		vbRegs.m.Unlock()
+		if unregs > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lb.journal.vbsLock.Lock()
+	defer lb.journal.vbsLock.Unlock()
+	if vbRegs.unregs != 1 || lb.journal.vbs != nil {
+		t.Errorf("Expected a closed journal to stop following the vbucket")
+	}
+	// The journal unsubscribes from the bucket before the vbuckets.
+	bRegs.m.Lock()
+	defer bRegs.m.Unlock()
+	if bRegs.unregs != 1 {
+		t.Errorf("Expected a closed journal to unsubscribe from the bucket")
+	}
+}
+
+func TestJournalTail(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	j, err := openJournal(d, &BucketSettings{})
+	if err != nil {
+		t.Fatalf("Expected journal, got %v", err)
+	}
+	defer j.Close()
+
+	start := time.Now()
+	for i, key := range []string{"a", "b", "c", "d"} {
+		j.append(&journalRecord{
+			Time: start.Add(time.Duration(i) * time.Second),
+			VBId: uint16(i % 2),
+			Key:  key,
+			Cas:  uint64(i + 1),
+			Op:   JOURNAL_OP_SET,
+		})
+	}
+	tests := []struct {
+		vbid  int
+		cas   uint64
+		since time.Time
+		limit int
+		keys  string
+	}{
+		{-1, 0, time.Time{}, 0, "abcd"},
+		{-1, 0, time.Time{}, 2, "cd"},
+		{-1, 2, time.Time{}, 0, "cd"},
+		{-1, 0, start.Add(time.Second), 0, "cd"},
+		{0, 0, time.Time{}, 0, "ac"},
+		{1, 3, time.Time{}, 0, "d"},
+	}
+	for _, test := range tests {
+		records, err := j.tail(test.vbid, test.cas, test.since, test.limit)
+		keys := ""
+		for _, r := range records {
+			keys += r.Key
+		}
+		if err != nil || keys != test.keys {
+			t.Errorf("Expected %#v, got %v, %v", test, keys, err)
+		}
+	}
+}
+
+func TestJournalRotation(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	settings := &BucketSettings{JournalFileBytes: 200, JournalMaxBytes: 500}
+	j, err := openJournal(d, settings)
+	if err != nil {
+		t.Fatalf("Expected journal, got %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		err = j.append(&journalRecord{
+			Time: time.Now(), Key: "k", Cas: uint64(i + 1), Op: JOURNAL_OP_SET})
+		if err != nil {
+			t.Fatalf("Expected append to work, got %v", err)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(d, "journal-*.jsonl"))
+	total := int64(0)
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil && f != j.fileName(j.ver) {
+			total += fi.Size()
+		}
+	}
+	records, _ := j.tail(-1, 0, time.Time{}, 0)
+	if len(files) < 3 || total > settings.JournalMaxBytes || j.ver < 5 ||
+		len(records) == 0 || records[len(records)-1].Cas != 20 ||
+		records[0].Cas == 1 {
+		t.Errorf("Expected rotated and pruned files, got %v, %v",
+			files, len(records))
+	}
+	j.Close()
+	if err = j.append(&journalRecord{Op: JOURNAL_OP_SET}); err == nil {
+		t.Errorf("Expected append to a closed journal to fail")
+	}
+
+	// A reopened journal continues in its latest file, and prunes the
+	// files past the retention period.
+	ver := j.ver
+	old := time.Now().Add(-time.Hour)
+	for _, f := range files {
+		os.Chtimes(f, old, old)
+	}
+	settings.JournalRetention = 60
+	j, err = openJournal(d, settings)
+	if err != nil || j.ver != ver || len(j.vers) != 1 {
+		t.Errorf("Expected reopened journal, got %v, %v", j.vers, err)
+	}
+	j.Close()
+}
@@ -33,6 +33,10 @@ var verbose = flag.Bool("v", true,
 	"Amount of logging")
 var addr = flag.String("addr", ":11210",
 	"Data protocol listen address")
+var addrAscii = flag.String("addr-ascii", "",
+	"ASCII data protocol listen address; empty to disable")
+var addrRedis = flag.String("addr-redis", "",
+	"Redis protocol listen address; empty to disable")
 var data = flag.String("data", "./tmp",
 	"Data directory")
 var restCouch = flag.String("rest-couch", ":8092",
@@ -45,10 +49,25 @@ var defaultBucketName = flag.String("default-bucket-name", DEFAULT_BUCKET_NAME,
 	`Name of the default bucket ("" disables)`)
 var defaultNumPartitions = flag.Int("default-num-partitions", 1,
 	"Number of partitions for default bucket")
+var defaultNumStores = flag.Int("default-num-stores", STORES_PER_BUCKET,
+	"Number of store files for default bucket")
 var defaultQuotaBytes = flagbytes.Bytes("default-quota", "100MB",
 	"Quota for default bucket")
 var defaultPersistence = flag.Int("default-persistence", 2,
 	"Persistence level for default bucket")
+var defaultFlushEnabled = flag.Bool("default-flush-enabled", false,
+	"Allow flushing all items of the default bucket")
+var defaultDurability = flag.String("default-durability", DURABILITY_INTERVAL,
+	"When new buckets persist item changes: none, interval, fsync or sync")
+var defaultEvictionPolicy = flag.String("default-eviction-policy", EVICTION_NONE,
+	"What new buckets evict at their quota: none, random, lru or value")
+var defaultJournalEnabled = flag.Bool("default-journal-enabled", false,
+	"Journal the mutations of new buckets into their bucket dirs")
+var passwordHashFunc = flag.String("password-hash-func", SCRAM_SHA256,
+	"Hash func for bucket passwords: SCRAM-SHA-256, PBKDF2-SHA256 or bcrypt")
+var passwordCramMD5 = flag.Bool("password-cram-md5", false,
+	"Offer CRAM-MD5 by keeping HMAC-MD5 keys next to hashed bucket passwords,"+
+		" which work as the passwords for CRAM-MD5 and are fast to guess offline")
 var quiesceFreq = flag.Duration("quiesce-freq", time.Minute*5,
 	"Bucket quiescence frequency")
 var expireFreq = flag.Duration("expire-freq", time.Minute*5,
@@ -69,8 +88,8 @@ var compactEvery = flag.Int("compact-every", 10000,
 	"Compact file after this many writes")
 
 var buckets *Buckets
+var replications *replicationManager
 var bucketSettings *BucketSettings
-var mutationLogCh = make(chan interface{}, 1024)
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "cbgb - version %s\n", VERSION)
@@ -101,6 +120,17 @@ func main() {
 	initAdmin()
 	initPeriodically()
 
+	if pwhashers[*passwordHashFunc] == nil {
+		log.Fatalf("error: unknown password-hash-func: %v", *passwordHashFunc)
+	}
+	if !durabilities[*defaultDurability] {
+		log.Fatalf("error: unknown default-durability: %v", *defaultDurability)
+	}
+	if !evictionPolicies[*defaultEvictionPolicy] {
+		log.Fatalf("error: unknown default-eviction-policy: %v",
+			*defaultEvictionPolicy)
+	}
+
 	if !*verbose {
 		log.SetOutput(ioutil.Discard)
 	}
@@ -114,12 +144,17 @@ func main() {
 		log.Printf("-------------------------------------------------------")
 	}
 
-	go MutationLogger(mutationLogCh)
-
 	bss := &BucketSettings{
 		NumPartitions: *defaultNumPartitions,
+		NumStores:     *defaultNumStores,
 		QuotaBytes:    int64(*defaultQuotaBytes),
 		MemoryOnly:    MemoryOnly_LEVEL_PERSIST_NOTHING - *defaultPersistence,
+		FlushEnabled:  *defaultFlushEnabled,
+		Durability:    *defaultDurability,
+
+		EvictionPolicy: *defaultEvictionPolicy,
+
+		JournalEnabled: *defaultJournalEnabled,
 	}
 	bs, err := NewBuckets(*data, bss)
 	if err != nil {
@@ -131,17 +166,22 @@ func main() {
 	}
 
 	buckets = bs
+	replications = newReplicationManager(bs)
+	if err = replications.Load(); err != nil {
+		log.Fatalf("error: could not load replications: %v, data dir: %v",
+			err, *data)
+	}
 	bucketSettings = bss
 
-	mainServer(*defaultBucketName, *addr, *maxConns, *restCouch, *restNS,
-		*staticPath, filepath.Join(*data, ".staticCache"))
+	mainServer(*defaultBucketName, *addr, *addrAscii, *addrRedis, *maxConns,
+		*restCouch, *restNS, *staticPath, filepath.Join(*data, ".staticCache"))
 
 	// Let goroutines do their work.
 	select {}
 }
 
-func mainServer(defaultBucketName string, addr string, maxConns int,
-	restCouch string, restNS string,
+func mainServer(defaultBucketName string, addr string, addrAscii string,
+	addrRedis string, maxConns int, restCouch string, restNS string,
 	staticPath string, staticCachePath string) {
 	if buckets.Get(defaultBucketName) == nil && defaultBucketName != "" {
 		_, err := createBucket(defaultBucketName, bucketSettings)
@@ -158,6 +198,20 @@ func mainServer(defaultBucketName string, addr string, maxConns int,
 			os.Exit(1)
 		}
 	}
+	if addrAscii != "" {
+		_, err := StartAsciiServer(addrAscii, maxConns, buckets, defaultBucketName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: could not start ascii server: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if addrRedis != "" {
+		_, err := StartRedisServer(addrRedis, maxConns, buckets, defaultBucketName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: could not start redis server: %v\n", err)
+			os.Exit(1)
+		}
+	}
 	log.Printf("primary connections...")
 	if restNS != "" {
 		go restNSServe(restNS, staticPath, staticCachePath)
@@ -173,6 +227,12 @@ func mainServer(defaultBucketName string, addr string, maxConns int,
 		log.Printf("  view listening: %s", restCouch)
 	}
 	log.Printf("  data listening: %s", addr)
+	if addrAscii != "" {
+		log.Printf("  ascii data listening: %s", addrAscii)
+	}
+	if addrRedis != "" {
+		log.Printf("  redis listening: %s", addrRedis)
+	}
 }
 
 func createBucket(bucketName string, bucketSettings *BucketSettings) (
@@ -185,8 +245,6 @@ func createBucket(bucketName string, bucketSettings *BucketSettings) (
 		return nil, err
 	}
 
-	bucket.Subscribe(mutationLogCh)
-
 	for vbid := 0; vbid < bucketSettings.NumPartitions; vbid++ {
 		bucket.CreateVBucket(uint16(vbid))
 		bucket.SetVBState(uint16(vbid), VBActive)
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+// Key states reported by OBSERVE.
+const (
+	OBSERVE_FOUND_NOT_PERSISTED = byte(0x00)
+	OBSERVE_FOUND_PERSISTED     = byte(0x01)
+	OBSERVE_NOT_FOUND           = byte(0x80)
+	OBSERVE_LOGICALLY_DELETED   = byte(0x81)
+)
+
+// The OBSERVE request body is a sequence of (vbid uint16, key length
+// uint16, key) entries.  The response body echoes each entry followed
+// by the key state byte and the item's current cas.
+func doObserve(b Bucket, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	out := &bytes.Buffer{}
+	now := time.Now()
+
+	body := req.Body
+	for len(body) > 0 {
+		if len(body) < 4 {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.EINVAL,
+				Body:   []byte("truncated observe entry"),
+			}
+		}
+		vbid := binary.BigEndian.Uint16(body[0:2])
+		keyLen := int(binary.BigEndian.Uint16(body[2:4]))
+		if len(body) < 4+keyLen {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.EINVAL,
+				Body:   []byte("truncated observe key"),
+			}
+		}
+		key := body[4 : 4+keyLen]
+		body = body[4+keyLen:]
+
+		vb, err := b.GetVBucket(vbid)
+		if err == bucketUnavailable {
+			return dropConnection
+		}
+		if vb == nil || vb.GetVBState() != VBActive {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.NOT_MY_VBUCKET,
+			}
+		}
+
+		keyState, cas, err := vb.observe(key, now)
+		if err != nil {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store get error %v", err)),
+			}
+		}
+
+		entry := make([]byte, 4+keyLen+1+8)
+		binary.BigEndian.PutUint16(entry[0:2], vbid)
+		binary.BigEndian.PutUint16(entry[2:4], uint16(keyLen))
+		copy(entry[4:], key)
+		entry[4+keyLen] = keyState
+		binary.BigEndian.PutUint64(entry[4+keyLen+1:], cas)
+		out.Write(entry)
+	}
+
+	// TODO: Report persistence and replication latency stats in the
+	// response cas, like couchbase does.
+	return &gomemcached.MCResponse{Body: out.Bytes()}
+}
+
+// Returns the OBSERVE key state and cas of a key, where a deleted key
+// is logically deleted until its deletion is persisted, and then not
+// found, with the cas of its deletion.
+func (v *VBucket) observe(key []byte, now time.Time) (
+	keyState byte, cas uint64, err error) {
+	atomic.AddInt64(&v.stats.Observes, 1)
+
+	i, err := v.getUnexpired(key, now)
+	if err != nil {
+		return 0, 0, err
+	}
+	if i == nil {
+		d, err := v.ps.getDeletion(key)
+		if err != nil {
+			return 0, 0, err
+		}
+		if d == nil {
+			return OBSERVE_NOT_FOUND, 0, nil
+		}
+		if v.ps.persisted(d.cas) {
+			return OBSERVE_NOT_FOUND, d.cas, nil
+		}
+		return OBSERVE_LOGICALLY_DELETED, d.cas, nil
+	}
+	if v.ps.persisted(i.cas) {
+		return OBSERVE_FOUND_PERSISTED, i.cas, nil
+	}
+	return OBSERVE_FOUND_NOT_PERSISTED, i.cas, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func mkObserveBody(vbid uint16, keys ...string) []byte {
+	out := &bytes.Buffer{}
+	for _, k := range keys {
+		binary.Write(out, binary.BigEndian, vbid)
+		binary.Write(out, binary.BigEndian, uint16(len(k)))
+		out.WriteString(k)
+	}
+	return out.Bytes()
+}
+
+func TestObserve(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	rh := reqHandler{currentBucket: testBucket}
+	testBucket.CreateVBucket(3)
+	testBucket.SetVBState(3, VBActive)
+
+	res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.SET,
+		VBucket: 3,
+		Key:     []byte("a"),
+		Body:    []byte("aye"),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("Expected set success, got %v", res)
+	}
+	setCas := res.Cas
+
+	observe := func(keys ...string) *gomemcached.MCResponse {
+		return rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode: OBSERVE,
+			Body:   mkObserveBody(3, keys...),
+		})
+	}
+
+	checkEntry := func(body []byte, key string, keyState byte, cas uint64) []byte {
+		if len(body) < 4+len(key)+1+8 {
+			t.Fatalf("Expected observe entry for %v, got %v", key, body)
+		}
+		if binary.BigEndian.Uint16(body[0:2]) != 3 ||
+			int(binary.BigEndian.Uint16(body[2:4])) != len(key) ||
+			string(body[4:4+len(key)]) != key {
+			t.Errorf("Expected observe entry for %v, got %v", key, body)
+		}
+		body = body[4+len(key):]
+		if body[0] != keyState {
+			t.Errorf("Expected key state %x for %v, got %x", keyState, key, body[0])
+		}
+		if binary.BigEndian.Uint64(body[1:9]) != cas {
+			t.Errorf("Expected cas %v for %v, got %v",
+				cas, key, binary.BigEndian.Uint64(body[1:9]))
+		}
+		return body[9:]
+	}
+
+	res = observe("a", "missing")
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("Expected observe success, got %v", res)
+	}
+	rest := checkEntry(res.Body, "a", OBSERVE_FOUND_NOT_PERSISTED, setCas)
+	rest = checkEntry(rest, "missing", OBSERVE_NOT_FOUND, 0)
+	if len(rest) != 0 {
+		t.Errorf("Expected no more observe entries, got %v", rest)
+	}
+
+	if err := testBucket.Flush(); err != nil {
+		t.Fatalf("Expected flush to work, got %v", err)
+	}
+
+	res = observe("a")
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("Expected observe success, got %v", res)
+	}
+	checkEntry(res.Body, "a", OBSERVE_FOUND_PERSISTED, setCas)
+
+	// A deleted key is logically deleted until its deletion is persisted.
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.DELETE,
+		VBucket: 3,
+		Key:     []byte("a"),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("Expected delete success, got %v", res)
+	}
+	vb, _ := testBucket.GetVBucket(3)
+	d, _ := vb.ps.getDeletion([]byte("a"))
+	if d == nil || d.cas <= setCas {
+		t.Fatalf("Expected a deletion of a, got %v", d)
+	}
+	checkEntry(observe("a").Body, "a", OBSERVE_LOGICALLY_DELETED, d.cas)
+	if err := testBucket.Flush(); err != nil {
+		t.Fatalf("Expected flush to work, got %v", err)
+	}
+	checkEntry(observe("a").Body, "a", OBSERVE_NOT_FOUND, d.cas)
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: OBSERVE,
+		Body:   mkObserveBody(4, "a"),
+	})
+	if res.Status != gomemcached.NOT_MY_VBUCKET {
+		t.Errorf("Expected observe of missing vbucket to fail, got %v", res)
+	}
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: OBSERVE,
+		Body:   []byte{0, 3, 0, 10, 'a'},
+	})
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("Expected truncated observe to fail, got %v", res)
+	}
+
+	if vb.stats.Observes != 5 {
+		t.Errorf("Expected 5 observes, got %v", vb.stats.Observes)
+	}
+}
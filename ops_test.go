@@ -90,7 +90,7 @@ func TestBasicOps(t *testing.T) {
 		Unknowns:           1,
 		IncomingValueBytes: 6,
 		OutgoingValueBytes: 9,
-		ItemBytes:          144,
+		ItemBytes:          233,
 	}
 
 	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
@@ -1107,7 +1107,7 @@ func TestMutationOps(t *testing.T) {
 		Unknowns:           0,
 		IncomingValueBytes: 68,
 		OutgoingValueBytes: 139,
-		ItemBytes:          110,
+		ItemBytes:          182,
 	}
 
 	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
@@ -1244,7 +1244,7 @@ func TestArithOps(t *testing.T) {
 		Unknowns:           0,
 		IncomingValueBytes: 0,
 		OutgoingValueBytes: 12,
-		ItemBytes:          113,
+		ItemBytes:          185,
 	}
 
 	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
@@ -1327,3 +1327,368 @@ func TestArithOps(t *testing.T) {
 		}
 	}
 }
+
+func TestTouchOps(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	rh := reqHandler{currentBucket: testBucket}
+	vb, _ := testBucket.CreateVBucket(3)
+	testBucket.SetVBState(3, VBActive)
+
+	mkExtras := func(exp uint32) []byte {
+		extras := make([]byte, 4)
+		binary.BigEndian.PutUint32(extras, exp)
+		return extras
+	}
+
+	res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  TOUCH,
+		VBucket: 3,
+		Key:     []byte("a"),
+		Extras:  mkExtras(0),
+	})
+	if res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("Expected touch of missing key to fail, got %v", res)
+	}
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  GATQ,
+		VBucket: 3,
+		Key:     []byte("a"),
+		Extras:  mkExtras(0),
+	})
+	if res != nil {
+		t.Errorf("Expected quiet gatq of missing key, got %v", res)
+	}
+
+	setExtras := make([]byte, 8)
+	binary.BigEndian.PutUint32(setExtras[:4], 0xcafe)
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.SET,
+		VBucket: 3,
+		Key:     []byte("a"),
+		Extras:  setExtras,
+		Body:    []byte("aye"),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("Expected set success, got %v", res)
+	}
+	setCas := res.Cas
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  TOUCH,
+		VBucket: 3,
+		Key:     []byte("a"),
+	})
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("Expected touch without extras to fail, got %v", res)
+	}
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  TOUCH,
+		VBucket: 3,
+		Key:     []byte("a"),
+		Extras:  mkExtras(1000),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Errorf("Expected touch success, got %v", res)
+	}
+	if res.Cas <= setCas {
+		t.Errorf("Expected touch to bump cas past %v, got %v", setCas, res.Cas)
+	}
+	if len(res.Body) != 0 {
+		t.Errorf("Expected touch to not return a value, got %v", res)
+	}
+
+	i, err := vb.getUnexpired([]byte("a"), time.Now())
+	if err != nil || i == nil {
+		t.Fatalf("Expected touched item, got %v, %v", i, err)
+	}
+	if i.exp == 0 {
+		t.Errorf("Expected touched item to have an exp")
+	}
+	if i.flag != 0xcafe || string(i.data) != "aye" {
+		t.Errorf("Expected touch to keep flags and value, got %#v", i)
+	}
+
+	// Touching an item that already expires doesn't count it again.
+	rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  TOUCH,
+		VBucket: 3,
+		Key:     []byte("a"),
+		Extras:  mkExtras(2000),
+	})
+	if vb.stats.Expirable != 1 {
+		t.Errorf("Expected 1 expirable item, got %v", vb.stats.Expirable)
+	}
+
+	for _, op := range []gomemcached.CommandCode{GAT, GATQ} {
+		res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode:  op,
+			VBucket: 3,
+			Key:     []byte("a"),
+			Extras:  mkExtras(0),
+		})
+		if res == nil || res.Status != gomemcached.SUCCESS {
+			t.Fatalf("Expected %v success, got %v", op, res)
+		}
+		if string(res.Body) != "aye" {
+			t.Errorf("Expected %v value aye, got %s", op, res.Body)
+		}
+		if len(res.Extras) != 4 ||
+			binary.BigEndian.Uint32(res.Extras) != 0xcafe {
+			t.Errorf("Expected %v flags, got %v", op, res.Extras)
+		}
+	}
+
+	i, err = vb.getUnexpired([]byte("a"), time.Now())
+	if err != nil || i == nil || i.exp != 0 {
+		t.Errorf("Expected gat to clear exp, got %v, %v", i, err)
+	}
+
+	time.Sleep(10 * time.Millisecond) // Let async stats catch up.
+
+	if vb.stats.Touches != 7 {
+		t.Errorf("Expected 7 touches, got %v", vb.stats.Touches)
+	}
+	if vb.stats.Gets != 3 || vb.stats.GetMisses != 1 {
+		t.Errorf("Expected 3 gets and 1 miss, got %v, %v",
+			vb.stats.Gets, vb.stats.GetMisses)
+	}
+	if vb.stats.Updates != 4 {
+		t.Errorf("Expected 4 updates, got %v", vb.stats.Updates)
+	}
+}
+
+func TestGetLocked(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	rh := reqHandler{currentBucket: testBucket}
+	vb, _ := testBucket.CreateVBucket(3)
+	testBucket.SetVBState(3, VBActive)
+
+	do := func(op gomemcached.CommandCode, cas uint64) *gomemcached.MCResponse {
+		return rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode:  op,
+			VBucket: 3,
+			Key:     []byte("a"),
+			Cas:     cas,
+			Body:    []byte("aye"),
+		})
+	}
+
+	if res := do(GETL, 0); res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("Expected getl of missing item to fail, got %v", res)
+	}
+
+	res := do(gomemcached.SET, 0)
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("Expected set success, got %v", res)
+	}
+	setCas := res.Cas
+
+	res = do(GETL, 0)
+	if res.Status != gomemcached.SUCCESS || string(res.Body) != "aye" {
+		t.Fatalf("Expected getl success, got %v", res)
+	}
+	lockCas := res.Cas
+	if lockCas == setCas {
+		t.Errorf("Expected getl to return a lock cas, got %v", lockCas)
+	}
+
+	tests := []struct {
+		op        gomemcached.CommandCode
+		cas       uint64
+		expStatus gomemcached.Status
+	}{
+		{GETL, 0, gomemcached.TMPFAIL},
+		{gomemcached.SET, 0, gomemcached.TMPFAIL},
+		{gomemcached.SET, setCas, gomemcached.TMPFAIL},
+		{gomemcached.APPEND, 0, gomemcached.TMPFAIL},
+		{gomemcached.DELETE, 0, gomemcached.TMPFAIL},
+		{UNLOCK_KEY, setCas, gomemcached.TMPFAIL},
+		{gomemcached.GET, 0, gomemcached.SUCCESS},
+		{gomemcached.SET, lockCas, gomemcached.SUCCESS},
+		{gomemcached.SET, 0, gomemcached.SUCCESS},
+		{UNLOCK_KEY, lockCas, gomemcached.TMPFAIL},
+	}
+	for idx, x := range tests {
+		if res := do(x.op, x.cas); res.Status != x.expStatus {
+			t.Errorf("Expected %v for %v - %v, got %v",
+				x.expStatus, idx, x.op, res)
+		}
+	}
+
+	res = do(GETL, 0)
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("Expected getl success, got %v", res)
+	}
+	if res := do(UNLOCK_KEY, res.Cas); res.Status != gomemcached.SUCCESS {
+		t.Errorf("Expected unlock success, got %v", res)
+	}
+	if res := do(gomemcached.SET, 0); res.Status != gomemcached.SUCCESS {
+		t.Errorf("Expected set after unlock success, got %v", res)
+	}
+
+	res = do(GETL, 0)
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("Expected getl success, got %v", res)
+	}
+	vb.Apply(func() {
+		vb.locks["a"].until = time.Now().Add(-time.Second)
+	})
+	if res := do(gomemcached.DELETE, 0); res.Status != gomemcached.SUCCESS {
+		t.Errorf("Expected delete after lock expiration success, got %v", res)
+	}
+
+	expStats := map[string]int64{
+		"getLocks":        5,
+		"lockRejects":     6,
+		"lockExpirations": 1,
+		"lockedItems":     0,
+	}
+	actStats := map[string]int64{
+		"getLocks":        vb.stats.GetLocks,
+		"lockRejects":     vb.stats.LockRejects,
+		"lockExpirations": vb.stats.LockExpirations,
+		"lockedItems":     vb.stats.LockedItems,
+	}
+	if !reflect.DeepEqual(expStats, actStats) {
+		t.Errorf("Expected lock stats %v, got %v", expStats, actStats)
+	}
+}
+
+func mkWithMetaExtras(flag, exp uint32, rev, cas uint64) []byte {
+	extras := make([]byte, WITH_META_EXTRAS_LEN)
+	binary.BigEndian.PutUint32(extras[0:4], flag)
+	binary.BigEndian.PutUint32(extras[4:8], exp)
+	binary.BigEndian.PutUint64(extras[8:16], rev)
+	binary.BigEndian.PutUint64(extras[16:24], cas)
+	return extras
+}
+
+func TestWithMetaOps(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	rh := reqHandler{currentBucket: testBucket}
+	vb, _ := testBucket.CreateVBucket(3)
+	testBucket.SetVBState(3, VBActive)
+
+	do := func(op gomemcached.CommandCode, extras []byte,
+		body string) *gomemcached.MCResponse {
+		return rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode:  op,
+			VBucket: 3,
+			Key:     []byte("a"),
+			Extras:  extras,
+			Body:    []byte(body),
+		})
+	}
+
+	checkMeta := func(deleted, flag uint32, rev, cas uint64) {
+		res := do(GET_META, nil, "")
+		if res.Status != gomemcached.SUCCESS ||
+			len(res.Extras) != GET_META_EXTRAS_LEN {
+			t.Fatalf("Expected get meta success, got %v", res)
+		}
+		if binary.BigEndian.Uint32(res.Extras[0:4]) != deleted ||
+			binary.BigEndian.Uint32(res.Extras[4:8]) != flag ||
+			binary.BigEndian.Uint64(res.Extras[12:20]) != rev ||
+			res.Cas != cas {
+			t.Errorf("Expected meta %v/%v/%v/%v, got %v/%v",
+				deleted, flag, rev, cas, res.Extras, res.Cas)
+		}
+	}
+
+	if res := do(GET_META, nil, ""); res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("Expected get meta of missing item to fail, got %v", res)
+	}
+	if res := do(GETQ_META, nil, ""); res != nil {
+		t.Errorf("Expected quiet get meta of missing item to be nil, got %v", res)
+	}
+	// A deletion of a missing item still keeps its metadata.
+	res := do(DEL_WITH_META, mkWithMetaExtras(0, 0, 1, 500), "")
+	if res.Status != gomemcached.SUCCESS || res.Cas != 500 {
+		t.Errorf("Expected del with meta of missing item to work, got %v", res)
+	}
+	checkMeta(1, 0, 1, 500)
+
+	res = do(gomemcached.SET, make([]byte, 8), "aye")
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("Expected set success, got %v", res)
+	}
+	checkMeta(0, 0, 1, res.Cas)
+
+	res = do(SET_WITH_META, []byte{1, 2, 3}, "bee")
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("Expected bad extras to fail, got %v", res)
+	}
+	res = do(SET_WITH_META, mkWithMetaExtras(7, 0, 1, 1), "bee")
+	if res.Status != gomemcached.KEY_EEXISTS {
+		t.Errorf("Expected older item to lose conflict resolution, got %v", res)
+	}
+
+	res = do(SET_WITH_META, mkWithMetaExtras(7, 0, 5, 1000), "bee")
+	if res.Status != gomemcached.SUCCESS || res.Cas != 1000 {
+		t.Fatalf("Expected set with meta success, got %v", res)
+	}
+	res = do(gomemcached.GET, nil, "")
+	if res.Status != gomemcached.SUCCESS || string(res.Body) != "bee" ||
+		res.Cas != 1000 {
+		t.Errorf("Expected get of set with meta item, got %v", res)
+	}
+	checkMeta(0, 7, 5, 1000)
+
+	res = do(gomemcached.SET, make([]byte, 8), "sea")
+	if res.Status != gomemcached.SUCCESS || res.Cas <= 1000 {
+		t.Fatalf("Expected set to follow the with meta cas, got %v", res)
+	}
+	setCas := res.Cas
+	checkMeta(0, 0, 6, setCas)
+
+	res = do(SET_WITH_META, mkWithMetaExtras(0, 0, 10, setCas), "dee")
+	if res.Status != gomemcached.KEY_EEXISTS {
+		t.Errorf("Expected set with meta of a used cas to fail, got %v", res)
+	}
+
+	res = do(DEL_WITH_META, mkWithMetaExtras(0, 0, 20, 5000), "")
+	if res.Status != gomemcached.SUCCESS || res.Cas != 5000 {
+		t.Fatalf("Expected del with meta success, got %v", res)
+	}
+	if res = do(gomemcached.GET, nil, ""); res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("Expected get of deleted item to miss, got %v", res)
+	}
+	checkMeta(1, 0, 20, 5000)
+
+	// The deletion wins over an incoming item with a lower rev.
+	res = do(SET_WITH_META, mkWithMetaExtras(0, 0, 10, 6000), "eee")
+	if res.Status != gomemcached.KEY_EEXISTS {
+		t.Errorf("Expected the deletion to win conflict resolution, got %v", res)
+	}
+	res = do(DEL_WITH_META, mkWithMetaExtras(0, 0, 21, 7000), "")
+	if res.Status != gomemcached.SUCCESS || res.Cas != 7000 {
+		t.Fatalf("Expected del with meta of a deletion to work, got %v", res)
+	}
+	checkMeta(1, 0, 21, 7000)
+
+	if vb.stats.GetMetas != 8 || vb.stats.SetWithMetas != 5 ||
+		vb.stats.DelWithMetas != 3 || vb.stats.MetaConflicts != 2 ||
+		vb.stats.Items != 0 {
+		t.Errorf("Expected with meta stats, got %#v", vb.stats)
+	}
+}
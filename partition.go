@@ -13,23 +13,52 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/steveyen/gkvlite"
 )
 
 type partitionstore struct {
+	persistedCas uint64 // Changes with cas <= persistedCas are on disk.
+	lastSeqno    uint64 // Only changed while holding the lock.
+	evictedBytes int64  // The item bytes that are only on disk, estimated.
+
 	vbid    uint16
 	parent  *bucketstore
 	lock    sync.Mutex     // Properties below here are covered by this lock.
 	keys    unsafe.Pointer // *gkvlite.Collection
 	changes unsafe.Pointer // *gkvlite.Collection
+
+	// The cas of the latest deletion per key of the keys that haven't
+	// been set since, which is built from the changes stream at load.
+	deletions map[string]uint64
+
+	// The highest cas of the changes up to the lastSeqno, and the
+	// changes after outOfOrderFrom that have a lower cas than an
+	// earlier change, such as changes that kept another server's cas,
+	// in seqno order.  They bound where snapshots start in the changes
+	// stream.
+	seqnoMaxCas    uint64
+	outOfOrder     []seqnoCas
+	outOfOrderFrom uint64
+}
+
+type seqnoCas struct {
+	seqno uint64
+	cas   uint64
 }
 
+// The most out of order changes that a partition remembers, after
+// which it forgets the older half.
+const MAX_OUT_OF_ORDER_CHANGES = 10000
+
 // Should only be used by readers.
 func (p *partitionstore) colls() (keys, changes *gkvlite.Collection) {
 	return (*gkvlite.Collection)(atomic.LoadPointer(&p.keys)),
@@ -92,7 +121,11 @@ func (p *partitionstore) getItem(key []byte, withValue bool) (
 			if err = i.fromValueBytes(cItem.Val); err != nil {
 				return nil, err
 			}
-			atomic.StorePointer(&cItem.Transient, unsafe.Pointer(i))
+			// The item was only on disk, and is now in memory again.
+			if atomic.CompareAndSwapPointer(&cItem.Transient, nil,
+				unsafe.Pointer(i)) {
+				p.addEvictedBytes(-i.NumBytes())
+			}
 			atomic.StorePointer(&kItem.Transient, unsafe.Pointer(i))
 			return i, nil
 		}
@@ -102,6 +135,309 @@ func (p *partitionstore) getItem(key []byte, withValue bool) (
 	return nil, fmt.Errorf("max getItem retries for key: %v", key)
 }
 
+// Assigns the next seqno to an item change, where metadata changes
+// (with an empty key) have no seqno.  Must be called while holding
+// the lock, so that the changes stream has every change up to the
+// highSeqno().
+func (p *partitionstore) nextSeqno(i *item) {
+	if len(i.key) == 0 {
+		return
+	}
+	i.seqno = atomic.AddUint64(&p.lastSeqno, 1)
+	if i.cas > p.seqnoMaxCas {
+		p.seqnoMaxCas = i.cas
+		return
+	}
+	if len(p.outOfOrder) >= MAX_OUT_OF_ORDER_CHANGES {
+		n := len(p.outOfOrder) / 2
+		p.outOfOrderFrom = p.outOfOrder[n-1].seqno
+		p.outOfOrder = append([]seqnoCas(nil), p.outOfOrder[n:]...)
+	}
+	p.outOfOrder = append(p.outOfOrder, seqnoCas{i.seqno, i.cas})
+}
+
+// Returns the seqno of the latest item change, where the changes
+// stream has all the changes up to that seqno (except for the changes
+// that were de-duplicated by later changes).
+func (p *partitionstore) highSeqno() uint64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return atomic.LoadUint64(&p.lastSeqno)
+}
+
+// Returns the highSeqno() with the highest cas of the changes up to
+// it, and the lowest cas of the changes after the sent seqno, where
+// sentCas was the highest cas up to the sent seqno.  The startCas is
+// 0 when we don't know it, such as when sentCas is 0 or we've
+// forgotten some out of order changes after the sent seqno.
+func (p *partitionstore) snapshotBounds(sent, sentCas uint64) (
+	startCas, highSeqno, highCas uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	highSeqno = atomic.LoadUint64(&p.lastSeqno)
+	highCas = p.seqnoMaxCas
+	if sentCas == 0 || sent < p.outOfOrderFrom {
+		return 0, highSeqno, highCas
+	}
+	startCas = sentCas + 1
+	n := sort.Search(len(p.outOfOrder), func(i int) bool {
+		return p.outOfOrder[i].seqno > sent
+	})
+	for _, c := range p.outOfOrder[n:] {
+		if startCas > c.cas {
+			startCas = c.cas
+		}
+	}
+	return startCas, highSeqno, highCas
+}
+
+// Returns the cas of the latest change in the changes stream, or 0
+// if the changes stream is empty.
+func (p *partitionstore) maxCas() (uint64, error) {
+	_, changes := p.colls()
+	i, err := changes.MaxItem(false)
+	if err != nil || i == nil {
+		return 0, err
+	}
+	return casBytesParse(i.Key)
+}
+
+// Returns true if the change with the given cas has been flushed.
+func (p *partitionstore) persisted(cas uint64) bool {
+	return cas <= atomic.LoadUint64(&p.persistedCas)
+}
+
+// Returns the latest deletion of a key from the changes stream, or
+// nil if there's none or the key was set since.
+func (p *partitionstore) getDeletion(key []byte) (res *item, err error) {
+	p.lock.Lock()
+	cas, ok := p.deletions[string(key)]
+	p.lock.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	_, changes := p.colls()
+	cItem, err := changes.GetItem(casBytes(cas), true)
+	if err != nil || cItem == nil {
+		return nil, err
+	}
+	res = (*item)(atomic.LoadPointer(&cItem.Transient))
+	if res == nil {
+		res = &item{}
+		if err = res.fromValueBytes(cItem.Val); err != nil {
+			return nil, err
+		}
+	}
+	if !res.isDeletion() || !bytes.Equal(res.key, key) {
+		return nil, nil
+	}
+	return res, nil
+}
+
+// Replaces the deletions index with the latest deletions per key
+// from a scan of the changes stream at load, leaving out the keys
+// that were set since.
+func (p *partitionstore) loadDeletions(deletions map[string]uint64) error {
+	keys, _ := p.colls()
+	for key := range deletions {
+		kItem, err := keys.GetItem([]byte(key), false)
+		if err != nil {
+			return err
+		}
+		if kItem != nil {
+			delete(deletions, key)
+		}
+	}
+	p.lock.Lock()
+	p.deletions = deletions
+	p.lock.Unlock()
+	return nil
+}
+
+// Repairs the key-index at load time, as a flush that happened between
+// the changes update and the keys update of a mutation leaves a file
+// whose key-index is behind its changes stream.  The changes above the
+// key-index's high-water mark (its largest cas) are incorporated into
+// the key-index, and an entry whose change is gone is pointed at a
+// later change of its key, or else dropped.
+func (p *partitionstore) repairKeys() (fixed, dropped int, err error) {
+	p.mutate(func(keys, changes *gkvlite.Collection) {
+		var highCas uint64
+		dangling := map[string]uint64{} // Keyed by key, value is cas.
+		var vErr error
+		err = p.visit(keys, nil, true, func(kItem *gkvlite.Item) bool {
+			var cas uint64
+			if cas, vErr = casBytesParse(kItem.Val); vErr != nil {
+				return false
+			}
+			if highCas < cas {
+				highCas = cas
+			}
+			var cItem *gkvlite.Item
+			if cItem, vErr = changes.GetItem(kItem.Val, false); vErr != nil {
+				return false
+			}
+			if cItem == nil {
+				dangling[string(kItem.Key)] = cas
+			}
+			return true
+		})
+		if err == nil {
+			err = vErr
+		}
+		if err != nil {
+			return
+		}
+
+		// The latest changes of the keys that need repairs, where only
+		// dangling entries need a scan of the whole changes stream.
+		var start []byte
+		if len(dangling) == 0 {
+			start = casBytes(highCas + 1)
+		}
+		latest := map[string]*item{}
+		err = p.visitChanges(start, true, func(i *item) bool {
+			if len(i.key) == 0 {
+				return true // Skip metadata changes.
+			}
+			k := string(i.key)
+			if cas, ok := dangling[k]; i.cas > highCas || (ok && i.cas > cas) {
+				latest[k] = i
+			}
+			return true
+		})
+		if err != nil {
+			return
+		}
+
+		for k, i := range latest {
+			delete(dangling, k)
+			if i.isDeletion() {
+				var deleted bool
+				if deleted, err = keys.Delete(i.key); err != nil {
+					return
+				}
+				if deleted {
+					fixed++
+				}
+				continue
+			}
+			err = keys.SetItem(&gkvlite.Item{
+				Key:      i.key,
+				Val:      casBytes(i.cas),
+				Priority: p.parent.keyPriority(),
+			})
+			if err != nil {
+				return
+			}
+			fixed++
+		}
+		for k := range dangling {
+			if _, err = keys.Delete([]byte(k)); err != nil {
+				return
+			}
+			dropped++
+		}
+		if fixed+dropped > 0 {
+			p.parent.dirty(true)
+		}
+	})
+	return fixed, dropped, err
+}
+
+// Lets gkvlite drop some of the items that are already on disk from
+// memory, returning how many it dropped, where their values come back
+// from the file on their next access.  As the changes stream holds the
+// values, too, both collections drop items.
+func (p *partitionstore) evictSomeItems() (keysEvicted, changesEvicted uint64) {
+	p.mutate(func(keys, changes *gkvlite.Collection) {
+		keysEvicted = keys.EvictSomeItems()
+		changesEvicted = changes.EvictSomeItems()
+	})
+	return keysEvicted, changesEvicted
+}
+
+// Adds to the item bytes that are only on disk, which stay at or
+// above 0, as the evictions only estimate them, along with the total
+// of the bucketstore.
+func (p *partitionstore) addEvictedBytes(delta int64) {
+	for {
+		prev := atomic.LoadInt64(&p.evictedBytes)
+		next := prev + delta
+		if next < 0 {
+			next = 0
+		}
+		if atomic.CompareAndSwapInt64(&p.evictedBytes, prev, next) {
+			atomic.AddInt64(&p.parent.evictedBytes, next-prev)
+			return
+		}
+	}
+}
+
+// Moves a key to the current minute in an lru bucket, so that reads
+// keep a key from being evicted.  As that replaces the key-index
+// entry, a key moves at most once a minute.
+func (p *partitionstore) touchLRU(key []byte, now time.Time) {
+	if p.parent.eviction != EVICTION_LRU {
+		return
+	}
+	keys, _ := p.colls()
+	kItem, err := keys.GetItem(key, true)
+	if err != nil || kItem == nil || lruAge(kItem.Priority, now) == 0 {
+		return
+	}
+	p.mutate(func(keys, _ *gkvlite.Collection) {
+		kCurr, err := keys.GetItem(key, true)
+		if err != nil || kCurr == nil || !bytes.Equal(kCurr.Val, kItem.Val) {
+			return // A concurrent mutation already moved the key.
+		}
+		kNext := kCurr.Copy()
+		kNext.Priority = lruPriority(now)
+		keys.SetItem(kNext)
+	})
+}
+
+// Removes the oldest deletions from the changes stream, until they
+// add up to at least maxBytes, returning the bytes that they took.
+func (p *partitionstore) purgeDeletions(maxBytes int64) (
+	purged int, freed int64, err error) {
+	var cass []uint64
+	var keys []string
+	var sizes []int64
+	var total int64
+	err = p.visitChanges(nil, true, func(i *item) bool {
+		if len(i.key) > 0 && i.isDeletion() { // Keep metadata changes.
+			cass = append(cass, i.cas)
+			keys = append(keys, string(i.key))
+			sizes = append(sizes, i.NumBytes())
+			total += i.NumBytes()
+		}
+		return total < maxBytes
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	p.mutate(func(_, changes *gkvlite.Collection) {
+		for x, cas := range cass {
+			var deleted bool
+			if deleted, err = changes.Delete(casBytes(cas)); err != nil {
+				return
+			}
+			if deleted {
+				purged++
+				freed += sizes[x]
+			}
+			if p.deletions[keys[x]] == cas {
+				delete(p.deletions, keys[x])
+			}
+		}
+		if purged > 0 {
+			p.parent.dirty(false)
+		}
+	})
+	return purged, freed, err
+}
+
 func (p *partitionstore) getTotals() (
 	numItems uint64, numItemBytes uint64, err error) {
 	keys, changes := p.colls()
@@ -196,7 +532,6 @@ func (p *partitionstore) setWithCallback(newItem *item, oldItem *item,
 	cBytes := casBytes(newItem.cas)
 	cItem := &gkvlite.Item{
 		Key:       cBytes,
-		Val:       newItem.toValueBytes(),
 		Priority:  rand.Int31(),
 		Transient: unsafe.Pointer(newItem),
 	}
@@ -206,13 +541,11 @@ func (p *partitionstore) setWithCallback(newItem *item, oldItem *item,
 		kItem = &gkvlite.Item{
 			Key:       newItem.key,
 			Val:       cBytes,
-			Priority:  rand.Int31(),
+			Priority:  p.parent.keyPriority(),
 			Transient: unsafe.Pointer(newItem),
 		}
 	}
 
-	deltaItemBytes = newItem.NumBytes()
-
 	var oldItemCasBytes []byte
 	if oldItem != nil {
 		oldItemCasBytes = make([]byte, 8)
@@ -222,18 +555,21 @@ func (p *partitionstore) setWithCallback(newItem *item, oldItem *item,
 	}
 
 	p.mutate(func(keys, changes *gkvlite.Collection) {
+		p.nextSeqno(newItem)
+		cItem.Val = newItem.toValueBytes()
+		deltaItemBytes += newItem.NumBytes()
 		if err = changes.SetItem(cItem); err != nil {
 			return
 		}
 		dirtyForce := false
 		if newItem.key != nil && len(newItem.key) > 0 {
-			// TODO: What if we flush between the keys update and changes
-			// update?  That could result in an inconsistent db file?
-			// Solution idea #1 is to have load-time fixup, that
-			// incorporates changes into the key-index.
+			// A flush between the changes update and the keys update
+			// leaves a key-index that's behind the changes stream in
+			// the file, which repairKeys() fixes at load time.
 			if err = keys.SetItem(kItem); err != nil {
 				return
 			}
+			delete(p.deletions, string(newItem.key))
 		} else {
 			dirtyForce = true // An nil/empty key means this is a metadata change.
 		}
@@ -254,17 +590,24 @@ func (p *partitionstore) setWithCallback(newItem *item, oldItem *item,
 
 func (p *partitionstore) del(key []byte, cas uint64, oldItem *item) (
 	deltaItemBytes int64, err error) {
-	cBytes := casBytes(cas)
 	dItem := &item{key: key, cas: cas}
-	vBytes := dItem.markAsDeletion().toValueBytes()
+	if oldItem != nil {
+		dItem.rev = oldItem.rev + 1
+	}
+	return p.delItem(dItem, oldItem)
+}
+
+// Records a deletion of dItem's key into the changes stream, where
+// the deletion keeps dItem's cas and rev as its metadata.
+func (p *partitionstore) delItem(dItem *item, oldItem *item) (
+	deltaItemBytes int64, err error) {
+	key := dItem.key
+	cBytes := casBytes(dItem.cas)
 	cItem := &gkvlite.Item{
 		Key:      cBytes,
-		Val:      vBytes,
 		Priority: rand.Int31(),
 	}
 
-	deltaItemBytes = dItem.NumBytes()
-
 	var oldItemCasBytes []byte
 	if oldItem != nil {
 		oldItemCasBytes = make([]byte, 8)
@@ -274,18 +617,21 @@ func (p *partitionstore) del(key []byte, cas uint64, oldItem *item) (
 	}
 
 	p.mutate(func(keys, changes *gkvlite.Collection) {
+		p.nextSeqno(dItem)
+		cItem.Val = dItem.markAsDeletion().toValueBytes()
+		deltaItemBytes += dItem.NumBytes()
 		if err = changes.SetItem(cItem); err != nil {
 			return
 		}
 		dirtyForce := false
 		if key != nil && len(key) > 0 {
-			// TODO: What if we flush between the keys update and changes
-			// update?  That could result in an inconsistent db file?
-			// Solution idea #1 is to have load-time fixup, that
-			// incorporates changes into the key-index.
+			// A flush between the changes update and the keys update
+			// leaves a key-index that's behind the changes stream in
+			// the file, which repairKeys() fixes at load time.
 			if _, err = keys.Delete(key); err != nil {
 				return
 			}
+			p.deletions[string(key)] = dItem.cas
 		} else {
 			dirtyForce = true // An nil/empty key means this is a metadata change.
 		}
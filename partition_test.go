@@ -5,6 +5,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/dustin/gomemcached"
 	"github.com/steveyen/gkvlite"
 )
 
@@ -52,6 +53,150 @@ func TestPartitionStoreEmptyVisit(t *testing.T) {
 	}
 }
 
+func TestPartitionStoreDeletions(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	b, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	if err != nil {
+		t.Fatalf("Expected NewBucket() to work")
+	}
+	defer b.Close()
+	vb, _ := b.CreateVBucket(0)
+	b.SetVBState(0, VBActive)
+
+	tapTestMutate(vb, gomemcached.SET, "a", "aye")
+	tapTestMutate(vb, gomemcached.DELETE, "a", "")
+	i, err := vb.ps.getDeletion([]byte("a"))
+	if err != nil || i == nil || !i.isDeletion() || string(i.key) != "a" ||
+		vb.ps.deletions["a"] != i.cas {
+		t.Errorf("expected the deletion of a, got: %#v, %v", i, err)
+	}
+
+	// Later deletions update the index.
+	tapTestMutate(vb, gomemcached.SET, "a", "aye")
+	tapTestMutate(vb, gomemcached.DELETE, "a", "")
+	tapTestMutate(vb, gomemcached.SET, "b", "bee")
+	tapTestMutate(vb, gomemcached.DELETE, "b", "")
+	i, err = vb.ps.getDeletion([]byte("a"))
+	if err != nil || i == nil || i.cas != vb.Meta().LastCas-2 {
+		t.Errorf("expected the latest deletion of a, got: %#v, %v", i, err)
+	}
+	if i, err = vb.ps.getDeletion([]byte("c")); err != nil || i != nil {
+		t.Errorf("expected no deletion of c, got: %#v, %v", i, err)
+	}
+
+	// Setting a key again drops its deletion.
+	tapTestMutate(vb, gomemcached.SET, "a", "aye")
+	i, err = vb.ps.getDeletion([]byte("a"))
+	if _, ok := vb.ps.deletions["a"]; err != nil || i != nil || ok {
+		t.Errorf("expected no deletion of a after a set, got: %#v, %v", i, err)
+	}
+
+	if _, _, err = vb.ps.purgeDeletions(1 << 20); err != nil {
+		t.Errorf("expected purgeDeletions to work, got: %v", err)
+	}
+	i, err = vb.ps.getDeletion([]byte("b"))
+	if err != nil || i != nil || len(vb.ps.deletions) != 0 {
+		t.Errorf("expected purged deletions to be gone, got: %#v, %v, %v",
+			i, err, vb.ps.deletions)
+	}
+
+	tapTestMutate(vb, gomemcached.SET, "c", "sea")
+	tapTestMutate(vb, gomemcached.DELETE, "c", "")
+	if err = vb.flushItems(); err != nil {
+		t.Errorf("expected flushItems to work, got: %v", err)
+	}
+	i, err = vb.ps.getDeletion([]byte("c"))
+	if err != nil || i != nil {
+		t.Errorf("expected flushed deletions to be gone, got: %#v, %v", i, err)
+	}
+}
+
+func TestPartitionStoreLoadDeletions(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	settings := &BucketSettings{NumPartitions: 1}
+	b0, err := NewBucket("test", testBucketDir, settings)
+	if err != nil {
+		t.Fatalf("Expected NewBucket() to work")
+	}
+	vb, _ := b0.CreateVBucket(0)
+	b0.SetVBState(0, VBActive)
+	tapTestMutate(vb, gomemcached.SET, "a", "aye")
+	tapTestMutate(vb, gomemcached.DELETE, "a", "")
+	tapTestMutate(vb, gomemcached.SET, "b", "bee")
+	tapTestMutate(vb, gomemcached.DELETE, "b", "")
+	tapTestMutate(vb, gomemcached.SET, "b", "bee")
+	aDel, _ := vb.ps.getDeletion([]byte("a"))
+	b0.Flush()
+	b0.Close()
+
+	b1, err := NewBucket("test", testBucketDir, settings)
+	if err != nil {
+		t.Fatalf("expected NewBucket re-open to work, err: %v", err)
+	}
+	defer b1.Close()
+	if err = b1.Load(); err != nil {
+		t.Errorf("expected Load to work, err: %v", err)
+	}
+	vb, _ = b1.GetVBucket(0)
+	// The load builds the index, without the keys that were set since.
+	if aDel == nil || len(vb.ps.deletions) != 1 ||
+		vb.ps.deletions["a"] != aDel.cas {
+		t.Errorf("expected the loaded deletion of a, got: %v, %v",
+			aDel, vb.ps.deletions)
+	}
+}
+
+func TestPartitionStoreSnapshotBounds(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	b, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	if err != nil {
+		t.Fatalf("Expected NewBucket() to work")
+	}
+	defer b.Close()
+	vb, _ := b.CreateVBucket(0)
+
+	set := func(key string, cas uint64) {
+		_, err := vb.ps.set(&item{key: []byte(key), cas: cas}, nil)
+		if err != nil {
+			t.Fatalf("expected set to work, got: %v", err)
+		}
+	}
+	expect := func(sent, sentCas, expStart, expHigh, expHighCas uint64) {
+		start, high, highCas := vb.ps.snapshotBounds(sent, sentCas)
+		if start != expStart || high != expHigh || highCas != expHighCas {
+			t.Errorf("expected snapshotBounds(%v, %v) of %v, %v, %v,"+
+				" got: %v, %v, %v", sent, sentCas,
+				expStart, expHigh, expHighCas, start, high, highCas)
+		}
+	}
+
+	set("a", 100)
+	set("b", 200)
+	expect(0, 0, 0, 2, 200)
+	expect(2, 200, 201, 2, 200)
+
+	// A change with a lower cas lowers the start of later snapshots.
+	set("c", 150)
+	set("d", 300)
+	expect(2, 200, 150, 4, 300)
+	expect(3, 200, 201, 4, 300)
+	expect(4, 300, 301, 4, 300)
+
+	// We can't bound the snapshots after forgotten changes.
+	vb.ps.outOfOrderFrom = 3
+	expect(2, 200, 0, 4, 300)
+	expect(3, 200, 201, 4, 300)
+}
+
 func testFillColl(x *gkvlite.Collection, arr []string) {
 	for i, s := range arr {
 		x.SetItem(&gkvlite.Item{
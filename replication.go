@@ -0,0 +1,665 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+// A replication feeds the replica vbuckets of a destination bucket
+// with the changes of a source bucket's active vbuckets, by consuming
+// a TAP stream of the source bucket.  The destination is a bucket of
+// this process, or a bucket of another cbgb process, written as
+// "host:port/bucketName", which receives the TAP stream on its binary
+// protocol port.  A failed replication is restarted after a backoff.
+type replication struct {
+	src      string
+	dst      string
+	password string // For the SASL auth to a remote destination.
+	buckets  *Buckets
+
+	stopch chan bool
+	donech chan bool // Closed when the replication has stopped.
+
+	m        sync.Mutex
+	state    string
+	err      error // The last stream error, covered by m.
+	restarts int64 // Covered by m.
+
+	// The last cas per vbucket that was applied to the destination
+	// (or, for another cbgb, sent to it), covered by m.
+	applied map[uint16]uint64
+}
+
+const (
+	REPLICATION_STARTING  = "starting"
+	REPLICATION_STREAMING = "streaming"
+	REPLICATION_BACKOFF   = "backoff"
+	REPLICATION_STOPPED   = "stopped"
+)
+
+var replicationDialTimeout = 10 * time.Second
+
+var replicationBackoffMin = 100 * time.Millisecond
+var replicationBackoffMax = 30 * time.Second
+
+// Returns the host:port and bucket name of a remote destination, or
+// an empty host for a bucket of this process.
+func parseReplicationDst(dst string) (host, bucketName string) {
+	if !strings.Contains(dst, ":") {
+		return "", dst
+	}
+	x := strings.SplitN(dst, "/", 2)
+	if len(x) < 2 || x[1] == "" {
+		return x[0], DEFAULT_BUCKET_NAME
+	}
+	return x[0], x[1]
+}
+
+// Streams until the replication is stopped, restarting the stream
+// with an exponential backoff when it fails.
+func (r *replication) run() {
+	defer close(r.donech)
+	backoff := replicationBackoffMin
+	for {
+		start := time.Now()
+		err := r.stream()
+		r.m.Lock()
+		r.err = err
+		r.state = REPLICATION_BACKOFF
+		if err == nil {
+			r.state = REPLICATION_STOPPED
+		}
+		r.m.Unlock()
+		if err == nil {
+			return
+		}
+		log.Printf("error: replication, src: %v, dst: %v, err: %v,"+
+			" restarting in: %v", r.src, r.dst, err, backoff)
+
+		select {
+		case <-r.stopch:
+			r.setState(REPLICATION_STOPPED)
+			return
+		case <-time.After(backoff):
+		}
+		// A stream that ran for a while starts a new backoff.
+		backoff *= 2
+		if time.Since(start) > replicationBackoffMax {
+			backoff = replicationBackoffMin
+		}
+		if backoff > replicationBackoffMax {
+			backoff = replicationBackoffMax
+		}
+		r.m.Lock()
+		r.restarts++
+		r.state = REPLICATION_STARTING
+		r.m.Unlock()
+	}
+}
+
+func (r *replication) setState(state string) {
+	r.m.Lock()
+	r.state = state
+	r.m.Unlock()
+}
+
+func (r *replication) setApplied(vbid uint16, cas uint64) {
+	r.m.Lock()
+	if cas > r.applied[vbid] {
+		r.applied[vbid] = cas
+	}
+	r.m.Unlock()
+}
+
+// Returns the applied cas of the source's vbuckets, except where the
+// vbucket's LastCas is behind it, which means the vbucket was
+// recreated since.
+func (r *replication) resumeCas(src Bucket) map[uint16]uint64 {
+	r.m.Lock()
+	defer r.m.Unlock()
+	rv := map[uint16]uint64{}
+	for vbid, cas := range r.applied {
+		vb, _ := src.GetVBucket(vbid)
+		if vb != nil && cas <= atomic.LoadUint64(&vb.Meta().LastCas) {
+			rv[vbid] = cas
+		}
+	}
+	return rv
+}
+
+// Returns how far behind the destination is, as the sum over the
+// source's streamed vbuckets of each vbucket's LastCas minus its last
+// applied cas.  Metadata changes, such as vbucket state changes, also
+// advance a vbucket's LastCas.
+func (r *replication) lag() int64 {
+	src := r.buckets.Get(r.src)
+	if src == nil {
+		return 0
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	var rv int64
+	np := src.GetBucketSettings().NumPartitions
+	for vbid := 0; vbid < np; vbid++ {
+		vb, _ := src.GetVBucket(uint16(vbid))
+		if vb == nil || !replicationStreams(vb.GetVBState()) {
+			continue
+		}
+		lastCas := atomic.LoadUint64(&vb.Meta().LastCas)
+		if applied := r.applied[uint16(vbid)]; lastCas > applied {
+			rv += int64(lastCas - applied)
+		}
+	}
+	return rv
+}
+
+// Replications stream replica vbuckets too, so that they can be
+// chained through replica buckets.
+func replicationStreams(state VBState) bool {
+	return state == VBActive || state == VBReplica
+}
+
+func (r *replication) info() map[string]interface{} {
+	lag := r.lag()
+	r.m.Lock()
+	defer r.m.Unlock()
+	rv := map[string]interface{}{
+		"src":      r.src,
+		"dst":      r.dst,
+		"state":    r.state,
+		"restarts": r.restarts,
+		"lag":      lag,
+	}
+	if r.err != nil {
+		rv["err"] = r.err.Error()
+	}
+	return rv
+}
+
+// Backfills and then forwards the source bucket's changes until the
+// replication is stopped or fails.
+func (r *replication) stream() (err error) {
+	src := r.buckets.Get(r.src)
+	if src == nil {
+		return fmt.Errorf("no source bucket: %v", r.src)
+	}
+	dst, err := r.connect()
+	if err != nil {
+		return err
+	}
+	r.setState(REPLICATION_STREAMING)
+
+	treq := &gomemcached.MCRequest{
+		Opcode: gomemcached.TAP_CONNECT,
+		Extras: make([]byte, 4),
+		Body:   make([]byte, 8), // Backfill from the beginning.
+	}
+	binary.BigEndian.PutUint32(treq.Extras, uint32(gomemcached.BACKFILL))
+	tc, err := treq.ParseTapCommands()
+	if err != nil {
+		dst.close()
+		return err
+	}
+	ts, res := newTapStream(src, &tc)
+	if res != nil {
+		dst.close()
+		return res
+	}
+	ts.replicas = true
+	// A restart resumes each vbucket from its last applied cas, as
+	// registered TAP clients resume from their checkpoints, instead of
+	// backfilling everything again.  Another cbgb might not have
+	// received all that we sent, so it gets the full backfill.
+	if host, _ := parseReplicationDst(r.dst); host == "" {
+		ts.checkpoints = r.resumeCas(src)
+	}
+
+	chpkt := make(chan transmissible, 128)
+	cherr := make(chan error, 1)
+	tapdonech := make(chan bool)
+	go func() {
+		defer close(tapdonech)
+		doTapStream(ts, &tc, treq, dst.acks(), chpkt, cherr)
+	}()
+	defer func() {
+		// Stop the TAP stream, which might be waiting for an ack.
+		cherr <- io.EOF
+		dst.close()
+		for {
+			select {
+			case <-chpkt:
+			case <-tapdonech:
+				return
+			}
+		}
+	}()
+
+	replicas := map[uint16]bool{}
+	setReplica := func(vbid uint16) error {
+		if replicas[vbid] {
+			return nil
+		}
+		replicas[vbid] = true
+		return dst.send(replicaVBStateRequest(vbid))
+	}
+	np := src.GetBucketSettings().NumPartitions
+	for vbid := 0; vbid < np; vbid++ {
+		vb, _ := src.GetVBucket(uint16(vbid))
+		if vb != nil && replicationStreams(vb.GetVBState()) {
+			if err = setReplica(uint16(vbid)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-r.stopch:
+			return nil
+		case pkt, ok := <-chpkt:
+			if !ok {
+				return fmt.Errorf("tap stream closed")
+			}
+			req, ok := pkt.(*gomemcached.MCRequest)
+			if !ok {
+				continue
+			}
+			switch req.Opcode {
+			case gomemcached.TAP_MUTATION, gomemcached.TAP_DELETE,
+				gomemcached.TAP_FLUSH:
+				// A vbucket that became active after we started.
+				if err = setReplica(req.VBucket); err != nil {
+					return err
+				}
+				if err = dst.send(req); err != nil {
+					return err
+				}
+				r.setApplied(req.VBucket, req.Cas)
+				continue
+			case gomemcached.TAP_VBUCKET_SET:
+				continue // Our replica vbuckets keep their state.
+			}
+			if err = dst.send(req); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func replicaVBStateRequest(vbid uint16) *gomemcached.MCRequest {
+	req := &gomemcached.MCRequest{
+		Opcode:  gomemcached.TAP_VBUCKET_SET,
+		VBucket: vbid,
+		Extras:  make([]byte, TAP_EXTRAS_LEN),
+		Body:    make([]byte, 4),
+	}
+	req.Extras[4] = TAP_TTL
+	binary.BigEndian.PutUint32(req.Body, uint32(VBReplica))
+	return req
+}
+
+// Where a replication sends its TAP messages, and from where the TAP
+// stream reads the acks of those messages.
+type replicationDst interface {
+	send(req *gomemcached.MCRequest) error
+	acks() io.Reader
+	close()
+}
+
+func (r *replication) connect() (replicationDst, error) {
+	host, bucketName := parseReplicationDst(r.dst)
+	if host == "" {
+		b := r.buckets.Get(bucketName)
+		if b == nil {
+			return nil, fmt.Errorf("no destination bucket: %v", bucketName)
+		}
+		pr, pw := io.Pipe()
+		return &localReplicationDst{b: b, pr: pr, pw: pw}, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", host, replicationDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	auth := &gomemcached.MCRequest{
+		Opcode: gomemcached.SASL_AUTH,
+		Key:    []byte(SASL_PLAIN),
+		Body:   []byte("\x00" + bucketName + "\x00" + r.password),
+	}
+	if err = auth.Transmit(conn); err == nil {
+		var res *gomemcached.MCResponse
+		res, err = readResponse(conn)
+		if err == nil && res.Status != gomemcached.SUCCESS {
+			err = fmt.Errorf("auth failed, bucket: %v, res: %v", bucketName, res)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &remoteReplicationDst{conn: conn}, nil
+}
+
+// Applies TAP messages to a bucket of this process.
+type localReplicationDst struct {
+	b  Bucket
+	pr *io.PipeReader
+	pw *io.PipeWriter
+}
+
+func (d *localReplicationDst) send(req *gomemcached.MCRequest) error {
+	res := doTapReceive(d.b, req)
+	if res == nil {
+		return nil
+	}
+	if res.Fatal {
+		return fmt.Errorf("destination bucket unavailable")
+	}
+	res.Opcode = req.Opcode
+	res.Opaque = req.Opaque
+	_, err := d.pw.Write(res.Bytes())
+	return err
+}
+
+func (d *localReplicationDst) acks() io.Reader {
+	return d.pr
+}
+
+func (d *localReplicationDst) close() {
+	d.pw.Close()
+}
+
+// Sends TAP messages to another cbgb, which responds with the acks.
+type remoteReplicationDst struct {
+	conn net.Conn
+}
+
+func (d *remoteReplicationDst) send(req *gomemcached.MCRequest) error {
+	return req.Transmit(d.conn)
+}
+
+func (d *remoteReplicationDst) acks() io.Reader {
+	return d.conn
+}
+
+func (d *remoteReplicationDst) close() {
+	d.conn.Close()
+}
+
+// Holder of the replications between buckets, which is the
+// replication topology, persisted in the buckets directory.
+type replicationManager struct {
+	buckets *Buckets
+
+	m    sync.Mutex
+	reps map[string]*replication // Keyed by replicationKey().
+}
+
+// A persisted replication.
+type replicationEdge struct {
+	Src      string `json:"src"`
+	Dst      string `json:"dst"`
+	Password string `json:"password,omitempty"`
+}
+
+const REPLICATIONS_FILE = "replications.json"
+
+func newReplicationManager(b *Buckets) *replicationManager {
+	return &replicationManager{
+		buckets: b,
+		reps:    map[string]*replication{},
+	}
+}
+
+func replicationKey(src, dst string) string {
+	return src + "->" + dst
+}
+
+// Starts replicating a source bucket into a destination bucket.  The
+// replication makes the destination's vbuckets replicas, so a local
+// destination that has active vbuckets is refused unless forced.
+func (rm *replicationManager) Start(src, dst, password string,
+	force bool) error {
+	if rm.buckets.Get(src) == nil {
+		return fmt.Errorf("no source bucket: %v", src)
+	}
+	host, bucketName := parseReplicationDst(dst)
+	if host == "" {
+		if bucketName == src {
+			return fmt.Errorf("bucket cannot replicate to itself: %v", src)
+		}
+		b := rm.buckets.Get(bucketName)
+		if b == nil {
+			return fmt.Errorf("no destination bucket: %v", bucketName)
+		}
+		if !force && hasActiveVBuckets(b) {
+			return fmt.Errorf("destination bucket has active vbuckets: %v",
+				bucketName)
+		}
+	}
+
+	rm.m.Lock()
+	defer rm.m.Unlock()
+	k := replicationKey(src, dst)
+	if rm.reps[k] != nil {
+		return fmt.Errorf("replication already exists: %v", k)
+	}
+	// Each bucket of a cycle would demote the others' vbuckets, so
+	// they'd all end up as replicas of each other.
+	if host == "" && rm.reaches_unlocked(bucketName, src) {
+		return fmt.Errorf("replication would make a cycle: %v", k)
+	}
+	r := &replication{
+		src:      src,
+		dst:      dst,
+		password: password,
+		buckets:  rm.buckets,
+		stopch:   make(chan bool),
+		donech:   make(chan bool),
+		state:    REPLICATION_STARTING,
+		applied:  map[uint16]uint64{},
+	}
+	rm.reps[k] = r
+	go r.run()
+	return rm.save_unlocked()
+}
+
+// Returns whether the local replications lead from one bucket to
+// another.  The replications into other cbgb's aren't followed.
+func (rm *replicationManager) reaches_unlocked(from, to string) bool {
+	visited := map[string]bool{}
+	next := []string{from}
+	for len(next) > 0 {
+		name := next[len(next)-1]
+		next = next[:len(next)-1]
+		if name == to {
+			return true
+		}
+		if visited[name] {
+			continue
+		}
+		visited[name] = true
+		for _, r := range rm.reps {
+			host, bucketName := parseReplicationDst(r.dst)
+			if r.src == name && host == "" {
+				next = append(next, bucketName)
+			}
+		}
+	}
+	return false
+}
+
+func hasActiveVBuckets(b Bucket) bool {
+	np := b.GetBucketSettings().NumPartitions
+	for vbid := 0; vbid < np; vbid++ {
+		vb, _ := b.GetVBucket(uint16(vbid))
+		if vb != nil && vb.GetVBState() == VBActive {
+			return true
+		}
+	}
+	return false
+}
+
+// Stops and forgets a replication.
+func (rm *replicationManager) Stop(src, dst string) error {
+	rm.m.Lock()
+	k := replicationKey(src, dst)
+	r := rm.reps[k]
+	delete(rm.reps, k)
+	err := rm.save_unlocked()
+	rm.m.Unlock()
+	if r == nil {
+		return fmt.Errorf("no replication: %v", k)
+	}
+	close(r.stopch)
+	<-r.donech
+	return err
+}
+
+func (rm *replicationManager) save_unlocked() error {
+	edges := []replicationEdge{}
+	for _, r := range rm.reps {
+		edges = append(edges, replicationEdge{r.src, r.dst, r.password})
+	}
+	j, err := json.Marshal(edges)
+	if err != nil {
+		return err
+	}
+	// The file has the passwords of remote destinations.
+	fname := filepath.Join(rm.buckets.dir, REPLICATIONS_FILE)
+	fnameNew := fname + ".new"
+	if err = ioutil.WriteFile(fnameNew, j, 0600); err != nil {
+		return err
+	}
+	return os.Rename(fnameNew, fname)
+}
+
+// Starts the persisted replications, after the buckets are loaded.
+func (rm *replicationManager) Load() error {
+	j, err := ioutil.ReadFile(filepath.Join(rm.buckets.dir, REPLICATIONS_FILE))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	edges := []replicationEdge{}
+	if err = json.Unmarshal(j, &edges); err != nil {
+		return err
+	}
+	// The persisted replications were checked when they were started,
+	// and their destinations already have replica vbuckets.
+	for _, e := range edges {
+		if err = rm.Start(e.Src, e.Dst, e.Password, true); err != nil {
+			log.Printf("error: could not start replication, src: %v, dst: %v,"+
+				" err: %v", e.Src, e.Dst, err)
+		}
+	}
+	return nil
+}
+
+// Stops the replications from or into a bucket.
+func (rm *replicationManager) StopBucket(name string) {
+	for _, r := range rm.list("") {
+		if r.src == name || r.isLocalDst(name) {
+			rm.Stop(r.src, r.dst)
+		}
+	}
+}
+
+func (r *replication) isLocalDst(name string) bool {
+	host, bucketName := parseReplicationDst(r.dst)
+	return host == "" && bucketName == name
+}
+
+// Returns the replications of a source bucket, or all replications
+// for an empty src, sorted by their keys.
+func (rm *replicationManager) list(src string) []*replication {
+	rm.m.Lock()
+	defer rm.m.Unlock()
+	keys := make([]string, 0, len(rm.reps))
+	for k, r := range rm.reps {
+		if src == "" || r.src == src {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	rv := make([]*replication, len(keys))
+	for i, k := range keys {
+		rv[i] = rm.reps[k]
+	}
+	return rv
+}
+
+func (rm *replicationManager) Infos(src string) []map[string]interface{} {
+	rv := []map[string]interface{}{}
+	for _, r := range rm.list(src) {
+		rv = append(rv, r.info())
+	}
+	return rv
+}
+
+// Sends the stats of a bucket's replications, such as their lag.
+func (rm *replicationManager) sendStats(b Bucket, ch chan<- statItem) {
+	for _, r := range rm.list(b.Name()) {
+		if rm.buckets.Get(r.src) != b {
+			continue
+		}
+		info := r.info()
+		for _, k := range []string{"state", "restarts", "lag"} {
+			ch <- statItem{"replication:" + r.dst + ":" + k,
+				fmt.Sprintf("%v", info[k])}
+		}
+	}
+}
+
+// Returns the destinations of a source bucket's replications.
+func (rm *replicationManager) Dsts(src string) []string {
+	rv := []string{}
+	for _, r := range rm.list(src) {
+		rv = append(rv, r.dst)
+	}
+	return rv
+}
+
+// Makes a bucket's replica vbuckets active, after stopping the
+// replications into the bucket, returning the promoted vbuckets.
+func (rm *replicationManager) Promote(name string) ([]uint16, error) {
+	b := rm.buckets.Get(name)
+	if b == nil {
+		return nil, fmt.Errorf("no bucket: %v", name)
+	}
+	for _, r := range rm.list("") {
+		if r.isLocalDst(name) {
+			rm.Stop(r.src, r.dst)
+		}
+	}
+
+	rv := []uint16{}
+	np := b.GetBucketSettings().NumPartitions
+	for vbid := 0; vbid < np; vbid++ {
+		vb, _ := b.GetVBucket(uint16(vbid))
+		if vb == nil || vb.GetVBState() != VBReplica {
+			continue
+		}
+		if err := b.SetVBState(uint16(vbid), VBActive); err != nil {
+			return rv, err
+		}
+		rv = append(rv, uint16(vbid))
+	}
+	return rv, nil
+}
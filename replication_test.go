@@ -0,0 +1,338 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+// Waits for a replicated item (or its deletion, for an empty val).
+func waitForReplica(t *testing.T, b Bucket, key, val string) {
+	for j := 0; j < 500; j++ {
+		res := GetItem(b, []byte(key), VBReplica)
+		if val == "" && res != nil && res.Status == gomemcached.KEY_ENOENT {
+			return
+		}
+		if val != "" && res != nil && string(res.Body) == val {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected replica of key: %v, val: %v", key, val)
+}
+
+func testSetupReplicationBuckets(t *testing.T, d string) (
+	*Buckets, Bucket, Bucket) {
+	bs, _ := NewBuckets(d, &BucketSettings{NumPartitions: 2})
+	src, err := bs.New("src", bs.settings)
+	if err != nil {
+		t.Fatalf("Expected src bucket, got %v", err)
+	}
+	for vbid := uint16(0); vbid < 2; vbid++ {
+		src.CreateVBucket(vbid)
+		src.SetVBState(vbid, VBActive)
+	}
+	dst, err := bs.New("dst", bs.settings)
+	if err != nil {
+		t.Fatalf("Expected dst bucket, got %v", err)
+	}
+	return bs, src, dst
+}
+
+func TestReplicationLocal(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	bs, src, dst := testSetupReplicationBuckets(t, d)
+	defer bs.CloseAll()
+
+	for _, k := range []string{"a", "b", "c"} {
+		SetItem(src, []byte(k), []byte(k+k), VBActive)
+	}
+
+	rm := newReplicationManager(bs)
+	if err := rm.Start("src", "dst", "", false); err != nil {
+		t.Fatalf("Expected replication to start, got %v", err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		waitForReplica(t, dst, k, k+k)
+	}
+	for vbid := uint16(0); vbid < 2; vbid++ {
+		vb, _ := dst.GetVBucket(vbid)
+		if vb == nil || vb.GetVBState() != VBReplica {
+			t.Errorf("Expected replica vbucket %v, got %v", vbid, vb)
+		}
+	}
+
+	SetItem(src, []byte("d"), []byte("dd"), VBActive)
+	waitForReplica(t, dst, "d", "dd")
+	vb, _ := GetVBucketForKey(src, []byte("a"))
+	tapTestMutate(vb, gomemcached.DELETE, "a", "")
+	waitForReplica(t, dst, "a", "")
+
+	infos := rm.Infos("src")
+	if len(infos) != 1 || infos[0]["dst"] != "dst" ||
+		infos[0]["state"] != REPLICATION_STREAMING {
+		t.Errorf("Expected a streaming replication, got %v", infos)
+	}
+	if dsts := rm.Dsts("dst"); len(dsts) != 0 {
+		t.Errorf("Expected no replications from dst, got %v", dsts)
+	}
+
+	vbids, err := rm.Promote("dst")
+	if err != nil || len(vbids) != 2 {
+		t.Fatalf("Expected promote to work, got %v, %v", vbids, err)
+	}
+	if len(rm.Infos("")) != 0 {
+		t.Errorf("Expected promote to stop the replication, got %v",
+			rm.Infos(""))
+	}
+	res := GetItem(dst, []byte("b"), VBActive)
+	if res == nil || string(res.Body) != "bb" {
+		t.Errorf("Expected promoted item, got %v", res)
+	}
+	// Clients keep the cas that they got from the source.
+	if srcRes := GetItem(src, []byte("b"), VBActive); res.Cas != srcRes.Cas {
+		t.Errorf("Expected promoted item to keep the source cas, got %v, %v",
+			res.Cas, srcRes.Cas)
+	}
+	SetItem(src, []byte("e"), []byte("ee"), VBActive)
+	time.Sleep(50 * time.Millisecond)
+	if res = GetItem(dst, []byte("e"), VBActive); res == nil ||
+		res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("Expected no more replication after promote, got %v", res)
+	}
+}
+
+func TestReplicationResume(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	bs, src, dst := testSetupReplicationBuckets(t, d)
+	defer bs.CloseAll()
+
+	for _, k := range []string{"a", "b", "c"} {
+		SetItem(src, []byte(k), []byte(k+k), VBActive)
+	}
+	rm := newReplicationManager(bs)
+	rm.Start("src", "dst", "", false)
+	r := rm.list("src")[0]
+	for j := 0; j < 500 && r.lag() != 0; j++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	rm.Stop("src", "dst")
+
+	// A restart only streams the changes since the applied cas.
+	SetItem(src, []byte("d"), []byte("dd"), VBActive)
+	r.stopch = make(chan bool)
+	r.donech = make(chan bool)
+	go r.run()
+	defer func() {
+		close(r.stopch)
+		<-r.donech
+	}()
+	waitForReplica(t, dst, "d", "dd")
+	var receives int64
+	for vbid := uint16(0); vbid < 2; vbid++ {
+		vb, _ := dst.GetVBucket(vbid)
+		receives += atomic.LoadInt64(&vb.stats.TapReceives)
+	}
+	if receives != 4 {
+		t.Errorf("Expected 4 tap receives, got %v", receives)
+	}
+}
+
+func TestReplicationRemote(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	bs, src, dst := testSetupReplicationBuckets(t, d)
+	defer bs.CloseAll()
+
+	ls, err := StartServer("127.0.0.1:0", 10, bs, "default")
+	if err != nil {
+		t.Fatalf("Expected server to start, got %v", err)
+	}
+	defer ls.Close()
+
+	SetItem(src, []byte("a"), []byte("aa"), VBActive)
+	rm := newReplicationManager(bs)
+	dstName := ls.Addr().String() + "/dst"
+	if err := rm.Start("src", dstName, "", false); err != nil {
+		t.Fatalf("Expected replication to start, got %v", err)
+	}
+	waitForReplica(t, dst, "a", "aa")
+	SetItem(src, []byte("b"), []byte("bb"), VBActive)
+	waitForReplica(t, dst, "b", "bb")
+
+	if err = rm.Stop("src", dstName); err != nil {
+		t.Errorf("Expected stop to work, got %v", err)
+	}
+	if err = rm.Stop("src", dstName); err == nil {
+		t.Errorf("Expected second stop to fail")
+	}
+
+	// A failing replication is restarted after a backoff.
+	replicationBackoffMin = time.Millisecond
+	defer func() { replicationBackoffMin = 100 * time.Millisecond }()
+	rm.Start("src", ls.Addr().String()+"/nope", "", false)
+	for j := 0; j < 500 && rm.Infos("")[0]["restarts"].(int64) < 2; j++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if infos := rm.Infos(""); len(infos) != 1 || infos[0]["err"] == nil ||
+		infos[0]["restarts"].(int64) < 2 {
+		t.Errorf("Expected auth failures and restarts, got %v", infos)
+	}
+	rm.StopBucket("src")
+	if len(rm.Infos("")) != 0 {
+		t.Errorf("Expected StopBucket to stop replications")
+	}
+}
+
+func TestReplicationErrors(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	bs, _, _ := testSetupReplicationBuckets(t, d)
+	defer bs.CloseAll()
+
+	rm := newReplicationManager(bs)
+	if rm.Start("nope", "dst", "", false) == nil {
+		t.Errorf("Expected missing src to fail")
+	}
+	if rm.Start("src", "src", "", false) == nil {
+		t.Errorf("Expected replication to itself to fail")
+	}
+	if rm.Start("src", "nope", "", false) == nil {
+		t.Errorf("Expected missing dst to fail")
+	}
+	if rm.Start("src", "dst", "", false) != nil || rm.Start("src", "dst", "", false) == nil {
+		t.Errorf("Expected duplicate replication to fail")
+	}
+
+	bs.New("end", bs.settings)
+	if rm.Start("dst", "end", "", false) != nil {
+		t.Errorf("Expected a chain to work")
+	}
+	if rm.Start("end", "src", "", true) == nil ||
+		rm.Start("dst", "src", "", true) == nil {
+		t.Errorf("Expected a cycle to fail")
+	}
+	if rm.Start("end", "127.0.0.1:1/src", "", false) != nil {
+		t.Errorf("Expected a remote destination to work")
+	}
+
+	act, _ := bs.New("act", bs.settings)
+	act.CreateVBucket(1)
+	act.SetVBState(1, VBActive)
+	if rm.Start("src", "act", "", false) == nil {
+		t.Errorf("Expected a destination with active vbuckets to fail")
+	}
+	if rm.Start("src", "act", "", true) != nil {
+		t.Errorf("Expected a forced destination with active vbuckets to work")
+	}
+	rm.StopBucket("src")
+	rm.StopBucket("end")
+	if _, err := rm.Promote("nope"); err == nil {
+		t.Errorf("Expected promote of missing bucket to fail")
+	}
+}
+
+func TestParseReplicationDst(t *testing.T) {
+	tests := []struct{ dst, host, bucketName string }{
+		{"b", "", "b"},
+		{"host:11210", "host:11210", "default"},
+		{"host:11210/", "host:11210", "default"},
+		{"host:11210/b", "host:11210", "b"},
+	}
+	for _, test := range tests {
+		host, bucketName := parseReplicationDst(test.dst)
+		if host != test.host || bucketName != test.bucketName {
+			t.Errorf("Expected %#v, got %v, %v", test, host, bucketName)
+		}
+	}
+}
+
+func TestReplicationChainLag(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	bs, src, dst := testSetupReplicationBuckets(t, d)
+	defer bs.CloseAll()
+	end, _ := bs.New("end", bs.settings)
+
+	rm := newReplicationManager(bs)
+	defer rm.StopBucket("dst")
+	rm.Start("src", "dst", "", false)
+	rm.Start("dst", "end", "", false)
+	for _, k := range []string{"a", "b", "c", "d"} {
+		SetItem(src, []byte(k), []byte(k+k), VBActive)
+	}
+	for _, k := range []string{"a", "b", "c", "d"} {
+		waitForReplica(t, dst, k, k+k)
+		waitForReplica(t, end, k, k+k)
+	}
+
+	for _, r := range rm.list("") {
+		for j := 0; j < 500 && r.lag() != 0; j++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if r.lag() != 0 {
+			t.Errorf("Expected no lag, src: %v, got %v", r.src, r.lag())
+		}
+	}
+	rm.Stop("dst", "end")
+	SetItem(src, []byte("e"), []byte("ee"), VBActive)
+	waitForReplica(t, dst, "e", "ee")
+	r := rm.list("dst")
+	if len(r) != 0 {
+		t.Errorf("Expected stopped replication, got %v", r)
+	}
+
+	rm.Start("dst", "end", "", false)
+	waitForReplica(t, end, "e", "ee")
+
+	ch := make(chan statItem, 100)
+	rm.sendStats(dst, ch)
+	close(ch)
+	stats := map[string]string{}
+	for si := range ch {
+		stats[si.key] = si.val
+	}
+	if stats["replication:end:state"] != REPLICATION_STREAMING ||
+		stats["replication:end:restarts"] != "0" ||
+		stats["replication:end:lag"] == "" || len(stats) != 3 {
+		t.Errorf("Expected replication stats, got %v", stats)
+	}
+}
+
+func TestReplicationLoad(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	bs, _, _ := testSetupReplicationBuckets(t, d)
+	defer bs.CloseAll()
+
+	rm := newReplicationManager(bs)
+	if err := rm.Load(); err != nil || len(rm.Infos("")) != 0 {
+		t.Errorf("Expected no replications to load, got %v", err)
+	}
+	rm.Start("src", "dst", "", false)
+	rm.Start("src", "127.0.0.1:1/remote", "secret", false)
+	if rm.Start("dst", "src", "", false) == nil {
+		t.Errorf("Expected a cycle to fail")
+	}
+
+	rm2 := newReplicationManager(bs)
+	if err := rm2.Load(); err != nil {
+		t.Errorf("Expected load to work, got %v", err)
+	}
+	dsts := rm2.Dsts("src")
+	if len(dsts) != 2 || dsts[0] != "127.0.0.1:1/remote" || dsts[1] != "dst" ||
+		len(rm2.Dsts("dst")) != 0 {
+		t.Errorf("Expected loaded replications, got %v", dsts)
+	}
+	if rm2.list("src")[0].password != "secret" {
+		t.Errorf("Expected loaded password")
+	}
+	rm.StopBucket("src")
+	rm2.StopBucket("src")
+}
@@ -49,9 +49,22 @@ func restAPI(r *mux.Router) {
 		withBucketAccess(restGetBucketErrs)).Methods("GET")
 	sr.HandleFunc("/buckets/{bucketname}/logs",
 		withBucketAccess(restGetBucketLogs)).Methods("GET")
+	sr.HandleFunc("/buckets/{bucketname}/journal",
+		withBucketAccess(restGetBucketJournal)).Methods("GET")
+	sr.HandleFunc("/buckets/{bucketname}/replicas",
+		withBucketAccess(restGetBucketReplicas)).Methods("GET")
 
 	sra := r.PathPrefix("/_api/").MatcherFunc(adminRequired).Subrouter()
 	sra.HandleFunc("/buckets", restPostBucket).Methods("POST")
+	sra.HandleFunc("/buckets/{bucketname}/replicas",
+		restPostBucketReplica).Methods("POST")
+	sra.HandleFunc("/buckets/{bucketname}/replicas",
+		restDeleteBucketReplica).Methods("DELETE")
+	sra.HandleFunc("/buckets/{bucketname}/promote",
+		restPostBucketPromote).Methods("POST")
+	sra.HandleFunc("/replications", restGetReplications).Methods("GET")
+	sra.HandleFunc("/replications", restPostReplication).Methods("POST")
+	sra.HandleFunc("/replications", restDeleteReplication).Methods("DELETE")
 	sra.HandleFunc("/bucketsRescan", restPostBucketsRescan).Methods("POST")
 	sra.HandleFunc("/bucketPath", restGetBucketPath).Methods("GET")
 	sra.HandleFunc("/profile/cpu", restProfileCPU).Methods("POST")
@@ -180,12 +193,70 @@ func restPostBucket(w http.ResponseWriter, r *http.Request) {
 	bSettings := bucketSettings.Copy()
 	bucketPassword := r.FormValue("password")
 	if bucketPassword != "" {
-		bSettings.PasswordHash = bucketPassword
+		hashFunc := r.FormValue("passwordHashFunc")
+		if hashFunc == "" {
+			hashFunc = *passwordHashFunc
+		}
+		if pwhashers[hashFunc] == nil {
+			http.Error(w,
+				fmt.Sprintf("unknown password hash func: %v", hashFunc), 400)
+			return
+		}
+		err = bSettings.SetPassword(hashFunc, bucketPassword, *passwordCramMD5)
+		if err != nil {
+			http.Error(w,
+				fmt.Sprintf("could not set bucket password, err: %v", err), 500)
+			return
+		}
+	}
+	bSettings.NumStores = int(getIntValue(r.Form, "numStores",
+		int64(bucketSettings.NumStores)))
+	if bSettings.NumStores < 0 || bSettings.NumStores > bSettings.NumPartitions {
+		http.Error(w,
+			fmt.Sprintf("illegal numStores: %v", bSettings.NumStores), 400)
+		return
 	}
 	bSettings.QuotaBytes = getIntValue(r.Form, "quotaBytes",
 		bucketSettings.QuotaBytes)
 	bSettings.MemoryOnly = int(getIntValue(r.Form, "memoryOnly",
 		int64(bucketSettings.MemoryOnly)))
+	if r.FormValue("flushEnabled") != "" {
+		bSettings.FlushEnabled = getIntValue(r.Form, "flushEnabled", 0) != 0
+	}
+	if r.FormValue("durability") != "" {
+		bSettings.Durability = r.FormValue("durability")
+	}
+	if !durabilities[bSettings.Durability] {
+		http.Error(w,
+			fmt.Sprintf("unknown durability: %v", bSettings.Durability), 400)
+		return
+	}
+	if r.FormValue("evictionPolicy") != "" {
+		bSettings.EvictionPolicy = r.FormValue("evictionPolicy")
+	}
+	if !evictionPolicies[bSettings.EvictionPolicy] {
+		http.Error(w,
+			fmt.Sprintf("unknown evictionPolicy: %v", bSettings.EvictionPolicy), 400)
+		return
+	}
+	if bSettings.EvictionPolicy == EVICTION_VALUE &&
+		bSettings.MemoryOnly != MemoryOnly_LEVEL_PERSIST_EVERYTHING {
+		http.Error(w,
+			"evictionPolicy value needs a bucket that persists items", 400)
+		return
+	}
+	if r.FormValue("journalEnabled") != "" {
+		bSettings.JournalEnabled = getIntValue(r.Form, "journalEnabled", 0) != 0
+	}
+	if r.FormValue("journalValues") != "" {
+		bSettings.JournalValues = getIntValue(r.Form, "journalValues", 0) != 0
+	}
+	bSettings.JournalFileBytes = getIntValue(r.Form, "journalFileBytes",
+		bucketSettings.JournalFileBytes)
+	bSettings.JournalMaxBytes = getIntValue(r.Form, "journalMaxBytes",
+		bucketSettings.JournalMaxBytes)
+	bSettings.JournalRetention = getIntValue(r.Form, "journalRetention",
+		bucketSettings.JournalRetention)
 
 	_, err = createBucket(bucketName, bSettings)
 	if err != nil {
@@ -232,6 +303,7 @@ func restDeleteBucket(w http.ResponseWriter, r *http.Request) {
 	if bucket == nil {
 		return
 	}
+	replications.StopBucket(bucketName)
 	err := buckets.Close(bucketName, true)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("error deleting bucket: %v, err: %v",
@@ -264,7 +336,7 @@ func restPostBucketFlushDirty(w http.ResponseWriter, r *http.Request) {
 }
 
 func restGetBucketStats(w http.ResponseWriter, r *http.Request) {
-	_, bucket := parseBucketName(w, mux.Vars(r))
+	bucketName, bucket := parseBucketName(w, mux.Vars(r))
 	if bucket == nil {
 		return
 	}
@@ -275,7 +347,9 @@ func restGetBucketStats(w http.ResponseWriter, r *http.Request) {
 		time.Sleep(statsSnapshotDelay)
 		st = bucket.SnapshotStats()
 	}
-	jsonEncode(w, st.ToMap())
+	m := st.ToMap()
+	m["replications"] = replications.Infos(bucketName)
+	jsonEncode(w, m)
 }
 
 func restGetBucketErrs(w http.ResponseWriter, r *http.Request) {
@@ -294,6 +368,133 @@ func restGetBucketLogs(w http.ResponseWriter, r *http.Request) {
 	jsonEncode(w, bucket.Logs())
 }
 
+// Tails the journal of a bucket, optionally filtered to a vbid, to
+// mutations after a cas, or to records after a time (RFC 3339)...
+//    curl http://127.0.0.1:8091/_api/buckets/default/journal?limit=10 \
+//      -d since=2013-06-01T12:00:00Z -G
+func restGetBucketJournal(w http.ResponseWriter, r *http.Request) {
+	_, bucket := parseBucketName(w, mux.Vars(r))
+	if bucket == nil {
+		return
+	}
+	lb, ok := bucket.(*livebucket)
+	if !ok || lb.journal == nil {
+		http.Error(w, "the bucket has no journal", 404)
+		return
+	}
+	var since time.Time
+	if s := r.FormValue("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, fmt.Sprintf("invalid since: %v, err: %v", s, err), 400)
+			return
+		}
+	}
+	records, err := lb.journal.tail(
+		int(getIntValue(r.Form, "vbid", -1)),
+		uint64(getIntValue(r.Form, "cas", 0)),
+		since,
+		int(getIntValue(r.Form, "limit", JOURNAL_TAIL_LIMIT)))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading journal: %v", err), 500)
+		return
+	}
+	jsonEncode(w, records)
+}
+
+func restGetBucketReplicas(w http.ResponseWriter, r *http.Request) {
+	bucketName, bucket := parseBucketName(w, mux.Vars(r))
+	if bucket == nil {
+		return
+	}
+	jsonEncode(w, replications.Infos(bucketName))
+}
+
+// To replicate a bucket into the replica vbuckets of another bucket...
+//    curl -X POST http://127.0.0.1:8091/_api/buckets/default/replicas \
+//      -d dst=default-replica
+// Or into a bucket of another cbgb...
+//      -d dst=HOST:11210/default -d password=PASSWORD
+// A local dst that has active vbuckets needs -d force=true, as they
+// become replicas.
+func restPostBucketReplica(w http.ResponseWriter, r *http.Request) {
+	bucketName, bucket := parseBucketName(w, mux.Vars(r))
+	if bucket == nil {
+		return
+	}
+	dst := r.FormValue("dst")
+	if dst == "" {
+		http.Error(w, "missing dst parameter", 400)
+		return
+	}
+	err := replications.Start(bucketName, dst, r.FormValue("password"),
+		r.FormValue("force") == "true")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error starting replication: %v", err), 400)
+		return
+	}
+	http.Redirect(w, r, "/_api/buckets/"+bucketName+"/replicas", 303)
+}
+
+func restDeleteBucketReplica(w http.ResponseWriter, r *http.Request) {
+	bucketName, bucket := parseBucketName(w, mux.Vars(r))
+	if bucket == nil {
+		return
+	}
+	if err := replications.Stop(bucketName, r.FormValue("dst")); err != nil {
+		http.Error(w, fmt.Sprintf("error stopping replication: %v", err), 404)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// Stops the replications into a bucket and makes its replica
+// vbuckets active.
+func restPostBucketPromote(w http.ResponseWriter, r *http.Request) {
+	bucketName, bucket := parseBucketName(w, mux.Vars(r))
+	if bucket == nil {
+		return
+	}
+	vbids, err := replications.Promote(bucketName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error promoting bucket: %v, err: %v",
+			bucketName, err), 500)
+		return
+	}
+	jsonEncode(w, map[string]interface{}{"promoted": vbids})
+}
+
+func restGetReplications(w http.ResponseWriter, r *http.Request) {
+	jsonEncode(w, replications.Infos(""))
+}
+
+// To declare a replication edge of the replication topology...
+//    curl -X POST http://127.0.0.1:8091/_api/replications \
+//      -d src=a -d dst=b
+func restPostReplication(w http.ResponseWriter, r *http.Request) {
+	src, dst := r.FormValue("src"), r.FormValue("dst")
+	if src == "" || dst == "" {
+		http.Error(w, "missing src or dst parameter", 400)
+		return
+	}
+	err := replications.Start(src, dst, r.FormValue("password"),
+		r.FormValue("force") == "true")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error starting replication: %v", err), 400)
+		return
+	}
+	http.Redirect(w, r, "/_api/replications", 303)
+}
+
+func restDeleteReplication(w http.ResponseWriter, r *http.Request) {
+	err := replications.Stop(r.FormValue("src"), r.FormValue("dst"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error stopping replication: %v", err), 404)
+		return
+	}
+	w.WriteHeader(204)
+}
+
 // To start a cpu profiling...
 //    curl -X POST http://127.0.0.1:8091/_api/profile/cpu -d secs=5
 // To analyze a profiling...
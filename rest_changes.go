@@ -0,0 +1,396 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Wakes up the _changes feeds waiting for a bucket's mutations, where
+// the sequence is the bucket name.  The published numbers come from
+// the changesClock, which every mutation ticks after it's stored, as a
+// vbucket's cas can be behind the cas of other vbuckets.
+var changesPubSub = newSequencePubSub()
+
+var changesClock uint64
+
+// The number of _changes feeds that may wait, per bucket name, so
+// that mutations only publish to the changesPubSub when a feed of
+// their bucket is waiting.  The total is checked first, so that the
+// write path only reads an atomic when no feed is open.
+var changesWaiters = struct {
+	sync.RWMutex
+	total   int32 // Atomic.
+	buckets map[string]int
+}{buckets: map[string]int{}}
+
+func addChangesWaiter(bucketName string, delta int) {
+	changesWaiters.Lock()
+	changesWaiters.buckets[bucketName] += delta
+	if changesWaiters.buckets[bucketName] <= 0 {
+		delete(changesWaiters.buckets, bucketName)
+	}
+	atomic.AddInt32(&changesWaiters.total, int32(delta))
+	changesWaiters.Unlock()
+}
+
+func hasChangesWaiters(bucketName string) bool {
+	if atomic.LoadInt32(&changesWaiters.total) <= 0 {
+		return false
+	}
+	changesWaiters.RLock()
+	n := changesWaiters.buckets[bucketName]
+	changesWaiters.RUnlock()
+	return n > 0
+}
+
+// Ticks the changesClock, and only wakes up the bucket's feeds when
+// there are some.  A feed registers as a waiter before it reads the
+// clock, so a tick after that read always sees the waiter.
+func publishChange(bucketName string) {
+	clock := atomic.AddUint64(&changesClock, 1)
+	if hasChangesWaiters(bucketName) {
+		changesPubSub.Pub(sequenceId(bucketName), int64(clock))
+	}
+}
+
+const changesDefaultTimeout = 60 * time.Second
+
+type couchChange struct {
+	Seq     string              `json:"seq"`
+	Id      string              `json:"id"`
+	Changes []map[string]string `json:"changes"`
+	Deleted bool                `json:"deleted,omitempty"`
+	Doc     *ViewDocValue       `json:"doc,omitempty"`
+
+	vbid uint16
+	cas  uint64
+}
+
+type couchChanges []*couchChange
+
+func (a couchChanges) Len() int      { return len(a) }
+func (a couchChanges) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a couchChanges) Less(i, j int) bool {
+	if a[i].cas != a[j].cas {
+		return a[i].cas < a[j].cas
+	}
+	return a[i].vbid < a[j].vbid
+}
+
+// Returns the changes of a bucket's active vbuckets after their
+// positions, which are the last cas per vbucket that a feed has seen,
+// by merging their changes streams in cas order.  A limit of 0 means
+// no limit.
+func getCouchChanges(bucket Bucket, positions []uint64, limit int,
+	includeDocs bool) (couchChanges, error) {
+	rv := couchChanges{}
+	for vbid, pos := range positions {
+		vb, _ := bucket.GetVBucket(uint16(vbid))
+		if vb == nil || vb.GetVBState() != VBActive {
+			continue
+		}
+		n := 0
+		// The rev comes from the value, so it's always visited.
+		err := vb.ps.visitChanges(casBytes(pos+1), true,
+			func(i *item) bool {
+				if len(i.key) == 0 {
+					return true // Skip VBMeta changes.
+				}
+				rv = append(rv, newCouchChange(vb.vbid, i, includeDocs))
+				n++
+				return limit <= 0 || n < limit
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Sort(rv)
+	if limit > 0 && len(rv) > limit {
+		rv = rv[:limit]
+	}
+	return rv, nil
+}
+
+func newCouchChange(vbid uint16, i *item, includeDoc bool) *couchChange {
+	docId := string(i.key)
+	c := &couchChange{
+		Id:      docId,
+		Changes: []map[string]string{{"rev": couchRev(i)}},
+		Deleted: i.isDeletion(),
+		vbid:    vbid,
+		cas:     i.cas,
+	}
+	if includeDoc && !c.Deleted {
+		docType := "json"
+		var doc interface{}
+		if err := json.Unmarshal(i.data, &doc); err != nil {
+			doc = base64.StdEncoding.EncodeToString(i.data)
+			docType = "base64"
+		}
+		c.Doc = &ViewDocValue{
+			Meta: map[string]interface{}{
+				"id":   docId,
+				"rev":  couchRev(i),
+				"type": docType,
+			},
+			Json: doc,
+		}
+	}
+	return c
+}
+
+// Advances the positions past the changes, giving every change the
+// seq of the positions after it.
+func advanceCouchChanges(positions []uint64, changes couchChanges) {
+	for _, c := range changes {
+		positions[c.vbid] = c.cas
+		c.Seq = formatChangesSeq(positions)
+	}
+}
+
+// A seq is the positions of a feed, as the "vbid:cas" of every
+// vbucket that has a position, so that a since continues each vbucket
+// where it was.
+func formatChangesSeq(positions []uint64) string {
+	parts := []string{}
+	for vbid, pos := range positions {
+		if pos > 0 {
+			parts = append(parts, fmt.Sprintf("%v:%v", vbid, pos))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Parses a seq into the positions, where a plain number, like the seqs
+// of CouchDB, is the position of every vbucket.
+func parseChangesSeq(s string, positions []uint64) error {
+	if s == "" {
+		return nil
+	}
+	if !strings.Contains(s, ":") {
+		pos, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		for vbid := range positions {
+			positions[vbid] = pos
+		}
+		return nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(part, ":", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid seq part: %v", part)
+		}
+		vbid, err := strconv.ParseUint(kv[0], 10, 16)
+		if err != nil {
+			return err
+		}
+		if int(vbid) >= len(positions) {
+			return fmt.Errorf("invalid seq vbid: %v", vbid)
+		}
+		if positions[vbid], err = strconv.ParseUint(kv[1], 10, 64); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type changesParams struct {
+	since       string
+	limit       int
+	includeDocs bool
+	feed        string
+	heartbeat   time.Duration
+	timeout     time.Duration
+}
+
+func parseChangesParams(r *http.Request) (*changesParams, error) {
+	p := &changesParams{feed: "normal", timeout: changesDefaultTimeout}
+	var err error
+	p.since = r.FormValue("since")
+	if s := r.FormValue("limit"); s != "" {
+		if p.limit, err = strconv.Atoi(s); err != nil || p.limit < 0 {
+			return nil, fmt.Errorf("invalid limit: %v", s)
+		}
+	}
+	if s := r.FormValue("include_docs"); s != "" {
+		if p.includeDocs, err = strconv.ParseBool(s); err != nil {
+			return nil, fmt.Errorf("invalid include_docs: %v", s)
+		}
+	}
+	if s := r.FormValue("feed"); s != "" {
+		switch s {
+		case "normal", "longpoll", "continuous", "eventsource":
+			p.feed = s
+		default:
+			return nil, fmt.Errorf("invalid feed: %v", s)
+		}
+	}
+	for _, d := range []struct {
+		name string
+		dur  *time.Duration
+	}{{"heartbeat", &p.heartbeat}, {"timeout", &p.timeout}} {
+		if s := r.FormValue(d.name); s != "" {
+			ms, err := strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %v: %v", d.name, s)
+			}
+			*d.dur = time.Duration(ms) * time.Millisecond
+		}
+	}
+	return p, nil
+}
+
+// Follows the mutations of a bucket, where the seq of a change is the
+// positions of the feed's vbuckets after it, as a vbucket's cas can be
+// behind the cas of other vbuckets.  The longpoll, continuous and
+// eventsource feeds wait for more changes, until their timeout, which
+// a heartbeat overrides.
+func couchDbChanges(w http.ResponseWriter, r *http.Request) {
+	_, bucketName, bucket := checkDb(w, r)
+	if bucket == nil {
+		return
+	}
+	p, err := parseChangesParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	positions := make([]uint64, bucket.GetBucketSettings().NumPartitions)
+	if err = parseChangesSeq(p.since, positions); err != nil {
+		http.Error(w, fmt.Sprintf("invalid since: %v, %v", p.since, err), 400)
+		return
+	}
+	if p.feed != "normal" {
+		addChangesWaiter(bucketName, 1)
+		defer addChangesWaiter(bucketName, -1)
+	}
+	clock := atomic.LoadUint64(&changesClock)
+	changes, err := getCouchChanges(bucket, positions, p.limit, p.includeDocs)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("changes error: %v", err), 500)
+		return
+	}
+
+	var timeout <-chan time.Time
+	var wakeup <-chan int64
+	// Waits for a mutation after the clock, or a timeout, and then
+	// returns the changes after the positions.
+	waitForChanges := func(limit int) bool {
+		if wakeup == nil {
+			wakeup = changesPubSub.Sub(sequenceId(bucketName), int64(clock+1))
+		}
+		select {
+		case <-timeout:
+			return false
+		case n, ok := <-wakeup:
+			wakeup = nil
+			if !ok {
+				return false // The bucket was closed.
+			}
+			clock = uint64(n)
+		}
+		changes, err = getCouchChanges(bucket, positions, limit, p.includeDocs)
+		return err == nil
+	}
+
+	if p.feed == "normal" || p.feed == "longpoll" {
+		if p.feed == "longpoll" {
+			timeout = time.After(p.timeout)
+			for len(changes) == 0 {
+				if !waitForChanges(p.limit) {
+					break
+				}
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("changes error: %v", err), 500)
+				return
+			}
+		}
+		advanceCouchChanges(positions, changes)
+		jsonEncode(w, map[string]interface{}{
+			"results":  changes,
+			"last_seq": formatChangesSeq(positions),
+		})
+		return
+	}
+
+	if p.feed == "eventsource" {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	flusher, _ := w.(http.Flusher)
+	wait := p.timeout
+	if p.heartbeat > 0 {
+		wait = p.heartbeat
+	}
+	sent := 0
+	for {
+		advanceCouchChanges(positions, changes)
+		for _, c := range changes {
+			j, err := json.Marshal(c)
+			if err != nil {
+				return
+			}
+			if p.feed == "eventsource" {
+				_, err = fmt.Fprintf(w, "id: %v\ndata: %s\n\n", c.Seq, j)
+			} else {
+				_, err = fmt.Fprintf(w, "%s\n", j)
+			}
+			if err != nil {
+				return
+			}
+			sent++
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if p.limit > 0 && sent >= p.limit {
+			break
+		}
+
+		limit := 0
+		if p.limit > 0 {
+			limit = p.limit - sent
+		}
+		// A heartbeat keeps waiting with the same subscription.
+		timeout = time.After(wait)
+		if !waitForChanges(limit) {
+			if err != nil || wakeup == nil {
+				return
+			}
+			if p.heartbeat <= 0 {
+				break
+			}
+			changes = nil
+			if _, err = w.Write([]byte("\n")); err != nil {
+				return
+			}
+		}
+	}
+	if p.feed == "continuous" {
+		fmt.Fprintf(w, "{\"last_seq\":%q}\n", formatChangesSeq(positions))
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestCouchDbChanges(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 2, uint16(0))
+	defer os.RemoveAll(d)
+	defer buckets.CloseAll()
+	bucket.CreateVBucket(1)
+	bucket.SetVBState(1, VBActive)
+	mr := testSetupMux(d)
+
+	get := func(params string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET",
+			"http://127.0.0.1/default/_changes?"+params, nil)
+		mr.ServeHTTP(rr, r)
+		return rr
+	}
+	changes := func(params string) (results []*couchChange, lastSeq string) {
+		rr := get(params)
+		if rr.Code != 200 {
+			t.Fatalf("expected _changes to 200, got: %#v, %v",
+				rr, rr.Body.String())
+		}
+		res := struct {
+			Results []*couchChange `json:"results"`
+			LastSeq string         `json:"last_seq"`
+		}{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+			t.Fatalf("expected changes json, got: %v, %v",
+				rr.Body.String(), err)
+		}
+		return res.Results, res.LastSeq
+	}
+
+	// The key b hashes to vbucket 0, and the keys a and c to vbucket 1.
+	SetItem(bucket, []byte("a"), []byte(`{"x":1}`), VBActive)
+	SetItem(bucket, []byte("b"), []byte("bb"), VBActive)
+	SetItem(bucket, []byte("c"), []byte("cc"), VBActive)
+	vb, _ := GetVBucketForKey(bucket, []byte("c"))
+	tapTestMutate(vb, gomemcached.DELETE, "c", "")
+
+	results, lastSeq := changes("")
+	ids := []string{}
+	for _, c := range results {
+		ids = append(ids, c.Id)
+	}
+	// Equal cas's are ordered by vbucket.
+	if strings.Join(ids, ",") != "b,a,c" || lastSeq != results[2].Seq ||
+		results[0].cas != results[1].cas || results[1].cas > results[2].cas {
+		t.Errorf("expected changes in cas order, got: %v, %v", ids, lastSeq)
+	}
+	if !strings.HasPrefix(results[0].Seq, "0:") ||
+		strings.Contains(results[0].Seq, ",") ||
+		!strings.HasPrefix(results[1].Seq, results[0].Seq+",1:") {
+		t.Errorf("expected seqs of the vbucket positions, got: %v, %v",
+			results[0].Seq, results[1].Seq)
+	}
+	if !results[2].Deleted || results[0].Deleted ||
+		!strings.HasPrefix(results[0].Changes[0]["rev"], "1-") ||
+		results[0].Doc != nil {
+		t.Errorf("expected change details, got: %#v, %#v",
+			results[0], results[2])
+	}
+
+	// A seq continues every vbucket where it was, even when a vbucket's
+	// cas is behind.
+	results, _ = changes("since=" + url.QueryEscape(results[0].Seq))
+	if len(results) != 2 || results[0].Id != "a" || results[1].Id != "c" {
+		t.Errorf("expected the changes after b, got: %#v", results)
+	}
+	results, _ = changes("since=2&include_docs=true")
+	if len(results) != 1 || results[0].Id != "c" || results[0].Doc != nil {
+		t.Errorf("expected a deletion since 2, got: %#v", results)
+	}
+	results, _ = changes("include_docs=true&limit=2")
+	if len(results) != 2 || results[0].Doc.Meta["type"] != "base64" ||
+		results[1].Doc.Meta["id"] != "a" ||
+		results[1].Doc.Json.(map[string]interface{})["x"] != 1.0 {
+		t.Errorf("expected docs, got: %#v", results)
+	}
+
+	since := url.QueryEscape(lastSeq)
+	results, lastSeqPoll := changes("feed=longpoll&timeout=1&since=" + since)
+	if len(results) != 0 || lastSeqPoll != lastSeq {
+		t.Errorf("expected a longpoll timeout, got: %v, %v",
+			results, lastSeqPoll)
+	}
+	donech := make(chan bool)
+	go func() {
+		results, _ := changes("feed=longpoll&since=" + since)
+		if len(results) != 1 || results[0].Id != "d" {
+			t.Errorf("expected a longpoll change, got: %v", results)
+		}
+		close(donech)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	SetItem(bucket, []byte("d"), []byte("dd"), VBActive)
+	<-donech
+
+	rr := get("feed=continuous&timeout=10")
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if len(lines) != 5 || !strings.HasPrefix(lines[4], `{"last_seq":`) {
+		t.Errorf("expected continuous changes, got: %v", rr.Body.String())
+	}
+
+	// The cas of e is behind the cas of d, as e is in another vbucket.
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		SetItem(bucket, []byte("e"), []byte("ee"), VBActive)
+	}()
+	rr = get("feed=eventsource&heartbeat=5&limit=5")
+	body := rr.Body.String()
+	if rr.Header().Get("Content-Type") != "text/event-stream" ||
+		strings.Count(body, "data: ") != 5 ||
+		!strings.Contains(body, `"id":"e"`) ||
+		!strings.Contains(body, "\n\n\n") {
+		t.Errorf("expected eventsource changes and heartbeats, got: %v", body)
+	}
+
+	// The rev has the flags from the value, even without the docs.
+	vb, _ = GetVBucketForKey(bucket, []byte("f"))
+	vbMutate(vb, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SET,
+		Key:    []byte("f"),
+		Extras: []byte{0, 0, 0, 7, 0, 0, 0, 0},
+		Body:   []byte("ff"),
+	})
+	bucket.Flush()
+	results, _ = changes("")
+	if len(results) == 0 || results[len(results)-1].Id != "f" ||
+		!strings.HasSuffix(results[len(results)-1].Changes[0]["rev"], "00000007") {
+		t.Errorf("expected a rev with flags, got: %#v", results)
+	}
+
+	for _, params := range []string{"since=x", "since=2:1", "since=0:x",
+		"feed=nope", "limit=-1"} {
+		if rr = get(params); rr.Code != 400 {
+			t.Errorf("expected 400 for %v, got: %v", params, rr.Code)
+		}
+	}
+}
+
+func TestPublishChangeWaiters(t *testing.T) {
+	defer changesPubSub.Delete(sequenceId("waiters"))
+	if hasChangesWaiters("waiters") {
+		t.Errorf("expected no waiters")
+	}
+	clock := atomic.LoadUint64(&changesClock)
+	wakeup := changesPubSub.Sub(sequenceId("waiters"), int64(clock+1))
+	publishChange("waiters")
+	if atomic.LoadUint64(&changesClock) <= clock {
+		t.Errorf("expected a mutation to tick the clock without waiters")
+	}
+	select {
+	case n := <-wakeup:
+		t.Errorf("expected no publish without waiters, got: %v", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	addChangesWaiter("waiters", 1)
+	if !hasChangesWaiters("waiters") || hasChangesWaiters("other") {
+		t.Errorf("expected only the waiters bucket to have waiters")
+	}
+	publishChange("waiters")
+	select {
+	case n := <-wakeup:
+		if uint64(n) != atomic.LoadUint64(&changesClock) {
+			t.Errorf("expected the clock to be published, got: %v", n)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected a publish with a waiter")
+	}
+	addChangesWaiter("waiters", -1)
+	if hasChangesWaiters("waiters") {
+		t.Errorf("expected no waiters after the feed is done")
+	}
+}
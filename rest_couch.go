@@ -62,6 +62,9 @@ func restCouchAPI(r *mux.Router) *mux.Router {
 		http.HandlerFunc(deadlinedHandler(time.Second, couchDbAllDocs))).
 		Methods("GET")
 
+	dbr.Handle("/_changes",
+		http.HandlerFunc(couchDbChanges)).Methods("GET")
+
 	dbr.Handle("/_design/{docId}/_view/{viewId}",
 		http.HandlerFunc(deadlinedHandler(time.Second, couchDbGetView))).
 		Methods("GET")
@@ -211,8 +214,49 @@ func couchDbGetDb(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// TODO this implementation does no conflict resolution
-// only suitable for one way replications
+// XDCR revs are "SEQ-HEX", where SEQ is the item's rev and the
+// optional HEX has the cas, expiration and flags of the revision.
+func couchRev(i *item) string {
+	if i.isDeletion() {
+		// A deletion's flags and exp mark it as a deletion.
+		return fmt.Sprintf("%d-%016x%08x%08x", i.rev, i.cas, 0, 0)
+	}
+	return fmt.Sprintf("%d-%016x%08x%08x", i.rev, i.cas, i.exp, i.flag)
+}
+
+func parseCouchRev(rev string) (seq, cas uint64, err error) {
+	x := strings.SplitN(rev, "-", 2)
+	if seq, err = strconv.ParseUint(x[0], 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid rev: %v", rev)
+	}
+	if len(x) > 1 && len(x[1]) >= 16 {
+		if cas, err = strconv.ParseUint(x[1][:16], 16, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid rev: %v", rev)
+		}
+	}
+	return seq, cas, nil
+}
+
+// Returns whether we're missing a doc's rev, which is when the rev
+// would win conflict resolution against what we have.
+func couchRevMissing(bucket Bucket, docId, rev string) bool {
+	seq, cas, err := parseCouchRev(rev)
+	if err != nil {
+		return true // So that _bulk_docs reports the error.
+	}
+	vb, _ := GetVBucket(bucket, []byte(docId), VBActive)
+	if vb == nil {
+		return true
+	}
+	i, _, err := vb.getMeta([]byte(docId))
+	if err != nil || i == nil {
+		return true
+	}
+	return (&item{rev: seq, cas: cas}).winsConflict(i)
+}
+
+// The _revs_diff request maps doc ids to a rev or a list of revs, and
+// the response has the docs with the revs that we're missing.
 func couchDbRevsDiff(w http.ResponseWriter, r *http.Request) {
 	_, _, bucket := checkDb(w, r)
 	if bucket == nil {
@@ -228,7 +272,24 @@ func couchDbRevsDiff(w http.ResponseWriter, r *http.Request) {
 
 	revsDiffResponse := map[string]interface{}{}
 	for key, val := range revsDiffRequest {
-		revsDiffResponse[key] = map[string]interface{}{"missing": val}
+		switch revs := val.(type) {
+		case string:
+			if couchRevMissing(bucket, key, revs) {
+				revsDiffResponse[key] = map[string]interface{}{"missing": revs}
+			}
+		case []interface{}:
+			missing := []interface{}{}
+			for _, rev := range revs {
+				if s, ok := rev.(string); !ok || couchRevMissing(bucket, key, s) {
+					missing = append(missing, rev)
+				}
+			}
+			if len(missing) > 0 {
+				revsDiffResponse[key] = map[string]interface{}{"missing": missing}
+			}
+		default:
+			revsDiffResponse[key] = map[string]interface{}{"missing": val}
+		}
 	}
 	jsonEncode(w, revsDiffResponse)
 }
@@ -251,10 +312,10 @@ type BulkDocsRequest struct {
 	Docs []BulkDocsItem `json:"docs"`
 }
 
-// TODO this implementation uses the wrong memcached commands
-// it should use commands that can overwrite the metadata
-// for now this is done with the wrong commands just to get
-// data transfer up and running
+// Applies docs with their revs, flags, expirations and deletions, as
+// an XDCR destination, where a doc only replaces an existing doc if it
+// wins conflict resolution.  Each doc gets its own result, which is
+// either the rev that we now have or an error.
 func couchDbBulkDocs(w http.ResponseWriter, r *http.Request) {
 	_, _, bucket := checkDb(w, r)
 	if bucket == nil {
@@ -272,49 +333,71 @@ func couchDbBulkDocs(w http.ResponseWriter, r *http.Request) {
 
 	bulkDocsResponse := make([]map[string]interface{}, 0, len(bulkDocsRequest.Docs))
 	for _, doc := range bulkDocsRequest.Docs {
-		key := []byte(doc.Meta.Id)
-		vbucketId := VBucketIdForKey(key, bucket.GetBucketSettings().NumPartitions)
-		vbucket, _ := bucket.GetVBucket(vbucketId)
-		if vbucket == nil {
-			http.Error(w, fmt.Sprintf("Invalid vbucket for this key: %v - %v",
-				key, err), 500)
-			return
-		}
+		bulkDocsResponse = append(bulkDocsResponse, couchBulkDoc(bucket, &doc))
+	}
+	w.WriteHeader(201)
+	jsonEncode(w, bulkDocsResponse)
+}
 
-		val, err := base64.StdEncoding.DecodeString(doc.Base64)
+func couchBulkDocError(doc *BulkDocsItem, kind, reason string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":     doc.Meta.Id,
+		"error":  kind,
+		"reason": reason,
+	}
+}
+
+func couchBulkDoc(bucket Bucket, doc *BulkDocsItem) map[string]interface{} {
+	key := []byte(doc.Meta.Id)
+	seq, cas, err := parseCouchRev(doc.Meta.Rev)
+	if err != nil {
+		return couchBulkDocError(doc, "bad_request", err.Error())
+	}
+	vbucket, _ := GetVBucket(bucket, key, VBActive)
+	if vbucket == nil {
+		return couchBulkDocError(doc, "not_found",
+			fmt.Sprintf("no active vbucket for key: %s", key))
+	}
+
+	itemNew := &item{
+		key:  key,
+		flag: uint32(doc.Meta.Flags),
+		exp:  uint32(doc.Meta.Expiration),
+		rev:  seq,
+		cas:  cas,
+	}
+	opcode := SET_WITH_META
+	if doc.Meta.Deleted {
+		opcode = DEL_WITH_META
+	} else {
+		itemNew.data, err = base64.StdEncoding.DecodeString(doc.Base64)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error decoding base64 data "+
-				"_bulk_docs body as JSON for key: %v - %v",
-				key, err), 500)
-			return
+			return couchBulkDocError(doc, "bad_request",
+				fmt.Sprintf("Error decoding base64 data: %v", err))
 		}
-
-		response := vbucket.Dispatch(nil, &gomemcached.MCRequest{
-			Opcode:  gomemcached.SET,
-			VBucket: vbucketId,
-			Key:     key,
-			Body:    val,
-		})
-
-		// TODO proper error handling
-		// for now we just bail if anything ever goes wrong
-		if response.Status != gomemcached.SUCCESS {
-			log.Printf("Got error writing data: %v - %v",
-				string(key), string(response.Body))
-			http.Error(w, "Internal Error", 500)
-			return
-		} else {
-			// TODO return actual revision created here we
-			// just lie and pretend to have created the
-			// requested revsion (we did not)
-			bulkDocsResponse = append(bulkDocsResponse,
-				map[string]interface{}{
-					"id":  doc.Meta.Id,
-					"rev": doc.Meta.Rev})
+		if len(itemNew.data) > MAX_ITEM_DATA_LENGTH {
+			return couchBulkDocError(doc, "too_large",
+				fmt.Sprintf("data too big: %v", len(itemNew.data)))
 		}
+		itemNew.datatype = detectDatatype(itemNew.data)
 	}
-	w.WriteHeader(201)
-	jsonEncode(w, bulkDocsResponse)
+
+	res := vbApplyWithMeta(vbucket, &gomemcached.MCRequest{
+		Opcode:  opcode,
+		VBucket: vbucket.vbid,
+		Key:     key,
+	}, itemNew, doc.Meta.Deleted, false, false)
+	if res != nil && res.Status == gomemcached.KEY_EEXISTS {
+		return couchBulkDocError(doc, "conflict", string(res.Body))
+	}
+	// A deletion of a doc that we never had needs no work.
+	if res != nil && res.Status != gomemcached.SUCCESS &&
+		!(doc.Meta.Deleted && res.Status == gomemcached.KEY_ENOENT) {
+		log.Printf("Got error writing data: %v - %v",
+			string(key), string(res.Body))
+		return couchBulkDocError(doc, "internal_error", string(res.Body))
+	}
+	return map[string]interface{}{"id": doc.Meta.Id, "rev": couchRev(itemNew)}
 }
 
 func couchDbEnsureFullCommit(w http.ResponseWriter, r *http.Request) {
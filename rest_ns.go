@@ -159,7 +159,6 @@ func getNSBucket(host, bucketName, uuid string) (*couchbase.Bucket, error) {
 		StreamingURI: "/poolsStreaming/default/buckets/" + bucketName,
 		UUID:         bucketUUID,
 		Controllers: map[string]interface{}{
-			"flush":      "/pools/default/buckets/" + bucketName + "/controller/doFlush",
 			"compactAll": "/pools/default/buckets/" + bucketName + "/controller/compactBucket",
 		},
 		BasicStats: map[string]interface{}{
@@ -171,6 +170,10 @@ func getNSBucket(host, bucketName, uuid string) (*couchbase.Bucket, error) {
 		},
 		LocalRandomKeyURI: "/pools/default/buckets/" + bucketName + "/localRandomKey",
 	}
+	if bs.FlushEnabled {
+		rv.Controllers["flush"] =
+			"/pools/default/buckets/" + bucketName + "/controller/doFlush"
+	}
 	rv.DDocs.URI = "/pools/default/buckets/" + bucketName + "/ddocs" + bucketUUIDSuffix
 	// TODO: Perhaps dynamically generate a SASL password here, such
 	// based on server start time.
@@ -178,13 +181,31 @@ func getNSBucket(host, bucketName, uuid string) (*couchbase.Bucket, error) {
 		rv.Password = bs.PasswordHash // The json saslPassword field.
 	}
 	rv.VBucketServerMap.HashAlgorithm = "CRC"
-	rv.VBucketServerMap.NumReplicas = 1
 	rv.VBucketServerMap.ServerList = []string{getBindAddress(host)}
 
+	// The replicas of a replication into another bucket of this
+	// process aren't in the map, as a client can't reach that bucket
+	// through this node's server entry, which is the active bucket.
+	replicas := []int{}
+	for _, dst := range replications.Dsts(bucketName) {
+		dstHost, _ := parseReplicationDst(dst)
+		if dstHost == "" {
+			continue
+		}
+		rv.VBucketServerMap.ServerList =
+			append(rv.VBucketServerMap.ServerList, dstHost)
+		replicas = append(replicas, len(rv.VBucketServerMap.ServerList)-1)
+	}
+	if len(replicas) == 0 {
+		replicas = append(replicas, -1)
+	}
+	rv.Replicas = len(replicas)
+	rv.VBucketServerMap.NumReplicas = len(replicas)
+
 	np := bs.NumPartitions
 	rv.VBucketServerMap.VBucketMap = make([][]int, np)
 	for i := 0; i < np; i++ {
-		rv.VBucketServerMap.VBucketMap[i] = []int{0, -1}
+		rv.VBucketServerMap.VBucketMap[i] = append([]int{0}, replicas...)
 	}
 	return rv, nil
 }
@@ -267,6 +288,22 @@ func restNSStreaming(orig func(http.ResponseWriter,
 	}
 }
 
+func restNSBucketFlush(w http.ResponseWriter, r *http.Request) {
+	bucketName, bucket := parseBucketName(w, mux.Vars(r))
+	if bucket == nil {
+		return
+	}
+	err := bucket.FlushAll()
+	if err == bucketFlushDisabled {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error flushing bucket: %v, err: %v",
+			bucketName, err), 500)
+	}
+}
+
 func restNSSettingsStats(w http.ResponseWriter, r *http.Request) {
 	jsonEncode(w, map[string]interface{}{"sendStats": false})
 }
@@ -307,6 +344,8 @@ func restNSAPI(r *mux.Router) {
 		withBucketAccess(restNSBucketDDocs))
 	r.HandleFunc("/pools/default/buckets/{bucketname}/localRandomKey",
 		withBucketAccess(restNSLocalRandomKey))
+	r.HandleFunc("/pools/default/buckets/{bucketname}/controller/doFlush",
+		withBucketAccess(restNSBucketFlush)).Methods("POST")
 	r.HandleFunc("/poolsStreaming/default",
 		restNSStreaming(restNSPoolsDefault))
 	r.HandleFunc("/poolsStreaming/default/buckets/{bucketname}",
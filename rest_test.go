@@ -11,6 +11,7 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/dustin/go-jsonpointer"
 	"github.com/dustin/gomemcached"
@@ -48,6 +49,7 @@ func testSetupBuckets(t *testing.T, numPartitions int) (string, *Buckets) {
 	if buckets == nil {
 		t.Fatalf("testSetupBuckets had nil buckets")
 	}
+	replications = newReplicationManager(buckets)
 	return d, buckets
 }
 
@@ -275,6 +277,87 @@ func TestCouchDbRevsDiff(t *testing.T) {
 	}
 }
 
+func TestCouchDbBulkDocs(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "http://127.0.0.1/default%2f0/"+path,
+			strings.NewReader(body))
+		r.RequestURI = "/default%2f0/" + path
+		mr.ServeHTTP(rr, r)
+		return rr
+	}
+
+	rr := post("_bulk_docs", `{"docs":[
+{"meta":{"id":"a","rev":"2-000000000000000a0000000000000007","flags":7},
+ "base64":"eyJ4IjoxfQ=="},
+{"meta":{"id":"b","rev":"1-000000000000000b0000000000000000"},
+ "base64":"!!!"},
+{"meta":{"id":"c","rev":"nope"},"base64":""},
+{"meta":{"id":"d","rev":"1-000000000000000c0000000000000000","deleted":true}}]}`)
+	if rr.Code != 201 {
+		t.Fatalf("expected _bulk_docs to 201, got: %#v, %v",
+			rr, rr.Body.String())
+	}
+	results := []map[string]interface{}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil ||
+		len(results) != 4 {
+		t.Fatalf("expected per-doc results, got: %v, %v",
+			rr.Body.String(), err)
+	}
+	if results[0]["rev"] != "2-000000000000000a0000000000000007" ||
+		results[1]["error"] != "bad_request" ||
+		results[2]["error"] != "bad_request" ||
+		results[3]["rev"] != "1-000000000000000c0000000000000000" {
+		t.Errorf("expected per-doc results, got: %v", results)
+	}
+
+	vb, _ := bucket.GetVBucket(0)
+	i, _, _ := vb.getMeta([]byte("a"))
+	if i == nil || i.rev != 2 || i.cas != 10 || i.flag != 7 ||
+		string(i.data) != `{"x":1}` || i.datatype != DATATYPE_JSON {
+		t.Errorf("expected doc a with its meta, got: %#v", i)
+	}
+	if res := GetItem(bucket, []byte("b"), VBActive); res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected no doc b, got: %v", res)
+	}
+
+	// A lower rev loses, while a higher rev wins.
+	rr = post("_bulk_docs", `{"docs":[
+{"meta":{"id":"a","rev":"1-00000000000000ff0000000000000000"},
+ "base64":"eA=="}]}`)
+	if !strings.Contains(rr.Body.String(), `"error":"conflict"`) {
+		t.Errorf("expected conflict, got: %v", rr.Body.String())
+	}
+	rr = post("_revs_diff",
+		`{"a":["1-00000000000000ff0000000000000000",`+
+			`"2-000000000000000a0000000000000007",`+
+			`"3-000000000000000d0000000000000000"],`+
+			`"b":"1-000000000000000b0000000000000000"}`)
+	diff := map[string]map[string]interface{}{}
+	json.Unmarshal(rr.Body.Bytes(), &diff)
+	if fmt.Sprintf("%v", diff["a"]["missing"]) !=
+		"[3-000000000000000d0000000000000000]" ||
+		diff["b"]["missing"] != "1-000000000000000b0000000000000000" {
+		t.Errorf("expected missing revs, got: %v", rr.Body.String())
+	}
+	rr = post("_bulk_docs", `{"docs":[
+{"meta":{"id":"a","rev":"3-000000000000000d0000000000000000","deleted":true}}]}`)
+	if !strings.Contains(rr.Body.String(), `"rev":"3-000000000000000d0000000000000000"`) {
+		t.Errorf("expected deletion, got: %v", rr.Body.String())
+	}
+	if res := GetItem(bucket, []byte("a"), VBActive); res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected deleted doc a, got: %v", res)
+	}
+	rr = post("_revs_diff", `{"a":"3-000000000000000d0000000000000000"}`)
+	if strings.TrimSpace(rr.Body.String()) != "{}" {
+		t.Errorf("expected no missing revs, got: %v", rr.Body.String())
+	}
+}
+
 func TestCouchPutDDoc(t *testing.T) {
 	testCouchPutDDoc(t, 1)
 	testCouchPutDDoc(t, MAX_VBUCKETS)
@@ -853,6 +936,49 @@ func TestRestPostBucket(t *testing.T) {
 		t.Errorf("expected bucket creating to work, got: %#v, %v",
 			rr, rr.Body.String())
 	}
+
+	rr = testRestPost(t, "http://127.0.0.1/_api/buckets?name=hi2&durability=nope")
+	if rr.Code != 400 {
+		t.Errorf("expected unknown durability err, got: %#v, %v",
+			rr, rr.Body.String())
+	}
+
+	rr = testRestPost(t, "http://127.0.0.1/_api/buckets?name=hi3&durability=sync")
+	if rr.Code != 303 {
+		t.Errorf("expected bucket creating with durability to work, got: %#v, %v",
+			rr, rr.Body.String())
+	}
+
+	rr = testRestPost(t, "http://127.0.0.1/_api/buckets?name=hi4&evictionPolicy=nope")
+	if rr.Code != 400 {
+		t.Errorf("expected unknown evictionPolicy err, got: %#v, %v",
+			rr, rr.Body.String())
+	}
+
+	rr = testRestPost(t,
+		"http://127.0.0.1/_api/buckets?name=hi5&evictionPolicy=value&memoryOnly=2")
+	if rr.Code != 400 {
+		t.Errorf("expected value eviction of a memory-only bucket err, got: %#v, %v",
+			rr, rr.Body.String())
+	}
+
+	rr = testRestPost(t, "http://127.0.0.1/_api/buckets?name=hi6&evictionPolicy=lru")
+	if rr.Code != 303 {
+		t.Errorf("expected bucket creating with evictionPolicy to work, got: %#v, %v",
+			rr, rr.Body.String())
+	}
+	// The test buckets have 1 partition.
+	rr = testRestPost(t, "http://127.0.0.1/_api/buckets?name=hi7&numStores=2")
+	if rr.Code != 400 {
+		t.Errorf("expected more stores than partitions err, got: %#v, %v",
+			rr, rr.Body.String())
+	}
+
+	rr = testRestPost(t, "http://127.0.0.1/_api/buckets?name=hi8&numStores=1")
+	if rr.Code != 303 {
+		t.Errorf("expected bucket creating with numStores to work, got: %#v, %v",
+			rr, rr.Body.String())
+	}
 }
 
 func TestRestPostBucketCompact(t *testing.T) {
@@ -896,3 +1022,221 @@ func testRestPost(t *testing.T, url string) *httptest.ResponseRecorder {
 	mr.ServeHTTP(rr, r)
 	return rr
 }
+
+func TestRestNSBucketFlush(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+
+	SetItem(bucket, []byte("a"), []byte("aye"), VBActive)
+
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST",
+		"http://127.0.0.1/pools/default/buckets/default/controller/doFlush", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 400 {
+		t.Errorf("expected disabled flush to 400, got: %#v, %v",
+			rr, rr.Body.String())
+	}
+	if res := GetItem(bucket, []byte("a"), VBActive); res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected item to survive disabled flush, got: %v", res)
+	}
+
+	bucket.GetBucketSettings().FlushEnabled = true
+
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST",
+		"http://127.0.0.1/pools/default/buckets/default/controller/doFlush", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 200 {
+		t.Errorf("expected flush to 200, got: %#v, %v",
+			rr, rr.Body.String())
+	}
+	if res := GetItem(bucket, []byte("a"), VBActive); res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected item to be flushed, got: %v", res)
+	}
+}
+
+func TestRestBucketReplicas(t *testing.T) {
+	d, _, _ := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	defer buckets.CloseAll()
+	rep, _ := buckets.New("rep", bucketSettings)
+	mr := testSetupMux(d)
+
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST",
+		"http://127.0.0.1/_api/buckets/default/replicas?dst=nope", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 400 {
+		t.Errorf("expected missing dst bucket to fail, got: %#v", rr)
+	}
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST",
+		"http://127.0.0.1/_api/buckets/default/replicas?dst=rep", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 303 {
+		t.Errorf("expected replication to start, got: %#v, %v",
+			rr, rr.Body.String())
+	}
+	replications.Start("default", "127.0.0.1:1/other", "", false)
+	defer replications.Stop("default", "127.0.0.1:1/other")
+
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET",
+		"http://127.0.0.1/_api/buckets/default/replicas", nil)
+	mr.ServeHTTP(rr, r)
+	infos := []map[string]interface{}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &infos); err != nil ||
+		len(infos) != 2 {
+		t.Errorf("expected replications, got: %v, %v", rr.Body.String(), err)
+	}
+
+	nsb, err := getNSBucket("127.0.0.1", "default", "")
+	// The replica in the local rep bucket isn't in the vbucket map.
+	if err != nil || nsb.VBucketServerMap.NumReplicas != 1 ||
+		len(nsb.VBucketServerMap.ServerList) != 2 ||
+		nsb.VBucketServerMap.ServerList[1] != "127.0.0.1:1" ||
+		fmt.Sprintf("%v", nsb.VBucketServerMap.VBucketMap) != "[[0 1]]" {
+		t.Errorf("expected replicas in the vbucket map, got: %#v, %v",
+			nsb.VBucketServerMap, err)
+	}
+
+	for j := 0; j < 500; j++ {
+		if vb, _ := rep.GetVBucket(0); vb != nil && vb.GetVBState() == VBReplica {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST",
+		"http://127.0.0.1/_api/buckets/rep/promote", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 200 || strings.TrimSpace(rr.Body.String()) != `{"promoted":[0]}` {
+		t.Errorf("expected promote to work, got: %#v, %v",
+			rr, rr.Body.String())
+	}
+	if dsts := replications.Dsts("default"); len(dsts) != 1 {
+		t.Errorf("expected promote to stop the replication, got: %v", dsts)
+	}
+
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("DELETE",
+		"http://127.0.0.1/_api/buckets/default/replicas?dst=rep", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 404 {
+		t.Errorf("expected stopped replication delete to 404, got: %#v", rr)
+	}
+}
+
+func TestRestReplications(t *testing.T) {
+	d, _, _ := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	defer buckets.CloseAll()
+	buckets.New("rep", bucketSettings)
+	mr := testSetupMux(d)
+
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST",
+		"http://127.0.0.1/_api/replications?src=default", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 400 {
+		t.Errorf("expected missing dst to fail, got: %#v", rr)
+	}
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST",
+		"http://127.0.0.1/_api/replications?src=default&dst=rep", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 303 {
+		t.Errorf("expected replication to start, got: %#v, %v",
+			rr, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://127.0.0.1/_api/replications", nil)
+	mr.ServeHTTP(rr, r)
+	infos := []map[string]interface{}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &infos); err != nil ||
+		len(infos) != 1 || infos[0]["src"] != "default" ||
+		infos[0]["dst"] != "rep" {
+		t.Errorf("expected a replication, got: %v, %v", rr.Body.String(), err)
+	}
+
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET",
+		"http://127.0.0.1/_api/buckets/default/stats", nil)
+	mr.ServeHTTP(rr, r)
+	if !strings.Contains(rr.Body.String(), `"replications":[{`) {
+		t.Errorf("expected replications in the stats, got: %v",
+			rr.Body.String())
+	}
+
+	for j := 0; j < 2; j++ {
+		rr = httptest.NewRecorder()
+		r, _ = http.NewRequest("DELETE",
+			"http://127.0.0.1/_api/replications?src=default&dst=rep", nil)
+		mr.ServeHTTP(rr, r)
+		if (j == 0 && rr.Code != 204) || (j == 1 && rr.Code != 404) {
+			t.Errorf("expected replication delete %v, got: %#v", j, rr)
+		}
+	}
+}
+
+func TestRestBucketJournal(t *testing.T) {
+	d, _, _ := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	defer buckets.CloseAll()
+	mr := testSetupMux(d)
+
+	get := func(bucketName, params string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://127.0.0.1/_api/buckets/"+
+			bucketName+"/journal?"+params, nil)
+		mr.ServeHTTP(rr, r)
+		return rr
+	}
+	if rr := get("default", ""); rr.Code != 404 {
+		t.Errorf("expected no journal, got: %v", rr.Code)
+	}
+
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://127.0.0.1/_api/buckets",
+		strings.NewReader("name=journaled&journalEnabled=1"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 303 {
+		t.Fatalf("expected bucket create to work, got: %v, %v",
+			rr.Code, rr.Body.String())
+	}
+	journaled := buckets.Get("journaled")
+	if !journaled.GetBucketSettings().JournalEnabled {
+		t.Errorf("expected journal setting")
+	}
+	j := journaled.(*livebucket).journal
+	waitForJournal(t, j, time.Time{}, JOURNAL_OP_VBUCKETSTATE, 1)
+	SetItem(journaled, []byte("a"), []byte("aa"), VBActive)
+	SetItem(journaled, []byte("b"), []byte("bb"), VBActive)
+	waitForJournal(t, j, time.Time{}, JOURNAL_OP_SET, 2)
+
+	records := []*journalRecord{}
+	rr = get("journaled", "limit=1")
+	if err := json.Unmarshal(rr.Body.Bytes(), &records); err != nil ||
+		len(records) != 1 || records[0].Key != "b" || records[0].Value != nil {
+		t.Errorf("expected the last record, got: %v, %v", rr.Body.String(), err)
+	}
+	rr = get("journaled", fmt.Sprintf("cas=%v", records[0].Cas-1))
+	if err := json.Unmarshal(rr.Body.Bytes(), &records); err != nil ||
+		len(records) != 1 || records[0].Key != "b" {
+		t.Errorf("expected records after a cas, got: %v, %v",
+			rr.Body.String(), err)
+	}
+	since := time.Now().Add(time.Hour).Format(time.RFC3339)
+	rr = get("journaled", "since="+since)
+	if rr.Body.String() != "[]\n" {
+		t.Errorf("expected no records since the future, got: %v",
+			rr.Body.String())
+	}
+	if rr = get("journaled", "since=yesterday"); rr.Code != 400 {
+		t.Errorf("expected a bad since to fail, got: %v", rr.Code)
+	}
+}
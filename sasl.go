@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+const (
+	SASL_PLAIN    = "PLAIN"
+	SASL_CRAM_MD5 = "CRAM-MD5"
+	SCRAM_SHA256  = "SCRAM-SHA-256"
+
+	SCRAM_SALT_LEN              = 16
+	SCRAM_NONCE_LEN             = 18
+	DEFAULT_PASSWORD_ITERATIONS = 4096
+
+	// TODO: Move new status codes to gomemcached one day.
+	AUTH_CONTINUE = gomemcached.Status(0x21)
+)
+
+// The state of a multi-step SASL handshake, kept on the reqHandler
+// between the SASL_AUTH and SASL_STEP requests.
+type saslState struct {
+	mech string
+
+	challenge []byte // For CRAM-MD5.
+
+	bucketName  string // For SCRAM.
+	gs2Header   string
+	nonce       string
+	authMessage string // The client-first-bare and server-first messages.
+	storedKey   []byte
+	serverKey   []byte
+}
+
+func saslError(msg string) *gomemcached.MCResponse {
+	return &gomemcached.MCResponse{
+		Status: gomemcached.EINVAL,
+		Body:   []byte(msg),
+	}
+}
+
+// Returns the SASL mechs that we offer, where CRAM-MD5 is only offered
+// when hashed passwords keep their HMAC-MD5 keys.
+func saslMechs() string {
+	if *passwordCramMD5 {
+		return SCRAM_SHA256 + " " + SASL_CRAM_MD5 + " " + SASL_PLAIN
+	}
+	return SCRAM_SHA256 + " " + SASL_PLAIN
+}
+
+// Handles the first message of a CRAM-MD5 or SCRAM-SHA-256 handshake.
+func (rh *reqHandler) saslStart(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	rh.sasl = nil
+
+	switch string(req.Key) {
+	case SASL_CRAM_MD5:
+		challenge, err := cramMD5Challenge()
+		if err != nil {
+			return saslError(fmt.Sprintf("could not make challenge: %v", err))
+		}
+		rh.sasl = &saslState{mech: SASL_CRAM_MD5, challenge: challenge}
+		return &gomemcached.MCResponse{Status: AUTH_CONTINUE, Body: challenge}
+
+	case SCRAM_SHA256:
+		s, serverFirst, err := scramStart(rh.buckets, req.Body)
+		if err != nil {
+			return saslError(err.Error())
+		}
+		rh.sasl = s
+		return &gomemcached.MCResponse{
+			Status: AUTH_CONTINUE,
+			Body:   []byte(serverFirst),
+		}
+	}
+
+	return saslError(fmt.Sprintf("unsupported SASL auth mech: %s", req.Key))
+}
+
+// Handles the final client message of a multi-step handshake.
+func (rh *reqHandler) saslStep(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	s := rh.sasl
+	rh.sasl = nil
+	if s == nil || s.mech != string(req.Key) {
+		return saslError("no SASL auth in progress")
+	}
+
+	switch s.mech {
+	case SASL_CRAM_MD5:
+		// The response is the user name, a space and the hex digest.
+		i := bytes.LastIndex(req.Body, []byte(" "))
+		if i < 0 {
+			return saslError("invalid SASL step body")
+		}
+		bucketName := string(req.Body[:i])
+		b := rh.buckets.Get(bucketName)
+		if b == nil || !b.GetBucketSettings().AuthCramMD5(s.challenge, req.Body[i+1:]) {
+			return saslError("failed auth")
+		}
+		rh.currentBucket = b
+		rh.currentBucketName = bucketName
+		return &gomemcached.MCResponse{}
+
+	case SCRAM_SHA256:
+		serverFinal, err := s.scramFinish(req.Body)
+		if err != nil {
+			return saslError(err.Error())
+		}
+		b := rh.buckets.Get(s.bucketName)
+		if b == nil {
+			return saslError("not a bucket")
+		}
+		rh.currentBucket = b
+		rh.currentBucketName = s.bucketName
+		return &gomemcached.MCResponse{Body: []byte(serverFinal)}
+	}
+
+	return saslError("no SASL auth in progress")
+}
+
+func cramMD5Challenge() ([]byte, error) {
+	r := make([]byte, 8)
+	if _, err := rand.Read(r); err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("<%d.%d@cbgb>",
+		binary.BigEndian.Uint64(r), time.Now().Unix())), nil
+}
+
+// Returns the lowercase hex HMAC-MD5 of the challenge.
+func cramMD5Digest(password, challenge []byte) []byte {
+	h := hmac.New(md5.New, password)
+	h.Write(challenge)
+	return []byte(hex.EncodeToString(h.Sum(nil)))
+}
+
+// Returns the HMAC-MD5 hash states after the inner and outer padded
+// keys, which let CRAM-MD5 check digests without the password itself.
+func cramMD5Keys(password []byte) (string, error) {
+	key := make([]byte, md5.BlockSize)
+	if len(password) > md5.BlockSize {
+		sum := md5.Sum(password)
+		password = sum[:]
+	}
+	copy(key, password)
+	states := make([]string, 2)
+	for i, pad := range []byte{0x36, 0x5c} {
+		padded := make([]byte, md5.BlockSize)
+		for j := range key {
+			padded[j] = key[j] ^ pad
+		}
+		h := md5.New()
+		h.Write(padded)
+		state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return "", err
+		}
+		states[i] = base64.StdEncoding.EncodeToString(state)
+	}
+	return strings.Join(states, ":"), nil
+}
+
+// Returns the lowercase hex HMAC-MD5 of the challenge, from the hash
+// states of cramMD5Keys().
+func cramMD5KeysDigest(keys string, challenge []byte) ([]byte, error) {
+	states := strings.Split(keys, ":")
+	if len(states) != 2 {
+		return nil, errors.New("invalid CRAM-MD5 keys")
+	}
+	sum := challenge
+	for _, s := range states {
+		state, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		h := md5.New()
+		if err = h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+			return nil, err
+		}
+		h.Write(sum)
+		sum = h.Sum(nil)
+	}
+	return []byte(hex.EncodeToString(sum)), nil
+}
+
+// Parses the client-first message ("n,,n=user,r=nonce") and returns
+// the handshake state along with the server-first message.
+func scramStart(buckets *Buckets, clientFirst []byte) (*saslState, string, error) {
+	parts := strings.SplitN(string(clientFirst), ",", 3)
+	if len(parts) != 3 {
+		return nil, "", errors.New("invalid SCRAM client first message")
+	}
+	if parts[0] != "n" && parts[0] != "y" {
+		return nil, "", errors.New("SCRAM channel binding is not supported")
+	}
+	gs2Header := parts[0] + "," + parts[1] + ","
+	clientFirstBare := parts[2]
+
+	var user, clientNonce string
+	for _, attr := range strings.Split(clientFirstBare, ",") {
+		switch {
+		case strings.HasPrefix(attr, "n="):
+			user = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(attr[2:])
+		case strings.HasPrefix(attr, "r="):
+			clientNonce = attr[2:]
+		}
+	}
+	if user == "" || clientNonce == "" {
+		return nil, "", errors.New("invalid SCRAM client first message")
+	}
+
+	if buckets == nil {
+		return nil, "", errors.New("not a bucket")
+	}
+	b := buckets.Get(user)
+	if b == nil {
+		return nil, "", errors.New("not a bucket")
+	}
+	salt, iterations, storedKey, serverKey, err :=
+		b.GetBucketSettings().scramCredentials()
+	if err != nil {
+		return nil, "", err
+	}
+
+	r := make([]byte, SCRAM_NONCE_LEN)
+	if _, err = rand.Read(r); err != nil {
+		return nil, "", err
+	}
+	nonce := clientNonce + base64.StdEncoding.EncodeToString(r)
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", nonce,
+		base64.StdEncoding.EncodeToString(salt), iterations)
+
+	return &saslState{
+		mech:        SCRAM_SHA256,
+		bucketName:  user,
+		gs2Header:   gs2Header,
+		nonce:       nonce,
+		authMessage: clientFirstBare + "," + serverFirst,
+		storedKey:   storedKey,
+		serverKey:   serverKey,
+	}, serverFirst, nil
+}
+
+// Verifies the client-final message ("c=binding,r=nonce,p=proof") and
+// returns the server-final message.
+func (s *saslState) scramFinish(clientFinal []byte) (string, error) {
+	i := bytes.LastIndex(clientFinal, []byte(",p="))
+	if i < 0 {
+		return "", errors.New("invalid SCRAM client final message")
+	}
+	withoutProof := string(clientFinal[:i])
+	proof, err := base64.StdEncoding.DecodeString(string(clientFinal[i+3:]))
+	if err != nil || len(proof) != sha256.Size {
+		return "", errors.New("invalid SCRAM client proof")
+	}
+
+	binding := "c=" + base64.StdEncoding.EncodeToString([]byte(s.gs2Header))
+	if withoutProof != binding+",r="+s.nonce {
+		return "", errors.New("invalid SCRAM channel binding or nonce")
+	}
+
+	authMessage := []byte(s.authMessage + "," + withoutProof)
+	clientSignature := hmacSHA256(s.storedKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for j := range proof {
+		clientKey[j] = proof[j] ^ clientSignature[j]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if !hmac.Equal(storedKey[:], s.storedKey) {
+		return "", errors.New("failed auth")
+	}
+
+	return "v=" + base64.StdEncoding.EncodeToString(
+		hmacSHA256(s.serverKey, authMessage)), nil
+}
+
+// Returns the SCRAM-SHA-256 StoredKey and ServerKey of a password.
+func scramKeys(password, salt []byte, iterations int) (storedKey, serverKey []byte) {
+	saltedPassword := pbkdf2SHA256(password, salt, iterations, sha256.Size)
+	clientKey := hmacSHA256(saltedPassword, []byte("Client Key"))
+	h := sha256.Sum256(clientKey)
+	return h[:], hmacSHA256(saltedPassword, []byte("Server Key"))
+}
+
+// The stored SCRAM hash is the base64 StoredKey and ServerKey,
+// separated by a colon.
+func parseScramHash(s string) (storedKey, serverKey []byte, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, nil, errors.New("invalid scram password hash")
+	}
+	if storedKey, err = base64.StdEncoding.DecodeString(parts[0]); err != nil {
+		return nil, nil, err
+	}
+	if serverKey, err = base64.StdEncoding.DecodeString(parts[1]); err != nil {
+		return nil, nil, err
+	}
+	return storedKey, serverKey, nil
+}
+
+func hmacSHA256(key, msg []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// PBKDF2 (RFC 2898) with HMAC-SHA-256 as the PRF.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var rv []byte
+	for block := uint32(1); len(rv) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16),
+			byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		rv = append(rv, t...)
+	}
+	return rv[:keyLen]
+}
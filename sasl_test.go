@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	tests := []struct {
+		iterations int
+		exp        string
+	}{
+		{1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+	for _, test := range tests {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte("password"), []byte("salt"),
+			test.iterations, 32))
+		if got != test.exp {
+			t.Errorf("Expected pbkdf2 %v for %v iterations, got %v",
+				test.exp, test.iterations, got)
+		}
+	}
+}
+
+func mkSaslTestBuckets(t *testing.T, dir string) *Buckets {
+	bs, _ := NewBuckets(dir, &BucketSettings{NumPartitions: 1})
+	plain := &BucketSettings{NumPartitions: 1, PasswordHash: "plainpswd"}
+	if _, err := bs.New("plain", plain); err != nil {
+		t.Fatalf("Expected bucket creation to work, got %v", err)
+	}
+	hashed := &BucketSettings{NumPartitions: 1}
+	hashed.SetPassword(SCRAM_SHA256, "hashedpswd", false)
+	if _, err := bs.New("hashed", hashed); err != nil {
+		t.Fatalf("Expected bucket creation to work, got %v", err)
+	}
+	cram := &BucketSettings{NumPartitions: 1}
+	cram.SetPassword(SCRAM_SHA256, "crampswd", true)
+	if _, err := bs.New("cram", cram); err != nil {
+		t.Fatalf("Expected bucket creation to work, got %v", err)
+	}
+	return bs
+}
+
+func TestSaslCramMD5(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	bs := mkSaslTestBuckets(t, testBucketDir)
+	defer bs.CloseAll()
+
+	auth := func(user, pswd string) *gomemcached.MCResponse {
+		rh := &reqHandler{buckets: bs}
+		res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.SASL_AUTH,
+			Key:    []byte(SASL_CRAM_MD5),
+		})
+		if res.Status != AUTH_CONTINUE || len(res.Body) == 0 {
+			t.Fatalf("Expected a CRAM-MD5 challenge, got %v", res)
+		}
+		digest := cramMD5Digest([]byte(pswd), res.Body)
+		res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.SASL_STEP,
+			Key:    []byte(SASL_CRAM_MD5),
+			Body:   []byte(user + " " + string(digest)),
+		})
+		if res.Status == gomemcached.SUCCESS && rh.currentBucketName != user {
+			t.Errorf("Expected auth to select bucket %v, got %v",
+				user, rh.currentBucketName)
+		}
+		return res
+	}
+
+	if res := auth("plain", "plainpswd"); res.Status != gomemcached.SUCCESS {
+		t.Errorf("Expected CRAM-MD5 auth to work, got %v", res)
+	}
+	if res := auth("plain", "wrong"); res.Status != gomemcached.EINVAL {
+		t.Errorf("Expected CRAM-MD5 auth with wrong password to fail, got %v", res)
+	}
+	if res := auth("hashed", "hashedpswd"); res.Status != gomemcached.EINVAL {
+		t.Errorf("Expected CRAM-MD5 auth of hashed password to fail, got %v", res)
+	}
+	if res := auth("cram", "crampswd"); res.Status != gomemcached.SUCCESS {
+		t.Errorf("Expected CRAM-MD5 auth with CRAM-MD5 keys to work, got %v", res)
+	}
+	if res := auth("cram", "wrong"); res.Status != gomemcached.EINVAL {
+		t.Errorf("Expected CRAM-MD5 auth with wrong password to fail, got %v", res)
+	}
+	if res := auth("missing", "plainpswd"); res.Status != gomemcached.EINVAL {
+		t.Errorf("Expected CRAM-MD5 auth of missing bucket to fail, got %v", res)
+	}
+
+	rh := &reqHandler{buckets: bs}
+	res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SASL_STEP,
+		Key:    []byte(SASL_CRAM_MD5),
+		Body:   []byte("plain 1234"),
+	})
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("Expected SASL step without auth to fail, got %v", res)
+	}
+}
+
+func TestCramMD5Keys(t *testing.T) {
+	challenge := []byte("<1.2@cbgb>")
+	for _, pswd := range []string{"", "pswd", strings.Repeat("p", 100)} {
+		keys, err := cramMD5Keys([]byte(pswd))
+		if err != nil {
+			t.Fatalf("Expected cramMD5Keys to work, got %v", err)
+		}
+		digest, err := cramMD5KeysDigest(keys, challenge)
+		if err != nil || string(digest) !=
+			string(cramMD5Digest([]byte(pswd), challenge)) {
+			t.Errorf("Expected the HMAC-MD5 digest for %q, got %s, %v",
+				pswd, digest, err)
+		}
+	}
+	if _, err := cramMD5KeysDigest("bad", challenge); err == nil {
+		t.Errorf("Expected bad keys to fail")
+	}
+}
+
+func TestSaslScramSHA256(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	bs := mkSaslTestBuckets(t, testBucketDir)
+	defer bs.CloseAll()
+
+	auth := func(user, pswd string) *gomemcached.MCResponse {
+		rh := &reqHandler{buckets: bs}
+		clientFirstBare := "n=" + user + ",r=clientnonce"
+		res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.SASL_AUTH,
+			Key:    []byte(SCRAM_SHA256),
+			Body:   []byte("n,," + clientFirstBare),
+		})
+		if res.Status != AUTH_CONTINUE {
+			return res
+		}
+
+		serverFirst := string(res.Body)
+		var nonce string
+		var salt []byte
+		iterations := 0
+		for _, attr := range strings.Split(serverFirst, ",") {
+			switch attr[:2] {
+			case "r=":
+				nonce = attr[2:]
+			case "s=":
+				salt, _ = base64.StdEncoding.DecodeString(attr[2:])
+			case "i=":
+				iterations, _ = strconv.Atoi(attr[2:])
+			}
+		}
+		if !strings.HasPrefix(nonce, "clientnonce") || len(salt) == 0 ||
+			iterations == 0 {
+			t.Fatalf("Expected server first message, got %v", serverFirst)
+		}
+
+		withoutProof := "c=biws,r=" + nonce
+		authMessage := []byte(clientFirstBare + "," + serverFirst + "," + withoutProof)
+		saltedPassword := pbkdf2SHA256([]byte(pswd), salt, iterations, sha256.Size)
+		clientKey := hmacSHA256(saltedPassword, []byte("Client Key"))
+		storedKey := sha256.Sum256(clientKey)
+		clientSignature := hmacSHA256(storedKey[:], authMessage)
+		proof := make([]byte, len(clientKey))
+		for i := range proof {
+			proof[i] = clientKey[i] ^ clientSignature[i]
+		}
+
+		res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.SASL_STEP,
+			Key:    []byte(SCRAM_SHA256),
+			Body: []byte(withoutProof + ",p=" +
+				base64.StdEncoding.EncodeToString(proof)),
+		})
+		if res.Status == gomemcached.SUCCESS {
+			serverKey := hmacSHA256(saltedPassword, []byte("Server Key"))
+			exp := "v=" + base64.StdEncoding.EncodeToString(
+				hmacSHA256(serverKey, authMessage))
+			if string(res.Body) != exp {
+				t.Errorf("Expected server signature %v, got %s", exp, res.Body)
+			}
+			if rh.currentBucketName != user {
+				t.Errorf("Expected auth to select bucket %v, got %v",
+					user, rh.currentBucketName)
+			}
+		}
+		return res
+	}
+
+	if res := auth("hashed", "hashedpswd"); res.Status != gomemcached.SUCCESS {
+		t.Errorf("Expected SCRAM auth to work, got %v", res)
+	}
+	if res := auth("plain", "plainpswd"); res.Status != gomemcached.SUCCESS {
+		t.Errorf("Expected SCRAM auth of cleartext password to work, got %v", res)
+	}
+	if res := auth("hashed", "wrong"); res.Status != gomemcached.EINVAL {
+		t.Errorf("Expected SCRAM auth with wrong password to fail, got %v", res)
+	}
+	if res := auth("missing", "wrong"); res.Status != gomemcached.EINVAL {
+		t.Errorf("Expected SCRAM auth of missing bucket to fail, got %v", res)
+	}
+}
@@ -14,15 +14,16 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"sync/atomic"
 	"time"
 
 	"github.com/dustin/gomemcached"
-	"github.com/dustin/gomemcached/server"
 )
 
 var serverStart = time.Now()
@@ -33,6 +34,9 @@ type reqHandler struct {
 	buckets           *Buckets
 	currentBucket     Bucket
 	currentBucketName string
+	sasl              *saslState      // A multi-step SASL auth in progress.
+	features          map[uint16]bool // Negotiated by HELLO.
+	upr               *uprConn        // Set by UPR_OPEN.
 }
 
 func (rh *reqHandler) HandleMessage(w io.Writer, r io.Reader,
@@ -48,6 +52,8 @@ func (rh *reqHandler) HandleMessage(w io.Writer, r io.Reader,
 		}
 	case gomemcached.NOOP:
 		return &gomemcached.MCResponse{}
+	case HELLO:
+		return rh.hello(w, req)
 	case gomemcached.SASL_LIST_MECHS:
 		if req.VBucket != 0 || req.Cas != 0 ||
 			len(req.Key) != 0 || len(req.Extras) != 0 || len(req.Body) != 0 {
@@ -56,19 +62,20 @@ func (rh *reqHandler) HandleMessage(w io.Writer, r io.Reader,
 			}
 		}
 		return &gomemcached.MCResponse{
-			Body: []byte("PLAIN"),
+			Body: []byte(saslMechs()),
 		}
 	case gomemcached.SASL_AUTH:
-		if req.VBucket != 0 || req.Cas != 0 ||
-			len(req.Extras) != 0 || len(req.Body) < 2 {
+		if req.VBucket != 0 || req.Cas != 0 || len(req.Extras) != 0 {
 			return &gomemcached.MCResponse{
 				Status: gomemcached.EINVAL,
 			}
 		}
-		if !bytes.Equal(req.Key, []byte("PLAIN")) {
+		if !bytes.Equal(req.Key, []byte(SASL_PLAIN)) {
+			return rh.saslStart(req)
+		}
+		if len(req.Body) < 2 {
 			return &gomemcached.MCResponse{
 				Status: gomemcached.EINVAL,
-				Body:   []byte(fmt.Sprintf("unsupported SASL auth mech: %v", req.Key)),
 			}
 		}
 		targetUserPswd := bytes.Split(req.Body, []byte("\x00"))
@@ -95,6 +102,13 @@ func (rh *reqHandler) HandleMessage(w io.Writer, r io.Reader,
 		rh.currentBucket = targetBucket
 		rh.currentBucketName = targetBucketName
 		return &gomemcached.MCResponse{}
+	case gomemcached.SASL_STEP:
+		if req.VBucket != 0 || req.Cas != 0 || len(req.Extras) != 0 {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.EINVAL,
+			}
+		}
+		return rh.saslStep(req)
 	}
 
 	if rh.currentBucket == nil {
@@ -125,6 +139,22 @@ func (rh *reqHandler) HandleMessage(w io.Writer, r io.Reader,
 			return &gomemcached.MCResponse{Fatal: true}
 		}
 		return nil
+	case OBSERVE:
+		return doObserve(rh.currentBucket, req)
+	case gomemcached.FLUSH, gomemcached.FLUSHQ:
+		return doFlushAll(rh.currentBucket, req)
+	case UPR_OPEN:
+		return rh.uprOpen(w, req)
+	case UPR_STREAM_REQ:
+		return rh.uprStreamReq(req)
+	case UPR_CLOSE_STREAM:
+		return rh.uprCloseStream(req)
+	case UPR_GET_FAILOVER_LOG:
+		return doUprGetFailoverLog(rh.currentBucket, req)
+	case gomemcached.TAP_MUTATION, gomemcached.TAP_DELETE,
+		gomemcached.TAP_FLUSH, gomemcached.TAP_VBUCKET_SET, gomemcached.TAP_OPAQUE,
+		gomemcached.TAP_CHECKPOINT_START, gomemcached.TAP_CHECKPOINT_END:
+		return doTapReceive(rh.currentBucket, req)
 	}
 
 	vb, err := rh.currentBucket.GetVBucket(req.VBucket)
@@ -136,14 +166,100 @@ func (rh *reqHandler) HandleMessage(w io.Writer, r io.Reader,
 			Status: gomemcached.NOT_MY_VBUCKET,
 		}
 	}
+	if writeOpcodes[req.Opcode] && vb.GetVBState() == VBPending {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.TMPFAIL,
+			Body:   []byte("vbucket is pending"),
+		}
+	}
 
 	return vb.Dispatch(w, req)
 }
 
+// The requests that change items, which a pending vbucket refuses,
+// such as during a TAP takeover.
+var writeOpcodes = map[gomemcached.CommandCode]bool{
+	gomemcached.SET:        true,
+	gomemcached.SETQ:       true,
+	gomemcached.ADD:        true,
+	gomemcached.ADDQ:       true,
+	gomemcached.REPLACE:    true,
+	gomemcached.REPLACEQ:   true,
+	gomemcached.APPEND:     true,
+	gomemcached.APPENDQ:    true,
+	gomemcached.PREPEND:    true,
+	gomemcached.PREPENDQ:   true,
+	gomemcached.DELETE:     true,
+	gomemcached.DELETEQ:    true,
+	gomemcached.INCREMENT:  true,
+	gomemcached.INCREMENTQ: true,
+	gomemcached.DECREMENT:  true,
+	gomemcached.DECREMENTQ: true,
+	TOUCH:                  true,
+	GAT:                    true,
+	GATQ:                   true,
+	GETL:                   true,
+	UNLOCK_KEY:             true,
+	SET_WITH_META:          true,
+	SETQ_WITH_META:         true,
+	DEL_WITH_META:          true,
+	DELQ_WITH_META:         true,
+}
+
+// Fills in the vbucket for the request's key and handles the request
+// against the current bucket, for protocols that don't carry vbuckets.
+func (rh *reqHandler) handleKeyMessage(
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	return rh.handleKeyMessageWriter(ioutil.Discard, req)
+}
+
+// Like handleKeyMessage(), but an append, prepend, incr or decr keeps
+// the existing item's flags and exp.
+func (rh *reqHandler) handleKeyMessageKeepMeta(
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	return rh.handleKeyMessageWriter(keepMetaWriter{ioutil.Discard}, req)
+}
+
+func (rh *reqHandler) handleKeyMessageWriter(w io.Writer,
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if rh.currentBucket != nil {
+		req.VBucket = VBucketIdForKey(req.Key,
+			rh.currentBucket.GetBucketSettings().NumPartitions)
+	}
+	return rh.HandleMessage(w, nil, req)
+}
+
+func doFlushAll(b Bucket, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if len(req.Extras) == 4 && binary.BigEndian.Uint32(req.Extras) != 0 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("delayed flush is not supported"),
+		}
+	}
+	err := b.FlushAll()
+	if err == bucketFlushDisabled {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte(err.Error()),
+		}
+	}
+	if err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.TMPFAIL,
+			Body:   []byte(fmt.Sprintf("flush error %v", err)),
+		}
+	}
+	if req.Opcode.IsQuiet() {
+		return nil
+	}
+	return &gomemcached.MCResponse{}
+}
+
 func sessionLoop(s io.ReadWriteCloser, addr string, handler *reqHandler,
 	doneFun func()) {
 	defer s.Close()
 	defer doneFun()
+	defer handler.closeUpr()
 
 	var err error
 	for err == nil {
@@ -155,24 +271,97 @@ func sessionLoop(s io.ReadWriteCloser, addr string, handler *reqHandler,
 }
 
 func handleMessage(w io.Writer, r io.Reader, handler *reqHandler) error {
-	req, err := memcached.ReadPacket(r)
+	req, datatype, err := readPacket(r)
 	if err != nil {
 		return err
 	}
-	res := handler.HandleMessage(w, r, &req)
+	rw := &responseWriter{Writer: w}
+	res := handler.decodeRequest(&req, datatype)
+	if res == nil {
+		res = handler.HandleMessage(rw, r, &req)
+	}
 	if res == nil { // Quiet command
 		return nil
 	}
 	if !res.Fatal {
 		res.Opcode = req.Opcode
 		res.Opaque = req.Opaque
-		return res.Transmit(w)
+		datatype := handler.encodeResponse(&req, res, rw)
+		pkt := res.Bytes()
+		pkt[5] = datatype
+		if handler.upr != nil {
+			return handler.upr.write(pkt)
+		}
+		_, err = w.Write(pkt)
+		return err
 	}
 	return io.EOF
 }
 
+// Like memcached.ReadPacket(), but also returns the header's datatype.
+func readPacket(r io.Reader) (req gomemcached.MCRequest, datatype uint8,
+	err error) {
+	hdr, extras, key, body, err := readRawPacket(r, gomemcached.REQ_MAGIC)
+	if err != nil {
+		return req, 0, err
+	}
+	req.Opcode = gomemcached.CommandCode(hdr[1])
+	req.VBucket = binary.BigEndian.Uint16(hdr[6:])
+	req.Opaque = binary.BigEndian.Uint32(hdr[12:])
+	req.Cas = binary.BigEndian.Uint64(hdr[16:])
+	req.Extras, req.Key, req.Body = extras, key, body
+	return req, hdr[5], nil
+}
+
+// Reads a response, such as a TAP ack from a TAP receiver.
+func readResponse(r io.Reader) (*gomemcached.MCResponse, error) {
+	hdr, extras, key, body, err := readRawPacket(r, gomemcached.RES_MAGIC)
+	if err != nil {
+		return nil, err
+	}
+	return &gomemcached.MCResponse{
+		Opcode: gomemcached.CommandCode(hdr[1]),
+		Status: gomemcached.Status(binary.BigEndian.Uint16(hdr[6:])),
+		Opaque: binary.BigEndian.Uint32(hdr[12:]),
+		Cas:    binary.BigEndian.Uint64(hdr[16:]),
+		Extras: extras,
+		Key:    key,
+		Body:   body,
+	}, nil
+}
+
+func readRawPacket(r io.Reader, magic uint8) (hdr, extras, key, body []byte,
+	err error) {
+	hdr = make([]byte, gomemcached.HDR_LEN)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if hdr[0] != magic {
+		return nil, nil, nil, nil, fmt.Errorf("bad magic: 0x%02x", hdr[0])
+	}
+	klen := int(binary.BigEndian.Uint16(hdr[2:]))
+	elen := int(hdr[4])
+	blen := int(binary.BigEndian.Uint32(hdr[8:]))
+	if blen < klen+elen {
+		return nil, nil, nil, nil, fmt.Errorf("bad body length: %v,"+
+			" key length: %v, extras length: %v", blen, klen, elen)
+	}
+
+	buf := make([]byte, blen)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if elen > 0 {
+		extras = buf[0:elen]
+	}
+	return hdr, extras, buf[elen : elen+klen], buf[elen+klen:], nil
+}
+
+type sessionFun func(s io.ReadWriteCloser, addr string, handler *reqHandler,
+	doneFun func())
+
 func waitForConnections(ls net.Listener, maxConns int, buckets *Buckets,
-	defaultBucketName string) {
+	defaultBucketName string, session sessionFun) {
 	closech := make(chan bool)
 
 	for {
@@ -191,7 +380,7 @@ func waitForConnections(ls net.Listener, maxConns int, buckets *Buckets,
 				currentBucket:     buckets.Get(defaultBucketName),
 				currentBucketName: defaultBucketName,
 			}
-			go sessionLoop(s, s.RemoteAddr().String(), handler,
+			go session(s, s.RemoteAddr().String(), handler,
 				func() {
 					atomic.AddInt64(&serverStats.ClosedConns, 1)
 					open := atomic.AddInt64(&serverStats.OpenConns, -1)
@@ -216,7 +405,8 @@ func StartServer(addr string, maxConns int, buckets *Buckets,
 		return nil, err
 	}
 
-	go waitForConnections(ls, maxConns, buckets, defaultBucketName)
+	go waitForConnections(ls, maxConns, buckets, defaultBucketName,
+		sessionLoop)
 	return ls, nil
 }
 
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/gomemcached"
+)
+
+// The ASCII (text) memcached protocol, where each command is
+// translated into a binary protocol request for reqHandler, against
+// the connection's current bucket.
+
+// The longest command line that we read, which leaves room for gets
+// of many keys.
+const ASCII_MAX_LINE_LEN = 64 * 1024
+
+var asciiLineTooLong = errors.New("ascii command line too long")
+
+func StartAsciiServer(addr string, maxConns int, buckets *Buckets,
+	defaultBucketName string) (net.Listener, error) {
+	ls, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go waitForConnections(ls, maxConns, buckets, defaultBucketName,
+		asciiSessionLoop)
+	return ls, nil
+}
+
+func asciiSessionLoop(s io.ReadWriteCloser, addr string, handler *reqHandler,
+	doneFun func()) {
+	defer s.Close()
+	defer doneFun()
+
+	r := bufio.NewReader(s)
+	w := bufio.NewWriter(s)
+
+	var err error
+	for err == nil {
+		err = handleAsciiMessage(r, w, handler)
+		if ferr := w.Flush(); err == nil {
+			err = ferr
+		}
+	}
+	if err != io.EOF {
+		log.Printf("error: asciiSessionLoop, addr: %v, err: %v", addr, err)
+	}
+}
+
+func handleAsciiMessage(r *bufio.Reader, w io.Writer, rh *reqHandler) error {
+	line, err := readAsciiLine(r)
+	if err == asciiLineTooLong {
+		// The rest of the line can't be told apart from the next
+		// command, so the connection is dropped.
+		io.WriteString(w, "CLIENT_ERROR line too long\r\n")
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		_, err = io.WriteString(w, "ERROR\r\n")
+		return err
+	}
+
+	switch args[0] {
+	case "get":
+		return asciiGet(w, rh, args[1:], false)
+	case "gets":
+		return asciiGet(w, rh, args[1:], true)
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return asciiStore(r, w, rh, args)
+	case "incr", "decr":
+		return asciiArith(w, rh, args)
+	case "delete":
+		return asciiDelete(w, rh, args)
+	case "touch":
+		return asciiTouch(w, rh, args)
+	case "stats":
+		return asciiStats(w, rh, args[1:])
+	case "version":
+		_, err = io.WriteString(w, "VERSION "+VERSION+"\r\n")
+		return err
+	case "quit":
+		return io.EOF
+	}
+	_, err = io.WriteString(w, "ERROR\r\n")
+	return err
+}
+
+// Reads a line, without buffering more than ASCII_MAX_LINE_LEN bytes.
+func readAsciiLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		b, err := r.ReadSlice('\n')
+		if len(line)+len(b) > ASCII_MAX_LINE_LEN {
+			return "", asciiLineTooLong
+		}
+		line = append(line, b...)
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// Writes the ASCII protocol line for a response, where the given
+// status lines cover the expected outcomes of the command.  Returns
+// io.EOF when the connection should be dropped.
+func asciiReply(w io.Writer, res *gomemcached.MCResponse,
+	lines map[gomemcached.Status]string, noreply bool) error {
+	if res == nil || res.Fatal {
+		return io.EOF
+	}
+	line, ok := lines[res.Status]
+	if !ok {
+		line = asciiErrorLine(res)
+	}
+	if noreply {
+		return nil
+	}
+	_, err := io.WriteString(w, line+"\r\n")
+	return err
+}
+
+func asciiErrorLine(res *gomemcached.MCResponse) string {
+	switch res.Status {
+	case gomemcached.E2BIG:
+		return "SERVER_ERROR object too large for cache"
+	case gomemcached.EINVAL:
+		return "CLIENT_ERROR " + string(res.Body)
+	}
+	if len(res.Body) > 0 {
+		return "SERVER_ERROR " + string(res.Body)
+	}
+	return "SERVER_ERROR " + res.Status.String()
+}
+
+func asciiClientError(w io.Writer, msg string) error {
+	_, err := io.WriteString(w, "CLIENT_ERROR "+msg+"\r\n")
+	return err
+}
+
+// Handles a trailing, optional "noreply" argument, returning the
+// remaining arguments.
+func asciiNoReply(args []string) ([]string, bool) {
+	if len(args) > 0 && args[len(args)-1] == "noreply" {
+		return args[:len(args)-1], true
+	}
+	return args, false
+}
+
+func asciiKeyOk(key string) bool {
+	return len(key) <= MAX_ITEM_KEY_LENGTH
+}
+
+// get <key>*
+// gets <key>*
+func asciiGet(w io.Writer, rh *reqHandler, keys []string, withCas bool) error {
+	if len(keys) == 0 {
+		_, err := io.WriteString(w, "ERROR\r\n")
+		return err
+	}
+	for _, key := range keys {
+		if !asciiKeyOk(key) {
+			return asciiClientError(w, "bad command line format")
+		}
+		res := rh.handleKeyMessage(&gomemcached.MCRequest{
+			Opcode: gomemcached.GET,
+			Key:    []byte(key),
+		})
+		if res == nil || res.Fatal {
+			return io.EOF
+		}
+		if res.Status == gomemcached.KEY_ENOENT {
+			continue
+		}
+		if res.Status != gomemcached.SUCCESS {
+			_, err := io.WriteString(w, asciiErrorLine(res)+"\r\n")
+			return err
+		}
+		var flag uint32
+		if len(res.Extras) >= 4 {
+			flag = binary.BigEndian.Uint32(res.Extras)
+		}
+		var err error
+		if withCas {
+			_, err = fmt.Fprintf(w, "VALUE %s %d %d %d\r\n",
+				key, flag, len(res.Body), res.Cas)
+		} else {
+			_, err = fmt.Fprintf(w, "VALUE %s %d %d\r\n",
+				key, flag, len(res.Body))
+		}
+		if err == nil {
+			_, err = w.Write(res.Body)
+		}
+		if err == nil {
+			_, err = io.WriteString(w, "\r\n")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "END\r\n")
+	return err
+}
+
+var asciiStoreOpcodes = map[string]gomemcached.CommandCode{
+	"set":     gomemcached.SET,
+	"add":     gomemcached.ADD,
+	"replace": gomemcached.REPLACE,
+	"append":  gomemcached.APPEND,
+	"prepend": gomemcached.PREPEND,
+	"cas":     gomemcached.SET,
+}
+
+// <cmd> <key> <flags> <exptime> <bytes> [noreply]
+// cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+func asciiStore(r *bufio.Reader, w io.Writer, rh *reqHandler,
+	args []string) error {
+	cmd := args[0]
+	args, noreply := asciiNoReply(args[1:])
+
+	nargs := 4
+	if cmd == "cas" {
+		nargs = 5
+	}
+	if len(args) != nargs || !asciiKeyOk(args[0]) {
+		return asciiClientError(w, "bad command line format")
+	}
+	flag, err0 := strconv.ParseUint(args[1], 10, 32)
+	exp, err1 := strconv.ParseUint(args[2], 10, 32)
+	n, err2 := strconv.ParseUint(args[3], 10, 32)
+	if err0 != nil || err1 != nil || err2 != nil {
+		return asciiClientError(w, "bad command line format")
+	}
+	var cas uint64
+	if cmd == "cas" {
+		var err error
+		if cas, err = strconv.ParseUint(args[4], 10, 64); err != nil {
+			return asciiClientError(w, "bad command line format")
+		}
+	}
+
+	if n > MAX_ITEM_DATA_LENGTH {
+		// Skip the data block without buffering it.
+		if _, err := io.CopyN(ioutil.Discard, r, int64(n+2)); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w,
+			"SERVER_ERROR object too large for cache\r\n")
+		return err
+	}
+
+	data := make([]byte, n+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if data[n] != '\r' || data[n+1] != '\n' {
+		return asciiClientError(w, "bad data chunk")
+	}
+
+	req := &gomemcached.MCRequest{
+		Opcode: asciiStoreOpcodes[cmd],
+		Cas:    cas,
+		Key:    []byte(args[0]),
+		Body:   data[:n],
+	}
+	if req.Opcode != gomemcached.APPEND && req.Opcode != gomemcached.PREPEND {
+		req.Extras = make([]byte, 8)
+		binary.BigEndian.PutUint32(req.Extras, uint32(flag))
+		binary.BigEndian.PutUint32(req.Extras[4:], uint32(exp))
+	} else {
+		// Unlike the binary protocol, an append or prepend to a
+		// missing item stores nothing.
+		res := rh.handleKeyMessage(&gomemcached.MCRequest{
+			Opcode: gomemcached.GET,
+			Key:    req.Key,
+		})
+		if res == nil || res.Status != gomemcached.SUCCESS {
+			return asciiReply(w, res, map[gomemcached.Status]string{
+				gomemcached.KEY_ENOENT: "NOT_STORED",
+			}, noreply)
+		}
+	}
+	res := rh.handleKeyMessageKeepMeta(req)
+
+	if cmd == "cas" && res != nil && res.Status == gomemcached.EINVAL {
+		// A CAS mismatch is reported as EINVAL whether or not the
+		// item exists, so look the item up to tell the cases apart.
+		res = rh.handleKeyMessage(&gomemcached.MCRequest{
+			Opcode: gomemcached.GET,
+			Key:    req.Key,
+		})
+		if res != nil && res.Status == gomemcached.SUCCESS {
+			res.Status = gomemcached.KEY_EEXISTS
+		}
+		return asciiReply(w, res, map[gomemcached.Status]string{
+			gomemcached.KEY_EEXISTS: "EXISTS",
+			gomemcached.KEY_ENOENT:  "NOT_FOUND",
+		}, noreply)
+	}
+
+	return asciiReply(w, res, map[gomemcached.Status]string{
+		gomemcached.SUCCESS:     "STORED",
+		gomemcached.KEY_EEXISTS: "NOT_STORED",
+		gomemcached.KEY_ENOENT:  "NOT_STORED",
+	}, noreply)
+}
+
+// incr <key> <value> [noreply]
+// decr <key> <value> [noreply]
+func asciiArith(w io.Writer, rh *reqHandler, args []string) error {
+	cmd := args[0]
+	args, noreply := asciiNoReply(args[1:])
+	if len(args) != 2 || !asciiKeyOk(args[0]) {
+		return asciiClientError(w, "bad command line format")
+	}
+	amount, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return asciiClientError(w, "invalid numeric delta argument")
+	}
+
+	req := &gomemcached.MCRequest{
+		Opcode: gomemcached.INCREMENT,
+		Key:    []byte(args[0]),
+		Extras: make([]byte, 8+8+4),
+	}
+	if cmd == "decr" {
+		req.Opcode = gomemcached.DECREMENT
+	}
+	binary.BigEndian.PutUint64(req.Extras, amount)
+	binary.BigEndian.PutUint64(req.Extras[8:], ^uint64(0)) // Don't create.
+	res := rh.handleKeyMessageKeepMeta(req)
+
+	if res != nil && res.Status == gomemcached.SUCCESS && len(res.Body) == 8 {
+		if noreply {
+			return nil
+		}
+		_, err = fmt.Fprintf(w, "%d\r\n", binary.BigEndian.Uint64(res.Body))
+		return err
+	}
+	if res != nil && res.Status == gomemcached.EINVAL {
+		res.Body = []byte("cannot increment or decrement non-numeric value")
+	}
+	return asciiReply(w, res, map[gomemcached.Status]string{
+		gomemcached.KEY_ENOENT: "NOT_FOUND",
+	}, noreply)
+}
+
+// delete <key> [noreply]
+func asciiDelete(w io.Writer, rh *reqHandler, args []string) error {
+	args, noreply := asciiNoReply(args[1:])
+	if len(args) == 2 && args[1] == "0" { // Legacy clients send a 0 time.
+		args = args[:1]
+	}
+	if len(args) != 1 || !asciiKeyOk(args[0]) {
+		return asciiClientError(w, "bad command line format")
+	}
+	res := rh.handleKeyMessage(&gomemcached.MCRequest{
+		Opcode: gomemcached.DELETE,
+		Key:    []byte(args[0]),
+	})
+	return asciiReply(w, res, map[gomemcached.Status]string{
+		gomemcached.SUCCESS:    "DELETED",
+		gomemcached.KEY_ENOENT: "NOT_FOUND",
+	}, noreply)
+}
+
+// touch <key> <exptime> [noreply]
+func asciiTouch(w io.Writer, rh *reqHandler, args []string) error {
+	args, noreply := asciiNoReply(args[1:])
+	if len(args) != 2 || !asciiKeyOk(args[0]) {
+		return asciiClientError(w, "bad command line format")
+	}
+	exp, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		return asciiClientError(w, "invalid exptime argument")
+	}
+	req := &gomemcached.MCRequest{
+		Opcode: TOUCH,
+		Key:    []byte(args[0]),
+		Extras: make([]byte, 4),
+	}
+	binary.BigEndian.PutUint32(req.Extras, uint32(exp))
+	res := rh.handleKeyMessage(req)
+	return asciiReply(w, res, map[gomemcached.Status]string{
+		gomemcached.SUCCESS:    "TOUCHED",
+		gomemcached.KEY_ENOENT: "NOT_FOUND",
+	}, noreply)
+}
+
+// stats [<key>]
+func asciiStats(w io.Writer, rh *reqHandler, args []string) error {
+	if rh.currentBucket == nil {
+		_, err := io.WriteString(w, "SERVER_ERROR no bucket\r\n")
+		return err
+	}
+	key := ""
+	if len(args) > 0 {
+		key = args[0]
+	}
+
+	ch := make(chan statItem)
+	go func() {
+		sendStats(rh.currentBucket, ch, key)
+		close(ch)
+	}()
+
+	var err error
+	for st := range ch {
+		if err == nil {
+			_, err = fmt.Fprintf(w, "STAT %s %s\r\n", st.key, st.val)
+		}
+	}
+	if err == nil {
+		_, err = io.WriteString(w, "END\r\n")
+	}
+	return err
+}
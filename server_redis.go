@@ -0,0 +1,682 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+// The redis RESP protocol, where each command is translated into
+// binary protocol requests for reqHandler, against the connection's
+// current bucket.
+
+const (
+	REDIS_MAX_ARGS      = 1024 * 1024
+	REDIS_SCAN_COUNT    = 10
+	REDIS_MAX_BULK_SIZE = MAX_ITEM_DATA_LENGTH + MAX_ITEM_KEY_LENGTH
+)
+
+var redisProtocolError = errors.New("redis protocol error")
+
+type redisCommandFun func(w io.Writer, rh *reqHandler, args [][]byte) error
+
+type redisCommand struct {
+	fun     redisCommandFun
+	minArgs int // Including the command name.
+	maxArgs int // Or -1 for variadic commands.
+}
+
+var redisCommands = map[string]*redisCommand{
+	"PING":    {redisPing, 1, 2},
+	"QUIT":    {redisQuit, 1, 1},
+	"AUTH":    {redisAuth, 2, 3},
+	"SELECT":  {redisSelect, 2, 2},
+	"GET":     {redisGet, 2, 2},
+	"SET":     {redisSet, 3, -1},
+	"DEL":     {redisDel, 2, -1},
+	"EXISTS":  {redisExists, 2, -1},
+	"INCR":    {redisArith, 2, 2},
+	"INCRBY":  {redisArith, 3, 3},
+	"DECR":    {redisArith, 2, 2},
+	"DECRBY":  {redisArith, 3, 3},
+	"APPEND":  {redisAppend, 3, 3},
+	"EXPIRE":  {redisExpire, 3, 3},
+	"TTL":     {redisTTL, 2, 2},
+	"MGET":    {redisMGet, 2, -1},
+	"MSET":    {redisMSet, 3, -1},
+	"SCAN":    {redisScan, 2, 6},
+	"COMMAND": {redisCommandCmd, 1, -1},
+}
+
+func StartRedisServer(addr string, maxConns int, buckets *Buckets,
+	defaultBucketName string) (net.Listener, error) {
+	ls, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go waitForConnections(ls, maxConns, buckets, defaultBucketName,
+		redisSessionLoop)
+	return ls, nil
+}
+
+func redisSessionLoop(s io.ReadWriteCloser, addr string, handler *reqHandler,
+	doneFun func()) {
+	defer s.Close()
+	defer doneFun()
+
+	r := bufio.NewReader(s)
+	w := bufio.NewWriter(s)
+
+	var err error
+	for err == nil {
+		err = handleRedisMessage(r, w, handler)
+		if err == redisProtocolError {
+			redisError(w, "ERR Protocol error")
+		}
+		if ferr := w.Flush(); err == nil {
+			err = ferr
+		}
+	}
+	if err != io.EOF && err != redisProtocolError {
+		log.Printf("error: redisSessionLoop, addr: %v, err: %v", addr, err)
+	}
+}
+
+func handleRedisMessage(r *bufio.Reader, w io.Writer, rh *reqHandler) error {
+	args, err := readRedisCommand(r)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	name := strings.ToUpper(string(args[0]))
+	cmd := redisCommands[name]
+	if cmd == nil {
+		return redisError(w, fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	if len(args) < cmd.minArgs || (cmd.maxArgs >= 0 && len(args) > cmd.maxArgs) {
+		return redisError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command",
+			strings.ToLower(name)))
+	}
+	return cmd.fun(w, rh, args)
+}
+
+// Reads either a RESP array of bulk strings or an inline command.
+func readRedisCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readRedisLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return bytesFields(line), nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 || n > REDIS_MAX_ARGS {
+		return nil, redisProtocolError
+	}
+	args := make([][]byte, 0, n)
+	for len(args) < n {
+		line, err = readRedisLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, redisProtocolError
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > REDIS_MAX_BULK_SIZE {
+			return nil, redisProtocolError
+		}
+		arg := make([]byte, size+2)
+		if _, err = io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, redisProtocolError
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+func readRedisLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, redisProtocolError
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+func bytesFields(line []byte) [][]byte {
+	fields := strings.Fields(string(line))
+	rv := make([][]byte, len(fields))
+	for i, f := range fields {
+		rv[i] = []byte(f)
+	}
+	return rv
+}
+
+func redisStatus(w io.Writer, s string) error {
+	_, err := io.WriteString(w, "+"+s+"\r\n")
+	return err
+}
+
+func redisError(w io.Writer, s string) error {
+	_, err := io.WriteString(w, "-"+s+"\r\n")
+	return err
+}
+
+func redisInt(w io.Writer, n int64) error {
+	_, err := fmt.Fprintf(w, ":%d\r\n", n)
+	return err
+}
+
+// A nil value is written as the RESP null bulk string.
+func redisBulk(w io.Writer, b []byte) error {
+	if b == nil {
+		_, err := io.WriteString(w, "$-1\r\n")
+		return err
+	}
+	_, err := fmt.Fprintf(w, "$%d\r\n", len(b))
+	if err == nil {
+		_, err = w.Write(b)
+	}
+	if err == nil {
+		_, err = io.WriteString(w, "\r\n")
+	}
+	return err
+}
+
+func redisArrayHeader(w io.Writer, n int) error {
+	_, err := fmt.Fprintf(w, "*%d\r\n", n)
+	return err
+}
+
+// Writes a RESP error for an unexpected response, returning io.EOF
+// when the connection should be dropped.
+func redisResError(w io.Writer, res *gomemcached.MCResponse) error {
+	if res == nil || res.Fatal {
+		return io.EOF
+	}
+	switch res.Status {
+	case gomemcached.E2BIG:
+		return redisError(w, "ERR value is too large")
+	case gomemcached.NOT_MY_VBUCKET:
+		return redisError(w, "ERR key is not served by this server")
+	}
+	if len(res.Body) > 0 {
+		return redisError(w, "ERR "+string(res.Body))
+	}
+	return redisError(w, "ERR "+res.Status.String())
+}
+
+func redisKeyOk(w io.Writer, key []byte) bool {
+	if len(key) > MAX_ITEM_KEY_LENGTH {
+		redisError(w, "ERR key is too long")
+		return false
+	}
+	return true
+}
+
+// Converts a relative expiration in seconds into a memcached exp.
+func redisExp(seconds int64) uint32 {
+	if seconds > 30*86400 {
+		return uint32(time.Now().Unix() + seconds)
+	}
+	return uint32(seconds)
+}
+
+func redisPing(w io.Writer, rh *reqHandler, args [][]byte) error {
+	if len(args) > 1 {
+		return redisBulk(w, args[1])
+	}
+	return redisStatus(w, "PONG")
+}
+
+func redisQuit(w io.Writer, rh *reqHandler, args [][]byte) error {
+	redisStatus(w, "OK")
+	return io.EOF
+}
+
+// Returns an empty reply, so clients that probe the server's commands
+// on connect continue on.
+func redisCommandCmd(w io.Writer, rh *reqHandler, args [][]byte) error {
+	return redisArrayHeader(w, 0)
+}
+
+// AUTH <password> authenticates against the current bucket, while
+// AUTH <bucket> <password> also selects the bucket, like SASL PLAIN.
+func redisAuth(w io.Writer, rh *reqHandler, args [][]byte) error {
+	bucketName, pswd := rh.currentBucketName, args[1]
+	if len(args) == 3 {
+		bucketName, pswd = string(args[1]), args[2]
+	}
+	b := rh.buckets.Get(bucketName)
+	if b == nil || !b.Auth(pswd) {
+		return redisError(w, "WRONGPASS invalid username-password pair")
+	}
+	rh.currentBucket = b
+	rh.currentBucketName = bucketName
+	return redisStatus(w, "OK")
+}
+
+// SELECT <bucket> switches to a bucket that has no password; other
+// buckets need AUTH <bucket> <password>.
+func redisSelect(w io.Writer, rh *reqHandler, args [][]byte) error {
+	bucketName := string(args[1])
+	b := rh.buckets.Get(bucketName)
+	if b == nil {
+		return redisError(w, "ERR no such bucket")
+	}
+	if !b.Auth([]byte{}) {
+		return redisError(w, "NOAUTH Authentication required.")
+	}
+	rh.currentBucket = b
+	rh.currentBucketName = bucketName
+	return redisStatus(w, "OK")
+}
+
+func redisGet(w io.Writer, rh *reqHandler, args [][]byte) error {
+	if !redisKeyOk(w, args[1]) {
+		return nil
+	}
+	res := rh.handleKeyMessage(&gomemcached.MCRequest{
+		Opcode: gomemcached.GET,
+		Key:    args[1],
+	})
+	if res != nil && res.Status == gomemcached.KEY_ENOENT {
+		return redisBulk(w, nil)
+	}
+	if res == nil || res.Status != gomemcached.SUCCESS {
+		return redisResError(w, res)
+	}
+	return redisBulk(w, res.Body)
+}
+
+// SET <key> <value> [EX seconds|PX milliseconds] [NX|XX]
+func redisSet(w io.Writer, rh *reqHandler, args [][]byte) error {
+	if !redisKeyOk(w, args[1]) {
+		return nil
+	}
+	opcode := gomemcached.SET
+	var exp uint32
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NX":
+			opcode = gomemcached.ADD
+		case "XX":
+			opcode = gomemcached.REPLACE
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				return redisError(w, "ERR syntax error")
+			}
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || n <= 0 {
+				return redisError(w, "ERR invalid expire time in 'set' command")
+			}
+			if strings.ToUpper(string(args[i])) == "PX" {
+				n = (n + 999) / 1000 // Rounded up to whole seconds.
+			}
+			exp = redisExp(n)
+			i++
+		default:
+			return redisError(w, "ERR syntax error")
+		}
+	}
+
+	req := &gomemcached.MCRequest{
+		Opcode: opcode,
+		Key:    args[1],
+		Extras: make([]byte, 8),
+		Body:   args[2],
+	}
+	binary.BigEndian.PutUint32(req.Extras[4:], exp)
+	res := rh.handleKeyMessage(req)
+	if res == nil || res.Fatal {
+		return io.EOF
+	}
+	switch res.Status {
+	case gomemcached.SUCCESS:
+		return redisStatus(w, "OK")
+	case gomemcached.KEY_EEXISTS, gomemcached.KEY_ENOENT:
+		return redisBulk(w, nil)
+	}
+	return redisResError(w, res)
+}
+
+func redisDel(w io.Writer, rh *reqHandler, args [][]byte) error {
+	n := int64(0)
+	for _, key := range args[1:] {
+		if !redisKeyOk(w, key) {
+			return nil
+		}
+		res := rh.handleKeyMessage(&gomemcached.MCRequest{
+			Opcode: gomemcached.DELETE,
+			Key:    key,
+		})
+		if res == nil || res.Fatal {
+			return io.EOF
+		}
+		switch res.Status {
+		case gomemcached.SUCCESS:
+			n++
+		case gomemcached.KEY_ENOENT:
+		default:
+			return redisResError(w, res)
+		}
+	}
+	return redisInt(w, n)
+}
+
+func redisExists(w io.Writer, rh *reqHandler, args [][]byte) error {
+	n := int64(0)
+	for _, key := range args[1:] {
+		if !redisKeyOk(w, key) {
+			return nil
+		}
+		res := rh.handleKeyMessage(&gomemcached.MCRequest{
+			Opcode: gomemcached.GET,
+			Key:    key,
+		})
+		if res == nil || res.Fatal {
+			return io.EOF
+		}
+		switch res.Status {
+		case gomemcached.SUCCESS:
+			n++
+		case gomemcached.KEY_ENOENT:
+		default:
+			return redisResError(w, res)
+		}
+	}
+	return redisInt(w, n)
+}
+
+// INCR, INCRBY, DECR and DECRBY, where a missing key starts at 0.
+// Values don't go below 0, as with memcached.
+func redisArith(w io.Writer, rh *reqHandler, args [][]byte) error {
+	if !redisKeyOk(w, args[1]) {
+		return nil
+	}
+	name := strings.ToUpper(string(args[0]))
+	decr := name == "DECR" || name == "DECRBY"
+	amount := uint64(1)
+	if len(args) == 3 {
+		n, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			return redisError(w, "ERR value is not an integer or out of range")
+		}
+		amount = uint64(n)
+		if n < 0 {
+			// A negative INCRBY is a DECRBY, and the other way around.
+			decr = !decr
+			amount = uint64(-n)
+		}
+	}
+
+	req := &gomemcached.MCRequest{
+		Opcode: gomemcached.INCREMENT,
+		Key:    args[1],
+		Extras: make([]byte, 8+8+4),
+	}
+	initial := amount
+	if decr {
+		req.Opcode = gomemcached.DECREMENT
+		initial = 0
+	}
+	binary.BigEndian.PutUint64(req.Extras, amount)
+	binary.BigEndian.PutUint64(req.Extras[8:], initial)
+	res := rh.handleKeyMessageKeepMeta(req)
+	if res != nil && res.Status == gomemcached.SUCCESS && len(res.Body) == 8 {
+		return redisInt(w, int64(binary.BigEndian.Uint64(res.Body)))
+	}
+	if res != nil && res.Status == gomemcached.EINVAL {
+		return redisError(w, "ERR value is not an integer or out of range")
+	}
+	return redisResError(w, res)
+}
+
+func redisAppend(w io.Writer, rh *reqHandler, args [][]byte) error {
+	if !redisKeyOk(w, args[1]) {
+		return nil
+	}
+	res := rh.handleKeyMessageKeepMeta(&gomemcached.MCRequest{
+		Opcode: gomemcached.APPEND,
+		Key:    args[1],
+		Body:   args[2],
+	})
+	if res == nil || res.Status != gomemcached.SUCCESS {
+		return redisResError(w, res)
+	}
+	// TODO: The length might include a concurrent mutation's value.
+	res = rh.handleKeyMessage(&gomemcached.MCRequest{
+		Opcode: gomemcached.GET,
+		Key:    args[1],
+	})
+	if res == nil || res.Status != gomemcached.SUCCESS {
+		return redisResError(w, res)
+	}
+	return redisInt(w, int64(len(res.Body)))
+}
+
+// EXPIRE <key> <seconds>, where a non-positive timeout deletes the key.
+func redisExpire(w io.Writer, rh *reqHandler, args [][]byte) error {
+	if !redisKeyOk(w, args[1]) {
+		return nil
+	}
+	seconds, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return redisError(w, "ERR value is not an integer or out of range")
+	}
+
+	req := &gomemcached.MCRequest{
+		Opcode: TOUCH,
+		Key:    args[1],
+		Extras: make([]byte, 4),
+	}
+	if seconds <= 0 {
+		req.Opcode, req.Extras = gomemcached.DELETE, nil
+	} else {
+		binary.BigEndian.PutUint32(req.Extras, redisExp(seconds))
+	}
+	res := rh.handleKeyMessage(req)
+	if res == nil || res.Fatal {
+		return io.EOF
+	}
+	switch res.Status {
+	case gomemcached.SUCCESS:
+		return redisInt(w, 1)
+	case gomemcached.KEY_ENOENT:
+		return redisInt(w, 0)
+	}
+	return redisResError(w, res)
+}
+
+// TTL <key> replies -2 for a missing key and -1 for a key that
+// doesn't expire.
+func redisTTL(w io.Writer, rh *reqHandler, args [][]byte) error {
+	if !redisKeyOk(w, args[1]) {
+		return nil
+	}
+	res := rh.handleKeyMessage(&gomemcached.MCRequest{
+		Opcode: GET_META,
+		Key:    args[1],
+	})
+	if res == nil || res.Fatal {
+		return io.EOF
+	}
+	if res.Status == gomemcached.KEY_ENOENT {
+		return redisInt(w, -2)
+	}
+	if res.Status != gomemcached.SUCCESS || len(res.Extras) != GET_META_EXTRAS_LEN {
+		return redisResError(w, res)
+	}
+	if binary.BigEndian.Uint32(res.Extras[0:4]) != 0 {
+		return redisInt(w, -2)
+	}
+	exp := int64(binary.BigEndian.Uint32(res.Extras[8:12]))
+	if exp == 0 {
+		return redisInt(w, -1)
+	}
+	ttl := exp - time.Now().Unix()
+	if ttl < 0 {
+		ttl = 0
+	}
+	return redisInt(w, ttl)
+}
+
+func redisMGet(w io.Writer, rh *reqHandler, args [][]byte) error {
+	vals := make([][]byte, 0, len(args)-1)
+	for _, key := range args[1:] {
+		if !redisKeyOk(w, key) {
+			return nil
+		}
+		res := rh.handleKeyMessage(&gomemcached.MCRequest{
+			Opcode: gomemcached.GET,
+			Key:    key,
+		})
+		if res == nil || res.Fatal {
+			return io.EOF
+		}
+		switch res.Status {
+		case gomemcached.SUCCESS:
+			vals = append(vals, res.Body)
+		case gomemcached.KEY_ENOENT:
+			vals = append(vals, nil)
+		default:
+			return redisResError(w, res)
+		}
+	}
+	err := redisArrayHeader(w, len(vals))
+	for _, val := range vals {
+		if err == nil {
+			err = redisBulk(w, val)
+		}
+	}
+	return err
+}
+
+// MSET <key> <value> [<key> <value> ...], which isn't atomic, unlike
+// with redis.
+func redisMSet(w io.Writer, rh *reqHandler, args [][]byte) error {
+	if len(args)%2 != 1 {
+		return redisError(w, "ERR wrong number of arguments for 'mset' command")
+	}
+	for i := 1; i < len(args); i += 2 {
+		if !redisKeyOk(w, args[i]) {
+			return nil
+		}
+		res := rh.handleKeyMessage(&gomemcached.MCRequest{
+			Opcode: gomemcached.SET,
+			Key:    args[i],
+			Body:   args[i+1],
+		})
+		if res == nil || res.Status != gomemcached.SUCCESS {
+			return redisResError(w, res)
+		}
+	}
+	return redisStatus(w, "OK")
+}
+
+// SCAN <cursor> [MATCH <pattern>] [COUNT <count>], where the cursor is
+// the next vbucket id to visit.  Each vbucket is visited whole, so the
+// reply may have more keys than the count.
+func redisScan(w io.Writer, rh *reqHandler, args [][]byte) error {
+	cursor, err := strconv.ParseUint(string(args[1]), 10, 16)
+	if err != nil {
+		return redisError(w, "ERR invalid cursor")
+	}
+	pattern := ""
+	count := REDIS_SCAN_COUNT
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return redisError(w, "ERR syntax error")
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = string(args[i+1])
+			if _, err = path.Match(pattern, ""); err != nil {
+				return redisError(w, "ERR invalid pattern")
+			}
+		case "COUNT":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count < 1 {
+				return redisError(w, "ERR syntax error")
+			}
+		default:
+			return redisError(w, "ERR syntax error")
+		}
+	}
+
+	b := rh.currentBucket
+	if b == nil {
+		return redisError(w, "NOAUTH Authentication required.")
+	}
+	numPartitions := b.GetBucketSettings().NumPartitions
+
+	keys := [][]byte{}
+	now := time.Now()
+	vbid := int(cursor)
+	for ; vbid < numPartitions && len(keys) < count; vbid++ {
+		vb, err := b.GetVBucket(uint16(vbid))
+		if err == bucketUnavailable {
+			return io.EOF
+		}
+		if vb == nil || vb.GetVBState() != VBActive {
+			continue
+		}
+		err = vb.ps.visitItems(nil, false, func(i *item) bool {
+			if i.isExpired(now) {
+				return true
+			}
+			if pattern != "" {
+				if ok, _ := path.Match(pattern, string(i.key)); !ok {
+					return true
+				}
+			}
+			keys = append(keys, i.key)
+			return true
+		})
+		if err != nil {
+			return redisError(w, fmt.Sprintf("ERR scan error %v", err))
+		}
+	}
+	if vbid >= numPartitions {
+		vbid = 0
+	}
+
+	err = redisArrayHeader(w, 2)
+	if err == nil {
+		err = redisBulk(w, []byte(strconv.Itoa(vbid)))
+	}
+	if err == nil {
+		err = redisArrayHeader(w, len(keys))
+	}
+	for _, key := range keys {
+		if err == nil {
+			err = redisBulk(w, key)
+		}
+	}
+	return err
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"strings"
 	"testing"
 	"time"
 	"unsafe"
 
 	"github.com/dustin/gomemcached"
+	"github.com/golang/snappy"
 )
 
 func TestSaslListMechs(t *testing.T) {
@@ -21,8 +27,16 @@ func TestSaslListMechs(t *testing.T) {
 	if res == nil {
 		t.Errorf("expected SASL_LIST_MECHS to be non-nil")
 	}
-	if !bytes.Equal(res.Body, []byte("PLAIN")) {
-		t.Errorf("expected SASL_LIST_MECHS to be PLAIN")
+	if !bytes.Equal(res.Body, []byte("SCRAM-SHA-256 PLAIN")) {
+		t.Errorf("expected SASL_LIST_MECHS to be SCRAM-SHA-256 PLAIN")
+	}
+	*passwordCramMD5 = true
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SASL_LIST_MECHS,
+	})
+	*passwordCramMD5 = false
+	if !bytes.Equal(res.Body, []byte("SCRAM-SHA-256 CRAM-MD5 PLAIN")) {
+		t.Errorf("expected SASL_LIST_MECHS to offer CRAM-MD5, got: %s", res.Body)
 	}
 	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
 		Opcode:  gomemcached.SASL_LIST_MECHS,
@@ -398,3 +412,358 @@ func TestSizeOfReqRes(t *testing.T) {
 	t.Logf("  Sizeof(MCRequest{}): %v", unsafe.Sizeof(gomemcached.MCRequest{}))
 	t.Logf("  Sizeof(MCResponse{}): %v", unsafe.Sizeof(gomemcached.MCResponse{}))
 }
+
+// Sends a binary request with the given datatype through the session
+// handling and returns the response's datatype, status, extras and body.
+func helloRoundTrip(t *testing.T, rh *reqHandler, req *gomemcached.MCRequest,
+	datatype uint8) (uint8, gomemcached.Status, []byte, []byte) {
+	pkt := req.Bytes()
+	pkt[5] = datatype
+	w := &bytes.Buffer{}
+	if err := handleMessage(w, bytes.NewReader(pkt), rh); err != nil {
+		t.Fatalf("Expected handleMessage to work for %v, got %v", req, err)
+	}
+	b := w.Bytes()
+	if len(b) < gomemcached.HDR_LEN {
+		t.Fatalf("Expected a response for %v, got %v", req, b)
+	}
+	elen := int(b[4])
+	klen := int(binary.BigEndian.Uint16(b[2:]))
+	body := b[gomemcached.HDR_LEN:]
+	return b[5], gomemcached.Status(binary.BigEndian.Uint16(b[6:])),
+		body[:elen], body[elen+klen:]
+}
+
+func TestHello(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: 1,
+		})
+	defer testBucket.Close()
+	testBucket.CreateVBucket(0)
+	testBucket.SetVBState(0, VBActive)
+	rh := &reqHandler{currentBucket: testBucket}
+
+	jsonVal := []byte(`{"a":"` + strings.Repeat("x", 100) + `"}`)
+	set := &gomemcached.MCRequest{
+		Opcode: gomemcached.SET,
+		Key:    []byte("j"),
+		Extras: make([]byte, 8),
+		Body:   jsonVal,
+	}
+	get := &gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte("j")}
+
+	// Without HELLO, no datatype or seqno is returned, and
+	// compressed bodies are refused.
+	_, status, extras, _ := helloRoundTrip(t, rh, set, 0)
+	if status != gomemcached.SUCCESS || len(extras) != 0 {
+		t.Errorf("Expected plain set, got %v, %v", status, extras)
+	}
+	datatype, status, _, body := helloRoundTrip(t, rh, get, 0)
+	if datatype != 0 || status != gomemcached.SUCCESS ||
+		!bytes.Equal(body, jsonVal) {
+		t.Errorf("Expected plain get, got %v, %v, %s", datatype, status, body)
+	}
+	compressedSet := &gomemcached.MCRequest{
+		Opcode: gomemcached.SET,
+		Key:    []byte("s"),
+		Extras: make([]byte, 8),
+		Body:   snappy.Encode(nil, []byte("hello hello hello")),
+	}
+	_, status, _, _ = helloRoundTrip(t, rh, compressedSet, DATATYPE_SNAPPY)
+	if status != gomemcached.EINVAL {
+		t.Errorf("Expected un-negotiated snappy to fail, got %v", status)
+	}
+
+	hello := &gomemcached.MCRequest{
+		Opcode: HELLO,
+		Key:    []byte("test-agent"),
+		Body:   []byte{0, 0x0b, 0, 0x0a, 0, 0x04, 0xff, 0xff, 0, 0x0b},
+	}
+	_, status, _, body = helloRoundTrip(t, rh, hello, 0)
+	if status != gomemcached.SUCCESS ||
+		!bytes.Equal(body, []byte{0, 0x0b, 0, 0x0a, 0, 0x04}) {
+		t.Errorf("Expected supported features, got %v, %v", status, body)
+	}
+	hello.Body = []byte{0}
+	_, status, _, _ = helloRoundTrip(t, rh, hello, 0)
+	if status != gomemcached.EINVAL {
+		t.Errorf("Expected odd HELLO body to fail, got %v", status)
+	}
+	hello.Body = []byte{0, 0x0b, 0, 0x0a, 0, 0x04}
+	helloRoundTrip(t, rh, hello, 0)
+
+	_, status, extras, _ = helloRoundTrip(t, rh, set, 0)
+	vb, _ := testBucket.GetVBucket(0)
+	if status != gomemcached.SUCCESS || len(extras) != 16 ||
+		binary.BigEndian.Uint64(extras) != vb.Meta().FailoverLog[0].UUID ||
+		binary.BigEndian.Uint64(extras[8:]) != 2 {
+		t.Errorf("Expected set to return the vbucket uuid and seqno,"+
+			" got %v, %v", status, extras)
+	}
+	datatype, status, _, body = helloRoundTrip(t, rh, get, 0)
+	if datatype != DATATYPE_JSON|DATATYPE_SNAPPY || status != gomemcached.SUCCESS {
+		t.Errorf("Expected compressed json, got %v, %v", datatype, status)
+	}
+	if b, err := snappy.Decode(nil, body); err != nil || !bytes.Equal(b, jsonVal) {
+		t.Errorf("Expected compressed body to decode, got %s, %v", b, err)
+	}
+
+	_, status, _, _ = helloRoundTrip(t, rh, compressedSet, DATATYPE_SNAPPY)
+	if status != gomemcached.SUCCESS {
+		t.Errorf("Expected negotiated snappy to work, got %v", status)
+	}
+	res := GetItem(testBucket, []byte("s"), VBActive)
+	if res == nil || string(res.Body) != "hello hello hello" {
+		t.Errorf("Expected snappy set to store uncompressed, got %v", res)
+	}
+	datatype, _, _, body = helloRoundTrip(t, rh,
+		&gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte("s")}, 0)
+	if datatype != 0 || string(body) != "hello hello hello" {
+		t.Errorf("Expected small non-json value as-is, got %v, %s", datatype, body)
+	}
+	_, status, _, _ = helloRoundTrip(t, rh, compressedSet, 0x80)
+	if status != gomemcached.EINVAL {
+		t.Errorf("Expected unknown datatype to fail, got %v", status)
+	}
+}
+
+func TestAsciiProtocol(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: 1,
+		})
+	defer testBucket.Close()
+	testBucket.CreateVBucket(0)
+	testBucket.SetVBState(0, VBActive)
+	rh := &reqHandler{currentBucket: testBucket}
+
+	tests := []struct {
+		in, out string
+	}{
+		{"get a\r\n", "END\r\n"},
+		{"set a 5 0 3\r\naye\r\n", "STORED\r\n"},
+		{"get a b\r\n", "VALUE a 5 3\r\naye\r\nEND\r\n"},
+		{"add a 0 0 1\r\nx\r\n", "NOT_STORED\r\n"},
+		{"replace b 0 0 1\r\nx\r\n", "NOT_STORED\r\n"},
+		{"append a 0 0 1\r\nx\r\n", "STORED\r\n"},
+		{"prepend a 0 0 1\r\ny\r\n", "STORED\r\n"},
+		{"get a\r\n", "VALUE a 5 5\r\nyayex\r\nEND\r\n"},
+		{"append b 0 0 1\r\nx\r\n", "NOT_STORED\r\n"},
+		{"prepend b 0 0 1 noreply\r\nx\r\n", ""},
+		{"get b\r\n", "END\r\n"},
+		{"set n 3 1000 1\r\n1\r\n", "STORED\r\n"},
+		{"incr n 1\r\n", "2\r\n"},
+		{"get n\r\n", "VALUE n 3 1\r\n2\r\nEND\r\n"},
+		{"set a 0 0 1 noreply\r\n1\r\n", ""},
+		{"incr a 10\r\n", "11\r\n"},
+		{"decr a 20\r\n", "0\r\n"},
+		{"incr b 1\r\n", "NOT_FOUND\r\n"},
+		{"cas a 0 0 1 1\r\nz\r\n", "EXISTS\r\n"},
+		{"cas b 0 0 1 1\r\nz\r\n", "NOT_FOUND\r\n"},
+		{"touch a 100\r\n", "TOUCHED\r\n"},
+		{"touch b 100\r\n", "NOT_FOUND\r\n"},
+		{"delete a\r\n", "DELETED\r\n"},
+		{"delete a\r\n", "NOT_FOUND\r\n"},
+		{"set a 0 0 1\r\ntoolong\r\n", "CLIENT_ERROR bad data chunk\r\n"},
+		{"set a 0\r\n", "CLIENT_ERROR bad command line format\r\n"},
+		{"bogus\r\n", "ERROR\r\n"},
+		{"version\r\n", "VERSION " + VERSION + "\r\n"},
+	}
+
+	for _, test := range tests {
+		w := &bytes.Buffer{}
+		r := bufio.NewReader(strings.NewReader(test.in))
+		if err := handleAsciiMessage(r, w, rh); err != nil {
+			t.Errorf("Expected %q to work, got %v", test.in, err)
+		}
+		if w.String() != test.out {
+			t.Errorf("Expected %q for %q, got %q", test.out, test.in, w.String())
+		}
+	}
+
+	vb, _ := testBucket.GetVBucket(0)
+	if i, _ := vb.getUnexpired([]byte("n"), time.Now()); i == nil || i.exp == 0 {
+		t.Errorf("Expected incr to keep the exp, got %#v", i)
+	}
+
+	w := &bytes.Buffer{}
+	r := bufio.NewReader(strings.NewReader("set a 0 0 1\r\nx\r\ngets a\r\n"))
+	handleAsciiMessage(r, w, rh)
+	w.Reset()
+	handleAsciiMessage(r, w, rh)
+	res := GetItem(testBucket, []byte("a"), VBActive)
+	if w.String() != fmt.Sprintf("VALUE a 0 1 %d\r\nx\r\nEND\r\n", res.Cas) {
+		t.Errorf("Expected gets to report the cas, got %q", w.String())
+	}
+
+	w.Reset()
+	big := strings.Repeat("x", MAX_ITEM_DATA_LENGTH+1)
+	r = bufio.NewReader(strings.NewReader(fmt.Sprintf(
+		"set big 0 0 %d\r\n%s\r\nget big\r\n", len(big), big)))
+	handleAsciiMessage(r, w, rh)
+	handleAsciiMessage(r, w, rh)
+	if w.String() != "SERVER_ERROR object too large for cache\r\nEND\r\n" {
+		t.Errorf("Expected a too large item to be skipped, got %q", w.String())
+	}
+
+	w.Reset()
+	r = bufio.NewReader(strings.NewReader(
+		"get " + strings.Repeat("k", ASCII_MAX_LINE_LEN) + "\r\n"))
+	if err := handleAsciiMessage(r, w, rh); err != asciiLineTooLong ||
+		w.String() != "CLIENT_ERROR line too long\r\n" {
+		t.Errorf("Expected a too long line to fail, got %q, %v", w.String(), err)
+	}
+
+	w.Reset()
+	r = bufio.NewReader(strings.NewReader("stats\r\n"))
+	if err := handleAsciiMessage(r, w, rh); err != nil ||
+		!strings.HasPrefix(w.String(), "STAT uptime ") ||
+		!strings.HasSuffix(w.String(), "END\r\n") {
+		t.Errorf("Expected stats, got %q, %v", w.String(), err)
+	}
+
+	r = bufio.NewReader(strings.NewReader("quit\r\n"))
+	if err := handleAsciiMessage(r, w, rh); err != io.EOF {
+		t.Errorf("Expected quit to end the session, got %v", err)
+	}
+}
+
+func TestRedisProtocol(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	bs, _ := NewBuckets(testBucketDir,
+		&BucketSettings{
+			NumPartitions: 2,
+		})
+	defer bs.CloseAll()
+	for _, name := range []string{"default", "secret"} {
+		settings := &BucketSettings{NumPartitions: 2}
+		if name == "secret" {
+			settings.PasswordHash = "pswd"
+		}
+		b, err := bs.New(name, settings)
+		if err != nil {
+			t.Fatalf("Expected bucket creation to work, got %v", err)
+		}
+		for vbid := uint16(0); vbid < 2; vbid++ {
+			b.CreateVBucket(vbid)
+			b.SetVBState(vbid, VBActive)
+		}
+	}
+	rh := &reqHandler{
+		buckets:           bs,
+		currentBucket:     bs.Get("default"),
+		currentBucketName: "default",
+	}
+
+	// The alt output covers a second boundary passing during a TTL.
+	tests := []struct {
+		in, out, alt string
+	}{
+		{"PING\r\n", "+PONG\r\n", ""},
+		{"*2\r\n$3\r\nGET\r\n$1\r\na\r\n", "$-1\r\n", ""},
+		{"*3\r\n$3\r\nSET\r\n$1\r\na\r\n$3\r\naye\r\n", "+OK\r\n", ""},
+		{"GET a\r\n", "$3\r\naye\r\n", ""},
+		{"SET a bee NX\r\n", "$-1\r\n", ""},
+		{"SET b bee XX\r\n", "$-1\r\n", ""},
+		{"SET b bee NX EX 100\r\n", "+OK\r\n", ""},
+		{"SET b bee PX\r\n", "-ERR syntax error\r\n", ""},
+		{"TTL a\r\n", ":-1\r\n", ""},
+		{"TTL b\r\n", ":100\r\n", ":99\r\n"},
+		{"TTL c\r\n", ":-2\r\n", ""},
+		{"EXPIRE a 50\r\n", ":1\r\n", ""},
+		{"TTL a\r\n", ":50\r\n", ":49\r\n"},
+		{"EXPIRE c 50\r\n", ":0\r\n", ""},
+		{"APPEND a x\r\n", ":4\r\n", ""},
+		{"TTL a\r\n", ":50\r\n", ":49\r\n"},
+		{"EXISTS a b c\r\n", ":2\r\n", ""},
+		{"MGET a c b\r\n", "*3\r\n$4\r\nayex\r\n$-1\r\n$3\r\nbee\r\n", ""},
+		{"MSET n 1 m 2\r\n", "+OK\r\n", ""},
+		{"MSET n\r\n", "-ERR wrong number of arguments for 'mset' command\r\n", ""},
+		{"INCR n\r\n", ":2\r\n", ""},
+		{"INCRBY n 10\r\n", ":12\r\n", ""},
+		{"DECRBY n 5\r\n", ":7\r\n", ""},
+		{"INCRBY n -3\r\n", ":4\r\n", ""},
+		{"DECRBY n -5\r\n", ":9\r\n", ""},
+		{"DECRBY n 2\r\n", ":7\r\n", ""},
+		{"EXPIRE n 50\r\n", ":1\r\n", ""},
+		{"INCR n\r\n", ":8\r\n", ""},
+		{"DECR n\r\n", ":7\r\n", ""},
+		{"TTL n\r\n", ":50\r\n", ":49\r\n"},
+		{"DECR x\r\n", ":0\r\n", ""},
+		{"INCR a\r\n", "-ERR value is not an integer or out of range\r\n", ""},
+		{"DEL a b c\r\n", ":2\r\n", ""},
+		{"GET a\r\n", "$-1\r\n", ""},
+		{"GET\r\n", "-ERR wrong number of arguments for 'get' command\r\n", ""},
+		{"BOGUS\r\n", "-ERR unknown command 'BOGUS'\r\n", ""},
+		{"SELECT nope\r\n", "-ERR no such bucket\r\n", ""},
+		{"SELECT secret\r\n", "-NOAUTH Authentication required.\r\n", ""},
+		{"AUTH secret wrong\r\n", "-WRONGPASS invalid username-password pair\r\n", ""},
+		{"AUTH secret pswd\r\n", "+OK\r\n", ""},
+		{"GET n\r\n", "$-1\r\n", ""},
+		{"SELECT default\r\n", "+OK\r\n", ""},
+		{"GET n\r\n", "$1\r\n7\r\n", ""},
+	}
+
+	for _, test := range tests {
+		w := &bytes.Buffer{}
+		r := bufio.NewReader(strings.NewReader(test.in))
+		if err := handleRedisMessage(r, w, rh); err != nil {
+			t.Errorf("Expected %q to work, got %v", test.in, err)
+		}
+		if w.String() != test.out && w.String() != test.alt {
+			t.Errorf("Expected %q for %q, got %q", test.out, test.in, w.String())
+		}
+	}
+
+	// Scanning through the cursors visits all the keys.
+	keys := map[string]bool{}
+	cursor := "0"
+	for i := 0; i < 10; i++ {
+		w := &bytes.Buffer{}
+		r := bufio.NewReader(strings.NewReader("SCAN " + cursor + " COUNT 1\r\n"))
+		if err := handleRedisMessage(r, w, rh); err != nil {
+			t.Fatalf("Expected scan to work, got %v", err)
+		}
+		lines := strings.Split(w.String(), "\r\n")
+		if len(lines) < 4 || lines[0] != "*2" {
+			t.Fatalf("Expected scan reply, got %q", w.String())
+		}
+		cursor = lines[2]
+		for j := 5; j < len(lines); j += 2 {
+			keys[lines[j]] = true
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if cursor != "0" || len(keys) != 3 || !keys["n"] || !keys["m"] || !keys["x"] {
+		t.Errorf("Expected scan to find n, m and x, got %v, %v", cursor, keys)
+	}
+
+	w := &bytes.Buffer{}
+	r := bufio.NewReader(strings.NewReader("SCAN 0 MATCH [mn]\r\n"))
+	handleRedisMessage(r, w, rh)
+	if !strings.HasPrefix(w.String(), "*2\r\n$1\r\n0\r\n*2\r\n") {
+		t.Errorf("Expected scan match of 2 keys, got %q", w.String())
+	}
+
+	r = bufio.NewReader(strings.NewReader("*1\r\n$4\r\nPING\r\n*x\r\n"))
+	if err := handleRedisMessage(r, w, rh); err != nil {
+		t.Errorf("Expected ping to work, got %v", err)
+	}
+	if err := handleRedisMessage(r, w, rh); err != redisProtocolError {
+		t.Errorf("Expected protocol error, got %v", err)
+	}
+	for _, msg := range []string{"*-1\r\n", "*1\r\n$-1\r\n"} {
+		r = bufio.NewReader(strings.NewReader(msg))
+		if err := handleRedisMessage(r, w, rh); err != redisProtocolError {
+			t.Errorf("Expected protocol error for %q, got %v", msg, err)
+		}
+	}
+}
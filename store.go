@@ -18,11 +18,16 @@ var persistPeriodic *periodically
 
 type bucketstore struct {
 	dirtiness     int64          // To track when we need flush to storage.
+	dirtied       int64          // Count of all dirty() calls, to order flushes.
+	synced        int64          // The dirtied count covered by the last fsync.
+	evictedBytes  int64          // The item bytes of its partitions that are only on disk.
 	bsf           unsafe.Pointer // *bucketstorefile
 	bsfMemoryOnly *bucketstorefile
 	endch         chan bool
 	partitions    map[uint16]*partitionstore
 	stats         *BucketStoreStats
+	durability    string
+	eviction      string
 
 	keyCompareForCollection func(collName string) gkvlite.KeyCompare
 
@@ -68,6 +73,8 @@ func newBucketStore(path string, settings BucketSettings,
 		endch:         make(chan bool),
 		partitions:    make(map[uint16]*partitionstore),
 		stats:         bsf.stats,
+		durability:    settings.durability(),
+		eviction:      settings.evictionPolicy(),
 		keyCompareForCollection: keyCompareForCollection,
 	}, nil
 }
@@ -114,17 +121,53 @@ func (s *bucketstore) Stats() *BucketStoreStats {
 func (s *bucketstore) Flush() (int64, error) {
 	s.diskLock.Lock()
 	defer s.diskLock.Unlock()
-	return s.flush_unlocked()
+	return s.flush_unlocked(s.fsyncs())
 }
 
-func (s *bucketstore) flush_unlocked() (int64, error) {
+// Returns whether item changes reach the disk, as opposed to staying
+// in memory until the bucket goes away.
+func (s *bucketstore) persists() bool {
+	return s.BSF().file != nil && s.bsfMemoryOnly == nil
+}
+
+// Returns whether every flush is fsync'ed.
+func (s *bucketstore) fsyncs() bool {
+	return s.durability == DURABILITY_FSYNC || s.durability == DURABILITY_SYNC
+}
+
+func (s *bucketstore) flush_unlocked(fsync bool) (int64, error) {
 	d := atomic.LoadInt64(&s.dirtiness)
+	dirtied := atomic.LoadInt64(&s.dirtied)
 	bsf := s.BSF()
 	if bsf.file != nil {
+		// Snapshot the flush watermarks before flushing, as changes
+		// that arrive during the flush might not make it to disk.
+		var watermarks map[*partitionstore]uint64
+		if s.bsfMemoryOnly == nil {
+			watermarks = make(map[*partitionstore]uint64, len(s.partitions))
+			for _, p := range s.partitions {
+				cas, err := p.maxCas()
+				if err != nil {
+					atomic.AddInt64(&s.stats.FlushErrors, 1)
+					return atomic.LoadInt64(&s.dirtiness), err
+				}
+				watermarks[p] = cas
+			}
+		}
 		if err := bsf.store.Flush(); err != nil {
 			atomic.AddInt64(&s.stats.FlushErrors, 1)
 			return atomic.LoadInt64(&s.dirtiness), err
 		}
+		if fsync {
+			if err := bsf.Sync(); err != nil {
+				atomic.AddInt64(&s.stats.FlushErrors, 1)
+				return atomic.LoadInt64(&s.dirtiness), err
+			}
+			atomic.StoreInt64(&s.synced, dirtied)
+		}
+		for p, cas := range watermarks {
+			atomic.StoreUint64(&p.persistedCas, cas)
+		}
 	} // else, we're in memory-only mode.
 	atomic.AddInt64(&s.stats.Flushes, 1)
 	return atomic.AddInt64(&s.dirtiness, -d), nil
@@ -150,10 +193,27 @@ func (s *bucketstore) mkPersistFun() func(time.Time) bool {
 	}
 }
 
+// Waits until a flush and fsync covers the changes up to a dirtied
+// count, flushing if needed.  Concurrent waiters queue on the diskLock,
+// so one flush commits the changes of many waiters.
+func (s *bucketstore) waitPersisted(dirtied int64) error {
+	if !s.persists() {
+		return fmt.Errorf("bucketstore does not persist items")
+	}
+	s.diskLock.Lock()
+	defer s.diskLock.Unlock()
+	if atomic.LoadInt64(&s.synced) >= dirtied {
+		return nil
+	}
+	_, err := s.flush_unlocked(true)
+	return err
+}
+
 func (s *bucketstore) dirty(force bool) {
 	if force || s.bsfMemoryOnly == nil {
+		atomic.AddInt64(&s.dirtied, 1)
 		newval := atomic.AddInt64(&s.dirtiness, 1)
-		if newval == 1 {
+		if newval == 1 && s.durability != DURABILITY_NONE {
 			// TODO: Might want to kick off a persistence right now
 			// rather than only schedule a periodic persistence.
 			persistPeriodic.Register(s.endch, s.mkPersistFun())
@@ -205,9 +265,21 @@ func (s *bucketstore) getPartitionStore(vbid uint16) (res *partitionstore) {
 	}
 	res.keys = unsafe.Pointer(k)
 	res.changes = unsafe.Pointer(c)
+	res.deletions = map[string]uint64{} // Until a load.
 	return res
 }
 
+// Replaces a partition's keys and changes collections with new, empty
+// collections.  Should only be called while holding the diskLock.
+func (s *bucketstore) resetPartitionColls_unlocked(vbid uint16) (
+	keys, changes *gkvlite.Collection) {
+	kName := fmt.Sprintf("%v%s", vbid, COLL_SUFFIX_KEYS)
+	cName := fmt.Sprintf("%v%s", vbid, COLL_SUFFIX_CHANGES)
+	s.BSFData().store.RemoveCollection(kName)
+	s.BSFData().store.RemoveCollection(cName)
+	return s.coll(kName), s.coll(cName)
+}
+
 func mkBucketStoreCallbacks(keyCompareForCollection func(string) gkvlite.KeyCompare) gkvlite.StoreCallbacks {
 	return gkvlite.StoreCallbacks{
 		ItemValLength:           itemValLength,
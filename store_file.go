@@ -95,6 +95,22 @@ func (bsf *bucketstorefile) Truncate(size int64) (err error) {
 	return err
 }
 
+func (bsf *bucketstorefile) Sync() (err error) {
+	bsf.apply(func() {
+		if bsf.purge {
+			err = fmt.Errorf("Sync to purgable bucketstorefile: %v",
+				bsf.path)
+			return
+		}
+		atomic.AddInt64(&bsf.stats.Syncs, 1)
+		err = bsf.file.Sync()
+		if err != nil {
+			atomic.AddInt64(&bsf.stats.SyncErrors, 1)
+		}
+	})
+	return err
+}
+
 // Remove previous version files.
 func (bsf *bucketstorefile) removeOldFiles() error {
 	fname := filepath.Base(bsf.path)
@@ -176,6 +192,33 @@ func latestStoreFileName(dirForBucket string, prefix string, suffix string) (
 	return latestName, nil
 }
 
+// Returns the number of store files in a bucket directory, where the
+// prefixes of the store files are 0 to N-1, or 0 for a new bucket.
+func numStoreFiles(dirForBucket string, suffix string) (int, error) {
+	fileInfos, err := ioutil.ReadDir(dirForBucket)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() {
+			continue
+		}
+		prefix, _, err := parseStoreFileName(fileInfo.Name(), suffix)
+		if err != nil {
+			continue
+		}
+		i, err := strconv.Atoi(prefix)
+		if err != nil || i < 0 {
+			continue
+		}
+		if n < i+1 {
+			n = i + 1
+		}
+	}
+	return n, nil
+}
+
 // The store files follow a "PREFIX-VER.SUFFIX" naming pattern,
 // such as "0-0.store".
 func makeStoreFileName(prefix string, ver int, suffix string) string {
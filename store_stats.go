@@ -11,6 +11,7 @@ type BucketStoreStats struct {
 	Reads         int64 `json:"reads"`
 	Writes        int64 `json:"writes"`
 	Stats         int64 `json:"stats"`
+	Syncs         int64 `json:"syncs"`
 	Compacts      int64 `json:"compacts"`
 	LastCompactAt int64 `json:"lastCompactAt"`
 
@@ -18,6 +19,7 @@ type BucketStoreStats struct {
 	ReadErrors    int64 `json:"readErrors"`
 	WriteErrors   int64 `json:"writeErrors"`
 	StatErrors    int64 `json:"statErrors"`
+	SyncErrors    int64 `json:"syncErrors"`
 	CompactErrors int64 `json:"compactErrors"`
 
 	ReadBytes  int64 `json:"readBytes"`
@@ -40,11 +42,13 @@ func (bss *BucketStoreStats) Op(in *BucketStoreStats, op func(int64, int64) int6
 	bss.Reads = op(bss.Reads, atomic.LoadInt64(&in.Reads))
 	bss.Writes = op(bss.Writes, atomic.LoadInt64(&in.Writes))
 	bss.Stats = op(bss.Stats, atomic.LoadInt64(&in.Stats))
+	bss.Syncs = op(bss.Syncs, atomic.LoadInt64(&in.Syncs))
 	bss.Compacts = op(bss.Compacts, atomic.LoadInt64(&in.Compacts))
 	bss.FlushErrors = op(bss.FlushErrors, atomic.LoadInt64(&in.FlushErrors))
 	bss.ReadErrors = op(bss.ReadErrors, atomic.LoadInt64(&in.ReadErrors))
 	bss.WriteErrors = op(bss.WriteErrors, atomic.LoadInt64(&in.WriteErrors))
 	bss.StatErrors = op(bss.StatErrors, atomic.LoadInt64(&in.StatErrors))
+	bss.SyncErrors = op(bss.SyncErrors, atomic.LoadInt64(&in.SyncErrors))
 	bss.CompactErrors = op(bss.CompactErrors, atomic.LoadInt64(&in.CompactErrors))
 	bss.ReadBytes = op(bss.ReadBytes, atomic.LoadInt64(&in.ReadBytes))
 	bss.WriteBytes = op(bss.WriteBytes, atomic.LoadInt64(&in.WriteBytes))
@@ -64,11 +68,13 @@ func (bss *BucketStoreStats) Equal(in *BucketStoreStats) bool {
 		bss.Reads == atomic.LoadInt64(&in.Reads) &&
 		bss.Writes == atomic.LoadInt64(&in.Writes) &&
 		bss.Stats == atomic.LoadInt64(&in.Stats) &&
+		bss.Syncs == atomic.LoadInt64(&in.Syncs) &&
 		bss.Compacts == atomic.LoadInt64(&in.Compacts) &&
 		bss.FlushErrors == atomic.LoadInt64(&in.FlushErrors) &&
 		bss.ReadErrors == atomic.LoadInt64(&in.ReadErrors) &&
 		bss.WriteErrors == atomic.LoadInt64(&in.WriteErrors) &&
 		bss.StatErrors == atomic.LoadInt64(&in.StatErrors) &&
+		bss.SyncErrors == atomic.LoadInt64(&in.SyncErrors) &&
 		bss.CompactErrors == atomic.LoadInt64(&in.CompactErrors) &&
 		bss.ReadBytes == atomic.LoadInt64(&in.ReadBytes) &&
 		bss.WriteBytes == atomic.LoadInt64(&in.WriteBytes) &&
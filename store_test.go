@@ -2,14 +2,19 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/dustin/gomemcached"
+	"github.com/steveyen/gkvlite"
 )
 
 type brokenFile struct {
@@ -36,6 +41,10 @@ func (b brokenFile) Truncate(size int64) error {
 	return b.error
 }
 
+func (b brokenFile) Sync() error {
+	return b.error
+}
+
 func testLoadInts(t *testing.T, rh *reqHandler, vbid int, numItems int) {
 	for i := 0; i < numItems; i++ {
 		req := &gomemcached.MCRequest{
@@ -561,6 +570,270 @@ func TestStoreFiles(t *testing.T) {
 	}
 }
 
+func TestSaveLoadNumStores(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: 4,
+			NumStores:     3,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	r0 := &reqHandler{currentBucket: b0}
+	for vbid := 0; vbid < 4; vbid++ {
+		b0.CreateVBucket(uint16(vbid))
+		b0.SetVBState(uint16(vbid), VBActive)
+		testLoadInts(t, r0, vbid, vbid+1)
+	}
+	vb3, _ := b0.GetVBucket(3)
+	if vb3.bs != b0.GetBucketStore(0) || b0.GetBucketStore(3) != nil {
+		t.Errorf("expected vbuckets assigned to stores by modulo")
+	}
+	if err = b0.Flush(); err != nil {
+		t.Errorf("expected Flush to work, got: %v", err)
+	}
+	if err = b0.Compact(); err != nil {
+		t.Errorf("expected Compact to work, got: %v", err)
+	}
+	if agg := AggregateBucketStoreStats(b0, ""); agg.Compacts != 3 {
+		t.Errorf("expected stats of 3 stores, got: %#v", agg)
+	}
+	b0.Close()
+	for i := 0; i < 3; i++ {
+		removeOldFiles(testBucketDir, makeStoreFileName(strconv.Itoa(i), 1,
+			STORE_FILE_SUFFIX), STORE_FILE_SUFFIX)
+	}
+	files, _ := filepath.Glob(filepath.Join(testBucketDir, "*.store"))
+	if len(files) != 3 {
+		t.Errorf("expected 3 store files, got: %v", files)
+	}
+
+	// The bucket keeps its number of store files when it's reloaded
+	// with a different setting.
+	settings := &BucketSettings{NumPartitions: 4, NumStores: 1}
+	b1, err := NewBucket("test", testBucketDir, settings)
+	if err != nil {
+		t.Fatalf("expected NewBucket re-open to work, err: %v", err)
+	}
+	defer b1.Close()
+	if err = b1.Load(); err != nil {
+		t.Errorf("expected Load to work, err: %v", err)
+	}
+	if settings.NumStores != 3 || b1.GetBucketStore(2) == nil {
+		t.Errorf("expected 3 stores, got: %v", settings.NumStores)
+	}
+	r1 := &reqHandler{currentBucket: b1}
+	for vbid := 0; vbid < 4; vbid++ {
+		expected := []int{}
+		for i := 0; i <= vbid; i++ {
+			expected = append(expected, i)
+		}
+		testExpectInts(t, r1, vbid, expected, "reload")
+	}
+}
+
+func TestLoadRepairKeys(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	settings := &BucketSettings{NumPartitions: 1}
+	b0, err := NewBucket("test", testBucketDir, settings)
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	vb, _ := b0.CreateVBucket(0)
+	b0.SetVBState(0, VBActive)
+	SetItem(b0, []byte("a"), []byte("a"), VBActive)
+	SetItem(b0, []byte("b"), []byte("b"), VBActive)
+	SetItem(b0, []byte("c"), []byte("c"), VBActive)
+	bOld, _ := vb.ps.get([]byte("b"))
+	cOld, _ := vb.ps.get([]byte("c"))
+	SetItem(b0, []byte("b"), []byte("bb"), VBActive)
+	SetItem(b0, []byte("d"), []byte("d"), VBActive)
+	tapTestMutate(vb, gomemcached.DELETE, "c", "")
+	bNew, _ := vb.ps.get([]byte("b"))
+	if bOld == nil || cOld == nil || bNew == nil || bNew.cas <= bOld.cas {
+		t.Fatalf("expected items, got: %v, %v, %v", bOld, cOld, bNew)
+	}
+
+	// Mimic flushes that missed the keys updates of the later changes.
+	vb.ps.mutate(func(keys, changes *gkvlite.Collection) {
+		keys.Delete([]byte("d"))
+		for _, ki := range []struct {
+			key string
+			cas uint64
+		}{{"b", bOld.cas}, {"c", cOld.cas}, {"zombie", bOld.cas}} {
+			keys.SetItem(&gkvlite.Item{
+				Key: []byte(ki.key), Val: casBytes(ki.cas), Priority: 1})
+		}
+	})
+	b0.Flush()
+	b0.Close()
+
+	for _, expectRepairs := range []int64{4, 0} {
+		b1, err := NewBucket("test", testBucketDir, settings)
+		if err != nil {
+			t.Fatalf("expected NewBucket re-open to work, err: %v", err)
+		}
+		if err = b1.Load(); err != nil {
+			t.Errorf("expected Load to work, err: %v", err)
+		}
+		stats := AggregateBucketStats(b1, "")
+		if stats.LoadRepairs != expectRepairs || stats.Items != 3 {
+			t.Errorf("expected %v repairs and 3 items, got: %v, %v",
+				expectRepairs, stats.LoadRepairs, stats.Items)
+		}
+		if expectRepairs > 0 && (len(b1.Logs()) != 1 ||
+			!strings.Contains(b1.Logs()[0], "fixed: 3, dropped: 1")) {
+			t.Errorf("expected a repair log, got: %v", b1.Logs())
+		}
+		for _, kv := range [][]string{{"a", "a"}, {"b", "bb"}, {"c", ""},
+			{"d", "d"}, {"zombie", ""}} {
+			res := GetItem(b1, []byte(kv[0]), VBActive)
+			if kv[1] == "" && res.Status != gomemcached.KEY_ENOENT {
+				t.Errorf("expected no %v, got: %v", kv[0], res)
+			}
+			if kv[1] != "" && string(res.Body) != kv[1] {
+				t.Errorf("expected %v, got: %v", kv, res)
+			}
+		}
+		b1.Flush()
+		b1.Close()
+	}
+}
+
+func testDurableSet(rh *reqHandler, opcode gomemcached.CommandCode,
+	key string, flags uint32) *gomemcached.MCResponse {
+	extras := make([]byte, 8+DURABLE_EXTRAS_LEN)
+	binary.BigEndian.PutUint32(extras[8:], flags)
+	return rh.HandleMessage(nil, nil, &gomemcached.MCRequest{
+		Opcode: opcode,
+		Key:    []byte(key),
+		Body:   []byte(key),
+		Extras: extras,
+	})
+}
+
+func TestDurableMutations(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: 1,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+	r0 := &reqHandler{currentBucket: b0}
+	v0, _ := b0.CreateVBucket(0)
+	b0.SetVBState(0, VBActive)
+
+	res := testDurableSet(r0, gomemcached.SET, "a", 0)
+	casA := res.Cas
+	if res.Status != gomemcached.SUCCESS || v0.ps.persisted(casA) {
+		t.Errorf("expected a non-durable set to not wait, got: %v", res)
+	}
+	// The flush of a durable set covers the earlier changes, too.
+	res = testDurableSet(r0, gomemcached.SET, "b", DURABLE_PERSIST)
+	if res.Status != gomemcached.SUCCESS || !v0.ps.persisted(res.Cas) ||
+		!v0.ps.persisted(casA) {
+		t.Errorf("expected a durable set to be persisted, got: %v", res)
+	}
+	if v0.bs.Stats().Syncs != 1 || v0.stats.DurableWaits != 1 {
+		t.Errorf("expected a fsync, got: %#v, %v", v0.bs.Stats(),
+			v0.stats.DurableWaits)
+	}
+	res = testDurableSet(r0, gomemcached.SETQ, "c", DURABLE_PERSIST)
+	if res != nil || v0.bs.Stats().Syncs != 2 {
+		t.Errorf("expected a quiet durable set, got: %v", res)
+	}
+	res = testDurableSet(r0, gomemcached.ADD, "c", DURABLE_PERSIST)
+	if res.Status != gomemcached.KEY_EEXISTS || v0.stats.DurableWaits != 2 {
+		t.Errorf("expected a failed durable add to not wait, got: %v", res)
+	}
+	res = testDurableSet(r0, gomemcached.SET, "d", 0x2)
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("expected unknown durability flags to fail, got: %v", res)
+	}
+
+	res = r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.DELETE,
+		Key:    []byte("a"),
+		Extras: []byte{0, 0, 0, 1},
+	})
+	if res.Status != gomemcached.SUCCESS || !v0.ps.persisted(res.Cas) {
+		t.Errorf("expected a durable delete to be persisted, got: %v", res)
+	}
+
+	v0.bs.BSF().file = brokenFile{fmt.Errorf("I'm broken")}
+	res = testDurableSet(r0, gomemcached.SET, "e", DURABLE_PERSIST)
+	if res.Status != gomemcached.TMPFAIL || v0.stats.DurableErrors != 1 {
+		t.Errorf("expected a durable set to fail, got: %v", res)
+	}
+}
+
+func TestDurabilitySettings(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: 1,
+			Durability:    DURABILITY_SYNC,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	r0 := &reqHandler{currentBucket: b0}
+	v0, _ := b0.CreateVBucket(0)
+	b0.SetVBState(0, VBActive)
+
+	// Concurrent mutations of a sync bucket share flushes.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res := r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+				Opcode: gomemcached.SET,
+				Key:    []byte(strconv.Itoa(i)),
+				Body:   []byte(strconv.Itoa(i)),
+			})
+			if res.Status != gomemcached.SUCCESS || !v0.ps.persisted(res.Cas) {
+				t.Errorf("expected a sync set to be persisted, got: %v", res)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if syncs := v0.bs.Stats().Syncs; syncs < 1 || syncs > 20 {
+		t.Errorf("expected at most a fsync per set, got: %v", syncs)
+	}
+	b0.Close()
+
+	b1, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: 1,
+			MemoryOnly:    MemoryOnly_LEVEL_PERSIST_METADATA,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b1.Close()
+	r1 := &reqHandler{currentBucket: b1}
+	b1.CreateVBucket(0)
+	b1.SetVBState(0, VBActive)
+	res := testDurableSet(r1, gomemcached.SET, "a", DURABLE_PERSIST)
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("expected a durable set of a memory-only bucket to fail,"+
+			" got: %v", res)
+	}
+}
+
 func TestFlushError(t *testing.T) {
 	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
 	defer os.RemoveAll(testBucketDir)
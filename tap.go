@@ -2,26 +2,32 @@ package main
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"sync/atomic"
 	"time"
 
 	"github.com/dustin/gomemcached"
-	"github.com/dustin/gomemcached/server"
+	"github.com/steveyen/gkvlite"
 )
 
-// Message sent on object change
+// Message sent on object change, where a mutation without a key is a
+// flush of all of its vbucket's items.
 type mutation struct {
 	vb      uint16
 	key     []byte
 	cas     uint64
 	deleted bool
+	data    []byte // The value of a set, for observers like the journal.
 }
 
 func (m mutation) String() string {
 	sym := "M"
-	if m.deleted {
+	if len(m.key) == 0 {
+		sym = "F"
+	} else if m.deleted {
 		sym = "D"
 	}
 	return fmt.Sprintf("%v: vb:%v %s -> %v", sym, m.vb, m.key, m.cas)
@@ -30,6 +36,204 @@ func (m mutation) String() string {
 // How often to send opaque "heartbeats" on tap streams.
 var tapTickFreq = time.Second
 
+// The state of a TAP stream that we're sending to a TAP consumer.
+type tapStream struct {
+	b     Bucket
+	name  string          // Non-empty for a registered TAP client.
+	vbids map[uint16]bool // From LIST_VBUCKETS, where nil means all.
+
+	// Also stream replica vbuckets, so that replications can be
+	// chained through replica buckets.
+	replicas bool
+
+	// The checkpoints are the last cas that a registered TAP client
+	// acked per vbucket, and sent is the last cas we sent.
+	checkpoints map[uint16]uint64
+	sent        map[uint16]uint64
+
+	mch        chan interface{} // Mutations from registered vbuckets.
+	registered map[uint16]bool
+	pending    []mutation // Mutations that arrived during a backfill.
+}
+
+func newTapStream(b Bucket, tc *gomemcached.TapConnect) (
+	*tapStream, *gomemcached.MCResponse) {
+	ts := &tapStream{
+		b:          b,
+		sent:       map[uint16]uint64{},
+		mch:        make(chan interface{}, 1000),
+		registered: map[uint16]bool{},
+	}
+
+	if v, ok := tc.Flags[gomemcached.LIST_VBUCKETS]; ok {
+		vbids, ok := v.([]uint16)
+		if !ok {
+			return nil, &gomemcached.MCResponse{Fatal: true}
+		}
+		ts.vbids = map[uint16]bool{}
+		for _, vbid := range vbids {
+			ts.vbids[vbid] = true
+		}
+	}
+
+	res, registered := tapFlagBool(tc, gomemcached.REGISTERED_CLIENT)
+	if res != nil {
+		return nil, res
+	}
+	if registered {
+		if tc.Name == "" {
+			return nil, &gomemcached.MCResponse{
+				Status: gomemcached.EINVAL,
+				Body:   []byte("registered tap client needs a name"),
+			}
+		}
+		ts.name = tc.Name
+		ts.checkpoints = map[uint16]uint64{}
+		np := b.GetBucketSettings().NumPartitions
+		for vbid := 0; vbid < np; vbid++ {
+			vb, _ := b.GetVBucket(uint16(vbid))
+			if vb == nil || !ts.wants(uint16(vbid)) {
+				continue
+			}
+			cas, err := vb.getTapCheckpoint(ts.name)
+			if err != nil {
+				return nil, &gomemcached.MCResponse{
+					Status: gomemcached.TMPFAIL,
+					Body:   []byte(fmt.Sprintf("getTapCheckpoint err: %v", err)),
+				}
+			}
+			// A checkpoint past the vbucket's last cas is from some
+			// previous incarnation of the vbucket, so it's ignored.
+			if cas > 0 && cas <= atomic.LoadUint64(&vb.Meta().LastCas) {
+				ts.checkpoints[uint16(vbid)] = cas
+			}
+		}
+	}
+
+	return ts, nil
+}
+
+func (ts *tapStream) wants(vbid uint16) bool {
+	return ts.vbids == nil || ts.vbids[vbid]
+}
+
+func (ts *tapStream) streams(state VBState) bool {
+	return state == VBActive || (ts.replicas && state == VBReplica)
+}
+
+// Registers for the mutations of the stream's vbuckets before any
+// backfill, so there's no gap between the backfill and forwarding.
+func (ts *tapStream) observe() {
+	np := ts.b.GetBucketSettings().NumPartitions
+	for vbid := 0; vbid < np; vbid++ {
+		vb, _ := ts.b.GetVBucket(uint16(vbid))
+		if vb != nil && ts.wants(vb.vbid) && ts.streams(vb.GetVBState()) {
+			ts.register(vb)
+		}
+	}
+}
+
+func (ts *tapStream) register(vb *VBucket) {
+	vb.observer.Register(ts.mch)
+	ts.registered[vb.vbid] = true
+}
+
+func (ts *tapStream) unregister(vb *VBucket) {
+	vb.observer.Unregister(ts.mch)
+	delete(ts.registered, vb.vbid)
+}
+
+func (ts *tapStream) close() {
+	for vbid := range ts.registered {
+		vb, _ := ts.b.GetVBucket(vbid)
+		if vb != nil {
+			vb.observer.Unregister(ts.mch)
+		}
+	}
+}
+
+// Queues up mutations while we're busy with a backfill, so that the
+// vbucket observers aren't blocked.
+func (ts *tapStream) drain() {
+	for {
+		select {
+		case mi := <-ts.mch:
+			ts.pending = append(ts.pending, mi.(mutation))
+		default:
+			return
+		}
+	}
+}
+
+// Persists the checkpoints of a registered TAP client, for sent
+// changes that the client has acked.
+func (ts *tapStream) saveCheckpoints(acked map[uint16]uint64) error {
+	if ts.name == "" {
+		return nil
+	}
+	for vbid, cas := range acked {
+		if ts.checkpoints[vbid] >= cas {
+			continue
+		}
+		vb, _ := ts.b.GetVBucket(vbid)
+		if vb == nil {
+			continue
+		}
+		if err := vb.setTapCheckpoint(ts.name, cas); err != nil {
+			return err
+		}
+		ts.checkpoints[vbid] = cas
+	}
+	return nil
+}
+
+func (ts *tapStream) copySent() map[uint16]uint64 {
+	rv := make(map[uint16]uint64, len(ts.sent))
+	for vbid, cas := range ts.sent {
+		rv[vbid] = cas
+	}
+	return rv
+}
+
+type tapCheckpoint struct {
+	LastCas uint64 `json:"lastCas"`
+}
+
+func tapCheckpointKey(vbid uint16, name string) []byte {
+	return []byte(fmt.Sprintf("%d/%s", vbid, name))
+}
+
+func (v *VBucket) getTapCheckpoint(name string) (cas uint64, err error) {
+	var x *gkvlite.Item
+	v.bs.apply(func() {
+		x, err = v.bs.collMeta(COLL_TAP_CHECKPOINTS).GetItem(
+			tapCheckpointKey(v.vbid, name), true)
+	})
+	if err != nil || x == nil || x.Val == nil {
+		return 0, err
+	}
+	c := &tapCheckpoint{}
+	if err = json.Unmarshal(x.Val, c); err != nil {
+		return 0, err
+	}
+	return c.LastCas, nil
+}
+
+func (v *VBucket) setTapCheckpoint(name string, cas uint64) (err error) {
+	j, err := json.Marshal(&tapCheckpoint{LastCas: cas})
+	if err != nil {
+		return err
+	}
+	v.bs.apply(func() {
+		err = v.bs.collMeta(COLL_TAP_CHECKPOINTS).Set(
+			tapCheckpointKey(v.vbid, name), j)
+	})
+	if err == nil {
+		v.bs.dirty(false)
+	}
+	return err
+}
+
 func doTap(b Bucket, req *gomemcached.MCRequest, r io.Reader,
 	chpkt chan<- transmissible, cherr <-chan error) *gomemcached.MCResponse {
 	tc, err := req.ParseTapCommands()
@@ -40,14 +244,30 @@ func doTap(b Bucket, req *gomemcached.MCRequest, r io.Reader,
 		}
 	}
 
-	// TODO: TAP of a vbucket list.
+	ts, res := newTapStream(b, &tc)
+	if res != nil {
+		return res
+	}
+	return doTapStream(ts, &tc, req, r, chpkt, cherr)
+}
 
-	res, yesDump := tapFlagBool(&tc, gomemcached.DUMP)
+func doTapStream(ts *tapStream, tc *gomemcached.TapConnect,
+	req *gomemcached.MCRequest, r io.Reader,
+	chpkt chan<- transmissible, cherr <-chan error) *gomemcached.MCResponse {
+	ts.observe()
+	defer ts.close()
+
+	res, yesDump := tapFlagBool(tc, gomemcached.DUMP)
+	if res != nil {
+		return res
+	}
+	res, yesTakeover := tapFlagBool(tc, gomemcached.TAKEOVER_VBUCKETS)
 	if res != nil {
 		return res
 	}
-	if yesDump || tapFlagExists(&tc, gomemcached.BACKFILL) {
-		res := doTapBackFill(b, req, r, chpkt, cherr, tc)
+	yesBackFill := yesDump || tapFlagExists(tc, gomemcached.BACKFILL)
+	if yesBackFill || len(ts.checkpoints) > 0 {
+		res := doTapBackFill(ts, req, r, chpkt, cherr, yesBackFill)
 		if res != nil {
 			return res
 		}
@@ -56,10 +276,11 @@ func doTap(b Bucket, req *gomemcached.MCRequest, r io.Reader,
 			return &gomemcached.MCResponse{Fatal: true}
 		}
 	}
+	if yesTakeover {
+		return doTapTakeover(ts, r, chpkt, cherr)
+	}
 
-	// TODO: There's probably a mutation gap between backfill and tap-forward.
-
-	return doTapForward(b, req, r, chpkt, cherr, tc)
+	return doTapForward(ts, req, r, chpkt, cherr)
 }
 
 func tapFlagBool(tc *gomemcached.TapConnect, flag gomemcached.TapConnectFlag) (
@@ -79,11 +300,10 @@ func tapFlagExists(tc *gomemcached.TapConnect, flag gomemcached.TapConnectFlag)
 	return ok
 }
 
-func doTapForward(b Bucket, req *gomemcached.MCRequest, r io.Reader,
-	chpkt chan<- transmissible, cherr <-chan error,
-	tc gomemcached.TapConnect) *gomemcached.MCResponse {
+func doTapForward(ts *tapStream, req *gomemcached.MCRequest, r io.Reader,
+	chpkt chan<- transmissible, cherr <-chan error) *gomemcached.MCResponse {
+	b := ts.b
 	bch := make(chan interface{})
-	mch := make(chan interface{}, 1000)
 
 	b.Subscribe(bch)
 	defer b.Unsubscribe(bch)
@@ -91,68 +311,71 @@ func doTapForward(b Bucket, req *gomemcached.MCRequest, r io.Reader,
 	ticker := time.NewTicker(tapTickFreq)
 	defer ticker.Stop()
 
-	// defer cleanup vbucket mchs
-	registered := map[uint16]bool{}
-	defer func() {
-		for vbid := range registered {
-			vb, _ := b.GetVBucket(vbid)
-			if vb != nil {
-				vb.observer.Unregister(mch)
-			}
-		}
-	}()
+	// A registered TAP client acks our heartbeats, where each ack
+	// checkpoints what we sent before the heartbeat.
+	var ackch chan *gomemcached.MCResponse
+	var ackOpaque uint32
+	acksPending := map[uint32]map[uint16]uint64{}
+	if ts.name != "" && r != nil {
+		ackch = make(chan *gomemcached.MCResponse, 1)
+		donech := make(chan bool)
+		defer close(donech)
+		go readTapAcks(r, ackch, donech)
+	}
+	ackedSent := ts.copySent()
+
+	for _, m := range ts.pending {
+		ts.forward(m, chpkt)
+	}
+	ts.pending = nil
 
 	for {
 		select {
 		case ci := <-bch:
 			// VBucket state change, so update registrations
 			c := ci.(vbucketChange)
-			if vb := c.getVBucket(); vb != nil {
-				if c.newState == VBActive {
-					vb.observer.Register(mch)
-					registered[vb.vbid] = true
-				} else if vb != nil {
-					vb.observer.Unregister(mch)
-					delete(registered, vb.vbid)
+			if vb := c.getVBucket(); vb != nil && ts.wants(vb.vbid) {
+				if ts.streams(c.newState) {
+					ts.register(vb)
+				} else {
+					ts.unregister(vb)
 				}
 			}
-		case mi := <-mch:
-			// Send a change
-			m := mi.(mutation)
+		case mi := <-ts.mch:
+			ts.forward(mi.(mutation), chpkt)
+		case <-ticker.C:
+			// Send a noop, which a registered client acks if we've
+			// sent anything since the last ack.
 			pkt := &gomemcached.MCRequest{
-				Opcode:  gomemcached.TAP_MUTATION,
-				Key:     m.key,
-				VBucket: m.vb,
+				Opcode: gomemcached.TAP_OPAQUE,
+				Extras: make([]byte, TAP_EXTRAS_LEN),
 			}
-			if m.deleted {
-				pkt.Opcode = gomemcached.TAP_DELETE
-				pkt.Extras = make([]byte, 8) // TODO: fill
-			} else {
-				pkt.Extras = make([]byte, 16) // TODO: fill
-
-				vb, _ := b.GetVBucket(m.vb)
-				if vb != nil {
-					// TODO: if vb is suspended, the get() will freeze
-					// the TAP stream until vb is resumed; that may be
-					// or may not be what we want.
-					res := vb.get(m.key)
-					if res.Status != gomemcached.SUCCESS {
-						log.Printf("tapped a missing item, skipping key: %s",
-							m.key)
-						continue
-					}
-					pkt.Body = res.Body
-				} else {
-					log.Printf("tapping a missing partition: %v", m.vb)
-					continue
-				}
+			if ackch != nil && !tapSentEqual(ackedSent, ts.sent) {
+				ackOpaque++
+				ackedSent = ts.copySent()
+				acksPending[ackOpaque] = ackedSent
+				pkt.Opaque = ackOpaque
+				binary.BigEndian.PutUint16(pkt.Extras[2:], TAP_FLAG_ACK)
 			}
 			chpkt <- pkt
-		case <-ticker.C:
-			// Send a noop
-			chpkt <- &gomemcached.MCRequest{
-				Opcode: gomemcached.TAP_OPAQUE,
-				Extras: make([]byte, 8),
+		case res, ok := <-ackch:
+			if !ok {
+				return &gomemcached.MCResponse{Fatal: true}
+			}
+			acked := acksPending[res.Opaque]
+			if res.Opcode != gomemcached.TAP_OPAQUE || acked == nil ||
+				res.Status != gomemcached.SUCCESS {
+				log.Printf("error: unexpected tap ack: %v", res)
+				return &gomemcached.MCResponse{Fatal: true}
+			}
+			for opaque := range acksPending {
+				if opaque <= res.Opaque {
+					delete(acksPending, opaque)
+				}
+			}
+			if err := ts.saveCheckpoints(acked); err != nil {
+				log.Printf("error: tap saveCheckpoints, name: %v, err: %v",
+					ts.name, err)
 			}
 		case <-cherr:
 			return &gomemcached.MCResponse{Fatal: true}
@@ -162,64 +385,284 @@ func doTapForward(b Bucket, req *gomemcached.MCRequest, r io.Reader,
 	panic("unreachable")
 }
 
-func doTapBackFill(b Bucket, req *gomemcached.MCRequest, r io.Reader,
+// Sends a change, unless we've already sent it (or something later)
+// during the backfill.
+func (ts *tapStream) forward(m mutation, chpkt chan<- transmissible) {
+	if !ts.wants(m.vb) || m.cas <= ts.sent[m.vb] {
+		return
+	}
+	if len(m.key) == 0 {
+		chpkt <- tapFlushRequest(m.vb, m.cas)
+		ts.sent[m.vb] = m.cas
+		return
+	}
+	i := &item{key: m.key, cas: m.cas}
+	if !m.deleted {
+		vb, _ := ts.b.GetVBucket(m.vb)
+		if vb == nil {
+			log.Printf("tapping a missing partition: %v", m.vb)
+			return
+		}
+		var err error
+		i, err = vb.getUnexpired(m.key, time.Now())
+		if err != nil || i == nil {
+			log.Printf("tapped a missing item, skipping key: %s, err: %v",
+				m.key, err)
+			return
+		}
+	}
+	chpkt <- tapItemRequest(m.vb, i, m.deleted)
+	ts.sent[m.vb] = m.cas
+}
+
+// Encodes an item as a TAP_MUTATION or TAP_DELETE.  We have no engine
+// specific data, and a TAP_DELETE's extras have no item flags or exp.
+func tapItemRequest(vbid uint16, i *item, deletion bool) *gomemcached.MCRequest {
+	pkt := &gomemcached.MCRequest{
+		Opcode:  gomemcached.TAP_MUTATION,
+		VBucket: vbid,
+		Key:     i.key,
+		Cas:     i.cas,
+	}
+	if deletion {
+		pkt.Opcode = gomemcached.TAP_DELETE
+		pkt.Extras = make([]byte, TAP_EXTRAS_LEN)
+	} else {
+		pkt.Extras = make([]byte, TAP_MUTATION_EXTRAS_LEN)
+		binary.BigEndian.PutUint32(pkt.Extras[TAP_EXTRAS_LEN:], i.flag)
+		binary.BigEndian.PutUint32(pkt.Extras[TAP_EXTRAS_LEN+4:], i.exp)
+		pkt.Body = i.data
+	}
+	pkt.Extras[4] = TAP_TTL
+	return pkt
+}
+
+func tapFlushRequest(vbid uint16, cas uint64) *gomemcached.MCRequest {
+	pkt := &gomemcached.MCRequest{
+		Opcode:  gomemcached.TAP_FLUSH,
+		VBucket: vbid,
+		Cas:     cas,
+		Extras:  make([]byte, TAP_EXTRAS_LEN),
+	}
+	pkt.Extras[4] = TAP_TTL
+	return pkt
+}
+
+func tapSentEqual(a, b map[uint16]uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for vbid, cas := range a {
+		if b[vbid] != cas {
+			return false
+		}
+	}
+	return true
+}
+
+// Reads TAP acks from a TAP client until the connection fails, which
+// closes the ackch.
+func readTapAcks(r io.Reader, ackch chan<- *gomemcached.MCResponse,
+	donech <-chan bool) {
+	defer close(ackch)
+	for {
+		res, err := readResponse(r)
+		if err != nil {
+			return
+		}
+		select {
+		case ackch <- res:
+		case <-donech:
+			return
+		}
+	}
+}
+
+// Sends the items of the stream's vbuckets, or, for vbuckets
+// where a registered TAP client has a checkpoint, only the changes
+// since the checkpoint.
+//
+// The backfill only sends items up to each vbucket's last cas from
+// when the backfill started.  Then, the changes after that cas are
+// replayed from the changes stream, so that the mutations during the
+// backfill aren't lost before doTapForward takes over.
+func doTapBackFill(ts *tapStream, req *gomemcached.MCRequest, r io.Reader,
 	chpkt chan<- transmissible, cherr <-chan error,
-	tc gomemcached.TapConnect) *gomemcached.MCResponse {
+	yesBackFill bool) *gomemcached.MCResponse {
 	var err error
 
-	np := b.GetBucketSettings().NumPartitions
+	vbs := []*VBucket{}
+	startCas := map[uint16]uint64{}
+	np := ts.b.GetBucketSettings().NumPartitions
 	for vbid := 0; vbid < np; vbid++ {
-		vb, _ := b.GetVBucket(uint16(vbid))
+		if !ts.wants(uint16(vbid)) {
+			continue
+		}
+		vb, _ := ts.b.GetVBucket(uint16(vbid))
 		if vb == nil {
 			continue
 		}
-		if vb.GetVBState() != VBActive {
+		if !ts.streams(vb.GetVBState()) {
 			continue
 		}
-
-		errVisit := vb.ps.visitItems(nil, true, func(i *item) bool {
-			// TODO: Need to occasionally send TAP_ACK's.
-			chpkt <- &gomemcached.MCRequest{
-				Opcode:  gomemcached.TAP_MUTATION,
-				VBucket: uint16(vbid),
-				Key:     i.key,
-				Cas:     i.cas,
-				Extras:  make([]byte, 16),
-				Body:    i.data,
+		cas, ok := ts.checkpoints[vb.vbid]
+		if !ok {
+			if !yesBackFill {
+				continue
 			}
-			select {
-			case err = <-cherr:
-				return false
-			default:
+			cas = atomic.LoadUint64(&vb.Meta().LastCas)
+		}
+		vbs = append(vbs, vb)
+		startCas[vb.vbid] = cas
+	}
+
+	send := func(vbid uint16, i *item) bool {
+		// TODO: Need to occasionally send TAP_ACK's.
+		pkt := tapItemRequest(vbid, i, i.isDeletion())
+		chpkt <- pkt
+		if i.cas > ts.sent[vbid] {
+			ts.sent[vbid] = i.cas
+		}
+		ts.drain()
+		select {
+		case err = <-cherr:
+			return false
+		default:
+		}
+		return true
+	}
+
+	for _, vb := range vbs {
+		vbid := vb.vbid
+		if _, ok := ts.checkpoints[vbid]; !ok {
+			errVisit := vb.ps.visitItems(nil, true, func(i *item) bool {
+				if i.cas > startCas[vbid] {
+					return true // The replay below sends it.
+				}
+				return send(vbid, i)
+			})
+			if errVisit != nil || err != nil {
+				close(chpkt)
+				return &gomemcached.MCResponse{Fatal: true}
 			}
-			return true
-		})
-		if errVisit != nil {
-			close(chpkt)
-			return &gomemcached.MCResponse{Fatal: true}
 		}
-		if err != nil {
+
+		errVisit := vb.ps.visitChanges(casBytes(startCas[vbid]+1), true,
+			func(i *item) bool {
+				if len(i.key) == 0 || i.cas <= ts.sent[vbid] {
+					return true // Skip VBMeta changes and duplicates.
+				}
+				return send(vbid, i)
+			})
+		if errVisit != nil || err != nil {
 			close(chpkt)
 			return &gomemcached.MCResponse{Fatal: true}
 		}
 	}
 
-	// TODO: Skipping error handling for now, as it always errors
-	// since the memcached.ReadPacket() is expecting a REQ instead of
-	// RES for the ACK's header magic.  The fix involves exposing more
-	// helper functions in gomemcached to help us flip the REQ/RES
-	// stream direction.
-	doTapAck(r, chpkt, cherr)
+	if err = doTapAck(r, chpkt, cherr); err != nil {
+		log.Printf("error: tap backfill ack, err: %v", err)
+		close(chpkt)
+		return &gomemcached.MCResponse{Fatal: true}
+	}
+	if err = ts.saveCheckpoints(ts.sent); err != nil {
+		log.Printf("error: tap saveCheckpoints, name: %v, err: %v",
+			ts.name, err)
+	}
 
 	return nil
 }
 
+// Hands the stream's vbuckets over to the TAP client.  Our vbuckets
+// become pending, which refuses writes, so that the client can catch
+// up with their remaining changes.  The client then makes its
+// vbuckets active, and once it acks that, our vbuckets become dead.
+func doTapTakeover(ts *tapStream, r io.Reader,
+	chpkt chan<- transmissible, cherr <-chan error) *gomemcached.MCResponse {
+	vbids := []uint16{}
+	np := ts.b.GetBucketSettings().NumPartitions
+	for vbid := 0; vbid < np; vbid++ {
+		if ts.registered[uint16(vbid)] {
+			vbids = append(vbids, uint16(vbid))
+		}
+	}
+
+	setVBStates := func(state VBState) (err error) {
+		for _, vbid := range vbids {
+			if err = ts.b.SetVBState(vbid, state); err != nil {
+				log.Printf("error: tap takeover SetVBState, vbucket: %v,"+
+					" state: %v, err: %v", vbid, state, err)
+			}
+		}
+		return err
+	}
+	fail := func() *gomemcached.MCResponse {
+		setVBStates(VBActive)
+		close(chpkt)
+		return &gomemcached.MCResponse{Fatal: true}
+	}
+
+	if setVBStates(VBPending) != nil {
+		return fail()
+	}
+
+	for _, vbid := range vbids {
+		vb, _ := ts.b.GetVBucket(vbid)
+		if vb == nil {
+			continue
+		}
+		errVisit := vb.ps.visitChanges(casBytes(ts.sent[vbid]+1), true,
+			func(i *item) bool {
+				if len(i.key) == 0 || i.cas <= ts.sent[vbid] {
+					return true // Skip VBMeta changes and duplicates.
+				}
+				chpkt <- tapItemRequest(vbid, i, i.isDeletion())
+				ts.sent[vbid] = i.cas
+				ts.drain()
+				return true
+			})
+		if errVisit != nil {
+			log.Printf("error: tap takeover visitChanges, vbucket: %v, err: %v",
+				vbid, errVisit)
+			return fail()
+		}
+
+		pkt := &gomemcached.MCRequest{
+			Opcode:  gomemcached.TAP_VBUCKET_SET,
+			VBucket: vbid,
+			Extras:  make([]byte, TAP_EXTRAS_LEN),
+			Body:    make([]byte, 4),
+		}
+		pkt.Extras[4] = TAP_TTL
+		binary.BigEndian.PutUint32(pkt.Body, uint32(VBActive))
+		chpkt <- pkt
+
+		select {
+		case <-cherr:
+			return fail()
+		default:
+		}
+	}
+
+	if err := doTapAck(r, chpkt, cherr); err != nil {
+		log.Printf("error: tap takeover ack, err: %v", err)
+		return fail()
+	}
+	if err := ts.saveCheckpoints(ts.sent); err != nil {
+		log.Printf("error: tap saveCheckpoints, name: %v, err: %v",
+			ts.name, err)
+	}
+	setVBStates(VBDead)
+
+	close(chpkt)
+	return &gomemcached.MCResponse{Fatal: true}
+}
+
 func doTapAck(r io.Reader, chpkt chan<- transmissible, cherr <-chan error) error {
 	ackReq := &gomemcached.MCRequest{
 		Opcode: gomemcached.TAP_OPAQUE,
-		Extras: make([]byte, 8),
+		Extras: make([]byte, TAP_EXTRAS_LEN),
 	}
-	TAP_FLAG_ACK := uint16(0x01)
 	binary.BigEndian.PutUint16(ackReq.Extras[2:], TAP_FLAG_ACK)
 
 	chpkt <- ackReq
@@ -229,26 +672,12 @@ func doTapAck(r io.Reader, chpkt chan<- transmissible, cherr <-chan error) error
 	default:
 	}
 
-	// TODO: Validate that the response matches the ACK that we expect.
-	_, err := memcached.ReadPacket(r)
-	return err
-}
-
-func MutationLogger(ch chan interface{}) {
-	for i := range ch {
-		switch o := i.(type) {
-		case mutation:
-			log.Printf("tap mutation: %v", o)
-		case vbucketChange:
-			log.Printf("tap partition change: %v", o)
-			if o.newState == VBActive {
-				if vb := o.getVBucket(); vb != nil {
-					// Watch state changes
-					vb.observer.Register(ch)
-				}
-			}
-		default:
-			panic(fmt.Sprintf("unhandled mutation logger type %T: %v", i, i))
-		}
+	res, err := readResponse(r)
+	if err != nil {
+		return err
+	}
+	if res.Opcode != gomemcached.TAP_OPAQUE || res.Status != gomemcached.SUCCESS {
+		return fmt.Errorf("unexpected tap ack: %v", res)
 	}
+	return nil
 }
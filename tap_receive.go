@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/dustin/gomemcached"
+)
+
+const (
+	TAP_FLAG_ACK      = uint16(0x01)
+	TAP_FLAG_NO_VALUE = uint16(0x02)
+
+	// The extras of every TAP message: engine specific length,
+	// flags, ttl and 3 reserved bytes.
+	TAP_EXTRAS_LEN = 2 + 2 + 1 + 3
+
+	// TAP_MUTATION extras also have the item's flags and exp.
+	TAP_MUTATION_EXTRAS_LEN = TAP_EXTRAS_LEN + 4 + 4
+
+	// The hop count of the TAP messages that we send.
+	TAP_TTL = uint8(0xff)
+)
+
+// Handles a TAP message that a TAP source sent to us, where we only
+// respond if the source asked for an ack.
+func doTapReceive(b Bucket, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if len(req.Extras) < TAP_EXTRAS_LEN {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body: []byte(fmt.Sprintf("wrong extras size for tap: %v",
+				len(req.Extras))),
+		}
+	}
+	flags := binary.BigEndian.Uint16(req.Extras[2:])
+
+	res := tapReceive(b, req, flags)
+	if flags&TAP_FLAG_ACK == 0 {
+		if res != nil && res.Status != gomemcached.SUCCESS {
+			log.Printf("error: tap receive, opcode: %v, vbucket: %v, key: %s,"+
+				" res: %v", req.Opcode, req.VBucket, req.Key, res)
+		}
+		return nil
+	}
+	if res == nil {
+		res = &gomemcached.MCResponse{}
+	}
+	return res
+}
+
+func tapReceive(b Bucket, req *gomemcached.MCRequest,
+	flags uint16) *gomemcached.MCResponse {
+	switch req.Opcode {
+	case gomemcached.TAP_MUTATION, gomemcached.TAP_DELETE:
+		return tapReceiveItem(b, req, flags)
+	case gomemcached.TAP_FLUSH:
+		return tapReceiveFlush(b, req)
+	case gomemcached.TAP_VBUCKET_SET:
+		return tapReceiveVBState(b, req)
+	}
+	return nil // The TAP_OPAQUE and checkpoint messages need no work.
+}
+
+// Applies an incoming TAP_MUTATION or TAP_DELETE, keeping the item's
+// cas, flags and exp from the source.  Unlike regular requests, these
+// are also applied to replica and pending vbuckets.
+func tapReceiveItem(b Bucket, req *gomemcached.MCRequest,
+	flags uint16) *gomemcached.MCResponse {
+	deletion := req.Opcode == gomemcached.TAP_DELETE
+	if !deletion && len(req.Extras) != TAP_MUTATION_EXTRAS_LEN {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body: []byte(fmt.Sprintf("wrong extras size for tap mutation: %v",
+				len(req.Extras))),
+		}
+	}
+	if !deletion && flags&TAP_FLAG_NO_VALUE != 0 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("tap mutation without a value is not supported"),
+		}
+	}
+
+	key, body := req.Key, req.Body
+	if n := int(binary.BigEndian.Uint16(req.Extras)); n > 0 {
+		// The engine specific bytes come before the key, but aren't
+		// counted in the key length, so they were read as the key.
+		kb := append(append([]byte(nil), req.Key...), req.Body...)
+		if len(kb) < n+len(req.Key) {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.EINVAL,
+				Body:   []byte("tap engine specific length is too long"),
+			}
+		}
+		key, body = kb[n:n+len(req.Key)], kb[n+len(req.Key):]
+	}
+	if len(body) > MAX_ITEM_DATA_LENGTH {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.E2BIG,
+			Body: []byte(fmt.Sprintf("data too big: %v, key: %v",
+				len(body), key)),
+		}
+	}
+
+	vb, err := b.GetVBucket(req.VBucket)
+	if err == bucketUnavailable {
+		return dropConnection
+	}
+	if vb == nil || vb.GetVBState() == VBDead {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.NOT_MY_VBUCKET,
+		}
+	}
+	atomic.AddInt64(&vb.stats.Ops, 1)
+	atomic.AddInt64(&vb.stats.TapReceives, 1)
+
+	itemNew := &item{key: key, cas: req.Cas}
+	if !deletion {
+		itemNew.flag = binary.BigEndian.Uint32(req.Extras[8:12])
+		itemNew.exp = binary.BigEndian.Uint32(req.Extras[12:16])
+		itemNew.data = body
+		itemNew.datatype = detectDatatype(body)
+	}
+
+	return vbApplyWithMeta(vb, &gomemcached.MCRequest{
+		Opcode:  req.Opcode,
+		VBucket: req.VBucket,
+		Key:     key,
+	}, itemNew, deletion, true, true)
+}
+
+// A TAP_FLUSH removes all the items of its vbucket, whatever the
+// vbucket's state.
+func tapReceiveFlush(b Bucket, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	vb, err := b.GetVBucket(req.VBucket)
+	if err == bucketUnavailable {
+		return dropConnection
+	}
+	if vb == nil || vb.GetVBState() == VBDead {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.NOT_MY_VBUCKET,
+		}
+	}
+	atomic.AddInt64(&vb.stats.Ops, 1)
+	atomic.AddInt64(&vb.stats.TapReceives, 1)
+	if err = vb.flushItems(); err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.TMPFAIL,
+			Body:   []byte(fmt.Sprintf("flush error %v", err)),
+		}
+	}
+	return nil
+}
+
+// The TAP_VBUCKET_SET body is the new vbucket state, where the vbucket
+// is created if we don't have it yet.
+func tapReceiveVBState(b Bucket, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if len(req.Body) != 4 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("wrong body size for tap vbucket set"),
+		}
+	}
+	s := binary.BigEndian.Uint32(req.Body)
+	if s < uint32(VBActive) || s > uint32(VBDead) {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte(fmt.Sprintf("invalid vbucket state: %v", s)),
+		}
+	}
+	state := VBState(s)
+
+	vb, err := b.GetVBucket(req.VBucket)
+	if err == bucketUnavailable {
+		return dropConnection
+	}
+	if vb != nil && vb.GetVBState() == state {
+		return nil // A state change would needlessly use up a cas.
+	}
+	if vb == nil {
+		if _, err = b.CreateVBucket(req.VBucket); err != nil {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("CreateVBucket error %v", err)),
+			}
+		}
+	}
+	if err = b.SetVBState(req.VBucket, state); err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.TMPFAIL,
+			Body:   []byte(fmt.Sprintf("SetVBState error %v", err)),
+		}
+	}
+	return nil
+}
@@ -13,62 +13,6 @@ import (
 	"github.com/dustin/gomemcached"
 )
 
-// Exercise the mutation logger code. Output is not examined.
-func TestMutationLogger(t *testing.T) {
-	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
-	defer os.RemoveAll(testBucketDir)
-	b, _ := NewBucket("test", testBucketDir,
-		&BucketSettings{
-			NumPartitions: MAX_VBUCKETS,
-		})
-	b.CreateVBucket(0)
-
-	ch := make(chan interface{}, 10)
-	ch <- vbucketChange{bucket: b, vbid: 0, oldState: VBDead, newState: VBActive}
-	ch <- mutation{deleted: false, key: []byte("a"), cas: 0}
-	ch <- mutation{deleted: true, key: []byte("a"), cas: 0}
-	ch <- mutation{deleted: false, key: []byte("a"), cas: 2}
-	ch <- vbucketChange{oldState: VBDead, newState: VBActive} // invalid bucket
-	ch <- vbucketChange{bucket: b, vbid: 0, oldState: VBActive, newState: VBDead}
-	close(ch)
-
-	MutationLogger(ch)
-
-	// Should've eaten all the things
-	if len(ch) != 0 {
-		t.Fatalf("Failed to consume all the messages")
-	}
-}
-
-func TestMutationInvalid(t *testing.T) {
-	defer func() {
-		if x := recover(); x == nil {
-			t.Fatalf("Expected panic, didn't get it")
-		}
-	}()
-
-	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
-	defer os.RemoveAll(testBucketDir)
-	b, _ := NewBucket("test", testBucketDir,
-		&BucketSettings{
-			NumPartitions: MAX_VBUCKETS,
-		})
-	b.CreateVBucket(0)
-
-	ch := make(chan interface{}, 5)
-	// Notification of a non-existence bucket is a null lookup.
-	ch <- vbucketChange{bucket: b, vbid: 0, oldState: VBDead, newState: VBActive}
-	// But this is crazy stupid and will crash the logger.
-	ch <- 19
-
-	MutationLogger(ch)
-
-	// Should've eaten all the things
-	if len(ch) != 0 {
-		t.Fatalf("Failed to consume all the messages")
-	}
-}
-
 func TestTapSetup(t *testing.T) {
 	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
 	defer os.RemoveAll(testBucketDir)
@@ -186,15 +130,24 @@ func TestTapChanges(t *testing.T) {
 	sendReq(req)
 	mustTransmit("positive delete", gomemcached.TAP_DELETE)
 
+	// Verify we get a flush.
+	if err := vb0.flushItems(); err != nil {
+		t.Fatalf("Expected flushItems to work, got: %v", err)
+	}
+	mustTransmit("positive flush", gomemcached.TAP_FLUSH)
+
 	// Verify a change without a backing item does *not* transmit.
 	vb0.observer.Submit(mutation{key: testKey})
 	mustNotTransmit("negative set")
 
-	// Verify we *don't* get a set on a pending vbucket.
+	// Verify a pending vbucket refuses sets, so we *don't* get one.
 	testBucket.SetVBState(0, VBPending)
 	time.Sleep(100 * time.Millisecond) // Let the state change settle
 	req.Opcode = gomemcached.SET
-	sendReq(req)
+	res := rh.HandleMessage(ioutil.Discard, nil, req)
+	if res.Status != gomemcached.TMPFAIL {
+		t.Fatalf("Expected a set on a pending vbucket to fail, got: %v", res)
+	}
 	mustNotTransmit("negative set")
 
 	// Verify a change without a valid vbucket at all doesn't transmit
@@ -447,6 +400,629 @@ func TestTapBackFillBucket(t *testing.T) {
 	mustTransmit("post-DUMP-mutation", gomemcached.TAP_MUTATION)
 }
 
+func TestTapItemExtras(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	rh := reqHandler{currentBucket: testBucket}
+	testBucket.CreateVBucket(0)
+	testBucket.SetVBState(0, VBActive)
+
+	chpkt := make(chan transmissible, 128)
+	cherr := make(chan error, 1)
+	_, mustTransmit, mustBeTapAck := makeMustTapFuncs(t, &rh, chpkt)
+
+	set := func(key string, flag, exp uint32) *gomemcached.MCResponse {
+		req := &gomemcached.MCRequest{
+			Opcode: gomemcached.SET,
+			Key:    []byte(key),
+			Extras: make([]byte, 8),
+			Body:   []byte("val"),
+		}
+		binary.BigEndian.PutUint32(req.Extras, flag)
+		binary.BigEndian.PutUint32(req.Extras[4:], exp)
+		return rh.HandleMessage(ioutil.Discard, nil, req)
+	}
+	mustHaveExtras := func(m string, pkt *gomemcached.MCRequest,
+		cas uint64, flag, exp uint32) {
+		extrasLen := TAP_MUTATION_EXTRAS_LEN
+		if pkt.Opcode == gomemcached.TAP_DELETE {
+			extrasLen = TAP_EXTRAS_LEN
+		}
+		if len(pkt.Extras) != extrasLen {
+			t.Fatalf("On %v, expected extras len %v, got: %v",
+				m, extrasLen, pkt.Extras)
+		}
+		if pkt.Cas != cas || binary.BigEndian.Uint16(pkt.Extras) != 0 ||
+			pkt.Extras[4] != TAP_TTL {
+			t.Errorf("On %v, expected cas %v and ttl, got: %v, %v",
+				m, cas, pkt.Cas, pkt.Extras)
+		}
+		if pkt.Opcode == gomemcached.TAP_MUTATION &&
+			(binary.BigEndian.Uint32(pkt.Extras[8:]) != flag ||
+				binary.BigEndian.Uint32(pkt.Extras[12:]) != exp) {
+			t.Errorf("On %v, expected flag %v and exp %v, got: %v",
+				m, flag, exp, pkt.Extras)
+		}
+	}
+
+	exp := uint32(time.Now().Add(time.Hour).Unix())
+	res := set("a", 0x0f, exp)
+
+	treq := &gomemcached.MCRequest{
+		Opcode: gomemcached.TAP_CONNECT,
+		Extras: make([]byte, 4),
+		Body:   make([]byte, 8),
+	}
+	binary.BigEndian.PutUint32(treq.Extras, uint32(gomemcached.BACKFILL))
+	ackRes := &gomemcached.MCResponse{Opcode: gomemcached.TAP_OPAQUE}
+	go doTap(testBucket, treq, bytes.NewBuffer(ackRes.Bytes()), chpkt, cherr)
+	defer func() {
+		cherr <- io.EOF
+	}()
+
+	mustHaveExtras("backfill", mustTransmit("backfill", gomemcached.TAP_MUTATION),
+		res.Cas, 0x0f, exp)
+	mustBeTapAck(mustTransmit("ack", gomemcached.TAP_OPAQUE))
+
+	res = set("b", 0x07, 0)
+	mustHaveExtras("forward", mustTransmit("forward", gomemcached.TAP_MUTATION),
+		res.Cas, 0x07, 0)
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.DELETE,
+		Key:    []byte("a"),
+	})
+	mustHaveExtras("delete", mustTransmit("delete", gomemcached.TAP_DELETE),
+		res.Cas, 0, 0)
+}
+
+func TestTapDumpBadAck(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+
+	chpkt := make(chan transmissible, 128)
+	cherr := make(chan error, 1)
+
+	treq := &gomemcached.MCRequest{
+		Opcode: gomemcached.TAP_CONNECT,
+		Extras: make([]byte, 4),
+	}
+	binary.BigEndian.PutUint32(treq.Extras, uint32(gomemcached.DUMP))
+
+	ackRes := &gomemcached.MCResponse{
+		Opcode: gomemcached.TAP_OPAQUE,
+		Status: gomemcached.EINVAL,
+	}
+	res := doTap(testBucket, treq, bytes.NewBuffer(ackRes.Bytes()), chpkt, cherr)
+	if res == nil || !res.Fatal {
+		t.Errorf("expected a failed ack to be fatal, got: %v", res)
+	}
+}
+
+func TestTapReceive(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	rh := reqHandler{currentBucket: testBucket}
+
+	tapReq := func(opcode gomemcached.CommandCode, flags uint16,
+		extrasLen int) *gomemcached.MCRequest {
+		req := &gomemcached.MCRequest{
+			Opcode:  opcode,
+			VBucket: 1,
+			Extras:  make([]byte, extrasLen),
+		}
+		binary.BigEndian.PutUint16(req.Extras[2:], flags)
+		return req
+	}
+
+	req := tapReq(gomemcached.TAP_MUTATION, TAP_FLAG_ACK, TAP_MUTATION_EXTRAS_LEN)
+	req.Key = []byte("a")
+	req.Body = []byte("aye")
+	res := rh.HandleMessage(ioutil.Discard, nil, req)
+	if res == nil || res.Status != gomemcached.NOT_MY_VBUCKET {
+		t.Errorf("expected tap mutation without vbucket to fail, got: %v", res)
+	}
+
+	vbset := tapReq(gomemcached.TAP_VBUCKET_SET, TAP_FLAG_ACK, TAP_EXTRAS_LEN)
+	vbset.Body = make([]byte, 4)
+	binary.BigEndian.PutUint32(vbset.Body, uint32(VBReplica))
+	res = rh.HandleMessage(ioutil.Discard, nil, vbset)
+	if res == nil || res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected tap vbucket set ack, got: %v", res)
+	}
+	vb, _ := testBucket.GetVBucket(1)
+	if vb == nil || vb.GetVBState() != VBReplica {
+		t.Fatalf("expected tap vbucket set to make a replica vbucket")
+	}
+
+	req.Cas = 12345
+	binary.BigEndian.PutUint32(req.Extras[8:], 0x0f)
+	res = rh.HandleMessage(ioutil.Discard, nil, req)
+	if res == nil || res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected tap mutation ack, got: %v", res)
+	}
+	res = vb.get([]byte("a"))
+	if res.Status != gomemcached.SUCCESS || res.Cas != 12345 ||
+		string(res.Body) != "aye" || binary.BigEndian.Uint32(res.Extras) != 0x0f {
+		t.Errorf("expected tap mutation to keep cas and flags, got: %v", res)
+	}
+
+	// Engine specific bytes come before the key.
+	req = tapReq(gomemcached.TAP_MUTATION, 0, TAP_MUTATION_EXTRAS_LEN)
+	binary.BigEndian.PutUint16(req.Extras, 2)
+	req.Cas = 12346
+	req.Key = []byte("xx")
+	req.Body = []byte("bbee")
+	if res = rh.HandleMessage(ioutil.Discard, nil, req); res != nil {
+		t.Errorf("expected no response without ack flag, got: %v", res)
+	}
+	res = vb.get([]byte("bb"))
+	if res.Status != gomemcached.SUCCESS || string(res.Body) != "ee" {
+		t.Errorf("expected engine specific bytes to be skipped, got: %v", res)
+	}
+
+	del := tapReq(gomemcached.TAP_DELETE, TAP_FLAG_ACK, TAP_EXTRAS_LEN)
+	del.Key = []byte("a")
+	del.Cas = 12347
+	res = rh.HandleMessage(ioutil.Discard, nil, del)
+	if res == nil || res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected tap delete ack, got: %v", res)
+	}
+	if res = vb.get([]byte("a")); res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected tap delete to delete, got: %v", res)
+	}
+	if vb.Meta().LastCas != 12347 {
+		t.Errorf("expected tap cas to advance last cas, got: %v", vb.Meta().LastCas)
+	}
+
+	flush := tapReq(gomemcached.TAP_FLUSH, TAP_FLAG_ACK, TAP_EXTRAS_LEN)
+	res = rh.HandleMessage(ioutil.Discard, nil, flush)
+	if res == nil || res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected tap flush ack, got: %v", res)
+	}
+	if res = vb.get([]byte("bb")); res.Status != gomemcached.KEY_ENOENT ||
+		vb.stats.Items != 0 {
+		t.Errorf("expected tap flush to remove the items, got: %v", res)
+	}
+
+	res = rh.HandleMessage(ioutil.Discard, nil,
+		tapReq(gomemcached.TAP_OPAQUE, TAP_FLAG_ACK, TAP_EXTRAS_LEN))
+	if res == nil || res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected tap opaque ack, got: %v", res)
+	}
+
+	if vb.stats.TapReceives != 4 {
+		t.Errorf("expected 4 tap receives, got: %v", vb.stats.TapReceives)
+	}
+}
+
+// After a takeover, clients get the source cas of TAP-received items,
+// so their CAS operations keep working.
+func TestTapReceiveKeepsCas(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	testBucket.CreateVBucket(1)
+	testBucket.SetVBState(1, VBReplica)
+	rh := reqHandler{currentBucket: testBucket}
+
+	req := &gomemcached.MCRequest{
+		Opcode:  gomemcached.TAP_MUTATION,
+		VBucket: 1,
+		Key:     []byte("a"),
+		Cas:     5000,
+		Extras:  make([]byte, TAP_MUTATION_EXTRAS_LEN),
+		Body:    []byte("aye"),
+	}
+	if res := rh.HandleMessage(ioutil.Discard, nil, req); res != nil {
+		t.Errorf("expected no response without ack flag, got: %v", res)
+	}
+	testBucket.SetVBState(1, VBActive)
+
+	res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.GET,
+		VBucket: 1,
+		Key:     []byte("a"),
+	})
+	if res.Status != gomemcached.SUCCESS || res.Cas != 5000 {
+		t.Errorf("expected get to return the source cas, got: %v", res)
+	}
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.SET,
+		VBucket: 1,
+		Key:     []byte("a"),
+		Cas:     5000,
+		Extras:  make([]byte, 8),
+		Body:    []byte("bee"),
+	})
+	if res.Status != gomemcached.SUCCESS || res.Cas <= 5000 {
+		t.Errorf("expected a set with the source cas to work, got: %v", res)
+	}
+}
+
+func tapTestMutate(vb *VBucket, opcode gomemcached.CommandCode,
+	key, val string) {
+	vb.Dispatch(nil, &gomemcached.MCRequest{
+		Opcode:  opcode,
+		VBucket: vb.vbid,
+		Key:     []byte(key),
+		Body:    []byte(val),
+	})
+}
+
+func TestTapListVBuckets(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	for vbid := uint16(0); vbid < 3; vbid++ {
+		testBucket.CreateVBucket(vbid)
+		testBucket.SetVBState(vbid, VBActive)
+		vb, _ := testBucket.GetVBucket(vbid)
+		tapTestMutate(vb, gomemcached.SET, "a", "aye")
+	}
+
+	chpkt := make(chan transmissible, 128)
+	cherr := make(chan error, 1)
+	rh := reqHandler{currentBucket: testBucket}
+	_, mustTransmit, _ := makeMustTapFuncs(t, &rh, chpkt)
+
+	treq := &gomemcached.MCRequest{
+		Opcode: gomemcached.TAP_CONNECT,
+		Extras: make([]byte, 4),
+		Body:   []byte{0, 2, 0, 0, 0, 2},
+	}
+	binary.BigEndian.PutUint32(treq.Extras,
+		uint32(gomemcached.DUMP|gomemcached.LIST_VBUCKETS))
+	ackRes := &gomemcached.MCResponse{Opcode: gomemcached.TAP_OPAQUE}
+
+	go doTap(testBucket, treq, bytes.NewBuffer(ackRes.Bytes()), chpkt, cherr)
+
+	if m := mustTransmit("vb0", gomemcached.TAP_MUTATION); m.VBucket != 0 {
+		t.Errorf("expected vbucket 0, got: %v", m.VBucket)
+	}
+	if m := mustTransmit("vb2", gomemcached.TAP_MUTATION); m.VBucket != 2 {
+		t.Errorf("expected vbucket 2, got: %v", m.VBucket)
+	}
+	mustTransmit("ack wanted", gomemcached.TAP_OPAQUE)
+	mustTapDone("dump done", t, chpkt)
+}
+
+func TestTapTakeover(t *testing.T) {
+	srcDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(srcDir)
+	src, _ := NewBucket("src", srcDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer src.Close()
+	dstDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dstDir)
+	dst, _ := NewBucket("dst", dstDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer dst.Close()
+
+	for vbid := uint16(0); vbid < 2; vbid++ {
+		src.CreateVBucket(vbid)
+		src.SetVBState(vbid, VBActive)
+		vb, _ := src.GetVBucket(vbid)
+		tapTestMutate(vb, gomemcached.SET, "a", "aye")
+		tapTestMutate(vb, gomemcached.SET, "b", "bee")
+	}
+	dst.CreateVBucket(1)
+	dst.SetVBState(1, VBPending)
+
+	treq := &gomemcached.MCRequest{
+		Opcode: gomemcached.TAP_CONNECT,
+		Extras: make([]byte, 4),
+		Body:   []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 1},
+	}
+	binary.BigEndian.PutUint32(treq.Extras, uint32(gomemcached.BACKFILL|
+		gomemcached.LIST_VBUCKETS|gomemcached.TAKEOVER_VBUCKETS))
+
+	// Pipe the TAP stream into the destination bucket, and its acks
+	// back to the source.
+	chpkt := make(chan transmissible, 128)
+	cherr := make(chan error, 1)
+	ackr, ackw := io.Pipe()
+	go doTap(src, treq, ackr, chpkt, cherr)
+
+	srcRH := reqHandler{currentBucket: src}
+	rh := reqHandler{currentBucket: dst}
+	opcodes := []gomemcached.CommandCode{}
+	var pendingRes *gomemcached.MCResponse
+	donech := make(chan bool)
+	go func() {
+		defer close(donech)
+		for pkt := range chpkt {
+			req := pkt.(*gomemcached.MCRequest)
+			opcodes = append(opcodes, req.Opcode)
+			if req.Opcode == gomemcached.TAP_VBUCKET_SET {
+				pendingRes = srcRH.HandleMessage(ioutil.Discard, nil,
+					&gomemcached.MCRequest{
+						Opcode:  gomemcached.SET,
+						VBucket: 1,
+						Key:     []byte("c"),
+						Body:    []byte("sea"),
+					})
+			}
+			res := rh.HandleMessage(ioutil.Discard, nil, req)
+			if res != nil {
+				res.Opcode = req.Opcode
+				ackw.Write(res.Bytes())
+			}
+		}
+	}()
+
+	select {
+	case <-donech:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the takeover to finish")
+	}
+
+	if len(opcodes) < 2 ||
+		opcodes[len(opcodes)-2] != gomemcached.TAP_VBUCKET_SET ||
+		opcodes[len(opcodes)-1] != gomemcached.TAP_OPAQUE {
+		t.Errorf("expected a vbucket set and ack to end the takeover,"+
+			" got: %v", opcodes)
+	}
+	if pendingRes == nil || pendingRes.Status != gomemcached.TMPFAIL {
+		t.Errorf("expected the source to refuse writes during the takeover,"+
+			" got: %v", pendingRes)
+	}
+	vb0, _ := src.GetVBucket(0)
+	vb1, _ := src.GetVBucket(1)
+	if vb0.GetVBState() != VBActive || vb1.GetVBState() != VBDead {
+		t.Errorf("expected only the taken over source vbucket to be dead,"+
+			" got: %v, %v", vb0.GetVBState(), vb1.GetVBState())
+	}
+	dvb, _ := dst.GetVBucket(1)
+	if dvb.GetVBState() != VBActive {
+		t.Errorf("expected the destination vbucket to be active, got: %v",
+			dvb.GetVBState())
+	}
+	for _, kv := range [][]string{{"a", "aye"}, {"b", "bee"}} {
+		res := dvb.get([]byte(kv[0]))
+		if res.Status != gomemcached.SUCCESS || string(res.Body) != kv[1] {
+			t.Errorf("expected %v at the destination, got: %v", kv, res)
+		}
+	}
+}
+
+func TestTapRegisteredCheckpoints(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	vb, _ := testBucket.CreateVBucket(0)
+	testBucket.SetVBState(0, VBActive)
+	tapTestMutate(vb, gomemcached.SET, "a", "aye")
+	tapTestMutate(vb, gomemcached.SET, "b", "bee")
+
+	rh := reqHandler{currentBucket: testBucket}
+	ackRes := &gomemcached.MCResponse{Opcode: gomemcached.TAP_OPAQUE}
+
+	treq := &gomemcached.MCRequest{
+		Opcode: gomemcached.TAP_CONNECT,
+		Key:    []byte("replica-1"),
+		Extras: make([]byte, 4),
+	}
+	binary.BigEndian.PutUint32(treq.Extras,
+		uint32(gomemcached.DUMP|gomemcached.REGISTERED_CLIENT))
+
+	chpkt := make(chan transmissible, 128)
+	_, mustTransmit, _ := makeMustTapFuncs(t, &rh, chpkt)
+	doTap(testBucket, treq, bytes.NewBuffer(ackRes.Bytes()), chpkt,
+		make(chan error, 1))
+	mustTransmit("a", gomemcached.TAP_MUTATION)
+	mustTransmit("b", gomemcached.TAP_MUTATION)
+	mustTransmit("ack wanted", gomemcached.TAP_OPAQUE)
+
+	cas, err := vb.getTapCheckpoint("replica-1")
+	if err != nil || cas != vb.Meta().LastCas {
+		t.Errorf("expected checkpoint at last cas %v, got: %v, %v",
+			vb.Meta().LastCas, cas, err)
+	}
+
+	// A reconnecting client only sees the changes since its checkpoint.
+	tapTestMutate(vb, gomemcached.SET, "c", "sea")
+	tapTestMutate(vb, gomemcached.DELETE, "a", "")
+
+	chpkt = make(chan transmissible, 128)
+	_, mustTransmit, _ = makeMustTapFuncs(t, &rh, chpkt)
+	doTap(testBucket, treq, bytes.NewBuffer(ackRes.Bytes()), chpkt,
+		make(chan error, 1))
+	if m := mustTransmit("c", gomemcached.TAP_MUTATION); string(m.Key) != "c" {
+		t.Errorf("expected only the new change, got: %v", m)
+	}
+	if m := mustTransmit("a", gomemcached.TAP_DELETE); string(m.Key) != "a" {
+		t.Errorf("expected the deletion, got: %v", m)
+	}
+	mustTransmit("ack wanted", gomemcached.TAP_OPAQUE)
+	mustTapDone("resume done", t, chpkt)
+
+	// An unregistered client gets everything.
+	binary.BigEndian.PutUint32(treq.Extras, uint32(gomemcached.DUMP))
+	chpkt = make(chan transmissible, 128)
+	_, mustTransmit, _ = makeMustTapFuncs(t, &rh, chpkt)
+	doTap(testBucket, treq, bytes.NewBuffer(ackRes.Bytes()), chpkt,
+		make(chan error, 1))
+	mustTransmit("b", gomemcached.TAP_MUTATION)
+	mustTransmit("c", gomemcached.TAP_MUTATION)
+	mustTransmit("ack wanted", gomemcached.TAP_OPAQUE)
+}
+
+func TestTapForwardCheckpoints(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	vb, _ := testBucket.CreateVBucket(0)
+	testBucket.SetVBState(0, VBActive)
+
+	origFreq := tapTickFreq
+	tapTickFreq = 10 * time.Millisecond
+	defer func() {
+		tapTickFreq = origFreq
+	}()
+
+	treq := &gomemcached.MCRequest{
+		Opcode: gomemcached.TAP_CONNECT,
+		Key:    []byte("replica-1"),
+		Extras: make([]byte, 4),
+	}
+	binary.BigEndian.PutUint32(treq.Extras,
+		uint32(gomemcached.REGISTERED_CLIENT))
+
+	chpkt := make(chan transmissible, 128)
+	cherr := make(chan error, 1)
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go doTap(testBucket, treq, pr, chpkt, cherr)
+	defer func() {
+		cherr <- io.EOF
+	}()
+
+	time.Sleep(50 * time.Millisecond) // Let tap settle.
+	tapTestMutate(vb, gomemcached.SET, "a", "aye")
+
+	deadline := time.After(time.Second)
+	for {
+		var pkt *gomemcached.MCRequest
+		select {
+		case m := <-chpkt:
+			pkt = m.(*gomemcached.MCRequest)
+		case <-deadline:
+			t.Fatalf("expected a heartbeat wanting an ack")
+		}
+		if pkt.Opcode != gomemcached.TAP_OPAQUE ||
+			binary.BigEndian.Uint16(pkt.Extras[2:])&TAP_FLAG_ACK == 0 {
+			continue
+		}
+		ackRes := &gomemcached.MCResponse{
+			Opcode: gomemcached.TAP_OPAQUE,
+			Opaque: pkt.Opaque,
+		}
+		pw.Write(ackRes.Bytes())
+		break
+	}
+
+	for i := 0; i < 100; i++ {
+		if cas, _ := vb.getTapCheckpoint("replica-1"); cas == vb.Meta().LastCas {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("expected the ack to save a checkpoint")
+}
+
+func TestTapBackFillNoGap(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	vb, _ := testBucket.CreateVBucket(0)
+	testBucket.SetVBState(0, VBActive)
+	tapTestMutate(vb, gomemcached.SET, "a", "aye")
+	tapTestMutate(vb, gomemcached.SET, "b", "bee")
+	tapTestMutate(vb, gomemcached.SET, "c", "sea")
+
+	treq := &gomemcached.MCRequest{
+		Opcode: gomemcached.TAP_CONNECT,
+		Extras: make([]byte, 4),
+		Body:   make([]byte, 8),
+	}
+	binary.BigEndian.PutUint32(treq.Extras, uint32(gomemcached.BACKFILL))
+	ackRes := &gomemcached.MCResponse{Opcode: gomemcached.TAP_OPAQUE}
+
+	// An unbuffered chpkt blocks the backfill, so the mutations here
+	// land in the middle of it.
+	chpkt := make(chan transmissible)
+	cherr := make(chan error, 1)
+	go doTap(testBucket, treq, bytes.NewBuffer(ackRes.Bytes()), chpkt, cherr)
+	defer func() {
+		cherr <- io.EOF
+	}()
+
+	next := func() *gomemcached.MCRequest {
+		select {
+		case m := <-chpkt:
+			return m.(*gomemcached.MCRequest)
+		case <-time.After(time.Second):
+			t.Fatalf("expected more tap messages")
+		}
+		return nil
+	}
+
+	if m := next(); string(m.Key) != "a" {
+		t.Fatalf("expected a first, got: %v", m)
+	}
+	tapTestMutate(vb, gomemcached.SET, "c", "sea2")
+	tapTestMutate(vb, gomemcached.SET, "d", "dee")
+
+	seen := map[uint64]bool{}
+	vals := map[string]string{}
+	for {
+		m := next()
+		if m.Opcode == gomemcached.TAP_OPAQUE {
+			break
+		}
+		if seen[m.Cas] {
+			t.Errorf("expected no duplicates, got: %v", m)
+		}
+		seen[m.Cas] = true
+		vals[string(m.Key)] = string(m.Body)
+	}
+	if vals["b"] != "bee" || vals["c"] != "sea2" || vals["d"] != "dee" {
+		t.Errorf("expected the backfill to have all changes, got: %v", vals)
+	}
+
+	// The mutations during the backfill aren't forwarded again.
+	select {
+	case m := <-chpkt:
+		t.Errorf("expected no more tap messages, got: %v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	tapTestMutate(vb, gomemcached.SET, "e", "eee")
+	if m := next(); string(m.Key) != "e" {
+		t.Errorf("expected forwarding after the backfill, got: %v", m)
+	}
+}
+
 func TestSizeOfMutation(t *testing.T) {
 	t.Logf("sizeof various structs and types, in bytes...")
 	t.Logf("  Sizeof(mutation{}): %v", unsafe.Sizeof(mutation{}))
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+// UPR streams send a vbucket's changes in seqno order, as snapshots
+// built from the cas ordered changes stream.  Unlike TAP, a client
+// may resume a stream from any seqno of a branch of the vbucket's
+// failover log, and is told to rollback when its history diverged.
+
+const (
+	UPR_ROLLBACK = gomemcached.Status(0x23)
+
+	UPR_OPEN_PRODUCER = uint32(0x01) // UPR_OPEN flag.
+
+	UPR_SNAPSHOT_MEMORY = uint32(0x01) // UPR_SNAPSHOT_MARKER flags.
+	UPR_SNAPSHOT_DISK   = uint32(0x02)
+
+	UPR_STREAM_END_OK           = uint32(0x00) // UPR_STREAM_END flags.
+	UPR_STREAM_END_STATE_CHANGE = uint32(0x02)
+
+	// The UPR_STREAM_REQ extras: flags, reserved, start seqno, end
+	// seqno, vbucket uuid, snapshot start seqno and snapshot end seqno.
+	UPR_STREAM_REQ_EXTRAS_LEN = 4 + 4 + 8 + 8 + 8 + 8 + 8
+)
+
+// How often an idle UPR stream checks its vbucket's state.
+var uprTickFreq = time.Second
+
+// The UPR state of a connection, after UPR_OPEN.
+type uprConn struct {
+	name string
+
+	m       sync.Mutex // Serializes writes of responses and streams.
+	w       io.Writer
+	streams map[uint16]*uprStream // Keyed by vbid, covered by m.
+}
+
+type uprStream struct {
+	vb      *VBucket
+	opaque  uint32
+	end     uint64 // The stream ends after this seqno.
+	sent    uint64 // The end seqno of the last snapshot we sent.
+	sentCas uint64 // The highest cas up to sent, or 0 if unknown.
+	mch     chan interface{}
+	stopch  chan bool // Closed by UPR_CLOSE_STREAM or the connection.
+}
+
+func (uc *uprConn) write(pkt []byte) error {
+	uc.m.Lock()
+	defer uc.m.Unlock()
+	_, err := uc.w.Write(pkt)
+	return err
+}
+
+func (uc *uprConn) removeStream(s *uprStream) {
+	uc.m.Lock()
+	defer uc.m.Unlock()
+	if uc.streams[s.vb.vbid] == s {
+		delete(uc.streams, s.vb.vbid)
+	}
+}
+
+// The key of UPR_OPEN is the connection's name, and we only support
+// producer connections, which stream changes to the client.
+func (rh *reqHandler) uprOpen(w io.Writer,
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if len(req.Extras) != 8 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body: []byte(fmt.Sprintf("wrong extras size for upr open: %v",
+				len(req.Extras))),
+		}
+	}
+	if binary.BigEndian.Uint32(req.Extras[4:])&UPR_OPEN_PRODUCER == 0 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("only upr producer connections are supported"),
+		}
+	}
+	if rh.upr != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("upr connection is already open"),
+		}
+	}
+	if rw, ok := w.(*responseWriter); ok {
+		w = rw.Writer
+	}
+	rh.upr = &uprConn{
+		name:    string(req.Key),
+		w:       w,
+		streams: map[uint16]*uprStream{},
+	}
+	return &gomemcached.MCResponse{}
+}
+
+// Stops the streams of a closed connection.
+func (rh *reqHandler) closeUpr() {
+	if rh.upr == nil {
+		return
+	}
+	rh.upr.m.Lock()
+	defer rh.upr.m.Unlock()
+	for vbid, s := range rh.upr.streams {
+		close(s.stopch)
+		delete(rh.upr.streams, vbid)
+	}
+}
+
+func uprFailoverLogBytes(flog []FailoverEntry) []byte {
+	rv := make([]byte, 16*len(flog))
+	for j, e := range flog {
+		binary.BigEndian.PutUint64(rv[16*j:], e.UUID)
+		binary.BigEndian.PutUint64(rv[16*j+8:], e.Seqno)
+	}
+	return rv
+}
+
+func doUprGetFailoverLog(b Bucket,
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	vb, err := b.GetVBucket(req.VBucket)
+	if err == bucketUnavailable {
+		return dropConnection
+	}
+	if vb == nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.NOT_MY_VBUCKET,
+		}
+	}
+	return &gomemcached.MCResponse{
+		Body: uprFailoverLogBytes(vb.Meta().failoverLog()),
+	}
+}
+
+// Returns the seqno that a client must rollback to before it can
+// stream from startSeqno, when the client's history (its vbucket uuid
+// and its last, maybe partial, snapshot) isn't a part of ours.
+func uprRollback(flog []FailoverEntry, highSeqno, vbuuid,
+	startSeqno, snapStart, snapEnd uint64) (uint64, bool) {
+	if startSeqno == 0 {
+		return 0, false
+	}
+	for j, e := range flog {
+		if e.UUID != vbuuid {
+			continue
+		}
+		// The client's branch of our history ends where the next
+		// newer branch starts.
+		upper := highSeqno
+		if j > 0 {
+			upper = flog[j-1].Seqno
+		}
+		if snapEnd <= upper {
+			return 0, false
+		}
+		if snapStart < upper {
+			return snapStart, true
+		}
+		return upper, true
+	}
+	return 0, true
+}
+
+// Starts streaming a vbucket's changes after a start seqno, where
+// the success response has the vbucket's failover log.
+func (rh *reqHandler) uprStreamReq(
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	uc := rh.upr
+	if uc == nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("upr stream needs an upr open"),
+		}
+	}
+	if len(req.Extras) != UPR_STREAM_REQ_EXTRAS_LEN {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body: []byte(fmt.Sprintf("wrong extras size for upr stream: %v",
+				len(req.Extras))),
+		}
+	}
+	startSeqno := binary.BigEndian.Uint64(req.Extras[8:])
+	endSeqno := binary.BigEndian.Uint64(req.Extras[16:])
+	vbuuid := binary.BigEndian.Uint64(req.Extras[24:])
+	snapStart := binary.BigEndian.Uint64(req.Extras[32:])
+	snapEnd := binary.BigEndian.Uint64(req.Extras[40:])
+	if startSeqno > endSeqno || snapStart > startSeqno || startSeqno > snapEnd {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body: []byte(fmt.Sprintf("invalid upr stream seqnos,"+
+				" start: %v, end: %v, snapshot start: %v, snapshot end: %v",
+				startSeqno, endSeqno, snapStart, snapEnd)),
+		}
+	}
+
+	vb, err := rh.currentBucket.GetVBucket(req.VBucket)
+	if err == bucketUnavailable {
+		return dropConnection
+	}
+	if vb == nil || vb.GetVBState() != VBActive {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.NOT_MY_VBUCKET,
+		}
+	}
+
+	// Register before the first snapshot, so we're woken up by any
+	// later change.
+	s := &uprStream{
+		vb:     vb,
+		opaque: req.Opaque,
+		end:    endSeqno,
+		sent:   startSeqno,
+		mch:    make(chan interface{}, 1000),
+		stopch: make(chan bool),
+	}
+	vb.observer.Register(s.mch)
+
+	flog := vb.Meta().failoverLog()
+	rollbackSeqno, rollback := uprRollback(flog, vb.ps.highSeqno(),
+		vbuuid, startSeqno, snapStart, snapEnd)
+	if rollback {
+		vb.observer.Unregister(s.mch)
+		res := &gomemcached.MCResponse{
+			Status: UPR_ROLLBACK,
+			Body:   make([]byte, 8),
+		}
+		binary.BigEndian.PutUint64(res.Body, rollbackSeqno)
+		return res
+	}
+
+	uc.m.Lock()
+	defer uc.m.Unlock()
+	if uc.streams[vb.vbid] != nil {
+		vb.observer.Unregister(s.mch)
+		return &gomemcached.MCResponse{
+			Status: gomemcached.KEY_EEXISTS,
+			Body:   []byte("upr stream already exists for vbucket"),
+		}
+	}
+
+	// We write the response ourselves, so that it comes before the
+	// stream's messages.
+	res := &gomemcached.MCResponse{
+		Opcode: req.Opcode,
+		Opaque: req.Opaque,
+		Body:   uprFailoverLogBytes(flog),
+	}
+	if _, err = uc.w.Write(res.Bytes()); err != nil {
+		vb.observer.Unregister(s.mch)
+		return &gomemcached.MCResponse{Fatal: true}
+	}
+	uc.streams[vb.vbid] = s
+	go uc.runStream(s)
+	return nil
+}
+
+func (rh *reqHandler) uprCloseStream(
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if rh.upr == nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("upr close stream needs an upr open"),
+		}
+	}
+	rh.upr.m.Lock()
+	defer rh.upr.m.Unlock()
+	s := rh.upr.streams[req.VBucket]
+	if s == nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.KEY_ENOENT,
+			Body:   []byte("no upr stream for vbucket"),
+		}
+	}
+	close(s.stopch)
+	delete(rh.upr.streams, req.VBucket)
+	return &gomemcached.MCResponse{}
+}
+
+// Sends snapshots until the stream's end seqno, waiting for more
+// changes when we've sent them all.
+func (uc *uprConn) runStream(s *uprStream) {
+	defer s.vb.observer.Unregister(s.mch)
+
+	ticker := time.NewTicker(uprTickFreq)
+	defer ticker.Stop()
+
+	flags := UPR_SNAPSHOT_DISK
+	for {
+		if s.sent >= s.end {
+			uc.endStream(s, UPR_STREAM_END_OK)
+			return
+		}
+		if s.vb.GetVBState() != VBActive {
+			uc.endStream(s, UPR_STREAM_END_STATE_CHANGE)
+			return
+		}
+		startCas, highSeqno, highCas := s.vb.ps.snapshotBounds(s.sent, s.sentCas)
+		if highSeqno > s.sent {
+			snapEnd := highSeqno
+			if snapEnd > s.end {
+				snapEnd, highCas = s.end, 0
+			}
+			err := uc.sendSnapshot(s, startCas, snapEnd, flags)
+			if err != nil {
+				if err != ignore {
+					log.Printf("error: upr stream, name: %v, vbucket: %v,"+
+						" err: %v", uc.name, s.vb.vbid, err)
+				}
+				uc.removeStream(s)
+				return
+			}
+			s.sentCas = highCas
+			flags = UPR_SNAPSHOT_MEMORY
+			continue
+		}
+
+		select {
+		case <-s.mch:
+			s.drain()
+		case <-ticker.C:
+		case <-s.stopch:
+			return
+		}
+	}
+}
+
+// Sends the changes after the last snapshot up to snapEnd, which are
+// sent in cas order rather than seqno order, visiting the changes
+// stream from startCas, the lowest cas they can have, or from the
+// start when it's 0.  Changes de-duplicated by later changes aren't
+// sent, as the later change will be.
+func (uc *uprConn) sendSnapshot(s *uprStream, startCas, snapEnd uint64,
+	flags uint32) error {
+	marker := &gomemcached.MCRequest{
+		Opcode:  UPR_SNAPSHOT_MARKER,
+		VBucket: s.vb.vbid,
+		Opaque:  s.opaque,
+		Extras:  make([]byte, 8+8+4),
+	}
+	binary.BigEndian.PutUint64(marker.Extras, s.sent+1)
+	binary.BigEndian.PutUint64(marker.Extras[8:], snapEnd)
+	binary.BigEndian.PutUint32(marker.Extras[16:], flags)
+	if err := uc.write(marker.Bytes()); err != nil {
+		return err
+	}
+
+	var start []byte
+	if startCas > 0 {
+		start = casBytes(startCas)
+	}
+	var err error
+	errVisit := s.vb.ps.visitChanges(start, true, func(i *item) bool {
+		if len(i.key) == 0 || i.seqno <= s.sent || i.seqno > snapEnd {
+			return true // Skip VBMeta changes and other snapshots.
+		}
+		select {
+		case <-s.stopch:
+			err = ignore
+			return false
+		default:
+		}
+		if err = uc.write(uprItemRequest(s, i).Bytes()); err != nil {
+			return false
+		}
+		s.drain()
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if errVisit != nil {
+		return errVisit
+	}
+	s.sent = snapEnd
+	return nil
+}
+
+func (uc *uprConn) endStream(s *uprStream, flags uint32) {
+	uc.removeStream(s)
+	pkt := &gomemcached.MCRequest{
+		Opcode:  UPR_STREAM_END,
+		VBucket: s.vb.vbid,
+		Opaque:  s.opaque,
+		Extras:  make([]byte, 4),
+	}
+	binary.BigEndian.PutUint32(pkt.Extras, flags)
+	uc.write(pkt.Bytes())
+}
+
+// Discards the change notifications that we've caught up with, so
+// the vbucket's observer isn't blocked.
+func (s *uprStream) drain() {
+	for {
+		select {
+		case <-s.mch:
+		default:
+			return
+		}
+	}
+}
+
+// Encodes an item change as an UPR_MUTATION or UPR_DELETION.
+func uprItemRequest(s *uprStream, i *item) *gomemcached.MCRequest {
+	pkt := &gomemcached.MCRequest{
+		Opcode:  UPR_MUTATION,
+		VBucket: s.vb.vbid,
+		Opaque:  s.opaque,
+		Key:     i.key,
+		Cas:     i.cas,
+	}
+	if i.isDeletion() {
+		// The extras are the seqno, rev and the metadata length.
+		pkt.Opcode = UPR_DELETION
+		pkt.Extras = make([]byte, 8+8+2)
+	} else {
+		// The extras are the seqno, rev, flags, exp, lock time,
+		// metadata length and nru.
+		pkt.Extras = make([]byte, 8+8+4+4+4+2+1)
+		binary.BigEndian.PutUint32(pkt.Extras[16:], i.flag)
+		binary.BigEndian.PutUint32(pkt.Extras[20:], i.exp)
+		pkt.Body = i.data
+	}
+	binary.BigEndian.PutUint64(pkt.Extras, i.seqno)
+	binary.BigEndian.PutUint64(pkt.Extras[8:], i.rev)
+	return pkt
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+// A packet read from an UPR connection, where vbucket is the status
+// of responses.
+type uprTestPkt struct {
+	magic   uint8
+	opcode  gomemcached.CommandCode
+	vbucket uint16
+	opaque  uint32
+	extras  []byte
+	key     []byte
+	body    []byte
+}
+
+func readUprTestPkt(t *testing.T, r io.Reader) *uprTestPkt {
+	hdr := make([]byte, gomemcached.HDR_LEN)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		t.Fatalf("Expected to read an upr header, got %v", err)
+	}
+	elen := int(hdr[4])
+	klen := int(binary.BigEndian.Uint16(hdr[2:]))
+	blen := int(binary.BigEndian.Uint32(hdr[8:]))
+	buf := make([]byte, blen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("Expected to read an upr body, got %v", err)
+	}
+	return &uprTestPkt{
+		magic:   hdr[0],
+		opcode:  gomemcached.CommandCode(hdr[1]),
+		vbucket: binary.BigEndian.Uint16(hdr[6:]),
+		opaque:  binary.BigEndian.Uint32(hdr[12:]),
+		extras:  buf[:elen],
+		key:     buf[elen : elen+klen],
+		body:    buf[elen+klen:],
+	}
+}
+
+func uprTestStreamReq(vbid uint16, opaque uint32,
+	start, end, vbuuid, snapStart, snapEnd uint64) *gomemcached.MCRequest {
+	req := &gomemcached.MCRequest{
+		Opcode:  UPR_STREAM_REQ,
+		VBucket: vbid,
+		Opaque:  opaque,
+		Extras:  make([]byte, UPR_STREAM_REQ_EXTRAS_LEN),
+	}
+	binary.BigEndian.PutUint64(req.Extras[8:], start)
+	binary.BigEndian.PutUint64(req.Extras[16:], end)
+	binary.BigEndian.PutUint64(req.Extras[24:], vbuuid)
+	binary.BigEndian.PutUint64(req.Extras[32:], snapStart)
+	binary.BigEndian.PutUint64(req.Extras[40:], snapEnd)
+	return req
+}
+
+// Starts a session on a pipe, returning the client's end after an
+// UPR_OPEN.
+func uprTestOpen(t *testing.T, b Bucket) net.Conn {
+	client, server := net.Pipe()
+	go sessionLoop(server, "test", &reqHandler{currentBucket: b}, func() {})
+
+	open := &gomemcached.MCRequest{
+		Opcode: UPR_OPEN,
+		Key:    []byte("test-upr"),
+		Extras: []byte{0, 0, 0, 0, 0, 0, 0, 1},
+	}
+	client.Write(open.Bytes())
+	if pkt := readUprTestPkt(t, client); pkt.magic != gomemcached.RES_MAGIC ||
+		gomemcached.Status(pkt.vbucket) != gomemcached.SUCCESS {
+		t.Fatalf("Expected upr open to work, got %#v", pkt)
+	}
+	return client
+}
+
+func expectUprSnapshot(t *testing.T, pkt *uprTestPkt, start, end uint64,
+	flags uint32) {
+	if pkt.opcode != UPR_SNAPSHOT_MARKER || len(pkt.extras) != 20 ||
+		binary.BigEndian.Uint64(pkt.extras) != start ||
+		binary.BigEndian.Uint64(pkt.extras[8:]) != end ||
+		binary.BigEndian.Uint32(pkt.extras[16:]) != flags {
+		t.Errorf("Expected snapshot marker %v-%v, flags %v, got %#v",
+			start, end, flags, pkt)
+	}
+}
+
+func expectUprItem(t *testing.T, pkt *uprTestPkt,
+	opcode gomemcached.CommandCode, key string, seqno uint64) {
+	if pkt.opcode != opcode || string(pkt.key) != key ||
+		binary.BigEndian.Uint64(pkt.extras) != seqno {
+		t.Errorf("Expected %v of %v at seqno %v, got %#v",
+			opcode, key, seqno, pkt)
+	}
+}
+
+func TestUprRollback(t *testing.T) {
+	flog := []FailoverEntry{{UUID: 2, Seqno: 10}, {UUID: 1, Seqno: 0}}
+	tests := []struct {
+		vbuuid, start, snapStart, snapEnd uint64
+		exp                               uint64
+		expRollback                       bool
+	}{
+		{0, 0, 0, 0, 0, false},
+		{3, 0, 0, 0, 0, false},
+		{2, 15, 15, 15, 0, false},
+		{2, 25, 25, 25, 20, true},
+		{1, 8, 5, 8, 0, false},
+		{1, 10, 10, 10, 0, false},
+		{1, 12, 12, 12, 10, true},
+		{1, 9, 9, 12, 9, true},
+		{3, 5, 5, 5, 0, true},
+	}
+	for j, test := range tests {
+		rv, rollback := uprRollback(flog, 20, test.vbuuid,
+			test.start, test.snapStart, test.snapEnd)
+		if rv != test.exp || rollback != test.expRollback {
+			t.Errorf("test %v, %#v, got %v, %v", j, test, rv, rollback)
+		}
+	}
+}
+
+func TestUprStream(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	b, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer b.Close()
+	b.CreateVBucket(0)
+	b.SetVBState(0, VBActive)
+	vb, _ := b.GetVBucket(0)
+	tapTestMutate(vb, gomemcached.SET, "a", "aye")
+	tapTestMutate(vb, gomemcached.SET, "b", "bee")
+	tapTestMutate(vb, gomemcached.DELETE, "a", "")
+	if vb.ps.highSeqno() != 3 {
+		t.Fatalf("Expected high seqno 3, got %v", vb.ps.highSeqno())
+	}
+	vbuuid := vb.Meta().FailoverLog[0].UUID
+
+	client := uprTestOpen(t, b)
+	defer client.Close()
+
+	client.Write(uprTestStreamReq(0, 123, 0, math.MaxUint64, 0, 0, 0).Bytes())
+	pkt := readUprTestPkt(t, client)
+	if pkt.magic != gomemcached.RES_MAGIC || pkt.opcode != UPR_STREAM_REQ ||
+		gomemcached.Status(pkt.vbucket) != gomemcached.SUCCESS ||
+		pkt.opaque != 123 ||
+		!bytes.Equal(pkt.body, uprFailoverLogBytes(vb.Meta().failoverLog())) {
+		t.Fatalf("Expected stream req to return the failover log, got %#v", pkt)
+	}
+
+	expectUprSnapshot(t, readUprTestPkt(t, client), 1, 3, UPR_SNAPSHOT_DISK)
+	pkt = readUprTestPkt(t, client)
+	expectUprItem(t, pkt, UPR_MUTATION, "b", 2)
+	if string(pkt.body) != "bee" || pkt.opaque != 123 {
+		t.Errorf("Expected mutation value and opaque, got %#v", pkt)
+	}
+	expectUprItem(t, readUprTestPkt(t, client), UPR_DELETION, "a", 3)
+
+	tapTestMutate(vb, gomemcached.SET, "c", "sea")
+	expectUprSnapshot(t, readUprTestPkt(t, client), 4, 4, UPR_SNAPSHOT_MEMORY)
+	expectUprItem(t, readUprTestPkt(t, client), UPR_MUTATION, "c", 4)
+
+	client.Write(uprTestStreamReq(0, 124, 0, math.MaxUint64, 0, 0, 0).Bytes())
+	pkt = readUprTestPkt(t, client)
+	if gomemcached.Status(pkt.vbucket) != gomemcached.KEY_EEXISTS {
+		t.Errorf("Expected a second stream to fail, got %#v", pkt)
+	}
+
+	client.Write((&gomemcached.MCRequest{
+		Opcode:  UPR_CLOSE_STREAM,
+		VBucket: 0,
+	}).Bytes())
+	pkt = readUprTestPkt(t, client)
+	if pkt.opcode != UPR_CLOSE_STREAM ||
+		gomemcached.Status(pkt.vbucket) != gomemcached.SUCCESS {
+		t.Errorf("Expected close stream to work, got %#v", pkt)
+	}
+
+	// Resuming from our last snapshot only sends the later changes.
+	tapTestMutate(vb, gomemcached.SET, "b", "bye")
+	client.Write(uprTestStreamReq(0, 125, 4, 5, vbuuid, 4, 4).Bytes())
+	pkt = readUprTestPkt(t, client)
+	if gomemcached.Status(pkt.vbucket) != gomemcached.SUCCESS {
+		t.Fatalf("Expected stream resume to work, got %#v", pkt)
+	}
+	expectUprSnapshot(t, readUprTestPkt(t, client), 5, 5, UPR_SNAPSHOT_DISK)
+	expectUprItem(t, readUprTestPkt(t, client), UPR_MUTATION, "b", 5)
+	pkt = readUprTestPkt(t, client)
+	if pkt.opcode != UPR_STREAM_END || pkt.opaque != 125 ||
+		binary.BigEndian.Uint32(pkt.extras) != UPR_STREAM_END_OK {
+		t.Errorf("Expected stream end, got %#v", pkt)
+	}
+
+	// A client from an unknown history must rollback.
+	client.Write(uprTestStreamReq(0, 126, 2, 5, vbuuid+1, 2, 2).Bytes())
+	pkt = readUprTestPkt(t, client)
+	if gomemcached.Status(pkt.vbucket) != UPR_ROLLBACK ||
+		binary.BigEndian.Uint64(pkt.body) != 0 {
+		t.Errorf("Expected rollback, got %#v", pkt)
+	}
+
+	client.Write(uprTestStreamReq(0, 127, 0, math.MaxUint64, 0, 0, 0).Bytes())
+	readUprTestPkt(t, client)
+	expectUprSnapshot(t, readUprTestPkt(t, client), 1, 5, UPR_SNAPSHOT_DISK)
+	readUprTestPkt(t, client)
+	readUprTestPkt(t, client)
+	readUprTestPkt(t, client)
+	b.SetVBState(0, VBReplica)
+	pkt = readUprTestPkt(t, client)
+	if pkt.opcode != UPR_STREAM_END ||
+		binary.BigEndian.Uint32(pkt.extras) != UPR_STREAM_END_STATE_CHANGE {
+		t.Errorf("Expected stream end on state change, got %#v", pkt)
+	}
+}
+
+func TestUprStreamOutOfOrderCas(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	b, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer b.Close()
+	b.CreateVBucket(0)
+	b.SetVBState(0, VBActive)
+	rh := reqHandler{currentBucket: b}
+	setWithMeta := func(key string, cas uint64) {
+		res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode: SET_WITH_META,
+			Key:    []byte(key),
+			Extras: mkWithMetaExtras(0, 0, 1, cas),
+			Body:   []byte(key),
+		})
+		if res.Status != gomemcached.SUCCESS {
+			t.Fatalf("Expected set with meta to work, got %v", res)
+		}
+	}
+	setWithMeta("a", 1000)
+
+	client := uprTestOpen(t, b)
+	defer client.Close()
+	client.Write(uprTestStreamReq(0, 123, 0, math.MaxUint64, 0, 0, 0).Bytes())
+	readUprTestPkt(t, client)
+	expectUprSnapshot(t, readUprTestPkt(t, client), 1, 1, UPR_SNAPSHOT_DISK)
+	expectUprItem(t, readUprTestPkt(t, client), UPR_MUTATION, "a", 1)
+
+	// A change with a lower cas than the last snapshot is still sent.
+	setWithMeta("b", 500)
+	expectUprSnapshot(t, readUprTestPkt(t, client), 2, 2, UPR_SNAPSHOT_MEMORY)
+	expectUprItem(t, readUprTestPkt(t, client), UPR_MUTATION, "b", 2)
+}
+
+func TestUprNeedsOpen(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	b, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer b.Close()
+	b.CreateVBucket(0)
+	b.SetVBState(0, VBActive)
+
+	rh := &reqHandler{currentBucket: b}
+	res := rh.HandleMessage(ioutil.Discard, nil,
+		uprTestStreamReq(0, 0, 0, math.MaxUint64, 0, 0, 0))
+	if res == nil || res.Status != gomemcached.EINVAL {
+		t.Errorf("Expected stream req without open to fail, got %v", res)
+	}
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode: UPR_OPEN,
+		Extras: make([]byte, 8),
+	})
+	if res == nil || res.Status != gomemcached.EINVAL {
+		t.Errorf("Expected consumer upr open to fail, got %v", res)
+	}
+}
+
+func TestUprFailoverLog(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	b, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	b.CreateVBucket(0)
+	b.SetVBState(0, VBActive)
+	vb, _ := b.GetVBucket(0)
+	tapTestMutate(vb, gomemcached.SET, "a", "aye")
+	tapTestMutate(vb, gomemcached.SET, "b", "bee")
+
+	rh := &reqHandler{currentBucket: b}
+	getLog := &gomemcached.MCRequest{Opcode: UPR_GET_FAILOVER_LOG}
+	res := rh.HandleMessage(ioutil.Discard, nil, getLog)
+	if res.Status != gomemcached.SUCCESS || len(res.Body) != 16 ||
+		binary.BigEndian.Uint64(res.Body[8:]) != 0 {
+		t.Errorf("Expected one failover entry, got %v", res)
+	}
+
+	b.SetVBState(0, VBReplica)
+	b.SetVBState(0, VBActive)
+	res = rh.HandleMessage(ioutil.Discard, nil, getLog)
+	if res.Status != gomemcached.SUCCESS || len(res.Body) != 32 ||
+		binary.BigEndian.Uint64(res.Body[8:]) != 2 ||
+		binary.BigEndian.Uint64(res.Body[24:]) != 0 ||
+		binary.BigEndian.Uint64(res.Body) == binary.BigEndian.Uint64(res.Body[16:]) {
+		t.Errorf("Expected a new failover entry, got %v", res)
+	}
+
+	getLog.VBucket = 1
+	res = rh.HandleMessage(ioutil.Discard, nil, getLog)
+	if res.Status != gomemcached.NOT_MY_VBUCKET {
+		t.Errorf("Expected missing vbucket to fail, got %v", res)
+	}
+
+	// The seqnos and failover log survive a reload.
+	b.Flush()
+	b.Close()
+	b2, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer b2.Close()
+	b2.Load()
+	vb2, _ := b2.GetVBucket(0)
+	if vb2 == nil || vb2.ps.highSeqno() != 2 ||
+		len(vb2.Meta().FailoverLog) != 2 {
+		t.Fatalf("Expected seqnos and failover log to be reloaded, got %v", vb2)
+	}
+	tapTestMutate(vb2, gomemcached.SET, "c", "sea")
+	if vb2.ps.highSeqno() != 3 {
+		t.Errorf("Expected seqnos to continue, got %v", vb2.ps.highSeqno())
+	}
+}
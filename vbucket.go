@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+	"log"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,14 +16,37 @@ import (
 
 	"github.com/dustin/go-broadcast"
 	"github.com/dustin/gomemcached"
+	"github.com/steveyen/gkvlite"
 )
 
 const (
+	TOUCH                = gomemcached.CommandCode(0x1c)
+	GAT                  = gomemcached.CommandCode(0x1d)
+	GATQ                 = gomemcached.CommandCode(0x1e)
+	HELLO                = gomemcached.CommandCode(0x1f)
+	UPR_OPEN             = gomemcached.CommandCode(0x50)
+	UPR_CLOSE_STREAM     = gomemcached.CommandCode(0x52)
+	UPR_STREAM_REQ       = gomemcached.CommandCode(0x53)
+	UPR_GET_FAILOVER_LOG = gomemcached.CommandCode(0x54)
+	UPR_STREAM_END       = gomemcached.CommandCode(0x55)
+	UPR_SNAPSHOT_MARKER  = gomemcached.CommandCode(0x56)
+	UPR_MUTATION         = gomemcached.CommandCode(0x57)
+	UPR_DELETION         = gomemcached.CommandCode(0x58)
 	GET_VBMETA           = gomemcached.CommandCode(0x61)
 	SET_VBMETA           = gomemcached.CommandCode(0x62)
+	OBSERVE              = gomemcached.CommandCode(0x92)
+	GETL                 = gomemcached.CommandCode(0x94)
+	UNLOCK_KEY           = gomemcached.CommandCode(0x95)
+	GET_META             = gomemcached.CommandCode(0xa0)
+	GETQ_META            = gomemcached.CommandCode(0xa1)
+	SET_WITH_META        = gomemcached.CommandCode(0xa2)
+	SETQ_WITH_META       = gomemcached.CommandCode(0xa3)
+	DEL_WITH_META        = gomemcached.CommandCode(0xa8)
+	DELQ_WITH_META       = gomemcached.CommandCode(0xa9)
 	COLL_SUFFIX_KEYS     = ".k" // This suffix sorts before CHANGES suffix.
 	COLL_SUFFIX_CHANGES  = ".s" // The changes is like a "sequence" stream.
 	COLL_VBMETA          = "vbm"
+	COLL_TAP_CHECKPOINTS = "tapc"
 	MAX_VBID             = 0x0000ffff // Due to uint16.
 	MAX_ITEM_KEY_LENGTH  = 250
 	MAX_ITEM_DATA_LENGTH = 1024 * 1024
@@ -53,6 +77,9 @@ type VBucket struct {
 	viewsStore *bucketstore
 	viewsLock  sync.Mutex
 
+	locks   map[string]*itemLock // Keyed by item key, covered by lock.
+	locksch chan bool            // Keys the periodic lock sweeper.
+
 	available chan bool
 	vbid      uint16
 }
@@ -93,6 +120,20 @@ var dispatchTable = [256]dispatchFun{
 	gomemcached.RGET: vbRGet,
 
 	// TODO: Move new command codes to gomemcached one day.
+	TOUCH: vbTouch,
+	GAT:   vbTouch,
+	GATQ:  vbTouch,
+
+	GETL:       vbGetLocked,
+	UNLOCK_KEY: vbUnlock,
+
+	GET_META:       vbGetMeta,
+	GETQ_META:      vbGetMeta,
+	SET_WITH_META:  vbMutateWithMeta,
+	SETQ_WITH_META: vbMutateWithMeta,
+	DEL_WITH_META:  vbMutateWithMeta,
+	DELQ_WITH_META: vbMutateWithMeta,
+
 	GET_VBMETA: vbGetVBMeta,
 	SET_VBMETA: vbSetVBMeta,
 }
@@ -107,6 +148,7 @@ func newVBucket(parent Bucket, vbid uint16, bs *bucketstore,
 		ps:              bs.getPartitionStore(vbid),
 		observer:        broadcastMux.Sub(),
 		available:       make(chan bool),
+		locksch:         make(chan bool),
 		bucketItemBytes: bucketItemBytes,
 	}
 
@@ -122,9 +164,19 @@ func (v *VBucket) Close() error {
 		return nil
 	}
 	close(v.available)
+	close(v.locksch)
 	return v.observer.Close()
 }
 
+// Tells the vbucket's observers, such as TAP streams, and the bucket's
+// _changes feeds about a mutation.
+func (v *VBucket) submitMutation(m mutation) {
+	v.observer.Submit(m)
+	if v.parent != nil && v.vbid != VBID_DDOC {
+		publishChange(v.parent.Name())
+	}
+}
+
 func (v *VBucket) Dispatch(w io.Writer,
 	req *gomemcached.MCRequest) *gomemcached.MCResponse {
 	atomic.AddInt64(&v.stats.Ops, 1)
@@ -136,7 +188,15 @@ func (v *VBucket) Dispatch(w io.Writer,
 			Body:   []byte(fmt.Sprintf("Unknown command %v", req.Opcode)),
 		}
 	}
-	return f(v, w, req)
+	durable, res := v.durableRequest(req)
+	if res != nil {
+		return res
+	}
+	res = f(v, w, req)
+	if durable {
+		res = v.awaitDurable(res)
+	}
+	return res
 }
 
 func (v *VBucket) get(key []byte) *gomemcached.MCResponse {
@@ -172,6 +232,9 @@ func (v *VBucket) SetVBState(newState VBState,
 			newMeta := prevMeta.Copy()
 			newMeta.State = newState.String()
 			newMeta.MetaCas = casMeta
+			if newState == VBActive && prevState != VBActive {
+				newMeta.addFailoverEntry(v.ps.highSeqno())
+			}
 
 			err = v.setVBMeta(newMeta)
 			if err != nil {
@@ -185,6 +248,45 @@ func (v *VBucket) SetVBState(newState VBState,
 	return prevState, err
 }
 
+// Removes all items from the vbucket by swapping in empty
+// collections, and bumps the VBMeta so the flush is recorded as a
+// metadata change on the new changes stream.  The vbucket's observers
+// see the flush as a keyless mutation.
+func (v *VBucket) flushItems() (err error) {
+	var casMeta uint64
+	v.bs.apply(func() {
+		v.Apply(func() {
+			v.ps.collsPauseSwap(func() (*gkvlite.Collection, *gkvlite.Collection) {
+				v.ps.deletions = map[string]uint64{}
+				return v.bs.resetPartitionColls_unlocked(v.vbid)
+			})
+
+			itemBytes := atomic.LoadInt64(&v.stats.ItemBytes)
+			atomic.AddInt64(&v.stats.ItemBytes, -itemBytes)
+			atomic.AddInt64(v.bucketItemBytes, -itemBytes)
+			v.ps.addEvictedBytes(-atomic.LoadInt64(&v.ps.evictedBytes))
+			atomic.StoreInt64(&v.stats.Items, 0)
+			atomic.StoreInt64(&v.stats.Expirable, 0)
+			atomic.StoreInt64(&v.stats.LockedItems, 0)
+			v.locks = nil
+
+			prevMeta := v.Meta()
+			casMeta = atomic.AddUint64(&prevMeta.LastCas, 1)
+
+			newMeta := prevMeta.Copy()
+			newMeta.MetaCas = casMeta
+
+			err = v.setVBMeta(newMeta)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	v.markStale()
+	v.submitMutation(mutation{v.vbid, nil, casMeta, true, nil})
+	return v.clearViewsStore()
+}
+
 func (v *VBucket) setVBMeta(newMeta *VBMeta) (err error) {
 	// This should only be called when holding the bucketstore
 	// service/apply "lock", to ensure a Flush between changes stream
@@ -216,6 +318,31 @@ func (v *VBucket) setVBMeta(newMeta *VBMeta) (err error) {
 	return nil
 }
 
+// Runs the load-time repair of the key-index, reporting any repairs
+// in the logs and stats of the bucket.
+func (v *VBucket) repairKeys() {
+	fixed, dropped, err := v.ps.repairKeys()
+	if err != nil {
+		err = fmt.Errorf("could not repair keys of vbucket: %v, err: %v",
+			v.vbid, err)
+		log.Printf("%v", err)
+		if v.parent != nil {
+			v.parent.PushErr(err)
+		}
+		return
+	}
+	if fixed+dropped <= 0 {
+		return
+	}
+	atomic.AddInt64(&v.stats.LoadRepairs, int64(fixed+dropped))
+	msg := fmt.Sprintf("repaired keys of vbucket: %v at load,"+
+		" fixed: %v, dropped: %v", v.vbid, fixed, dropped)
+	log.Printf("%v", msg)
+	if v.parent != nil {
+		v.parent.PushLog(msg)
+	}
+}
+
 func (v *VBucket) load() (err error) {
 	v.Apply(func() {
 		meta := v.Meta().Copy()
@@ -247,6 +374,38 @@ func (v *VBucket) load() (err error) {
 			if meta.LastCas < lastCas {
 				meta.LastCas = lastCas
 			}
+			if v.bs.bsfMemoryOnly == nil {
+				atomic.StoreUint64(&v.ps.persistedCas, lastCas)
+			}
+
+			// The seqnos aren't in cas order, such as for changes that
+			// kept another server's cas, so find the last one by scanning,
+			// which also finds the latest deletion of every key.
+			var lastSeqno uint64
+			deletions := map[string]uint64{}
+			err = v.ps.visitChanges(nil, true, func(c *item) bool {
+				if lastSeqno < c.seqno {
+					lastSeqno = c.seqno
+				}
+				if len(c.key) > 0 && c.isDeletion() &&
+					deletions[string(c.key)] < c.cas {
+					deletions[string(c.key)] = c.cas
+				}
+				return true
+			})
+			if err != nil {
+				return
+			}
+			atomic.StoreUint64(&v.ps.lastSeqno, lastSeqno)
+			// We don't know which loaded changes were out of order.
+			v.ps.seqnoMaxCas = lastCas
+			v.ps.outOfOrderFrom = lastSeqno
+
+			v.repairKeys()
+
+			if err = v.ps.loadDeletions(deletions); err != nil {
+				return
+			}
 		}
 
 		atomic.StorePointer(&v.meta, unsafe.Pointer(meta))
@@ -256,6 +415,10 @@ func (v *VBucket) load() (err error) {
 			atomic.StoreInt64(&v.stats.Items, int64(numItems))
 			atomic.StoreInt64(&v.stats.ItemBytes, int64(numItemBytes))
 			atomic.AddInt64(v.bucketItemBytes, int64(numItemBytes))
+			if v.bs.bsfMemoryOnly == nil {
+				// The loaded items are only on disk until they're read.
+				v.ps.addEvictedBytes(int64(numItemBytes))
+			}
 		}
 
 		// TODO: What if we're loading something out of allowed range?
@@ -274,7 +437,8 @@ func vbGet(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (
 	res *gomemcached.MCResponse) {
 	atomic.AddInt64(&v.stats.Gets, 1)
 
-	i, err := v.getUnexpired(req.Key, time.Now())
+	now := time.Now()
+	i, err := v.getUnexpired(req.Key, now)
 	if err != nil {
 		return &gomemcached.MCResponse{
 			Status: gomemcached.TMPFAIL,
@@ -288,6 +452,7 @@ func vbGet(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (
 		}
 		return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
 	}
+	v.ps.touchLRU(req.Key, now)
 
 	res = &gomemcached.MCResponse{
 		Cas:    i.cas,
@@ -295,6 +460,7 @@ func vbGet(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (
 		Body:   i.data,
 	}
 	binary.BigEndian.PutUint32(res.Extras, i.flag)
+	setResponseDatatype(w, i)
 	wantsKey := (req.Opcode == gomemcached.GETK || req.Opcode == gomemcached.GETKQ)
 	if wantsKey {
 		res.Key = req.Key
@@ -360,7 +526,7 @@ func vbSetVBMeta(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (
 			// to client; which might not be what some management
 			// use cases want (ability to switch vbstate even if
 			// dirty queues are huge).
-			if _, err := v.bs.flush_unlocked(); err != nil {
+			if _, err := v.bs.flush_unlocked(v.bs.fsyncs()); err != nil {
 				res = &gomemcached.MCResponse{
 					Status: gomemcached.TMPFAIL,
 					Body:   []byte(fmt.Sprintf("setVBMeta flush error %v", err)),
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/dustin/gomemcached"
+)
+
+const (
+	// A durable mutation appends a word of durability flags to its
+	// usual request extras.
+	DURABLE_EXTRAS_LEN = 4
+
+	// The mutation's response waits until a flush and fsync covers it.
+	DURABLE_PERSIST = uint32(0x01)
+)
+
+// The usual request extras lengths of the mutations that can be durable.
+var durableExtrasLens = map[gomemcached.CommandCode]int{
+	gomemcached.SET:        8, // flags, exp
+	gomemcached.SETQ:       8,
+	gomemcached.ADD:        8,
+	gomemcached.ADDQ:       8,
+	gomemcached.REPLACE:    8,
+	gomemcached.REPLACEQ:   8,
+	gomemcached.APPEND:     0,
+	gomemcached.APPENDQ:    0,
+	gomemcached.PREPEND:    0,
+	gomemcached.PREPENDQ:   0,
+	gomemcached.DELETE:     0,
+	gomemcached.DELETEQ:    0,
+	gomemcached.INCREMENT:  8 + 8 + 4, // amount, initial, exp
+	gomemcached.INCREMENTQ: 8 + 8 + 4,
+	gomemcached.DECREMENT:  8 + 8 + 4,
+	gomemcached.DECREMENTQ: 8 + 8 + 4,
+	TOUCH:                  4, // exp
+	GAT:                    4,
+	GATQ:                   4,
+	SET_WITH_META:          WITH_META_EXTRAS_LEN,
+	SETQ_WITH_META:         WITH_META_EXTRAS_LEN,
+	DEL_WITH_META:          WITH_META_EXTRAS_LEN,
+	DELQ_WITH_META:         WITH_META_EXTRAS_LEN,
+}
+
+// Returns whether a mutation needs to wait for persistence, either as
+// it asked to with its durability flags, which are then stripped from
+// its extras, or as its bucket syncs every write.
+func (v *VBucket) durableRequest(req *gomemcached.MCRequest) (
+	bool, *gomemcached.MCResponse) {
+	n, ok := durableExtrasLens[req.Opcode]
+	if !ok {
+		return false, nil
+	}
+	if len(req.Extras) != n+DURABLE_EXTRAS_LEN {
+		return v.bs.durability == DURABILITY_SYNC && v.bs.persists(), nil
+	}
+	flags := binary.BigEndian.Uint32(req.Extras[n:])
+	req.Extras = req.Extras[:n]
+	if flags&^DURABLE_PERSIST != 0 {
+		return false, &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body: []byte(fmt.Sprintf("unknown durability flags: %x on key %v",
+				flags, req.Key)),
+		}
+	}
+	if flags&DURABLE_PERSIST == 0 {
+		return v.bs.durability == DURABILITY_SYNC && v.bs.persists(), nil
+	}
+	if !v.bs.persists() {
+		return false, &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("durable mutations need a bucket that persists items"),
+		}
+	}
+	return true, nil
+}
+
+// Holds back a successful mutation's response until the mutation is
+// persisted, where quiet mutations have a nil response on success.
+func (v *VBucket) awaitDurable(res *gomemcached.MCResponse) *gomemcached.MCResponse {
+	if res != nil && res.Status != gomemcached.SUCCESS {
+		return res
+	}
+	atomic.AddInt64(&v.stats.DurableWaits, 1)
+	// The dirtied count covers this mutation, as its dirty() happened
+	// before its response.
+	if err := v.bs.waitPersisted(atomic.LoadInt64(&v.bs.dirtied)); err != nil {
+		atomic.AddInt64(&v.stats.DurableErrors, 1)
+		return &gomemcached.MCResponse{
+			Status: gomemcached.TMPFAIL,
+			Body:   []byte(fmt.Sprintf("durable mutation persist error %v", err)),
+		}
+	}
+	return res
+}
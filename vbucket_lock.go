@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+const (
+	DEFAULT_LOCK_TIMEOUT = 15 // In seconds.
+	MAX_LOCK_TIMEOUT     = 30 // In seconds.
+)
+
+// A lock taken on an item by GETL.  Writers may only modify a locked
+// item by presenting the lock's cas.
+type itemLock struct {
+	cas   uint64
+	until time.Time
+}
+
+func vbGetLocked(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (
+	res *gomemcached.MCResponse) {
+	atomic.AddInt64(&v.stats.GetLocks, 1)
+
+	timeout := uint32(DEFAULT_LOCK_TIMEOUT)
+	if len(req.Extras) == 4 {
+		timeout = binary.BigEndian.Uint32(req.Extras)
+		if timeout == 0 || timeout > MAX_LOCK_TIMEOUT {
+			timeout = DEFAULT_LOCK_TIMEOUT
+		}
+	} else if len(req.Extras) != 0 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body: []byte(fmt.Sprintf("wrong extras size for getl: %v on key %v",
+				len(req.Extras), req.Key)),
+		}
+	}
+
+	now := time.Now()
+
+	v.Apply(func() {
+		i, err := v.getUnexpired(req.Key, now)
+		if err != nil {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store get error %v", err)),
+			}
+			return
+		}
+		if i == nil {
+			res = &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+			return
+		}
+		if v.getLock(req.Key, i, now) != nil {
+			atomic.AddInt64(&v.stats.LockRejects, 1)
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte("item is locked"),
+			}
+			return
+		}
+
+		l := &itemLock{
+			cas:   atomic.AddUint64(&v.Meta().LastCas, 1),
+			until: now.Add(time.Duration(timeout) * time.Second),
+		}
+		if v.locks == nil {
+			v.locks = map[string]*itemLock{}
+		}
+		v.locks[string(req.Key)] = l
+		atomic.AddInt64(&v.stats.LockedItems, 1)
+		if len(v.locks) == 1 {
+			expirePeriodic.Register(v.locksch, v.mkLockSweeper())
+		}
+
+		res = &gomemcached.MCResponse{
+			Cas:    l.cas,
+			Extras: make([]byte, 4),
+			Body:   i.data,
+		}
+		binary.BigEndian.PutUint32(res.Extras, i.flag)
+		setResponseDatatype(w, i)
+
+		atomic.AddInt64(&v.stats.OutgoingValueBytes, int64(len(i.data)))
+	})
+
+	return res
+}
+
+func vbUnlock(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (
+	res *gomemcached.MCResponse) {
+	now := time.Now()
+
+	v.Apply(func() {
+		i, err := v.getUnexpired(req.Key, now)
+		if err != nil {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store get error %v", err)),
+			}
+			return
+		}
+		if i == nil {
+			v.getLock(req.Key, nil, now) // Releases any lingering lock.
+			res = &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+			return
+		}
+		l := v.getLock(req.Key, i, now)
+		if l == nil {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte("item is not locked"),
+			}
+			return
+		}
+		if l.cas != req.Cas {
+			atomic.AddInt64(&v.stats.LockRejects, 1)
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte("item is locked"),
+			}
+			return
+		}
+		v.unlock(req.Key, false)
+		res = &gomemcached.MCResponse{}
+	})
+
+	return res
+}
+
+// Checks whether a writer may modify an item, which is not allowed
+// while the item is locked unless the writer presents the lock cas.
+// Returns a non-nil response when the writer is refused.  Otherwise,
+// returns the cas that the writer's request should be validated
+// against and whether the writer is the lock holder.  Must be
+// invoked while holding v.lock.
+func (v *VBucket) checkLock(key []byte, reqCas uint64, itemOld *item,
+	now time.Time) (cas uint64, holder bool, res *gomemcached.MCResponse) {
+	l := v.getLock(key, itemOld, now)
+	if l == nil {
+		return reqCas, false, nil
+	}
+	if l.cas != reqCas {
+		atomic.AddInt64(&v.stats.LockRejects, 1)
+		return 0, false, &gomemcached.MCResponse{
+			Status: gomemcached.TMPFAIL,
+			Body:   []byte("item is locked"),
+		}
+	}
+	return itemOld.cas, true, nil
+}
+
+// Returns the lock on an item, auto-releasing the lock if it expired
+// or if the item has gone away.  Must be invoked while holding v.lock.
+func (v *VBucket) getLock(key []byte, i *item, now time.Time) *itemLock {
+	l := v.locks[string(key)]
+	if l == nil {
+		return nil
+	}
+	if i == nil || !now.Before(l.until) {
+		v.unlock(key, true)
+		return nil
+	}
+	return l
+}
+
+// Must be invoked while holding v.lock.
+func (v *VBucket) unlock(key []byte, expired bool) {
+	delete(v.locks, string(key))
+	atomic.AddInt64(&v.stats.LockedItems, -1)
+	if expired {
+		atomic.AddInt64(&v.stats.LockExpirations, 1)
+	}
+}
+
+func (v *VBucket) mkLockSweeper() func(time.Time) bool {
+	return func(now time.Time) bool {
+		remaining := 0
+		v.Apply(func() {
+			for k, l := range v.locks {
+				if !now.Before(l.until) {
+					v.unlock([]byte(k), true)
+				}
+			}
+			remaining = len(v.locks)
+		})
+		return remaining > 0
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+const (
+	// The GET_META response extras: deleted, flags, exp and rev.
+	GET_META_EXTRAS_LEN = 4 + 4 + 4 + 8
+
+	// The SET_WITH_META and DEL_WITH_META request extras: flags,
+	// exp, rev and cas.
+	WITH_META_EXTRAS_LEN = 4 + 4 + 8 + 8
+)
+
+func vbGetMeta(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (
+	res *gomemcached.MCResponse) {
+	atomic.AddInt64(&v.stats.GetMetas, 1)
+
+	i, deleted, err := v.getMeta(req.Key)
+	if err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.TMPFAIL,
+			Body:   []byte(fmt.Sprintf("Store get error %v", err)),
+		}
+	}
+	if i == nil {
+		if req.Opcode == GETQ_META {
+			return nil
+		}
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+	}
+
+	res = &gomemcached.MCResponse{
+		Cas:    i.cas,
+		Extras: make([]byte, GET_META_EXTRAS_LEN),
+	}
+	if deleted {
+		binary.BigEndian.PutUint32(res.Extras[0:4], 1)
+	} else {
+		binary.BigEndian.PutUint32(res.Extras[4:8], i.flag)
+		binary.BigEndian.PutUint32(res.Extras[8:12], i.exp)
+	}
+	binary.BigEndian.PutUint64(res.Extras[12:20], i.rev)
+	return res
+}
+
+// Returns the item of a key, or else its latest deletion, whose
+// metadata is what conflict resolution compares.
+func (v *VBucket) getMeta(key []byte) (i *item, deleted bool, err error) {
+	i, err = v.getUnexpired(key, time.Now())
+	if err != nil || i != nil {
+		return i, false, err
+	}
+	i, err = v.ps.getDeletion(key)
+	return i, i != nil, err
+}
+
+// Handles SET_WITH_META and DEL_WITH_META, which write an item (or a
+// deletion) with the caller's cas and rev rather than allocating a new
+// cas, such as when moving items between servers.  The incoming item
+// only replaces an existing item, or the key's latest deletion, if it
+// wins conflict resolution.
+func vbMutateWithMeta(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (
+	res *gomemcached.MCResponse) {
+	deletion := req.Opcode == DEL_WITH_META || req.Opcode == DELQ_WITH_META
+	quiet := req.Opcode == SETQ_WITH_META || req.Opcode == DELQ_WITH_META
+	if deletion {
+		atomic.AddInt64(&v.stats.DelWithMetas, 1)
+	} else {
+		atomic.AddInt64(&v.stats.SetWithMetas, 1)
+	}
+
+	if len(req.Extras) != WITH_META_EXTRAS_LEN {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body: []byte(fmt.Sprintf("wrong extras size for with-meta: %v on key %v",
+				len(req.Extras), req.Key)),
+		}
+	}
+	if len(req.Body) > MAX_ITEM_DATA_LENGTH {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.E2BIG,
+			Body: []byte(fmt.Sprintf("data too big: %v, key: %v",
+				len(req.Body), req.Key)),
+		}
+	}
+
+	itemNew := &item{
+		key:      req.Key,
+		flag:     binary.BigEndian.Uint32(req.Extras[0:4]),
+		exp:      binary.BigEndian.Uint32(req.Extras[4:8]),
+		rev:      binary.BigEndian.Uint64(req.Extras[8:16]),
+		cas:      binary.BigEndian.Uint64(req.Extras[16:24]),
+		data:     req.Body,
+		datatype: detectDatatype(req.Body),
+	}
+	if itemNew.cas == 0 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("with-meta requires a cas"),
+		}
+	}
+
+	return vbApplyWithMeta(v, req, itemNew, deletion, quiet, false)
+}
+
+// Writes an item (or a deletion) that already has its metadata.  When
+// forced, such as for changes from a TAP stream, the item always wins
+// instead of going through lock, CAS and conflict checks, and it gets
+// a new cas if it has none.
+func vbApplyWithMeta(v *VBucket, req *gomemcached.MCRequest, itemNew *item,
+	deletion, quiet, force bool) (res *gomemcached.MCResponse) {
+	var deltaItemBytes int64
+	var itemOld, itemPrev *item
+	var err error
+	now := time.Now()
+
+	// The bs.apply() keeps a compaction from running concurrently,
+	// as the caller's cas might land in the middle of the changes
+	// stream instead of at its end.
+	v.bs.apply(func() {
+		v.Apply(func() {
+			itemOld, err = v.getUnexpired(itemNew.key, now)
+			if err != nil {
+				res = &gomemcached.MCResponse{
+					Status: gomemcached.TMPFAIL,
+					Body:   []byte(fmt.Sprintf("Store get itemOld error %v", err)),
+				}
+				return
+			}
+
+			// Without an item, the key's latest deletion is what the
+			// incoming item resolves against.
+			itemPrev = itemOld
+			if itemPrev == nil {
+				itemPrev, err = v.ps.getDeletion(itemNew.key)
+				if err != nil {
+					res = &gomemcached.MCResponse{
+						Status: gomemcached.TMPFAIL,
+						Body:   []byte(fmt.Sprintf("Store get deletion error %v", err)),
+					}
+					return
+				}
+			}
+
+			meta := v.Meta()
+			if itemNew.cas == 0 {
+				itemNew.cas = atomic.AddUint64(&meta.LastCas, 1)
+			}
+
+			res, err = vbMutateWithMetaValidate(v, req, quiet, force,
+				itemNew, itemOld, itemPrev, now)
+			if err != nil {
+				return
+			}
+
+			for {
+				lastCas := atomic.LoadUint64(&meta.LastCas)
+				if itemNew.cas <= lastCas ||
+					atomic.CompareAndSwapUint64(&meta.LastCas, lastCas, itemNew.cas) {
+					break
+				}
+			}
+
+			// TODO: Views only index changes that come after their last
+			// indexed cas, so they miss items written with an older cas.
+			// A previous deletion is replaced, too, so that the changes
+			// stream has only the latest change of the key.
+			if deletion {
+				deltaItemBytes, err = v.ps.delItem(itemNew, itemPrev)
+			} else {
+				deltaItemBytes, err = v.ps.set(itemNew, itemPrev)
+			}
+			if err != nil {
+				res = &gomemcached.MCResponse{
+					Status: gomemcached.TMPFAIL,
+					Body:   []byte(fmt.Sprintf("Store set error %v", err)),
+				}
+				return
+			}
+			if v.locks[string(itemNew.key)] != nil {
+				v.unlock(itemNew.key, false)
+			}
+			if !quiet {
+				res = &gomemcached.MCResponse{Cas: itemNew.cas}
+			}
+		})
+	})
+
+	if err != nil {
+		if err != ignore {
+			atomic.AddInt64(&v.stats.StoreErrors, 1)
+		}
+		return res
+	}
+
+	if deletion {
+		if itemOld != nil {
+			atomic.AddInt64(&v.stats.Items, -1)
+		}
+	} else if itemOld != nil {
+		atomic.AddInt64(&v.stats.Updates, 1)
+	} else {
+		atomic.AddInt64(&v.stats.Creates, 1)
+		atomic.AddInt64(&v.stats.Items, 1)
+	}
+	atomic.AddInt64(&v.stats.IncomingValueBytes, int64(len(itemNew.data)))
+	atomic.AddInt64(&v.stats.ItemBytes, deltaItemBytes)
+	atomic.AddInt64(v.bucketItemBytes, deltaItemBytes)
+
+	if !deletion && itemNew.exp != 0 {
+		v.markExpirable()
+	}
+
+	v.markStale()
+	v.submitMutation(mutation{v.vbid, itemNew.key, itemNew.cas, deletion,
+		itemNew.data})
+
+	return res
+}
+
+// Must be invoked while holding v.lock.  The itemOld is the current
+// item, if any, and the itemPrev is either itemOld or else the key's
+// latest deletion.
+func vbMutateWithMetaValidate(v *VBucket, req *gomemcached.MCRequest,
+	quiet, force bool, itemNew, itemOld, itemPrev *item, now time.Time) (
+	*gomemcached.MCResponse, error) {
+	if !force {
+		cas, _, lockRes := v.checkLock(req.Key, req.Cas, itemOld, now)
+		if lockRes != nil {
+			return lockRes, ignore
+		}
+		if cas != 0 && (itemOld == nil || itemOld.cas != cas) {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.EINVAL,
+				Body:   []byte("CAS mismatch"),
+			}, ignore
+		}
+	}
+	if itemPrev == nil {
+		if force && itemNew.rev == 0 {
+			itemNew.rev = 1
+		}
+	} else if force {
+		if itemNew.cas == itemPrev.cas {
+			// A replayed change, such as from a restarted TAP backfill.
+			if quiet {
+				return nil, ignore
+			}
+			return &gomemcached.MCResponse{Cas: itemNew.cas}, ignore
+		}
+		if itemNew.rev <= itemPrev.rev {
+			itemNew.rev = itemPrev.rev + 1
+		}
+	} else if !itemNew.winsConflict(itemPrev) {
+		atomic.AddInt64(&v.stats.MetaConflicts, 1)
+		return &gomemcached.MCResponse{
+			Status: gomemcached.KEY_EEXISTS,
+			Body:   []byte("existing item wins conflict resolution"),
+		}, ignore
+	}
+	// The changes stream is keyed by cas, so the caller's cas must
+	// not already be in use by some other change.
+	_, changes := v.ps.colls()
+	if c, err := changes.GetItem(casBytes(itemNew.cas), false); err != nil || c != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.KEY_EEXISTS,
+			Body:   []byte("cas already in use"),
+		}, ignore
+	}
+	return nil, nil
+}
+
+// Conflict resolution between two versions of an item, where the
+// highest rev wins, and then the highest cas wins.
+func (i *item) winsConflict(other *item) bool {
+	if i.rev != other.rev {
+		return i.rev > other.rev
+	}
+	return i.cas > other.cas
+}
@@ -42,6 +42,10 @@ func vbMutate(v *VBucket, w io.Writer,
 	var err error
 	now := time.Now()
 
+	// Eviction happens outside of the vbucket lock, as it visits the
+	// other vbuckets of the bucket.
+	v.makeRoom(int64(itemHdrLen + len(req.Key) + len(req.Body) + 8))
+
 	v.Apply(func() {
 		itemOld, err = v.getUnexpired(req.Key, now)
 		if err != nil {
@@ -52,7 +56,13 @@ func vbMutate(v *VBucket, w io.Writer,
 			return
 		}
 
-		res, err = vbMutateValidate(v, w, req, cmd, itemOld)
+		cas, holder, lockRes := v.checkLock(req.Key, req.Cas, itemOld, now)
+		if lockRes != nil {
+			res, err = lockRes, ignore
+			return
+		}
+
+		res, err = vbMutateValidate(v, w, req, cmd, cas, itemOld)
 		if err != nil {
 			return
 		}
@@ -66,7 +76,7 @@ func vbMutate(v *VBucket, w io.Writer,
 
 		quotaBytes := v.parent.GetBucketSettings().QuotaBytes
 		if quotaBytes > 0 {
-			nb := atomic.LoadInt64(v.bucketItemBytes)
+			nb := v.parent.GetResidentBytes()
 			nb = nb + itemNew.NumBytes()
 			if itemOld != nil {
 				nb = nb - itemOld.NumBytes()
@@ -77,6 +87,7 @@ func vbMutate(v *VBucket, w io.Writer,
 					Body: []byte(fmt.Sprintf("quota reached: %v, key: %v",
 						quotaBytes, req.Key)),
 				}
+				err = ignore
 				return
 			}
 		}
@@ -88,6 +99,10 @@ func vbMutate(v *VBucket, w io.Writer,
 				Body:   []byte(fmt.Sprintf("Store set error %v", err)),
 			}
 		} else {
+			setResponseSeqno(w, itemNew.seqno)
+			if holder {
+				v.unlock(req.Key, false)
+			}
 			if !req.Opcode.IsQuiet() {
 				res = &gomemcached.MCResponse{Cas: itemCas}
 				if cmd == gomemcached.INCREMENT || cmd == gomemcached.DECREMENT {
@@ -116,14 +131,14 @@ func vbMutate(v *VBucket, w io.Writer,
 
 	if err == nil {
 		v.markStale()
-		v.observer.Submit(mutation{v.vbid, req.Key, itemCas, false})
+		v.submitMutation(mutation{v.vbid, req.Key, itemCas, false, itemNew.data})
 	}
 
 	return res
 }
 
 func vbMutateValidate(v *VBucket, w io.Writer, req *gomemcached.MCRequest,
-	cmd gomemcached.CommandCode, itemOld *item) (*gomemcached.MCResponse, error) {
+	cmd gomemcached.CommandCode, cas uint64, itemOld *item) (*gomemcached.MCResponse, error) {
 	if cmd == gomemcached.ADD && itemOld != nil {
 		return &gomemcached.MCResponse{
 			Status: gomemcached.KEY_EEXISTS,
@@ -136,7 +151,7 @@ func vbMutateValidate(v *VBucket, w io.Writer, req *gomemcached.MCRequest,
 			Body:   []byte("REPLACE error because item does not exist"),
 		}, ignore
 	}
-	if req.Cas != 0 && (itemOld == nil || itemOld.cas != req.Cas) {
+	if cas != 0 && (itemOld == nil || itemOld.cas != cas) {
 		return &gomemcached.MCResponse{
 			Status: gomemcached.EINVAL,
 			Body:   []byte("CAS mismatch"),
@@ -145,6 +160,18 @@ func vbMutateValidate(v *VBucket, w io.Writer, req *gomemcached.MCRequest,
 	return nil, nil
 }
 
+// Wraps the writer of requests from front-ends, such as the ASCII
+// protocol, whose append, prepend, incr and decr keep an existing
+// item's flags and exp, unlike the binary protocol.
+type keepMetaWriter struct {
+	io.Writer
+}
+
+func keepsMeta(w io.Writer) bool {
+	_, ok := w.(keepMetaWriter)
+	return ok
+}
+
 func vbMutateItemNew(v *VBucket, w io.Writer, req *gomemcached.MCRequest,
 	cmd gomemcached.CommandCode, itemCas uint64, itemOld *item) (*gomemcached.MCResponse,
 	*item, uint64, error) {
@@ -174,6 +201,16 @@ func vbMutateItemNew(v *VBucket, w io.Writer, req *gomemcached.MCRequest,
 		flag: flag,
 		exp:  computeExp(exp, time.Now),
 		cas:  itemCas,
+		rev:  1,
+	}
+	if itemOld != nil {
+		itemNew.rev = itemOld.rev + 1
+		if keepsMeta(w) && (cmd == gomemcached.APPEND ||
+			cmd == gomemcached.PREPEND || cmd == gomemcached.INCREMENT ||
+			cmd == gomemcached.DECREMENT) {
+			itemNew.flag = itemOld.flag
+			itemNew.exp = itemOld.exp
+		}
 	}
 
 	if cmd == gomemcached.INCREMENT || cmd == gomemcached.DECREMENT {
@@ -221,11 +258,10 @@ func vbMutateItemNew(v *VBucket, w io.Writer, req *gomemcached.MCRequest,
 		}
 	}
 
+	itemNew.datatype = detectDatatype(itemNew.data)
+
 	if itemNew.exp != 0 {
-		expirable := atomic.AddInt64(&v.stats.Expirable, 1)
-		if expirable == 1 {
-			expirePeriodic.Register(v.available, v.mkVBucketSweeper())
-		}
+		v.markExpirable()
 	}
 
 	return nil, itemNew, aval, nil
@@ -249,7 +285,12 @@ func vbDelete(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (res *gomemca
 			}
 			return
 		}
-		if req.Cas != 0 && (prevItem == nil || prevItem.cas != req.Cas) {
+		reqCas, holder, lockRes := v.checkLock(req.Key, req.Cas, prevItem, now)
+		if lockRes != nil {
+			res, err = lockRes, ignore
+			return
+		}
+		if reqCas != 0 && (prevItem == nil || prevItem.cas != reqCas) {
 			res = &gomemcached.MCResponse{
 				Status: gomemcached.EINVAL,
 				Body:   []byte("CAS mismatch"),
@@ -273,6 +314,11 @@ func vbDelete(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (res *gomemca
 				Body:   []byte(fmt.Sprintf("Store del error %v", err)),
 			}
 		} else {
+			// We're the only writer, so the deletion has the last seqno.
+			setResponseSeqno(w, v.ps.highSeqno())
+			if holder {
+				v.unlock(req.Key, false)
+			}
 			if !req.Opcode.IsQuiet() {
 				res = &gomemcached.MCResponse{Cas: cas}
 			}
@@ -280,7 +326,9 @@ func vbDelete(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (res *gomemca
 	})
 
 	if err != nil {
-		atomic.AddInt64(&v.stats.StoreErrors, 1)
+		if err != ignore {
+			atomic.AddInt64(&v.stats.StoreErrors, 1)
+		}
 	} else if prevItem != nil {
 		atomic.AddInt64(&v.stats.Items, -1)
 		atomic.AddInt64(&v.stats.ItemBytes, deltaItemBytes)
@@ -289,12 +337,118 @@ func vbDelete(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (res *gomemca
 
 	if err == nil && prevItem != nil {
 		v.markStale()
-		v.observer.Submit(mutation{v.vbid, req.Key, cas, true})
+		v.submitMutation(mutation{v.vbid, req.Key, cas, true, nil})
 	}
 
 	return res
 }
 
+func vbTouch(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (res *gomemcached.MCResponse) {
+	atomic.AddInt64(&v.stats.Touches, 1)
+
+	if len(req.Extras) != 4 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body: []byte(fmt.Sprintf("wrong extras size for touch: %v on key %v",
+				len(req.Extras), req.Key)),
+		}
+	}
+	exp := binary.BigEndian.Uint32(req.Extras)
+	wantsValue := req.Opcode == GAT || req.Opcode == GATQ
+	if wantsValue {
+		atomic.AddInt64(&v.stats.Gets, 1)
+	}
+
+	var deltaItemBytes int64
+	var itemOld, itemNew *item
+	var err error
+	now := time.Now()
+
+	v.Apply(func() {
+		itemOld, err = v.getUnexpired(req.Key, now)
+		if err != nil {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store get itemOld error %v", err)),
+			}
+			return
+		}
+		if itemOld == nil {
+			err = ignore
+			if req.Opcode == GATQ {
+				return
+			}
+			res = &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+			return
+		}
+		if _, _, lockRes := v.checkLock(req.Key, req.Cas, itemOld, now); lockRes != nil {
+			res, err = lockRes, ignore
+			return
+		}
+
+		// Only the exp changes, so the item's value and flags are
+		// carried over into a new change with a new CAS.
+		itemNew = itemOld.clone()
+		itemNew.cas = atomic.AddUint64(&v.Meta().LastCas, 1)
+		itemNew.rev = itemOld.rev + 1
+		itemNew.exp = computeExp(exp, time.Now)
+
+		deltaItemBytes, err = v.ps.set(itemNew, itemOld)
+		if err != nil {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store set error %v", err)),
+			}
+			return
+		}
+
+		res = &gomemcached.MCResponse{Cas: itemNew.cas}
+		if wantsValue {
+			res.Extras = make([]byte, 4)
+			binary.BigEndian.PutUint32(res.Extras, itemNew.flag)
+			res.Body = itemNew.data
+			setResponseDatatype(w, itemNew)
+		}
+	})
+
+	if err != nil {
+		if err == ignore {
+			if wantsValue && itemOld == nil {
+				atomic.AddInt64(&v.stats.GetMisses, 1)
+			}
+		} else {
+			atomic.AddInt64(&v.stats.StoreErrors, 1)
+		}
+		return res
+	}
+
+	atomic.AddInt64(&v.stats.Updates, 1)
+	atomic.AddInt64(&v.stats.ItemBytes, deltaItemBytes)
+	atomic.AddInt64(v.bucketItemBytes, deltaItemBytes)
+	if wantsValue {
+		atomic.AddInt64(&v.stats.OutgoingValueBytes, int64(len(itemNew.data)))
+	}
+
+	// The item is only newly expirable if it didn't expire before.
+	if itemNew.exp != 0 && itemOld.exp == 0 {
+		v.markExpirable()
+	}
+
+	v.markStale()
+	v.submitMutation(mutation{v.vbid, req.Key, itemNew.cas, false, itemNew.data})
+
+	return res
+}
+
+// Registers the vbucket with the expiration scanner when the vbucket
+// gets its first expirable item.
+func (v *VBucket) markExpirable() {
+	expirable := atomic.AddInt64(&v.stats.Expirable, 1)
+	if expirable == 1 {
+		expirePeriodic.Register(v.available, v.mkVBucketSweeper())
+	}
+}
+
 func (v *VBucket) mkVBucketSweeper() func(time.Time) bool {
 	return func(time.Time) bool {
 		return v.expirationScan()
@@ -370,7 +524,7 @@ func (v *VBucket) expire(key []byte, now time.Time) (err error) {
 
 	if err == nil && expireCas != 0 {
 		v.markStale()
-		v.observer.Submit(mutation{v.vbid, key, expireCas, true})
+		v.submitMutation(mutation{v.vbid, key, expireCas, true, nil})
 	}
 
 	return err
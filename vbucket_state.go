@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"math/rand"
 	"sync/atomic"
 )
 
@@ -38,14 +39,33 @@ func parseVBState(s string) VBState {
 	return VBDead
 }
 
+// The number of failover log entries that a vbucket keeps.
+const MAX_FAILOVER_ENTRIES = 25
+
+// A failover log entry starts a new branch of a vbucket's history,
+// identified by a random UUID, from the given seqno onwards.
+type FailoverEntry struct {
+	UUID  uint64 `json:"uuid"`
+	Seqno uint64 `json:"seqno"`
+}
+
 type VBMeta struct {
-	LastCas uint64 `json:"lastCas"`
-	MetaCas uint64 `json:"metaCas"`
-	State   string `json:"state"`
-	Id      uint16 `json:"id"`
+	LastCas     uint64          `json:"lastCas"`
+	MetaCas     uint64          `json:"metaCas"`
+	State       string          `json:"state"`
+	Id          uint16          `json:"id"`
+	FailoverLog []FailoverEntry `json:"failoverLog,omitempty"` // Newest first.
 }
 
 func (t *VBMeta) Equal(u *VBMeta) bool {
+	if len(t.FailoverLog) != len(u.FailoverLog) {
+		return false
+	}
+	for i := range t.FailoverLog {
+		if t.FailoverLog[i] != u.FailoverLog[i] {
+			return false
+		}
+	}
 	return t.Id == u.Id &&
 		t.LastCas == u.LastCas &&
 		t.MetaCas == u.MetaCas &&
@@ -53,7 +73,30 @@ func (t *VBMeta) Equal(u *VBMeta) bool {
 }
 
 func (t *VBMeta) Copy() *VBMeta {
-	return (&VBMeta{Id: t.Id}).update(t)
+	rv := (&VBMeta{Id: t.Id}).update(t)
+	rv.FailoverLog = append([]FailoverEntry(nil), t.FailoverLog...)
+	return rv
+}
+
+// Starts a new branch of the vbucket's history, such as when the
+// vbucket becomes active.
+func (t *VBMeta) addFailoverEntry(seqno uint64) {
+	// The high bit keeps the uuid non-zero and of a fixed JSON size.
+	uuid := uint64(rand.Int63()) | 1<<62
+	t.FailoverLog = append([]FailoverEntry{{UUID: uuid, Seqno: seqno}},
+		t.FailoverLog...)
+	if len(t.FailoverLog) > MAX_FAILOVER_ENTRIES {
+		t.FailoverLog = t.FailoverLog[:MAX_FAILOVER_ENTRIES]
+	}
+}
+
+// Returns the failover log, where a vbucket from before failover logs
+// has a single branch with a zero UUID.
+func (t *VBMeta) failoverLog() []FailoverEntry {
+	if len(t.FailoverLog) == 0 {
+		return []FailoverEntry{{}}
+	}
+	return t.FailoverLog
 }
 
 func (t *VBMeta) update(from *VBMeta) *VBMeta {